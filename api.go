@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"github.com/real-time-footfall-analysis/rtfa-backend/consent"
+	"github.com/real-time-footfall-analysis/rtfa-backend/devices"
 	"github.com/real-time-footfall-analysis/rtfa-backend/emergency"
+	"github.com/real-time-footfall-analysis/rtfa-backend/health"
 	"github.com/real-time-footfall-analysis/rtfa-backend/notifications"
 	"net/http"
 
@@ -10,6 +13,7 @@ import (
 	"github.com/real-time-footfall-analysis/rtfa-backend/eventlivedata"
 	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
 	"github.com/real-time-footfall-analysis/rtfa-backend/locationupdate"
+	"github.com/real-time-footfall-analysis/rtfa-backend/metrics"
 	"github.com/real-time-footfall-analysis/rtfa-backend/readanalytics"
 	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
 )
@@ -25,11 +29,19 @@ func initialize(a *App) {
 
 }
 
+// shutdown sends on everything buffered by the packages of the API
+func shutdown(a *App) error {
+	return locationupdate.Close()
+}
+
 func initializeRoutes(a *App) {
 	a.Router.HandleFunc("/", standardHandler)
 	a.Router.HandleFunc("/api/health", healthHandler).Methods("GET")
+	a.Router.HandleFunc("/api/metrics", metricsHandler).Methods("GET")
 	a.Router.Methods("OPTIONS").HandlerFunc(preflightHandler)
 	eventstaticdata.Init(a.Router)
+	consent.Init(a.Router)
+	devices.Init(a.Router)
 	locationupdate.Init(a.Router)
 	eventlivedata.Init(a.Router)
 	readanalytics.Init(a.Router)
@@ -50,7 +62,14 @@ func standardHandler(w http.ResponseWriter, _ *http.Request) {
 	return
 }
 
-func healthHandler(_ http.ResponseWriter, _ *http.Request) {
+func healthHandler(w http.ResponseWriter, _ *http.Request) {
 
-	return
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(health.Report())
+}
+
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(metrics.Snapshot())
 }
@@ -2,14 +2,24 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 )
 
 var a = App{}
 
 func init() {
+	dir, err := ioutil.TempDir("", "rtfa-spool")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("RTFA_SPOOL_DIR", dir)
+	os.Setenv("RTFA_ARCHIVE_DIR", dir)
+	os.Setenv("RTFA_PSEUDONYM_SECRET", "test")
+	os.Setenv("RTFA_ENROLMENT_SECRET", "test")
 	initialize(&a)
 }
 
@@ -18,8 +28,29 @@ func TestServerHealth(t *testing.T) {
 	response := executeRequest(a, req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
-	if body := response.Body.String(); body != "" {
-		t.Errorf("Expected an empty body. Got %s", body)
+
+	var report map[string]interface{}
+	err := json.NewDecoder(response.Body).Decode(&report)
+	if err != nil {
+		t.Errorf("Expected json, got decode error")
+	}
+	if report["status"] != "ok" {
+		t.Errorf("Expected status ok. Got %v", report["status"])
+	}
+	if _, ok := report["spool"]; !ok {
+		t.Error("Expected the spool to be reported")
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/api/metrics", nil)
+	response := executeRequest(a, req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var counters map[string]int64
+	err := json.NewDecoder(response.Body).Decode(&counters)
+	if err != nil {
+		t.Errorf("Expected json, got decode error")
 	}
 }
 
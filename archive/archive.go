@@ -0,0 +1,312 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const (
+	FILE_BACKEND = "file"
+	NONE_BACKEND = "none"
+
+	DEFAULT_ARCHIVE_DIR = "/var/lib/rtfa/archive"
+
+	// FILE_SUFFIX ends the name of every archive file
+	FILE_SUFFIX = ".ndjson.gz"
+	// ID_FILE holds the identifier of the archive in its directory
+	ID_FILE = "archive-id"
+
+	// Records are buffered and written in batches, each a gzip member of
+	// its own, so every write leaves a complete file behind
+	MAX_BUFFERED_RECORDS   = 1000
+	DEFAULT_FLUSH_INTERVAL = 5 * time.Second
+)
+
+// ArchiveInterface keeps a copy of records partitioned by event and hour
+type ArchiveInterface interface {
+	Append(eventId int, occurredAt int, record interface{}) error
+	Flush() error
+	// Erase removes the event's records matched by the function from the
+	// hours from from to to inclusive, and returns how many it removed
+	Erase(eventId int, from time.Time, to time.Time, match func(json.RawMessage) bool) (int, error)
+}
+
+// Archive writes records as compressed NDJSON to one file per event and
+// hour of occurrence, at <eventId>/<yyyy-mm-dd>/<hh>.ndjson.gz
+type Archive struct {
+	storage       StorageInterface
+	flushInterval time.Duration
+
+	mutex    sync.Mutex
+	pending  map[string]*bytes.Buffer
+	buffered int
+	flusher  sync.Once
+	// writing is held while files are written, so files being rewritten
+	// by Erase aren't appended to at the same time
+	writing sync.Mutex
+}
+
+var shared ArchiveInterface
+var sharedOnce sync.Once
+
+// Shared returns the archive made by NewArchive which is shared by every
+// package of the server, so that records are erased from the files the
+// server is writing to
+func Shared() ArchiveInterface {
+	sharedOnce.Do(func() { shared = NewArchive() })
+	return shared
+}
+
+// NewArchive returns an archive on the storage chosen by
+// RTFA_ARCHIVE_BACKEND: "file" (the default) to write under
+// RTFA_ARCHIVE_DIR, or "none" to keep no archive
+func NewArchive() ArchiveInterface {
+	backend := utils.GetEnv("RTFA_ARCHIVE_BACKEND", FILE_BACKEND)
+	switch backend {
+	case NONE_BACKEND:
+		return &noArchive{}
+	case FILE_BACKEND:
+	default:
+		log.Printf("Unknown archive backend %q, using %s", backend, FILE_BACKEND)
+	}
+
+	return New(&FileStorage{Dir: utils.GetEnv("RTFA_ARCHIVE_DIR", DEFAULT_ARCHIVE_DIR)},
+		utils.GetEnvDuration("RTFA_ARCHIVE_FLUSH_INTERVAL", DEFAULT_FLUSH_INTERVAL))
+}
+
+// ArchiveId returns the identifier of the archive NewArchive writes to, or
+// "" if no archive is kept. It is made when first asked for and kept with
+// the archive, so it stays the same when the server restarts.
+func ArchiveId() (string, error) {
+	if utils.GetEnv("RTFA_ARCHIVE_BACKEND", FILE_BACKEND) == NONE_BACKEND {
+		return "", nil
+	}
+
+	dir := utils.GetEnv("RTFA_ARCHIVE_DIR", DEFAULT_ARCHIVE_DIR)
+	path := filepath.Join(dir, ID_FILE)
+	id, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(id)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	newId, err := utils.NewUUID()
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err == nil {
+		err = ioutil.WriteFile(path+".tmp", []byte(newId), 0600)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return newId, err
+}
+
+// New returns an archive on the storage which writes buffered records at
+// least as often as the flush interval
+func New(storage StorageInterface, flushInterval time.Duration) *Archive {
+	return &Archive{
+		storage:       storage,
+		flushInterval: flushInterval,
+		pending:       make(map[string]*bytes.Buffer),
+	}
+}
+
+// Append adds the record to the archive for the event and time it occurred,
+// given in seconds since the epoch
+func (a *Archive) Append(eventId int, occurredAt int, record interface{}) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// Write what has been buffered in the background
+	a.flusher.Do(func() { go a.flushPeriodically() })
+
+	a.mutex.Lock()
+	path := Path(eventId, time.Unix(int64(occurredAt), 0))
+	buffer, ok := a.pending[path]
+	if !ok {
+		buffer = &bytes.Buffer{}
+		a.pending[path] = buffer
+	}
+	buffer.Write(line)
+	buffer.WriteByte('\n')
+	a.buffered++
+	full := a.buffered >= MAX_BUFFERED_RECORDS
+	a.mutex.Unlock()
+
+	if full {
+		return a.Flush()
+	}
+	return nil
+}
+
+// Flush writes every buffered record to storage
+func (a *Archive) Flush() error {
+	a.mutex.Lock()
+	pending := a.pending
+	a.pending = make(map[string]*bytes.Buffer)
+	a.buffered = 0
+	a.mutex.Unlock()
+
+	a.writing.Lock()
+	defer a.writing.Unlock()
+
+	var firstErr error
+	for path, buffer := range pending {
+		err := a.storage.Append(path, compress(buffer.Bytes()))
+		if err != nil {
+			log.Println("Error writing to archive file "+path+":", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Erase rewrites the event's archive files without the matched records
+func (a *Archive) Erase(eventId int, from time.Time, to time.Time, match func(json.RawMessage) bool) (int, error) {
+	// Buffered records are written first so they are erased too
+	err := a.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	a.writing.Lock()
+	defer a.writing.Unlock()
+
+	erased := 0
+	for hour := from.UTC().Truncate(time.Hour); !hour.After(to); hour = hour.Add(time.Hour) {
+		path := Path(eventId, hour)
+		var kept bytes.Buffer
+		removed := 0
+		err = readFile(a.storage, path, func(record json.RawMessage) error {
+			if match(record) {
+				removed++
+			} else {
+				kept.Write(record)
+				kept.WriteByte('\n')
+			}
+			return nil
+		})
+		if err != nil {
+			return erased, err
+		}
+		if removed == 0 {
+			continue
+		}
+
+		var data []byte
+		if kept.Len() > 0 {
+			data = compress(kept.Bytes())
+		}
+		err = a.storage.Replace(path, data)
+		if err != nil {
+			log.Println("Error rewriting archive file "+path+":", err)
+			return erased, err
+		}
+		erased += removed
+	}
+	return erased, nil
+}
+
+// compress returns the data as a gzip member
+func compress(data []byte) []byte {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write(data)
+	_ = writer.Close()
+	return compressed.Bytes()
+}
+
+func (a *Archive) flushPeriodically() {
+	for range time.Tick(a.flushInterval) {
+		_ = a.Flush()
+	}
+}
+
+// Read calls fn with each record archived for the event in the hours from
+// from to to inclusive, an hour at a time. Records within an hour are in the
+// order they were archived.
+func Read(storage StorageInterface, eventId int, from time.Time, to time.Time, fn func(json.RawMessage) error) error {
+	for hour := from.UTC().Truncate(time.Hour); !hour.After(to); hour = hour.Add(time.Hour) {
+		err := readFile(storage, Path(eventId, hour), fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Path returns the archive file for the event and hour
+func Path(eventId int, occurredAt time.Time) string {
+	occurredAt = occurredAt.UTC()
+	return fmt.Sprintf("%d/%s/%02d%s", eventId, occurredAt.Format("2006-01-02"), occurredAt.Hour(), FILE_SUFFIX)
+}
+
+// readFile calls fn with each record in the archive file, if it exists
+func readFile(storage StorageInterface, path string, fn func(json.RawMessage) error) error {
+	file, err := storage.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	lines := bufio.NewReader(reader)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			fnErr := fn(json.RawMessage(bytes.TrimSpace(line)))
+			if fnErr != nil {
+				return fnErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// noArchive keeps no archive
+type noArchive struct{}
+
+func (na *noArchive) Append(eventId int, occurredAt int, record interface{}) error {
+	return nil
+}
+
+func (na *noArchive) Flush() error {
+	return nil
+}
+
+func (na *noArchive) Erase(eventId int, from time.Time, to time.Time, match func(json.RawMessage) bool) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,124 @@
+package archive
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type test_record struct {
+	Id int `json:"id"`
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtfa-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &FileStorage{Dir: dir}
+	a := New(storage, time.Hour)
+	hour := time.Date(2018, 12, 5, 14, 0, 0, 0, time.UTC)
+
+	// Each flush adds to the end of the hour's file
+	_ = a.Append(3, int(hour.Unix()), test_record{Id: 1})
+	_ = a.Append(3, int(hour.Unix())+3599, test_record{Id: 2})
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = a.Append(3, int(hour.Unix())+60, test_record{Id: 3})
+	_ = a.Append(3, int(hour.Unix())+3600, test_record{Id: 4})
+	_ = a.Append(4, int(hour.Unix()), test_record{Id: 5})
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(dir + "/3/2018-12-05/14" + FILE_SUFFIX); err != nil {
+		t.Errorf("Expected the archive to be partitioned by event, date and hour: %s", err)
+	}
+
+	var ids []int
+	err = Read(storage, 3, hour, hour.Add(time.Hour), func(data json.RawMessage) error {
+		var record test_record
+		err := json.Unmarshal(data, &record)
+		ids = append(ids, record.Id)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 4 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 || ids[3] != 4 {
+		t.Errorf("Expected the event's records for both hours in order. Got %v", ids)
+	}
+}
+
+func TestArchiveErase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtfa-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage := &FileStorage{Dir: dir}
+	a := New(storage, time.Hour)
+	hour := time.Date(2018, 12, 5, 14, 0, 0, 0, time.UTC)
+	_ = a.Append(3, int(hour.Unix()), test_record{Id: 1})
+	_ = a.Append(3, int(hour.Unix()), test_record{Id: 2})
+	_ = a.Flush()
+	_ = a.Append(3, int(hour.Unix())+3600, test_record{Id: 1})
+
+	isFirst := func(data json.RawMessage) bool {
+		var record test_record
+		_ = json.Unmarshal(data, &record)
+		return record.Id == 1
+	}
+	erased, err := a.Erase(3, hour, hour.Add(time.Hour), isFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if erased != 2 {
+		t.Errorf("Expected both matching records to be erased, including buffered ones. Got %d", erased)
+	}
+
+	var ids []int
+	_ = Read(storage, 3, hour, hour.Add(time.Hour), func(data json.RawMessage) error {
+		var record test_record
+		_ = json.Unmarshal(data, &record)
+		ids = append(ids, record.Id)
+		return nil
+	})
+	if len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("Expected only the other record to be left. Got %v", ids)
+	}
+	if _, err := os.Stat(dir + "/" + Path(3, hour.Add(time.Hour))); !os.IsNotExist(err) {
+		t.Error("Expected a file with no records left to be removed")
+	}
+}
+
+func TestArchiveId(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtfa-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("RTFA_ARCHIVE_DIR", dir)
+	defer os.Unsetenv("RTFA_ARCHIVE_DIR")
+
+	// The identifier is kept with the archive
+	id, err := ArchiveId()
+	if err != nil || id == "" {
+		t.Fatalf("Expected an identifier. Got %q, %v", id, err)
+	}
+	if again, _ := ArchiveId(); again != id {
+		t.Errorf("Expected the identifier to be kept. Got %s then %s", id, again)
+	}
+
+	os.Setenv("RTFA_ARCHIVE_BACKEND", NONE_BACKEND)
+	defer os.Unsetenv("RTFA_ARCHIVE_BACKEND")
+	if none, _ := ArchiveId(); none != "" {
+		t.Errorf("Expected no identifier without an archive. Got %s", none)
+	}
+}
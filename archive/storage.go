@@ -0,0 +1,87 @@
+package archive
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// StorageInterface stores archive files by slash separated path
+type StorageInterface interface {
+	// Append adds the data to the end of the file, creating it if needed
+	Append(path string, data []byte) error
+	// Open opens the file for reading, with an error satisfying
+	// os.IsNotExist if there is no such file
+	Open(path string) (io.ReadCloser, error)
+	// Replace replaces the contents of the file, removing it if the data
+	// is empty
+	Replace(path string, data []byte) error
+}
+
+// FileStorage stores archive files under a directory of the local filesystem
+type FileStorage struct {
+	Dir string
+}
+
+func (fs *FileStorage) Append(path string, data []byte) error {
+	fullPath := filepath.Join(fs.Dir, filepath.FromSlash(path))
+	err := os.MkdirAll(filepath.Dir(fullPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (fs *FileStorage) Open(path string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(fs.Dir, filepath.FromSlash(path)))
+}
+
+func (fs *FileStorage) Replace(path string, data []byte) error {
+	fullPath := filepath.Join(fs.Dir, filepath.FromSlash(path))
+	if len(data) == 0 {
+		err := os.Remove(fullPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// Write the new contents alongside and swap them in, so readers see
+	// either the old file or the new one
+	file, err := ioutil.TempFile(filepath.Dir(fullPath), filepath.Base(fullPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), fullPath)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+// RequireSteward only lets requests through to the handler which carry the
+// steward token from RTFA_STEWARD_TOKEN as a bearer token. If no token is
+// configured nobody is let through.
+func RequireSteward(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token := os.Getenv("RTFA_STEWARD_TOKEN")
+		if token == "" {
+			utils.SetAccessControlHeaders(writer)
+			log.Println("RTFA_STEWARD_TOKEN not set, refusing steward request")
+			http.Error(writer, "Steward access is not configured", http.StatusForbidden)
+			return
+		}
+
+		if !IsSteward(request) {
+			utils.SetAccessControlHeaders(writer)
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(writer, "Steward token required", http.StatusUnauthorized)
+			return
+		}
+
+		handler(writer, request)
+	}
+}
+
+// IsSteward returns whether the request carries the steward token
+func IsSteward(request *http.Request) bool {
+	token := os.Getenv("RTFA_STEWARD_TOKEN")
+	if token == "" {
+		return false
+	}
+	presented := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
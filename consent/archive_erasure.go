@@ -0,0 +1,208 @@
+package consent
+
+import (
+	"log"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	DEFAULT_ARCHIVE_ERASURE_INTERVAL = 30 * time.Second
+
+	// ARCHIVE_TTL is how long an archive stays registered once its server
+	// stops renewing the registration, after which it is taken to be gone
+	// and erasures stop waiting for it
+	ARCHIVE_TTL = 24 * time.Hour
+	// ARCHIVE_PROGRESS_TTL is how long an archive's part of an erasure is
+	// kept if the erasure is never completed
+	ARCHIVE_PROGRESS_TTL = 30 * 24 * time.Hour
+)
+
+// Every server keeps its own movement archive, so each must erase its copy.
+// An erasure waits in the archive_erasures table until every archive
+// registered in the archive_instances table has recorded its part in the
+// archive_erasure_progress table, then its receipt is completed.
+
+// archive_erasure is an erasure waiting to be carried out on the archives.
+// It is deleted once it is completed.
+type archive_erasure struct {
+	ReceiptId string `json:"receiptId"`
+	UUID      string `json:"uuid"`
+}
+
+// archive_instance is the archive of a server which erasures wait for
+type archive_instance struct {
+	ArchiveId string `json:"archiveId"`
+	ExpiresAt int    `json:"expiresAt"`
+}
+
+// archive_erasure_progress is what an archive's part of an erasure erased
+type archive_erasure_progress struct {
+	ProgressId string   `json:"progressId"`
+	ReceiptId  string   `json:"receiptId"`
+	Erased     int      `json:"erased"`
+	Errors     []string `json:"errors,omitempty"`
+	ExpiresAt  int      `json:"expiresAt"`
+}
+
+// wakeArchiveErasure lets this server's archive be erased without waiting
+// for the next interval
+var wakeArchiveErasure = make(chan struct{}, 1)
+
+// queueArchiveErasure leaves the erasure for every archive to carry out
+func queueArchiveErasure(uuid string, receiptId string) {
+	archiveErasures.SendItem(archive_erasure{ReceiptId: receiptId, UUID: uuid})
+
+	select {
+	case wakeArchiveErasure <- struct{}{}:
+	default:
+	}
+}
+
+// eraseArchives erases the archive with the ID every interval, or when
+// woken
+func eraseArchives(archiveId string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-wakeArchiveErasure:
+		}
+		eraseArchive(archiveId)
+	}
+}
+
+// eraseArchive registers the archive, carries out its part of the erasures
+// waiting, and completes the erasures every archive has carried out. A
+// server keeping no archive has an empty ID and only completes erasures.
+func eraseArchive(archiveId string) {
+	now := time.Now()
+	if archiveId != "" {
+		archiveInstances.SendItem(archive_instance{
+			ArchiveId: archiveId,
+			ExpiresAt: int(now.Add(ARCHIVE_TTL).Unix()),
+		})
+	}
+
+	waiting := archiveErasures.GetTableScan()
+	if len(waiting) == 0 {
+		return
+	}
+	archiveIds := registeredArchives(now)
+
+	for _, row := range waiting {
+		var job archive_erasure
+		_ = mapstructure.Decode(row, &job)
+		if job.ReceiptId == "" {
+			continue
+		}
+
+		if archiveId != "" {
+			done := archiveProgress.GetItem("progressId", progressId(job.ReceiptId, archiveId))
+			if done != nil && len(done) == 0 {
+				archiveProgress.SendItem(eraseArchiveCopy(job, archiveId))
+			}
+		}
+		completeErasure(job.ReceiptId, archiveIds)
+	}
+}
+
+// registeredArchives returns the IDs of the archives whose registration
+// hasn't expired
+func registeredArchives(now time.Time) []string {
+	var archiveIds []string
+	for _, row := range archiveInstances.GetTableScan() {
+		var instance archive_instance
+		_ = mapstructure.Decode(row, &instance)
+		if instance.ArchiveId != "" && int64(instance.ExpiresAt) > now.Unix() {
+			archiveIds = append(archiveIds, instance.ArchiveId)
+		}
+	}
+	return archiveIds
+}
+
+// eraseArchiveCopy removes the device's records from this server's archive
+// of every event
+func eraseArchiveCopy(job archive_erasure, archiveId string) archive_erasure_progress {
+	progress := archive_erasure_progress{
+		ProgressId: progressId(job.ReceiptId, archiveId),
+		ReceiptId:  job.ReceiptId,
+		ExpiresAt:  int(time.Now().Add(ARCHIVE_PROGRESS_TTL).Unix()),
+	}
+	fail := erasureFailure(job.ReceiptId, &progress.Errors)
+
+	events, err := sd.GetEvents()
+	if err != nil {
+		fail("failed to list events for archive %s: %s", archiveId, err)
+	}
+	for _, event := range events {
+		eventId := int(event.ID)
+		name, err := pseudonyms.Pseudonym(eventId, job.UUID)
+		if err != nil {
+			fail("failed to find the device's pseudonym at event %d: %s", eventId, err)
+			continue
+		}
+
+		erased, err := movements.Erase(eventId,
+			event.StartDate.Add(-ERASURE_MARGIN), event.EndDate.Add(ERASURE_MARGIN),
+			matchDevice([]string{name}))
+		progress.Erased += erased
+		if err != nil {
+			fail("failed to erase archive %s of event %d: %s", archiveId, eventId, err)
+		}
+	}
+	return progress
+}
+
+// completeErasure completes the receipt once every archive has carried out
+// its part of the erasure, adding up what they erased
+func completeErasure(receiptId string, archiveIds []string) {
+	var parts []archive_erasure_progress
+	for _, archiveId := range archiveIds {
+		row := archiveProgress.GetItem("progressId", progressId(receiptId, archiveId))
+		if len(row) == 0 {
+			// Still waiting for this archive
+			return
+		}
+		var part archive_erasure_progress
+		_ = mapstructure.Decode(row, &part)
+		parts = append(parts, part)
+	}
+
+	row := receipts.GetItem("receiptId", receiptId)
+	if len(row) == 0 {
+		log.Println("Unable to read receipt of erasure " + receiptId)
+		return
+	}
+	var receipt erasure_receipt
+	_ = mapstructure.Decode(row, &receipt)
+	if receipt.Erased == nil {
+		receipt.Erased = noneErased()
+	}
+	for _, part := range parts {
+		receipt.Erased["archive"] += part.Erased
+		receipt.Errors = append(receipt.Errors, part.Errors...)
+	}
+
+	receipt.Status = ERASURE_COMPLETED
+	if len(receipt.Errors) > 0 {
+		receipt.Status = ERASURE_FAILED
+	}
+	receipt.CompletedAt = int(time.Now().Unix())
+	receipts.SendItem(receipt)
+
+	err := archiveErasures.DeleteItem("receiptId", receiptId)
+	if err != nil {
+		log.Println("Error removing completed erasure "+receiptId+":", err)
+	}
+	for _, archiveId := range archiveIds {
+		_ = archiveProgress.DeleteItem("progressId", progressId(receiptId, archiveId))
+	}
+}
+
+// progressId is the key of an archive's part of an erasure
+func progressId(receiptId string, archiveId string) string {
+	return receiptId + ":" + archiveId
+}
@@ -0,0 +1,135 @@
+package consent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/metrics"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const (
+	DEFAULT_CONSENT_CACHE_TTL = time.Minute
+	MAX_CACHED_CONSENTS       = 200000
+)
+
+// device_consent is whether a device has agreed to be tracked. Devices are
+// tracked unless they have withdrawn. Devices are stored by a hash of their
+// identifier rather than the identifier itself.
+type device_consent struct {
+	DeviceHash string `json:"deviceHash"`
+	Granted    bool   `json:"granted"`
+	UpdatedAt  int    `json:"updatedAt"`
+}
+
+// ConsentInterface tells other packages which devices have withdrawn
+// their consent to be tracked
+type ConsentInterface interface {
+	InitConn() error
+	Withdrawn(uuid string) bool
+}
+
+// Devices is the consent client shared with the other packages, so that a
+// withdrawal made through this server takes effect straight away. Other
+// instances of the server see it once their cached copy expires.
+var Devices = &ConsentClient{
+	db:  &dynamoDB.DynamoDBClient{},
+	ttl: utils.GetEnvDuration("RTFA_CONSENT_CACHE_TTL", DEFAULT_CONSENT_CACHE_TTL),
+}
+
+// ConsentClient reads and records consent, caching what it reads
+type ConsentClient struct {
+	db  dynamoDB.DynamoDBInterface
+	ttl time.Duration
+
+	connect sync.Once
+	connErr error
+	mutex   sync.Mutex
+	cache   map[string]consentEntry
+}
+
+type consentEntry struct {
+	withdrawn bool
+	readAt    time.Time
+}
+
+// InitConn connects to the consent table, once however often it is called
+func (cc *ConsentClient) InitConn() error {
+	cc.connect.Do(func() {
+		cc.cache = make(map[string]consentEntry)
+		cc.connErr = cc.db.InitConn("device_consent")
+	})
+	return cc.connErr
+}
+
+// Withdrawn returns whether the device has withdrawn its consent. Devices
+// are assumed not to have withdrawn if consent can't be read.
+func (cc *ConsentClient) Withdrawn(uuid string) bool {
+	hash := DeviceHash(uuid)
+
+	cc.mutex.Lock()
+	entry, ok := cc.cache[hash]
+	cc.mutex.Unlock()
+	if ok && time.Since(entry.readAt) < cc.ttl {
+		return entry.withdrawn
+	}
+
+	consent, ok := cc.get(hash)
+	if !ok {
+		metrics.Add("consent_checks_failed", 1)
+		return false
+	}
+	cc.remember(hash, !consent.Granted)
+	return !consent.Granted
+}
+
+// Get returns the device's consent
+func (cc *ConsentClient) Get(uuid string) (device_consent, bool) {
+	return cc.get(DeviceHash(uuid))
+}
+
+// Set records whether the device consents to being tracked
+func (cc *ConsentClient) Set(uuid string, granted bool) device_consent {
+	consent := device_consent{
+		DeviceHash: DeviceHash(uuid),
+		Granted:    granted,
+		UpdatedAt:  int(time.Now().Unix()),
+	}
+	cc.db.SendItem(consent)
+	cc.remember(consent.DeviceHash, !granted)
+	return consent
+}
+
+// get reads the consent of the device with the hash, which is granted if
+// the device has never recorded any. It returns false if it can't be read.
+func (cc *ConsentClient) get(hash string) (device_consent, bool) {
+	row := cc.db.GetItem("deviceHash", hash)
+	if row == nil {
+		return device_consent{}, false
+	}
+
+	consent := device_consent{DeviceHash: hash, Granted: true}
+	if len(row) > 0 {
+		_ = mapstructure.Decode(row, &consent)
+	}
+	return consent, true
+}
+
+func (cc *ConsentClient) remember(hash string, withdrawn bool) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if cc.cache == nil || len(cc.cache) >= MAX_CACHED_CONSENTS {
+		cc.cache = make(map[string]consentEntry)
+	}
+	cc.cache[hash] = consentEntry{withdrawn: withdrawn, readAt: time.Now()}
+}
+
+// DeviceHash returns the key a device's consent is stored under
+func DeviceHash(uuid string) string {
+	sum := sha256.Sum256([]byte(uuid))
+	return hex.EncodeToString(sum[:])
+}
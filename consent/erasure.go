@@ -0,0 +1,165 @@
+package consent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const (
+	ERASURE_PENDING   = "pending"
+	ERASURE_COMPLETED = "completed"
+	ERASURE_FAILED    = "failed"
+
+	// ERASURE_QUEUE_SIZE is how many erasures can wait to be carried out
+	ERASURE_QUEUE_SIZE = 1000
+
+	// ERASURE_MARGIN widens the time searched around each event, to cover
+	// updates sent before it started and after it ended
+	ERASURE_MARGIN = 48 * time.Hour
+)
+
+// erasure_receipt records what was erased for a device, as evidence the
+// request was carried out. It identifies the device only by its hash.
+type erasure_receipt struct {
+	ReceiptId   string         `json:"receiptId"`
+	DeviceHash  string         `json:"deviceHash"`
+	RequestedAt int            `json:"requestedAt"`
+	CompletedAt int            `json:"completedAt"`
+	Status      string         `json:"status"`
+	Erased      map[string]int `json:"erased"`
+	Errors      []string       `json:"errors,omitempty"`
+}
+
+// erasure is an erasure waiting to be carried out
+type erasure struct {
+	uuid    string
+	receipt erasure_receipt
+}
+
+// erasures are carried out one at a time in the background. An erasure
+// still pending when the server stops is lost, and its receipt stays
+// pending, so the device should request it again.
+var erasures = make(chan erasure, ERASURE_QUEUE_SIZE)
+
+// queueErasure stores a pending receipt for the erasure of the device's
+// data and queues the erasure
+func queueErasure(uuid string) (erasure_receipt, error) {
+	receiptId, err := utils.NewUUID()
+	if err != nil {
+		return erasure_receipt{}, err
+	}
+	receipt := erasure_receipt{
+		ReceiptId:   receiptId,
+		DeviceHash:  DeviceHash(uuid),
+		RequestedAt: int(time.Now().Unix()),
+		Status:      ERASURE_PENDING,
+		Erased:      noneErased(),
+	}
+	receipts.SendItem(receipt)
+
+	select {
+	case erasures <- erasure{uuid: uuid, receipt: receipt}:
+		return receipt, nil
+	default:
+		receipt.Status = ERASURE_FAILED
+		receipt.Errors = []string{"too many erasures waiting"}
+		receipts.SendItem(receipt)
+		return erasure_receipt{}, errors.New(receipt.Errors[0])
+	}
+}
+
+// noneErased returns the count of each kind of data erased, before any is
+func noneErased() map[string]int {
+	return map[string]int{
+		"current_position":     0,
+		"emergency_events":     0,
+		"emergency_identities": 0,
+		"archive":              0,
+	}
+}
+
+// eraseQueued carries out the queued erasures
+func eraseQueued() {
+	for queued := range erasures {
+		erase(queued.uuid, queued.receipt)
+	}
+}
+
+// erase removes the device's rows from the current positions and
+// emergencies of every event, then leaves its movements for every server to
+// erase from its archive. The receipt stays pending until they all have.
+func erase(uuid string, receipt erasure_receipt) erasure_receipt {
+	fail := erasureFailure(receipt.ReceiptId, &receipt.Errors)
+	receipt.Erased = noneErased()
+
+	events, err := sd.GetEvents()
+	if err != nil {
+		fail("failed to list events: %s", err)
+	}
+	for _, event := range events {
+		eventId := int(event.ID)
+
+		// Data is stored under the device's pseudonym at the event
+		name, err := pseudonyms.Pseudonym(eventId, uuid)
+		if err != nil {
+			fail("failed to find the device's pseudonym at event %d: %s", eventId, err)
+			continue
+		}
+		eraseRow(&receipt, positions, "current_position", "uuid", name, fail)
+		eraseRow(&receipt, emergencies, "emergency_events", "uuid", name, fail)
+		eraseRow(&receipt, identities, "emergency_identities", "pseudonym", name, fail)
+	}
+
+	receipts.SendItem(receipt)
+	queueArchiveErasure(uuid, receipt.ReceiptId)
+	return receipt
+}
+
+// erasureFailure returns a function recording the failures of an erasure
+func erasureFailure(receiptId string, errs *[]string) func(string, ...interface{}) {
+	return func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		log.Println("Erasure " + receiptId + ": " + msg)
+		*errs = append(*errs, msg)
+	}
+}
+
+// eraseRow deletes the row with the key from the table, if there is one
+func eraseRow(receipt *erasure_receipt, db dynamoDB.DynamoDBInterface, table string, keyCol string, key string, fail func(string, ...interface{})) {
+	row := db.GetItem(keyCol, key)
+	if row == nil {
+		fail("failed to read %s", table)
+		return
+	}
+	if len(row) == 0 {
+		return
+	}
+
+	err := db.DeleteItem(keyCol, key)
+	if err != nil {
+		fail("failed to delete from %s: %s", table, err)
+		return
+	}
+	receipt.Erased[table]++
+}
+
+// matchDevice matches archived records made under any of the pseudonyms
+func matchDevice(names []string) func(json.RawMessage) bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return func(data json.RawMessage) bool {
+		var record struct {
+			UUID string `json:"uuid"`
+		}
+		_ = json.Unmarshal(data, &record)
+		return set[record.UUID]
+	}
+}
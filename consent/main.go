@@ -0,0 +1,288 @@
+package consent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mitchellh/mapstructure"
+	"github.com/real-time-footfall-analysis/rtfa-backend/archive"
+	"github.com/real-time-footfall-analysis/rtfa-backend/devices"
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/pseudonym"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const UUID_LENGTH = 36
+
+// consent_request is the body of a request to grant or withdraw consent,
+// signed with the device's secret at the event
+type consent_request struct {
+	EventId int   `json:"eventId"`
+	Granted *bool `json:"granted"`
+}
+
+// erasure_request is the body of a request to erase a device's data,
+// signed with the device's secret at the event
+type erasure_request struct {
+	EventId int `json:"eventId"`
+}
+
+var consents = Devices
+var positions dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var emergencies dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var identities dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var receipts dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var archiveErasures dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var archiveInstances dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var archiveProgress dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var sd eventstaticdata.StaticDataInterface = &eventstaticdata.StaticDataClient{}
+var pseudonyms pseudonym.PseudonymInterface = &pseudonym.Pseudonymiser{}
+var movements archive.ArchiveInterface
+
+// Consent and erasure change what is kept about a device, so unlike its
+// updates they must be signed by it however RTFA_ALLOW_UNSIGNED_UNTIL is set
+var signatures devices.VerifierInterface = devices.NewVerifier(devices.Devices,
+	utils.GetEnvDuration("RTFA_SIGNATURE_WINDOW", devices.DEFAULT_SIGNATURE_WINDOW),
+	time.Time{}, &dynamoDB.DynamoDBClient{})
+
+// Init registers the endpoints exposed by this package
+// with the given Router.
+func Init(r *mux.Router) {
+	tables := []struct {
+		db   dynamoDB.DynamoDBInterface
+		name string
+	}{
+		{positions, "current_position"},
+		{emergencies, "emergency_events"},
+		{identities, "emergency_identities"},
+		{receipts, "erasure_receipts"},
+		{archiveErasures, "archive_erasures"},
+		{archiveInstances, "archive_instances"},
+		{archiveProgress, "archive_erasure_progress"},
+	}
+	for _, table := range tables {
+		err := table.db.InitConn(table.name)
+		if err != nil {
+			log.Println("Error connecting to " + table.name + " table")
+			os.Exit(1)
+		}
+	}
+	err := consents.InitConn()
+	if err != nil {
+		log.Println("Error connecting to device_consent table")
+		os.Exit(1)
+	}
+	err = signatures.InitConn()
+	if err != nil {
+		log.Println("Error connecting to device_registrations table")
+		os.Exit(1)
+	}
+
+	pseudonyms.InitConn()
+	movements = archive.Shared()
+	archiveId, err := archive.ArchiveId()
+	if err != nil {
+		log.Println("Error reading archive ID:", err)
+		os.Exit(1)
+	}
+	go eraseQueued()
+	go eraseArchives(archiveId,
+		utils.GetEnvDuration("RTFA_ARCHIVE_ERASURE_INTERVAL", DEFAULT_ARCHIVE_ERASURE_INTERVAL))
+
+	r.HandleFunc("/devices/{uuid}/consent", getConsentHandler).Methods("GET")
+	r.HandleFunc("/devices/{uuid}/consent", putConsentHandler).Methods("PUT")
+	r.HandleFunc("/devices/{uuid}/erasure", erasureHandler).Methods("POST")
+	r.HandleFunc("/erasure-receipts/{receiptId}", getReceiptHandler).Methods("GET")
+}
+
+func getConsentHandler(writer http.ResponseWriter, request *http.Request) {
+
+	utils.SetAccessControlHeaders(writer)
+
+	uuid, err := parseDevice(request, writer)
+	if err != nil {
+		return
+	}
+	err = verifyQuery(request, writer, uuid, "consent request")
+	if err != nil {
+		return
+	}
+
+	consent, ok := consents.Get(uuid)
+	if !ok {
+		http.Error(
+			writer,
+			fmt.Sprint("Failed to read consent"),
+			http.StatusInternalServerError)
+		return
+	}
+
+	_ = json.NewEncoder(writer).Encode(consent)
+}
+
+func putConsentHandler(writer http.ResponseWriter, request *http.Request) {
+
+	utils.SetAccessControlHeaders(writer)
+
+	uuid, err := parseDevice(request, writer)
+	if err != nil {
+		return
+	}
+
+	var body consent_request
+	err = decodeSigned(request, writer, uuid, "consent", &body)
+	if err != nil {
+		return
+	}
+	if body.Granted == nil {
+		http.Error(
+			writer,
+			fmt.Sprint("granted not present in consent"),
+			http.StatusBadRequest)
+		return
+	}
+
+	consent := consents.Set(uuid, *body.Granted)
+	_ = json.NewEncoder(writer).Encode(consent)
+}
+
+func erasureHandler(writer http.ResponseWriter, request *http.Request) {
+
+	utils.SetAccessControlHeaders(writer)
+
+	uuid, err := parseDevice(request, writer)
+	if err != nil {
+		return
+	}
+
+	var body erasure_request
+	err = decodeSigned(request, writer, uuid, "erasure_request", &body)
+	if err != nil {
+		return
+	}
+
+	// Stop collecting straight away, then erase what has been collected
+	// in the background
+	consents.Set(uuid, false)
+	receipt, err := queueErasure(uuid)
+	if err != nil {
+		log.Println("Error starting erasure:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to start erasure: %s", err),
+			http.StatusServiceUnavailable)
+		return
+	}
+
+	// The receipt can be fetched to see when the erasure completes
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(writer).Encode(receipt)
+}
+
+func getReceiptHandler(writer http.ResponseWriter, request *http.Request) {
+
+	utils.SetAccessControlHeaders(writer)
+
+	receiptId := mux.Vars(request)["receiptId"]
+	row := receipts.GetItem("receiptId", receiptId)
+	if len(row) == 0 {
+		http.Error(
+			writer,
+			fmt.Sprintf("No erasure receipt %s", receiptId),
+			http.StatusNotFound)
+		return
+	}
+
+	var receipt erasure_receipt
+	_ = mapstructure.Decode(row, &receipt)
+	_ = json.NewEncoder(writer).Encode(receipt)
+}
+
+// parseDevice reads the device identifier from the path
+func parseDevice(request *http.Request, writer http.ResponseWriter) (string, error) {
+	uuid := mux.Vars(request)["uuid"]
+	if len(uuid) != UUID_LENGTH {
+		msg := fmt.Sprintf("uuid not %d characters", UUID_LENGTH)
+		log.Println(msg)
+		http.Error(
+			writer,
+			msg,
+			http.StatusBadRequest)
+		return "", errors.New(msg)
+	}
+	return uuid, nil
+}
+
+// decodeSigned decodes the body of a request into v, which must have been
+// signed by the device with its secret at the event named in the body
+func decodeSigned(request *http.Request, writer http.ResponseWriter, uuid string, name string, v interface{}) error {
+	body, err := ioutil.ReadAll(request.Body)
+	var signed struct {
+		EventId int `json:"eventId"`
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &signed)
+	}
+	if err == nil {
+		err = json.Unmarshal(body, v)
+	}
+	if err != nil {
+		log.Printf("Cannot decode %s: %s", name, err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to decode %s: %s", name, err),
+			http.StatusBadRequest)
+		return err
+	}
+	if signed.EventId <= 0 {
+		msg := fmt.Sprintf("Invalid EventId in %s", name)
+		log.Println(msg)
+		http.Error(
+			writer,
+			msg,
+			http.StatusBadRequest)
+		return errors.New(msg)
+	}
+
+	err = signatures.Verify(request, body, signed.EventId, uuid)
+	if err != nil {
+		log.Printf("Rejected %s: %s", name, err)
+		devices.Reject(writer, err)
+		return err
+	}
+	return nil
+}
+
+// verifyQuery checks a request without a body was signed by the device
+// with its secret at the event given by the eventId query parameter. The
+// signature is of an empty body.
+func verifyQuery(request *http.Request, writer http.ResponseWriter, uuid string, name string) error {
+	eventId, err := strconv.Atoi(request.URL.Query().Get("eventId"))
+	if err != nil || eventId <= 0 {
+		msg := fmt.Sprintf("Invalid eventId in %s", name)
+		log.Println(msg)
+		http.Error(
+			writer,
+			msg,
+			http.StatusBadRequest)
+		return errors.New(msg)
+	}
+
+	err = signatures.Verify(request, nil, eventId, uuid)
+	if err != nil {
+		log.Printf("Rejected %s: %s", name, err)
+		devices.Reject(writer, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,422 @@
+package consent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/real-time-footfall-analysis/rtfa-backend/archive"
+	"github.com/real-time-footfall-analysis/rtfa-backend/devices"
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+)
+
+const testUUID = "Test-UUID-00000000000000000000000000"
+
+var router *mux.Router
+
+func init() {
+	dir, err := ioutil.TempDir("", "rtfa-archive")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("RTFA_ARCHIVE_DIR", dir)
+	os.Setenv("RTFA_ARCHIVE_ERASURE_INTERVAL", "10ms")
+
+	consents = &ConsentClient{db: newDummyDB("deviceHash"), ttl: time.Minute}
+	positions = newDummyDB("uuid")
+	emergencies = newDummyDB("uuid")
+	identities = newDummyDB("pseudonym")
+	receipts = newDummyDB("receiptId")
+	archiveErasures = newDummyDB("receiptId")
+	archiveInstances = newDummyDB("archiveId")
+	archiveProgress = newDummyDB("progressId")
+	pseudonyms = &dummy_pseudonyms{}
+	signatures = devices.NewVerifier(&dummy_registry{}, time.Minute, time.Time{}, nil)
+	router = mux.NewRouter()
+	Init(router)
+	sd = &dummy_sd{}
+	movements = &dummy_archive{}
+}
+
+func TestConsent(t *testing.T) {
+	// Devices are tracked until they withdraw
+	req, _ := http.NewRequest("GET", "/devices/"+testUUID+"/consent?eventId=3", nil)
+	signRequest(req)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if !strings.Contains(response.Body.String(), `"granted":true`) {
+		t.Errorf("Expected consent to be granted. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("PUT", "/devices/"+testUUID+"/consent", strings.NewReader(`{"eventId":3,"granted":false}`))
+	signRequest(req)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if strings.Contains(response.Body.String(), testUUID) {
+		t.Errorf("Expected the device identifier not to be stored. Got %s", response.Body.String())
+	}
+	if !consents.Withdrawn(testUUID) {
+		t.Error("Expected the device to have withdrawn")
+	}
+
+	req, _ = http.NewRequest("PUT", "/devices/"+testUUID+"/consent", strings.NewReader(`{"eventId":3,"granted":true}`))
+	signRequest(req)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	if consents.Withdrawn(testUUID) {
+		t.Error("Expected the device to have granted consent again")
+	}
+}
+
+func TestInvalidConsent(t *testing.T) {
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"/devices/short/consent", `{"eventId":3,"granted":true}`},
+		{"/devices/" + testUUID + "/consent", `{"eventId":3}`},
+		{"/devices/" + testUUID + "/consent", `{"granted":true}`},
+		{"/devices/" + testUUID + "/consent", `granted`},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("PUT", test.path, strings.NewReader(test.body))
+		signRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+	}
+}
+
+func TestUnsignedRequests(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/devices/"+testUUID+"/consent?eventId=3", nil)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+	req, _ = http.NewRequest("GET", "/devices/"+testUUID+"/consent", nil)
+	signRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("PUT", "/devices/"+testUUID+"/consent", strings.NewReader(`{"eventId":3,"granted":false}`))
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+	if consents.Withdrawn(testUUID) {
+		t.Error("Expected an unsigned request not to withdraw consent")
+	}
+
+	req, _ = http.NewRequest("POST", "/devices/"+testUUID+"/erasure", strings.NewReader(`{"eventId":3}`))
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	// Signed by another device
+	req, _ = http.NewRequest("POST", "/devices/"+testUUID+"/erasure", strings.NewReader(`{"eventId":3}`))
+	req.Header.Set(devices.TIMESTAMP_HEADER, strconv.FormatInt(time.Now().Unix(), 10))
+	req.Header.Set(devices.SIGNATURE_HEADER, devices.Sign("other-secret", req.Header.Get(devices.TIMESTAMP_HEADER), []byte(`{"eventId":3}`)))
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+}
+
+func TestErasure(t *testing.T) {
+	pseudonym := "pseudonym-3-" + testUUID
+	positions.SendItem(map[string]interface{}{"uuid": pseudonym, "eventId": 3})
+	positions.SendItem(map[string]interface{}{"uuid": "someone-else", "eventId": 3})
+	emergencies.SendItem(map[string]interface{}{"uuid": pseudonym, "eventId": 3})
+	identities.SendItem(map[string]interface{}{"pseudonym": pseudonym, "uuid": testUUID})
+	movements = &dummy_archive{records: []string{
+		`{"uuid":"` + pseudonym + `"}`,
+		`{"uuid":"someone-else"}`,
+		`{"uuid":"` + pseudonym + `"}`,
+	}}
+
+	req, _ := http.NewRequest("POST", "/devices/"+testUUID+"/erasure", strings.NewReader(`{"eventId":3}`))
+	signRequest(req)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusAccepted, response.Code)
+
+	var receipt erasure_receipt
+	if err := json.NewDecoder(response.Body).Decode(&receipt); err != nil {
+		t.Fatalf("Unable to decode receipt: %s", err)
+	}
+	if receipt.Status != ERASURE_PENDING {
+		t.Errorf("Expected the erasure to be pending. Got %+v", receipt)
+	}
+	if !consents.Withdrawn(testUUID) {
+		t.Error("Expected erasure to withdraw consent straight away")
+	}
+
+	// The receipt can be fetched to see when the erasure completes
+	receipt = waitForErasure(t, receipt)
+	expected := map[string]int{
+		"current_position":     1,
+		"emergency_events":     1,
+		"emergency_identities": 1,
+		"archive":              2,
+	}
+	if receipt.Status != ERASURE_COMPLETED || fmt.Sprint(receipt.Erased) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v to be erased. Got %+v", expected, receipt)
+	}
+	if receipt.DeviceHash != DeviceHash(testUUID) {
+		t.Errorf("Expected the receipt to identify the device by its hash. Got %s", receipt.DeviceHash)
+	}
+	if len(positions.GetItem("uuid", pseudonym)) != 0 || len(positions.GetItem("uuid", "someone-else")) == 0 {
+		t.Error("Expected only the device's position to be erased")
+	}
+
+	req, _ = http.NewRequest("GET", "/erasure-receipts/unknown", nil)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+}
+
+func TestErasureWaitsForEveryArchive(t *testing.T) {
+	// Another server keeps an archive too
+	archiveInstances.SendItem(archive_instance{ArchiveId: "other", ExpiresAt: int(time.Now().Add(time.Hour).Unix())})
+	defer archiveInstances.DeleteItem("archiveId", "other")
+	movements = &dummy_archive{records: []string{`{"uuid":"pseudonym-3-` + testUUID + `"}`}}
+
+	req, _ := http.NewRequest("POST", "/devices/"+testUUID+"/erasure", strings.NewReader(`{"eventId":3}`))
+	signRequest(req)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusAccepted, response.Code)
+	var receipt erasure_receipt
+	_ = json.NewDecoder(response.Body).Decode(&receipt)
+
+	// This server erases its copy, but the receipt waits for the other's
+	deadline := time.Now().Add(5 * time.Second)
+	for len(movements.(*dummy_archive).remaining()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected this server's archive to be erased")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	req, _ = http.NewRequest("GET", "/erasure-receipts/"+receipt.ReceiptId, nil)
+	response = executeRequest(req)
+	_ = json.NewDecoder(response.Body).Decode(&receipt)
+	if receipt.Status != ERASURE_PENDING {
+		t.Fatalf("Expected the erasure to wait for the other archive. Got %+v", receipt)
+	}
+
+	archiveProgress.SendItem(archive_erasure_progress{
+		ProgressId: progressId(receipt.ReceiptId, "other"),
+		ReceiptId:  receipt.ReceiptId,
+		Erased:     2,
+	})
+	receipt = waitForErasure(t, receipt)
+	if receipt.Status != ERASURE_COMPLETED || receipt.Erased["archive"] != 3 {
+		t.Errorf("Expected the records erased from both archives. Got %+v", receipt)
+	}
+	if len(archiveErasures.GetTableScan()) != 0 {
+		t.Error("Expected the completed erasure to be removed")
+	}
+}
+
+// waitForErasure fetches the receipt until the erasure is no longer pending
+func waitForErasure(t *testing.T, receipt erasure_receipt) erasure_receipt {
+	deadline := time.Now().Add(5 * time.Second)
+	for receipt.Status == ERASURE_PENDING {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the erasure to complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		req, _ := http.NewRequest("GET", "/erasure-receipts/"+receipt.ReceiptId, nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if err := json.NewDecoder(response.Body).Decode(&receipt); err != nil {
+			t.Fatalf("Unable to decode receipt: %s", err)
+		}
+	}
+	return receipt
+}
+
+func executeRequest(req *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func checkResponseCode(t *testing.T, expected, actual int) {
+	if expected != actual {
+		t.Errorf("Expected response code %d. Got %d\n", expected, actual)
+	}
+}
+
+/***************************
+   FAKE DynamoDB tables
+***************************/
+
+type dummy_db struct {
+	mutex sync.Mutex
+	key   string
+	rows  map[string]map[string]interface{}
+}
+
+func newDummyDB(key string) *dummy_db {
+	return &dummy_db{key: key, rows: make(map[string]map[string]interface{})}
+}
+
+func (db *dummy_db) InitConn(tableName string) error {
+	return nil
+}
+
+func (db *dummy_db) GetTableScan() []map[string]interface{} {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	var rows []map[string]interface{}
+	for _, row := range db.rows {
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func (db *dummy_db) QueryItems(query dynamoDB.Query) ([]map[string]interface{}, string, error) {
+	return nil, "", nil
+}
+
+func (db *dummy_db) SendItem(req interface{}) {
+	data, _ := json.Marshal(req)
+	var row map[string]interface{}
+	_ = json.Unmarshal(data, &row)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.rows[fmt.Sprint(row[db.key])] = row
+}
+
+func (db *dummy_db) SendItemIf(req interface{}, condition string, values map[string]interface{}) (bool, error) {
+	db.SendItem(req)
+	return true, nil
+}
+
+func (db *dummy_db) GetItem(pKeyColName string, pKeyValue string) map[string]interface{} {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	row, ok := db.rows[pKeyValue]
+	if !ok {
+		return map[string]interface{}{}
+	}
+	return row
+}
+
+func (db *dummy_db) DeleteItem(pKeyColName string, pKeyValue string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	delete(db.rows, pKeyValue)
+	return nil
+}
+
+func (db *dummy_db) IncrementCounter(pKeyColName string, pKeyValue string, counterColName string) (int, error) {
+	return 0, nil
+}
+
+/***************************
+   FAKE Static data
+***************************/
+
+type dummy_sd struct{}
+
+func (sd *dummy_sd) GetEvents() ([]eventstaticdata.Event, error) {
+	return []eventstaticdata.Event{{
+		ID:        3,
+		StartDate: time.Date(2018, 12, 5, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2018, 12, 7, 0, 0, 0, 0, time.UTC),
+	}}, nil
+}
+
+func (sd *dummy_sd) GetEvent(eventID int) (*eventstaticdata.Event, error) {
+	return nil, nil
+}
+
+func (sd *dummy_sd) GetRegions(eventID int) ([]eventstaticdata.Region, error) {
+	return nil, nil
+}
+
+/***************************
+   FAKE Pseudonyms
+***************************/
+
+type dummy_pseudonyms struct{}
+
+func (dp *dummy_pseudonyms) InitConn() {
+}
+
+func (dp *dummy_pseudonyms) Pseudonym(eventId int, uuid string) (string, error) {
+	return fmt.Sprintf("pseudonym-%d-%s", eventId, uuid), nil
+}
+
+/***************************
+   FAKE Archive
+***************************/
+
+type dummy_archive struct {
+	mutex   sync.Mutex
+	records []string
+}
+
+func (da *dummy_archive) remaining() []string {
+	da.mutex.Lock()
+	defer da.mutex.Unlock()
+	return append([]string(nil), da.records...)
+}
+
+var _ archive.ArchiveInterface = &dummy_archive{}
+
+func (da *dummy_archive) Append(eventId int, occurredAt int, record interface{}) error {
+	return nil
+}
+
+func (da *dummy_archive) Flush() error {
+	return nil
+}
+
+func (da *dummy_archive) Erase(eventId int, from time.Time, to time.Time, match func(json.RawMessage) bool) (int, error) {
+	da.mutex.Lock()
+	defer da.mutex.Unlock()
+	kept := da.records[:0]
+	for _, record := range da.records {
+		if !match(json.RawMessage(record)) {
+			kept = append(kept, record)
+		}
+	}
+	erased := len(da.records) - len(kept)
+	da.records = kept
+	return erased, nil
+}
+
+/***************************
+   FAKE Device registry
+***************************/
+
+const TEST_SECRET = "test-secret"
+
+// signed counts the requests signed, to give each its own timestamp
+var signed int64
+
+// signRequest signs the request as its registered device would
+func signRequest(req *http.Request) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	signed++
+	timestamp := strconv.FormatInt(time.Now().Unix()-signed%60, 10)
+	req.Header.Set(devices.TIMESTAMP_HEADER, timestamp)
+	req.Header.Set(devices.SIGNATURE_HEADER, devices.Sign(TEST_SECRET, timestamp, body))
+}
+
+type dummy_registry struct{}
+
+func (dr *dummy_registry) InitConn() error {
+	return nil
+}
+
+func (dr *dummy_registry) Register(eventId int, uuid string) (string, error) {
+	return TEST_SECRET, nil
+}
+
+func (dr *dummy_registry) Secret(eventId int, uuid string) (string, error) {
+	return TEST_SECRET, nil
+}
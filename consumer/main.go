@@ -0,0 +1,149 @@
+package consumer
+
+import (
+	"log"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/kinesisqueue"
+	"github.com/real-time-footfall-analysis/rtfa-backend/locationupdate"
+)
+
+const (
+	// MAX_READ_FAILURES is how many reads in a row can fail before the
+	// consumer gives up and leaves a restart to resume from the checkpoints
+	MAX_READ_FAILURES = 5
+
+	minReadBackoff = time.Second
+
+	// An update only replaces an older position, and a leaving update only
+	// replaces the position in the region being left. Leaving updates are
+	// kept as tombstones so a late update can't bring the position back.
+	ENTER_CONDITION = "attribute_not_exists(occurredAt) OR occurredAt < :occurredAt"
+	LEAVE_CONDITION = "attribute_not_exists(occurredAt) OR (occurredAt < :occurredAt AND regionId = :regionId)"
+)
+
+var positions dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var checkpoints dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var source kinesisqueue.StreamReaderInterface = kinesisqueue.NewStreamReader()
+
+// checkpoint is how far a shard of a stream has been consumed
+type checkpoint struct {
+	ShardId  string `json:"shardId"`
+	Sequence string `json:"sequence"`
+}
+
+// Run consumes movement updates from the stream, keeping the current
+// position of each UUID up to date. It only returns if the stream or the
+// position store keeps failing; starting again resumes from the checkpoints.
+func Run() error {
+	err := positions.InitConn("current_position")
+	if err != nil {
+		log.Println("Error connecting to current position table")
+		return err
+	}
+	err = checkpoints.InitConn("stream_checkpoints")
+	if err != nil {
+		log.Println("Error connecting to stream checkpoints table")
+		return err
+	}
+	err = source.InitConn(locationupdate.KINESIS_STREAM_NAME, loadCheckpoint)
+	if err != nil {
+		log.Println("Error connecting to stream: " + locationupdate.KINESIS_STREAM_NAME)
+		return err
+	}
+
+	log.Println("Consuming " + locationupdate.KINESIS_STREAM_NAME)
+	failures := 0
+	for {
+		records, readErr := source.ReadRecords()
+
+		// Anything read before a failure is still processed
+		err = processRecords(records)
+		if err != nil {
+			return err
+		}
+
+		if readErr == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		log.Println("Error reading from stream:", readErr)
+		if failures >= MAX_READ_FAILURES {
+			return readErr
+		}
+		time.Sleep(minReadBackoff << uint(failures-1))
+	}
+}
+
+// processRecords applies each update in turn, then checkpoints each shard
+// up to the last record applied
+func processRecords(records []kinesisqueue.ConsumedRecord) error {
+	applied := make(map[string]string)
+	var err error
+	for _, record := range records {
+		err = processRecord(record)
+		if err != nil {
+			break
+		}
+		if record.Sequence != "" {
+			applied[record.Shard] = record.Sequence
+		}
+	}
+
+	for shard, sequence := range applied {
+		checkpoints.SendItem(checkpoint{
+			ShardId:  checkpointKey(shard),
+			Sequence: sequence,
+		})
+	}
+	return err
+}
+
+// processRecord decodes an update and applies it to the position store,
+// skipping records which aren't valid updates
+func processRecord(record kinesisqueue.ConsumedRecord) error {
+	update, err := locationupdate.DecodeRecord(record.Data)
+	if err != nil {
+		log.Println("Skipping undecodable movement update:", err)
+		return nil
+	}
+	if update.UUID == nil || update.EventID == nil || update.RegionID == nil ||
+		update.Entering == nil || update.OccurredAt == nil {
+		log.Println("Skipping incomplete movement update:", string(record.Data))
+		return nil
+	}
+
+	return applyUpdate(update)
+}
+
+// applyUpdate stores the update as the UUID's position unless a newer
+// update has already been stored
+func applyUpdate(update locationupdate.Movement_update) error {
+	condition := ENTER_CONDITION
+	values := map[string]interface{}{":occurredAt": *update.OccurredAt}
+	if !*update.Entering {
+		condition = LEAVE_CONDITION
+		values[":regionId"] = *update.RegionID
+	}
+
+	_, err := positions.SendItemIf(update, condition, values)
+	if err != nil {
+		log.Println("Error storing current position")
+		return err
+	}
+	return nil
+}
+
+// loadCheckpoint returns where the shard was last consumed up to
+func loadCheckpoint(shard string) string {
+	row := checkpoints.GetItem("shardId", checkpointKey(shard))
+	sequence, _ := row["sequence"].(string)
+	return sequence
+}
+
+// checkpointKey names the shard's checkpoint, as other streams share the table
+func checkpointKey(shard string) string {
+	return locationupdate.KINESIS_STREAM_NAME + "/" + shard
+}
@@ -0,0 +1,182 @@
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/kinesisqueue"
+	"github.com/real-time-footfall-analysis/rtfa-backend/locationupdate"
+)
+
+func TestOutOfOrderUpdates(t *testing.T) {
+	store := &dummy_positions{rows: make(map[string]locationupdate.Movement_update)}
+	positions = store
+	checkpoints = &dummy_checkpoints{}
+
+	err := processRecords([]kinesisqueue.ConsumedRecord{
+		movementRecord("1", 3, true, 100),
+		// Older than the stored position, so ignored
+		movementRecord("2", 4, true, 90),
+		// Leaving a region the UUID isn't in is ignored
+		movementRecord("3", 4, false, 110),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row := store.rows[testUUID]; *row.RegionID != 3 || *row.OccurredAt != 100 {
+		t.Errorf("Expected the newest position in region 3. Got %+v", row)
+	}
+
+	err = processRecords([]kinesisqueue.ConsumedRecord{
+		movementRecord("4", 3, false, 120),
+		// An update from before leaving can't bring the position back
+		movementRecord("5", 3, true, 115),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row := store.rows[testUUID]; *row.Entering || *row.OccurredAt != 120 {
+		t.Errorf("Expected the position to be kept as having left. Got %+v", row)
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	store := &dummy_positions{rows: make(map[string]locationupdate.Movement_update)}
+	positions = store
+	saved := &dummy_checkpoints{}
+	checkpoints = saved
+
+	undecodable := kinesisqueue.ConsumedRecord{
+		Record:   kinesisqueue.Record{Data: json.RawMessage(`"not an update"`)},
+		Shard:    "shard-1",
+		Sequence: "2",
+	}
+	err := processRecords([]kinesisqueue.ConsumedRecord{
+		movementRecord("1", 3, true, 100),
+		undecodable,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.rows["movement_event_stream/shard-1"] != "2" {
+		t.Errorf("Expected the shard to be checkpointed past skipped records. Got %v", saved.rows)
+	}
+	if loadCheckpoint("shard-1") != "2" {
+		t.Error("Expected the checkpoint to be loaded")
+	}
+	if loadCheckpoint("shard-2") != "" {
+		t.Error("Expected a shard without a checkpoint to start from the beginning")
+	}
+
+	// Nothing after a failed write is checkpointed
+	store.fail = true
+	err = processRecords([]kinesisqueue.ConsumedRecord{movementRecord("3", 3, true, 130)})
+	if err == nil {
+		t.Error("Expected an error when the position can't be stored")
+	}
+	if saved.rows["movement_event_stream/shard-1"] != "2" {
+		t.Errorf("Expected the checkpoint to stay before the failed record. Got %v", saved.rows)
+	}
+}
+
+const testUUID = "123e4567-e89b-12d3-a456-426655440000"
+
+func movementRecord(sequence string, regionId int, entering bool, occurredAt int) kinesisqueue.ConsumedRecord {
+	uuid := testUUID
+	eventId := 1
+	data, _ := json.Marshal(locationupdate.Movement_update{
+		UUID:       &uuid,
+		EventID:    &eventId,
+		RegionID:   &regionId,
+		Entering:   &entering,
+		OccurredAt: &occurredAt,
+	})
+	return kinesisqueue.ConsumedRecord{
+		Record:   kinesisqueue.Record{PartitionKey: "3", Data: data},
+		Shard:    "shard-1",
+		Sequence: sequence,
+	}
+}
+
+// dummy_positions applies the consumer's conditions to rows keyed by UUID
+type dummy_positions struct {
+	dummy_db
+	rows map[string]locationupdate.Movement_update
+	fail bool
+}
+
+func (db *dummy_positions) SendItemIf(req interface{}, condition string, values map[string]interface{}) (bool, error) {
+	if db.fail {
+		return false, errors.New("database unavailable")
+	}
+
+	update := req.(locationupdate.Movement_update)
+	stored, ok := db.rows[*update.UUID]
+	if ok {
+		newer := *stored.OccurredAt < values[":occurredAt"].(int)
+		if condition == LEAVE_CONDITION && (!newer || *stored.RegionID != values[":regionId"].(int)) {
+			return false, nil
+		}
+		if condition == ENTER_CONDITION && !newer {
+			return false, nil
+		}
+	}
+	db.rows[*update.UUID] = update
+	return true, nil
+}
+
+type dummy_checkpoints struct {
+	dummy_db
+	rows map[string]string
+}
+
+func (db *dummy_checkpoints) SendItem(req interface{}) {
+	if db.rows == nil {
+		db.rows = make(map[string]string)
+	}
+	saved := req.(checkpoint)
+	db.rows[saved.ShardId] = saved.Sequence
+}
+
+func (db *dummy_checkpoints) GetItem(pKeyColName string, pKeyValue string) map[string]interface{} {
+	sequence, ok := db.rows[pKeyValue]
+	if !ok {
+		return nil
+	}
+	return map[string]interface{}{pKeyColName: pKeyValue, "sequence": sequence}
+}
+
+type dummy_db struct{}
+
+func (db *dummy_db) InitConn(tableName string) error {
+	return nil
+}
+
+func (db *dummy_db) GetTableScan() []map[string]interface{} {
+	return nil
+}
+
+func (db *dummy_db) QueryItems(query dynamoDB.Query) ([]map[string]interface{}, string, error) {
+	return nil, "", nil
+}
+
+func (db *dummy_db) SendItem(req interface{}) {
+}
+
+func (db *dummy_db) SendItemIf(req interface{}, condition string, values map[string]interface{}) (bool, error) {
+	return true, nil
+}
+
+func (db *dummy_db) GetItem(pKeyColName string, pKeyValue string) map[string]interface{} {
+	return nil
+}
+
+func (db *dummy_db) DeleteItem(pKeyColName string, pKeyValue string) error {
+	return nil
+}
+
+func (db *dummy_db) IncrementCounter(pKeyColName string, pKeyValue string, counterColName string) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,46 @@
+package devices
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"strconv"
+)
+
+// ENROLMENT_HEADER carries the event's enrolment token when a device
+// registers
+const ENROLMENT_HEADER = "X-RTFA-Enrolment-Token"
+
+// Enrolment issues each event a token devices must present to register at
+// it. Tokens are derived from a secret, so they needn't be stored, and are
+// given to the event's app by its stewards.
+type Enrolment struct {
+	// Secret is read from RTFA_ENROLMENT_SECRET unless already set
+	Secret []byte
+}
+
+// InitConn reads the secret from the environment
+func (e *Enrolment) InitConn() {
+	if len(e.Secret) > 0 {
+		return
+	}
+	secret := os.Getenv("RTFA_ENROLMENT_SECRET")
+	if secret == "" {
+		log.Fatal("RTFA_ENROLMENT_SECRET not set.")
+	}
+	e.Secret = []byte(secret)
+}
+
+// Token returns the event's enrolment token
+func (e *Enrolment) Token(eventId int) string {
+	mac := hmac.New(sha256.New, e.Secret)
+	mac.Write([]byte("enrolment:" + strconv.Itoa(eventId)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Valid returns whether the token is the event's enrolment token
+func (e *Enrolment) Valid(eventId int, token string) bool {
+	return token != "" && hmac.Equal([]byte(token), []byte(e.Token(eventId)))
+}
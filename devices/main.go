@@ -0,0 +1,182 @@
+package devices
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/real-time-footfall-analysis/rtfa-backend/auth"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/metrics"
+	"github.com/real-time-footfall-analysis/rtfa-backend/ratelimit"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const UUID_LENGTH = 36
+
+type registration_request struct {
+	UUID string `json:"uuid"`
+}
+
+// registration_response gives a device the secret to sign its requests to
+// the event with
+type registration_response struct {
+	UUID    string `json:"uuid"`
+	EventId int    `json:"eventId"`
+	Secret  string `json:"secret"`
+}
+
+// enrolment_response gives stewards the token the event's app registers
+// devices with
+type enrolment_response struct {
+	EventId int    `json:"eventId"`
+	Token   string `json:"token"`
+}
+
+var registry RegistryInterface = Devices
+var events eventstaticdata.EventIndexInterface = eventstaticdata.Index
+var enrolment = &Enrolment{}
+var limits ratelimit.IngestionLimiterInterface = ratelimit.NewIngestionLimiter(eventstaticdata.Index)
+
+// Init registers the endpoints exposed by this package
+// with the given Router.
+func Init(r *mux.Router) {
+	err := registry.InitConn()
+	if err != nil {
+		log.Println("Error connecting to device_registrations table")
+		os.Exit(1)
+	}
+	enrolment.InitConn()
+
+	r.HandleFunc("/events/{eventId}/devices", registerHandler).Methods("POST")
+	r.HandleFunc("/events/{eventId}/enrolment-token", auth.RequireSteward(enrolmentHandler)).Methods("GET")
+}
+
+func registerHandler(writer http.ResponseWriter, request *http.Request) {
+
+	utils.SetAccessControlHeaders(writer)
+
+	// Turn away floods before doing any work for them
+	if ok, wait := limits.AllowClient(request); !ok {
+		metrics.Add("registrations_throttled_client", 1)
+		ratelimit.Reject(writer, wait)
+		return
+	}
+
+	eventId, err := parseEventId(request, writer)
+	if err != nil {
+		return
+	}
+
+	// Only the event's app can register devices
+	if !enrolment.Valid(eventId, request.Header.Get(ENROLMENT_HEADER)) {
+		metrics.Add("registrations_rejected_enrolment", 1)
+		http.Error(
+			writer,
+			fmt.Sprintf("Enrolment token for event %d required", eventId),
+			http.StatusUnauthorized)
+		return
+	}
+
+	var body registration_request
+	err = json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		log.Println("Cannot decode registration_request:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to decode registration_request: %s", err),
+			http.StatusBadRequest)
+		return
+	}
+	if len(body.UUID) != UUID_LENGTH {
+		http.Error(
+			writer,
+			fmt.Sprintf("uuid not %d characters", UUID_LENGTH),
+			http.StatusBadRequest)
+		return
+	}
+
+	// Only devices at events which are still running can register
+	event, err := events.GetEventRegions(eventId)
+	if err != nil {
+		log.Println("Error reading event", eventId, err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to read event %d", eventId),
+			http.StatusServiceUnavailable)
+		return
+	}
+	if event == nil {
+		http.Error(
+			writer,
+			fmt.Sprintf("Unknown EventId %d", eventId),
+			http.StatusNotFound)
+		return
+	}
+	if event.EndedBefore(time.Now()) {
+		http.Error(
+			writer,
+			fmt.Sprintf("Event %d ended", eventId),
+			http.StatusBadRequest)
+		return
+	}
+
+	secret, err := registry.Register(eventId, body.UUID)
+	if err == ErrAlreadyRegistered {
+		http.Error(
+			writer,
+			fmt.Sprintf("Device already registered at event %d", eventId),
+			http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println("Error registering device:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to register device: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(writer).Encode(registration_response{
+		UUID:    body.UUID,
+		EventId: eventId,
+		Secret:  secret,
+	})
+}
+
+func enrolmentHandler(writer http.ResponseWriter, request *http.Request) {
+
+	utils.SetAccessControlHeaders(writer)
+
+	eventId, err := parseEventId(request, writer)
+	if err != nil {
+		return
+	}
+
+	_ = json.NewEncoder(writer).Encode(enrolment_response{
+		EventId: eventId,
+		Token:   enrolment.Token(eventId),
+	})
+}
+
+// parseEventId reads the event from the path
+func parseEventId(request *http.Request, writer http.ResponseWriter) (int, error) {
+	eventId, err := strconv.Atoi(mux.Vars(request)["eventId"])
+	if err != nil {
+		log.Println("Cannot decode request eventId", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to decode request: %s", err),
+			http.StatusBadRequest)
+		return 0, err
+	}
+	return eventId, nil
+}
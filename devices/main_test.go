@@ -0,0 +1,324 @@
+package devices
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/ratelimit"
+)
+
+const testUUID = "Test-UUID-00000000000000000000000000"
+
+var router *mux.Router
+
+func init() {
+	registry = &Registry{db: &dummy_db{rows: make(map[string]map[string]interface{})}}
+	events = &dummy_events{}
+	enrolment = &Enrolment{Secret: []byte("test")}
+	limits = ratelimit.NewIngestionLimiter(&dummy_events{})
+	router = mux.NewRouter()
+	Init(router)
+}
+
+// newRegistration returns a request registering the device with the
+// event's enrolment token
+func newRegistration(path string, body string) *http.Request {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+	if eventId, err := strconv.Atoi(strings.Split(path, "/")[2]); err == nil {
+		req.Header.Set(ENROLMENT_HEADER, enrolment.Token(eventId))
+	}
+	return req
+}
+
+func TestRegister(t *testing.T) {
+	req := newRegistration("/events/1/devices", `{"uuid":"`+testUUID+`"}`)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var registration registration_response
+	_ = json.NewDecoder(response.Body).Decode(&registration)
+	if registration.UUID != testUUID || registration.EventId != 1 || len(registration.Secret) != 2*SECRET_BYTES {
+		t.Errorf("Expected a secret for the device. Got %+v", registration)
+	}
+
+	// The secret can't be issued again to take over the device
+	req = newRegistration("/events/1/devices", `{"uuid":"`+testUUID+`"}`)
+	checkResponseCode(t, http.StatusConflict, executeRequest(req).Code)
+
+	// A fresh registry reads the secret back from the table
+	fresh := &Registry{db: registry.(*Registry).db}
+	secret, err := fresh.Secret(1, testUUID)
+	if err != nil || secret != registration.Secret {
+		t.Errorf("Expected the issued secret. Got %q, %v", secret, err)
+	}
+	secret, _ = fresh.Secret(2, testUUID)
+	if secret != "" {
+		t.Errorf("Expected the device not to be registered at another event. Got %q", secret)
+	}
+}
+
+func TestRegisterInvalid(t *testing.T) {
+	tests := []struct {
+		path     string
+		body     string
+		expected int
+	}{
+		{"/events/one/devices", `{"uuid":"` + testUUID + `"}`, http.StatusBadRequest},
+		{"/events/1/devices", `{"uuid":"short"}`, http.StatusBadRequest},
+		{"/events/7/devices", `{"uuid":"` + testUUID + `"}`, http.StatusNotFound},
+		{"/events/5/devices", `{"uuid":"` + testUUID + `"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req := newRegistration(test.path, test.body)
+		checkResponseCode(t, test.expected, executeRequest(req).Code)
+	}
+}
+
+func TestRegisterWithoutEnrolment(t *testing.T) {
+	const uuid = "Test-UUID-00000000000000000000000002"
+
+	req, _ := http.NewRequest("POST", "/events/1/devices", strings.NewReader(`{"uuid":"`+uuid+`"}`))
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	// Another event's token doesn't do
+	req, _ = http.NewRequest("POST", "/events/1/devices", strings.NewReader(`{"uuid":"`+uuid+`"}`))
+	req.Header.Set(ENROLMENT_HEADER, enrolment.Token(2))
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	if secret, _ := registry.Secret(1, uuid); secret != "" {
+		t.Error("Expected the device not to be registered")
+	}
+}
+
+func TestEnrolmentToken(t *testing.T) {
+	os.Setenv("RTFA_STEWARD_TOKEN", "steward")
+	defer os.Unsetenv("RTFA_STEWARD_TOKEN")
+
+	req, _ := http.NewRequest("GET", "/events/1/enrolment-token", nil)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/events/1/enrolment-token", nil)
+	req.Header.Set("Authorization", "Bearer steward")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var token enrolment_response
+	_ = json.NewDecoder(response.Body).Decode(&token)
+	if token.EventId != 1 || !enrolment.Valid(1, token.Token) || enrolment.Valid(2, token.Token) {
+		t.Errorf("Expected the enrolment token of event 1. Got %+v", token)
+	}
+}
+
+func TestVerifyReplayWindow(t *testing.T) {
+	now := time.Date(2018, 12, 5, 14, 0, 0, 0, time.UTC)
+	verifier := NewVerifier(&Registry{db: &dummy_db{rows: make(map[string]map[string]interface{})}}, time.Minute, time.Time{}, nil)
+	verifier.now = func() time.Time { return now }
+	secret, _ := verifier.registry.Register(1, testUUID)
+
+	body := []byte(`{"uuid":"` + testUUID + `"}`)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req, _ := http.NewRequest("POST", "/update", nil)
+	req.Header.Set(TIMESTAMP_HEADER, timestamp)
+	req.Header.Set(SIGNATURE_HEADER, Sign(secret, timestamp, body))
+
+	if err := verifier.Verify(req, body, 1, testUUID); err != nil {
+		t.Errorf("Expected the request to be accepted. Got %v", err)
+	}
+	if err := verifier.Verify(req, body, 1, testUUID); err != ErrReplayed {
+		t.Errorf("Expected the request to be replayed. Got %v", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := verifier.Verify(req, body, 1, testUUID); err != ErrStale {
+		t.Errorf("Expected the request to be stale. Got %v", err)
+	}
+
+	// Signatures are forgotten once their timestamps can't be accepted
+	now = now.Add(time.Minute)
+	timestamp = strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(TIMESTAMP_HEADER, timestamp)
+	req.Header.Set(SIGNATURE_HEADER, Sign(secret, timestamp, body))
+	if err := verifier.Verify(req, body, 1, testUUID); err != nil {
+		t.Errorf("Expected a new request to be accepted. Got %v", err)
+	}
+	if len(verifier.seen) != 1 {
+		t.Errorf("Expected the old signature to be forgotten. Got %d", len(verifier.seen))
+	}
+}
+
+func TestVerifySharedReplayWindow(t *testing.T) {
+	// Two instances of the server sharing the table of received signatures
+	received := &dummy_db{rows: make(map[string]map[string]interface{})}
+	first := NewVerifier(&dummy_registry{}, time.Minute, time.Time{}, received)
+	second := NewVerifier(&dummy_registry{}, time.Minute, time.Time{}, received)
+
+	body := []byte(`{"uuid":"` + testUUID + `"}`)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, _ := http.NewRequest("POST", "/update", nil)
+	req.Header.Set(TIMESTAMP_HEADER, timestamp)
+	req.Header.Set(SIGNATURE_HEADER, Sign("test-secret", timestamp, body))
+
+	if err := first.Verify(req, body, 1, testUUID); err != nil {
+		t.Errorf("Expected the request to be accepted. Got %v", err)
+	}
+	if err := second.Verify(req, body, 1, testUUID); err != ErrReplayed {
+		t.Errorf("Expected the request to be replayed on the other instance. Got %v", err)
+	}
+}
+
+func TestVerifyUnsignedUntil(t *testing.T) {
+	now := time.Date(2018, 12, 5, 14, 0, 0, 0, time.UTC)
+	verifier := NewVerifier(&dummy_registry{}, time.Minute, now.Add(time.Hour), nil)
+	verifier.now = func() time.Time { return now }
+	req, _ := http.NewRequest("POST", "/update", nil)
+	if err := verifier.Verify(req, nil, 1, testUUID); err != nil {
+		t.Errorf("Expected an unsigned request to be let through. Got %v", err)
+	}
+
+	// Signed requests are still checked
+	req.Header.Set(TIMESTAMP_HEADER, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(SIGNATURE_HEADER, "forged")
+	if err := verifier.Verify(req, nil, 1, testUUID); err != ErrBadSignature {
+		t.Errorf("Expected a forged request to be rejected. Got %v", err)
+	}
+
+	// Unsigned requests are turned away once the time has passed
+	now = now.Add(time.Hour)
+	req, _ = http.NewRequest("POST", "/update", nil)
+	if err := verifier.Verify(req, nil, 1, testUUID); err != ErrUnsigned {
+		t.Errorf("Expected an unsigned request to be rejected. Got %v", err)
+	}
+}
+
+func TestAllowUnsignedUntil(t *testing.T) {
+	if until := allowUnsignedUntil(); !until.IsZero() {
+		t.Errorf("Expected unsigned requests not to be let through by default. Got %s", until)
+	}
+
+	deadline := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	os.Setenv("RTFA_ALLOW_UNSIGNED_UNTIL", deadline.Format(time.RFC3339))
+	defer os.Unsetenv("RTFA_ALLOW_UNSIGNED_UNTIL")
+	if until := allowUnsignedUntil(); !until.Equal(deadline) {
+		t.Errorf("Expected unsigned requests to be let through until %s. Got %s", deadline, until)
+	}
+}
+
+func executeRequest(req *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func checkResponseCode(t *testing.T, expected, actual int) {
+	if expected != actual {
+		t.Errorf("Expected response code %d. Got %d\n", expected, actual)
+	}
+}
+
+/***************************
+   FAKE DynamoDB table
+***************************/
+
+type dummy_db struct {
+	rows map[string]map[string]interface{}
+}
+
+func (db *dummy_db) InitConn(tableName string) error {
+	return nil
+}
+
+func (db *dummy_db) GetTableScan() []map[string]interface{} {
+	return nil
+}
+
+func (db *dummy_db) QueryItems(query dynamoDB.Query) ([]map[string]interface{}, string, error) {
+	return nil, "", nil
+}
+
+func (db *dummy_db) SendItem(req interface{}) {
+	row, key := db.row(req)
+	db.rows[key] = row
+}
+
+func (db *dummy_db) SendItemIf(req interface{}, condition string, values map[string]interface{}) (bool, error) {
+	if condition != REGISTER_CONDITION && condition != SEEN_CONDITION {
+		return false, fmt.Errorf("unexpected condition %s", condition)
+	}
+	if _, key := db.row(req); db.rows[key] != nil {
+		return false, nil
+	}
+	db.SendItem(req)
+	return true, nil
+}
+
+// row returns the item as a row and its key, a device key or a signature
+func (db *dummy_db) row(req interface{}) (map[string]interface{}, string) {
+	data, _ := json.Marshal(req)
+	var row map[string]interface{}
+	_ = json.Unmarshal(data, &row)
+	if key, ok := row["deviceKey"]; ok {
+		return row, fmt.Sprint(key)
+	}
+	return row, fmt.Sprint(row["signature"])
+}
+
+func (db *dummy_db) GetItem(pKeyColName string, pKeyValue string) map[string]interface{} {
+	row, ok := db.rows[pKeyValue]
+	if !ok {
+		return map[string]interface{}{}
+	}
+	return row
+}
+
+func (db *dummy_db) DeleteItem(pKeyColName string, pKeyValue string) error {
+	delete(db.rows, pKeyValue)
+	return nil
+}
+
+func (db *dummy_db) IncrementCounter(pKeyColName string, pKeyValue string, counterColName string) (int, error) {
+	return 0, nil
+}
+
+type dummy_registry struct{}
+
+func (dr *dummy_registry) InitConn() error {
+	return nil
+}
+
+func (dr *dummy_registry) Register(eventId int, uuid string) (string, error) {
+	return "", nil
+}
+
+func (dr *dummy_registry) Secret(eventId int, uuid string) (string, error) {
+	return "test-secret", nil
+}
+
+/***************************
+   FAKE Event index
+***************************/
+
+type dummy_events struct{}
+
+func (de *dummy_events) GetEventRegions(eventID int) (*eventstaticdata.EventRegions, error) {
+	now := time.Now()
+	switch eventID {
+	case 1, 2:
+		return &eventstaticdata.EventRegions{Event: eventstaticdata.Event{StartDate: now, EndDate: now}}, nil
+	case 5:
+		return &eventstaticdata.EventRegions{Event: eventstaticdata.Event{EndDate: now.AddDate(0, 0, -3)}}, nil
+	}
+	return nil, nil
+}
+
+func (de *dummy_events) Invalidate(eventID int) {
+}
@@ -0,0 +1,131 @@
+package devices
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+)
+
+const (
+	SECRET_BYTES = 32
+	// MAX_CACHED_SECRETS bounds the memory used by the cache of secrets
+	MAX_CACHED_SECRETS = 200000
+	// REGISTER_CONDITION makes registration fail for a device already
+	// registered, so nobody can take over a device by registering it again
+	REGISTER_CONDITION = "attribute_not_exists(deviceKey)"
+)
+
+// ErrAlreadyRegistered is returned when registering a device twice
+var ErrAlreadyRegistered = errors.New("device already registered")
+
+// device_registration is a device registered at an event, with the secret
+// it signs its requests with. Devices are stored by a hash of their
+// identifier rather than the identifier itself.
+type device_registration struct {
+	DeviceKey    string `json:"deviceKey"`
+	EventId      int    `json:"eventId"`
+	Secret       string `json:"secret"`
+	RegisteredAt int    `json:"registeredAt"`
+}
+
+// RegistryInterface issues and looks up the secrets of devices
+type RegistryInterface interface {
+	InitConn() error
+	// Register issues a secret to the device at the event
+	Register(eventId int, uuid string) (string, error)
+	// Secret returns the device's secret at the event, or "" if the device
+	// isn't registered there
+	Secret(eventId int, uuid string) (string, error)
+}
+
+// Registry keeps device registrations in DynamoDB, caching the secrets it
+// reads as they never change
+type Registry struct {
+	db dynamoDB.DynamoDBInterface
+
+	connect sync.Once
+	connErr error
+	mutex   sync.Mutex
+	secrets map[string]string
+}
+
+// InitConn connects to the registration table, once however often it is
+// called
+func (r *Registry) InitConn() error {
+	r.connect.Do(func() {
+		r.connErr = r.db.InitConn("device_registrations")
+	})
+	return r.connErr
+}
+
+func (r *Registry) Register(eventId int, uuid string) (string, error) {
+	bytes := make([]byte, SECRET_BYTES)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+
+	registration := device_registration{
+		DeviceKey:    DeviceKey(eventId, uuid),
+		EventId:      eventId,
+		Secret:       hex.EncodeToString(bytes),
+		RegisteredAt: int(time.Now().Unix()),
+	}
+	ok, err := r.db.SendItemIf(registration, REGISTER_CONDITION, nil)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrAlreadyRegistered
+	}
+
+	r.remember(registration.DeviceKey, registration.Secret)
+	return registration.Secret, nil
+}
+
+func (r *Registry) Secret(eventId int, uuid string) (string, error) {
+	key := DeviceKey(eventId, uuid)
+
+	r.mutex.Lock()
+	secret, ok := r.secrets[key]
+	r.mutex.Unlock()
+	if ok {
+		return secret, nil
+	}
+
+	row := r.db.GetItem("deviceKey", key)
+	if row == nil {
+		return "", errors.New("failed to read device registration")
+	}
+	var registration device_registration
+	_ = mapstructure.Decode(row, &registration)
+	if registration.Secret == "" {
+		return "", nil
+	}
+
+	r.remember(key, registration.Secret)
+	return registration.Secret, nil
+}
+
+func (r *Registry) remember(key string, secret string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.secrets == nil || len(r.secrets) >= MAX_CACHED_SECRETS {
+		r.secrets = make(map[string]string)
+	}
+	r.secrets[key] = secret
+}
+
+// DeviceKey returns the key a device's registration at an event is stored
+// under
+func DeviceKey(eventId int, uuid string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%s", eventId, uuid)))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,271 @@
+package devices
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/metrics"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const (
+	// Requests are signed with the hex HMAC-SHA256, keyed by the device's
+	// secret, of the timestamp header, a ".", and the body
+	SIGNATURE_HEADER = "X-RTFA-Signature"
+	TIMESTAMP_HEADER = "X-RTFA-Timestamp"
+	// SERVER_TIME_HEADER tells devices whose timestamps are too far out
+	// the time on the server
+	SERVER_TIME_HEADER = "X-RTFA-Server-Time"
+
+	DEFAULT_SIGNATURE_WINDOW = 5 * time.Minute
+	// MAX_SEEN_SIGNATURES bounds the memory used, forgetting the oldest
+	// signatures early if there are more than this many in the window
+	MAX_SEEN_SIGNATURES = 1000000
+	// MAX_UNSIGNED_PERIOD is the furthest ahead unsigned updates can be let
+	// through until, so they can't be allowed indefinitely
+	MAX_UNSIGNED_PERIOD = 30 * 24 * time.Hour
+	// SEEN_CONDITION makes recording a signature fail if any instance of
+	// the server has already received it
+	SEEN_CONDITION = "attribute_not_exists(signature)"
+)
+
+var (
+	ErrUnsigned     = errors.New("request is not signed")
+	ErrUnregistered = errors.New("device is not registered at the event")
+	ErrBadSignature = errors.New("signature does not match")
+	ErrStale        = errors.New("timestamp is too far from the server's time")
+	ErrReplayed     = errors.New("request has already been received")
+)
+
+// VerifierInterface checks that requests come from registered devices
+type VerifierInterface interface {
+	InitConn() error
+	// Verify returns an error unless the request, with the given body, was
+	// signed by the device at the event and hasn't been received before
+	Verify(request *http.Request, body []byte, eventId int, uuid string) error
+}
+
+// Signatures is the verifier shared by the handlers which receive updates
+// from devices. Signatures received are recorded in the request_signatures
+// table, which should expire rows by their expiresAt attribute, so a
+// request is accepted once however many instances of the server there are.
+//
+// Every update must be signed. While versions of the app from before
+// devices registered are still in use, unsigned updates can be let through
+// until the time RTFA_ALLOW_UNSIGNED_UNTIL is set to, at most
+// MAX_UNSIGNED_PERIOD ahead. The requests_unsigned metric shows how many
+// are still arriving.
+var Signatures = NewVerifier(Devices,
+	utils.GetEnvDuration("RTFA_SIGNATURE_WINDOW", DEFAULT_SIGNATURE_WINDOW),
+	allowUnsignedUntil(), &dynamoDB.DynamoDBClient{})
+
+// Devices is the registry shared by the registration endpoint and the
+// verifier
+var Devices = &Registry{db: &dynamoDB.DynamoDBClient{}}
+
+// Verifier checks the signatures of requests against the registry,
+// accepting each signature once
+type Verifier struct {
+	registry RegistryInterface
+	window   time.Duration
+	// unsignedUntil is when unsigned requests stop being let through while
+	// devices are moved over to signing. Before it they are counted but
+	// let through.
+	unsignedUntil time.Time
+	// received records the signatures received by every instance, if the
+	// verifier is shared between them
+	received dynamoDB.DynamoDBInterface
+	now      func() time.Time
+
+	connect sync.Once
+	connErr error
+
+	mutex sync.Mutex
+	seen  map[string]bool
+	order []seenSignature
+	head  int
+}
+
+type seenSignature struct {
+	signature string
+	seen      time.Time
+}
+
+// received_signature is a signature received by an instance of the server,
+// kept until its timestamp can no longer be accepted
+type received_signature struct {
+	Signature string `json:"signature"`
+	ExpiresAt int    `json:"expiresAt"`
+}
+
+// NewVerifier returns a verifier accepting timestamps within the window of
+// the server's time, letting unsigned requests through before
+// unsignedUntil. Signatures are recorded in received so requests are
+// accepted once by all the instances sharing it, or only by this instance
+// if it is nil.
+func NewVerifier(registry RegistryInterface, window time.Duration, unsignedUntil time.Time, received dynamoDB.DynamoDBInterface) *Verifier {
+	return &Verifier{
+		registry:      registry,
+		window:        window,
+		unsignedUntil: unsignedUntil,
+		received:      received,
+		now:           time.Now,
+		seen:          make(map[string]bool),
+	}
+}
+
+// allowUnsignedUntil returns when unsigned updates stop being let through,
+// set by RTFA_ALLOW_UNSIGNED_UNTIL as an RFC 3339 time. Unless it is set
+// they never are.
+func allowUnsignedUntil() time.Time {
+	until := utils.GetEnv("RTFA_ALLOW_UNSIGNED_UNTIL", "")
+	if until == "" {
+		return time.Time{}
+	}
+	deadline, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		log.Fatal("RTFA_ALLOW_UNSIGNED_UNTIL must be an RFC 3339 time: ", err)
+	}
+	if deadline.After(time.Now().Add(MAX_UNSIGNED_PERIOD)) {
+		log.Fatalf("RTFA_ALLOW_UNSIGNED_UNTIL must be within %s", MAX_UNSIGNED_PERIOD)
+	}
+	log.Println("Letting unsigned updates through until", deadline)
+	return deadline
+}
+
+// InitConn connects to the registry and the table of received signatures,
+// once however often it is called
+func (v *Verifier) InitConn() error {
+	err := v.registry.InitConn()
+	if err != nil {
+		return err
+	}
+	if v.received != nil {
+		v.connect.Do(func() {
+			v.connErr = v.received.InitConn("request_signatures")
+		})
+	}
+	return v.connErr
+}
+
+func (v *Verifier) Verify(request *http.Request, body []byte, eventId int, uuid string) error {
+	signature := request.Header.Get(SIGNATURE_HEADER)
+	timestamp := request.Header.Get(TIMESTAMP_HEADER)
+	if signature == "" || timestamp == "" {
+		if v.now().Before(v.unsignedUntil) {
+			metrics.Add("requests_unsigned", 1)
+			return nil
+		}
+		return ErrUnsigned
+	}
+
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	now := v.now()
+	offset := now.Sub(time.Unix(signedAt, 0))
+	if offset > v.window || offset < -v.window {
+		return ErrStale
+	}
+
+	secret, err := v.registry.Secret(eventId, uuid)
+	if err != nil {
+		return err
+	}
+	if secret == "" {
+		return ErrUnregistered
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return ErrBadSignature
+	}
+
+	if !v.reserve(signature, now) {
+		return ErrReplayed
+	}
+	if v.received == nil {
+		return nil
+	}
+
+	// Check no other instance has received it
+	recorded, err := v.received.SendItemIf(received_signature{
+		Signature: signature,
+		ExpiresAt: int(now.Add(2 * v.window).Unix()),
+	}, SEEN_CONDITION, nil)
+	if err != nil {
+		// Let the device send it again
+		v.release(signature)
+		return err
+	}
+	if !recorded {
+		return ErrReplayed
+	}
+	return nil
+}
+
+// Sign returns the signature of a request with the timestamp and body
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// reserve records the signature and reports whether it is new. Signatures
+// are remembered for twice the window, the longest their timestamp can be
+// accepted for.
+func (v *Verifier) reserve(signature string, now time.Time) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	for v.head < len(v.order) {
+		entry := v.order[v.head]
+		if now.Sub(entry.seen) < 2*v.window && len(v.order)-v.head <= MAX_SEEN_SIGNATURES {
+			break
+		}
+		delete(v.seen, entry.signature)
+		v.head++
+	}
+	if v.head > len(v.order)/2 {
+		v.order = append([]seenSignature(nil), v.order[v.head:]...)
+		v.head = 0
+	}
+
+	if v.seen[signature] {
+		return false
+	}
+	v.seen[signature] = true
+	v.order = append(v.order, seenSignature{signature: signature, seen: now})
+	return true
+}
+
+// release forgets a reserved signature
+func (v *Verifier) release(signature string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	delete(v.seen, signature)
+}
+
+// Reject writes the response to a request which failed verification
+func Reject(writer http.ResponseWriter, err error) {
+	status := http.StatusUnauthorized
+	if err != ErrUnsigned && err != ErrUnregistered && err != ErrBadSignature &&
+		err != ErrStale && err != ErrReplayed {
+		// The registry couldn't be read, so the device should try again
+		status = http.StatusServiceUnavailable
+	}
+	if err == ErrStale {
+		writer.Header().Set(SERVER_TIME_HEADER, strconv.FormatInt(time.Now().Unix(), 10))
+	}
+	metrics.Add("requests_rejected_signature", 1)
+	http.Error(writer, "Failed to verify request: "+err.Error(), status)
+}
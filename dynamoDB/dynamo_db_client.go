@@ -1,19 +1,48 @@
 package dynamoDB
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"log"
 )
 
+// ErrInvalidCursor is returned by QueryItems when the cursor wasn't one it made
+var ErrInvalidCursor = errors.New("invalid cursor")
+
 type DynamoDBInterface interface {
 	InitConn(tableName string) error
 	GetTableScan() []map[string]interface{}
+	QueryItems(query Query) ([]map[string]interface{}, string, error)
 	SendItem(req interface{})
+	SendItemIf(req interface{}, condition string, values map[string]interface{}) (bool, error)
 	GetItem(pKeyColName string, pKeyValue string) map[string]interface{}
+	DeleteItem(pKeyColName string, pKeyValue string) error
+	IncrementCounter(pKeyColName string, pKeyValue string, counterColName string) (int, error)
+}
+
+// Query selects the rows of a table, or of one of its indexes, that share a
+// partition key, optionally narrowed by a range of the numeric sort key and
+// by a list column containing a value
+type Query struct {
+	IndexName     string
+	PKeyColName   string
+	PKeyValue     interface{}
+	SortColName   string
+	SortFrom      *int
+	SortTo        *int
+	ContainsCol   string
+	ContainsValue interface{}
+	Descending    bool
+	Limit         int
+	// Cursor is the opaque position returned by the previous page, if any
+	Cursor string
 }
 
 type DynamoDBClient struct {
@@ -69,6 +98,117 @@ func (db *DynamoDBClient) GetTableScan() []map[string]interface{} {
 	return allRows
 }
 
+// QueryItems runs the query and returns a page of matching rows along with the
+// cursor of the next page, which is empty once there are no more rows.
+// Filtering on a contained value happens after the limit is applied, so a
+// page can hold fewer rows than the limit even when more follow.
+func (db *DynamoDBClient) QueryItems(query Query) ([]map[string]interface{}, string, error) {
+	// Build the key condition and any filter
+	names := map[string]*string{"#pk": aws.String(query.PKeyColName)}
+	values := map[string]interface{}{":pk": query.PKeyValue}
+	keyCondition := "#pk = :pk"
+	if query.SortFrom != nil || query.SortTo != nil {
+		names["#sk"] = aws.String(query.SortColName)
+	}
+	if query.SortFrom != nil && query.SortTo != nil {
+		keyCondition += " AND #sk BETWEEN :from AND :to"
+		values[":from"] = *query.SortFrom
+		values[":to"] = *query.SortTo
+	} else if query.SortFrom != nil {
+		keyCondition += " AND #sk >= :from"
+		values[":from"] = *query.SortFrom
+	} else if query.SortTo != nil {
+		keyCondition += " AND #sk <= :to"
+		values[":to"] = *query.SortTo
+	}
+
+	encodedValues, err := dynamodbattribute.MarshalMap(values)
+	if err != nil {
+		log.Println("Got error trying to marshal query values:", err.Error())
+		return nil, "", err
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(db.tableName),
+		KeyConditionExpression:    aws.String(keyCondition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: encodedValues,
+		ScanIndexForward:          aws.Bool(!query.Descending),
+	}
+	if query.IndexName != "" {
+		input.IndexName = aws.String(query.IndexName)
+	}
+	if query.ContainsCol != "" {
+		names["#contains"] = aws.String(query.ContainsCol)
+		input.ExpressionAttributeValues[":contains"], err = dynamodbattribute.Marshal(query.ContainsValue)
+		if err != nil {
+			log.Println("Got error trying to marshal query filter:", err.Error())
+			return nil, "", err
+		}
+		input.FilterExpression = aws.String("contains(#contains, :contains)")
+	}
+	if query.Limit > 0 {
+		input.Limit = aws.Int64(int64(query.Limit))
+	}
+
+	// Carry on from where the previous page stopped
+	if query.Cursor != "" {
+		input.ExclusiveStartKey, err = decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	result, err := db.connection.Query(input)
+	if err != nil {
+		log.Println("Got error doing query:", err.Error())
+		return nil, "", err
+	}
+
+	// Unmarshall to list of maps
+	var rows = make([]map[string]interface{}, len(result.Items))
+	for index, row := range result.Items {
+		err = dynamodbattribute.UnmarshalMap(row, &rows[index])
+		if err != nil {
+			log.Println("Got error unmarshalling:", err.Error())
+			return nil, "", err
+		}
+	}
+
+	// Hand back where the next page starts
+	cursor := ""
+	if len(result.LastEvaluatedKey) > 0 {
+		cursor, err = encodeCursor(result.LastEvaluatedKey)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return rows, cursor, nil
+}
+
+// encodeCursor turns the key a query stopped at into an opaque string
+func encodeCursor(key map[string]*dynamodb.AttributeValue) (string, error) {
+	data, err := json.Marshal(key)
+	if err != nil {
+		log.Println("Got error encoding cursor:", err.Error())
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor turns a cursor made by encodeCursor back into the key
+func decodeCursor(cursor string) (map[string]*dynamodb.AttributeValue, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var key map[string]*dynamodb.AttributeValue
+	if err = json.Unmarshal(data, &key); err != nil || len(key) == 0 {
+		return nil, ErrInvalidCursor
+	}
+	return key, nil
+}
+
 // Pre: the event object is valid
 func (db *DynamoDBClient) SendItem(req interface{}) {
 	// Encode the data
@@ -93,6 +233,46 @@ func (db *DynamoDBClient) SendItem(req interface{}) {
 	}
 }
 
+// SendItemIf puts the item only if the condition expression holds for the
+// row it would replace. It returns false without an error when the condition
+// did not hold, so the caller can tell a rejected write from a failed one.
+func (db *DynamoDBClient) SendItemIf(req interface{}, condition string, values map[string]interface{}) (bool, error) {
+	// Encode the data
+	encoded, err := dynamodbattribute.MarshalMap(req)
+	if err != nil {
+		log.Println("Got error trying to marshal request:")
+		log.Println(err.Error())
+		return false, err
+	}
+
+	// Wrap the item up in a conditional request
+	input := &dynamodb.PutItemInput{
+		Item:                encoded,
+		TableName:           aws.String(db.tableName),
+		ConditionExpression: aws.String(condition),
+	}
+	if len(values) > 0 {
+		input.ExpressionAttributeValues, err = dynamodbattribute.MarshalMap(values)
+		if err != nil {
+			log.Println("Got error trying to marshal condition values:")
+			log.Println(err.Error())
+			return false, err
+		}
+	}
+
+	// Send the item
+	_, err = db.connection.PutItem(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, nil
+	}
+	if err != nil {
+		log.Println("Got an error putting item in DynamoDB")
+		log.Println(err.Error())
+		return false, err
+	}
+	return true, nil
+}
+
 func (db *DynamoDBClient) GetItem(pKeyColName string, pKeyValue string) map[string]interface{} {
 	// Try and get the item
 	result, err := db.connection.GetItem(&dynamodb.GetItemInput{
@@ -124,3 +304,61 @@ func (db *DynamoDBClient) GetItem(pKeyColName string, pKeyValue string) map[stri
 
 	return m
 }
+
+// DeleteItem removes the row with the given key, if there is one
+func (db *DynamoDBClient) DeleteItem(pKeyColName string, pKeyValue string) error {
+	_, err := db.connection.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(db.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			pKeyColName: {
+				S: aws.String(pKeyValue),
+			},
+		},
+	})
+	if err != nil {
+		log.Println("Error deleting item from database")
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// IncrementCounter atomically adds one to the counter column of the row with
+// the given key, creating the row if it doesn't exist, and returns the new value
+func (db *DynamoDBClient) IncrementCounter(pKeyColName string, pKeyValue string, counterColName string) (int, error) {
+	// Update the counter in place so concurrent callers never get the same value
+	result, err := db.connection.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(db.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			pKeyColName: {
+				S: aws.String(pKeyValue),
+			},
+		},
+		UpdateExpression: aws.String("ADD #counter :one"),
+		ExpressionAttributeNames: map[string]*string{
+			"#counter": aws.String(counterColName),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {
+				N: aws.String("1"),
+			},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		log.Println("Error incrementing counter in database")
+		log.Println(err)
+		return 0, err
+	}
+
+	// Unmarshall the new counter value
+	var value int
+	err = dynamodbattribute.Unmarshal(result.Attributes[counterColName], &value)
+	if err != nil {
+		log.Println("Error unmarshalling the incremented counter")
+		log.Println(err)
+		return 0, err
+	}
+
+	return value, nil
+}
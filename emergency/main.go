@@ -1,17 +1,28 @@
 package emergency
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/mitchellh/mapstructure"
+	"github.com/real-time-footfall-analysis/rtfa-backend/auth"
+	"github.com/real-time-footfall-analysis/rtfa-backend/devices"
 	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/health"
+	"github.com/real-time-footfall-analysis/rtfa-backend/metrics"
+	"github.com/real-time-footfall-analysis/rtfa-backend/pseudonym"
 	"github.com/real-time-footfall-analysis/rtfa-backend/pusher"
+	"github.com/real-time-footfall-analysis/rtfa-backend/ratelimit"
 	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 )
 
 // Init registers the endpoints exposed by this package
@@ -19,7 +30,21 @@ import (
 // Also initialises the static data database connection
 
 const (
-	UUID_LENGTH = 36
+	UUID_LENGTH        = 36
+	DEFAULT_FEED_LIMIT = 100
+	MAX_FEED_LIMIT     = 500
+
+	// FEED_INDEX_NAME is the index of the emergencies table keyed by
+	// eventId and sorted by sequence
+	FEED_INDEX_NAME = "eventId-sequence-index"
+
+	// FEED_SETTLE_SECONDS is how long a gap in the sequence numbers of the
+	// feed is waited on before it is skipped
+	FEED_SETTLE_SECONDS = 30
+
+	// MAX_SUPERSEDED is how many of the sequence numbers an emergency had
+	// before its latest update are kept for readers of the feed to skip
+	MAX_SUPERSEDED = 100
 )
 
 type emergency_request struct {
@@ -33,9 +58,43 @@ type emergency_request struct {
 		Lat float64 `json:"lat"`
 		Lng float64 `json:"lng"`
 	} `json:"position"`
+	Sequence int `json:"sequence"`
+	// SequencedAt is when the sequence number was taken, which is only
+	// stored for readers of the feed
+	SequencedAt int `json:"-" dynamodbav:"sequencedAt,omitempty"`
+	// Supersedes are the sequence numbers the emergency had before, which
+	// are gaps in the feed once it is updated
+	Supersedes []int `json:"-" dynamodbav:"supersedes,omitempty"`
+}
+
+// emergency_status is a steward's change to the status of an emergency
+type emergency_status struct {
+	DealtWith *bool `json:"dealtWith"`
+}
+
+// emergency_identity links the pseudonym an emergency was reported under
+// back to the reporting device, for stewards who need to find the attendee
+type emergency_identity struct {
+	Pseudonym string `json:"pseudonym"`
+	EventId   int    `json:"eventId"`
+	UUID      string `json:"uuid"`
+}
+
+// emergency_feed is a page of the emergency change feed of an event
+type emergency_feed struct {
+	Emergencies []emergency_request `json:"emergencies"`
+	NextCursor  int                 `json:"nextCursor"`
 }
 
 var db dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var counters dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var identities dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var pseudonyms pseudonym.PseudonymInterface = &pseudonym.Pseudonymiser{}
+var signatures devices.VerifierInterface = devices.Signatures
+
+// Emergencies have limits of their own, so a device sending too many
+// movement updates can still report an emergency
+var limits ratelimit.IngestionLimiterInterface = ratelimit.NewIngestionLimiter(eventstaticdata.Index)
 var pc pusher.PusherChannelInterface = &pusher.PusherChannelClient{}
 
 func Init(r *mux.Router) {
@@ -43,22 +102,55 @@ func Init(r *mux.Router) {
 	if err != nil {
 		os.Exit(1)
 	}
+	err = counters.InitConn("sequence_counters")
+	if err != nil {
+		os.Exit(1)
+	}
+	err = identities.InitConn("emergency_identities")
+	if err != nil {
+		os.Exit(1)
+	}
+	err = signatures.InitConn()
+	if err != nil {
+		os.Exit(1)
+	}
 
 	pc.InitConn()
+	pseudonyms.InitConn()
+	health.Register("emergency_rate_limits", func() interface{} { return limits.Stats() })
 	r.HandleFunc("/emergency-update", updateHandler).Methods("POST")
-	r.HandleFunc("/live/emergency/{eventId}/{lastPoll}", requestHandler).Methods("GET")
+	r.HandleFunc("/live/emergency/{eventId}", feedHandler).Methods("GET")
+	r.HandleFunc("/events/{eventId}/emergencies/{pseudonym}/device", auth.RequireSteward(deviceHandler)).Methods("GET")
+	r.HandleFunc("/events/{eventId}/emergencies/{pseudonym}/status", auth.RequireSteward(statusHandler)).Methods("PUT")
 }
 
 func updateHandler(writer http.ResponseWriter, request *http.Request) {
 
 	utils.SetAccessControlHeaders(writer)
 
-	decoder := json.NewDecoder(request.Body)
+	// Turn away floods before doing any work for them
+	if ok, wait := limits.AllowClient(request); !ok {
+		metrics.Add("emergency_updates_throttled_client", 1)
+		ratelimit.Reject(writer, wait)
+		return
+	}
+
+	// Keep the body as it was sent to check its signature
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Println("Cannot read emergency_request:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to read emergency_request: %s", err),
+			http.StatusBadRequest)
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
 
 	var emergencyUpdate emergency_request
 
 	// Try and decode the data
-	err := decoder.Decode(&emergencyUpdate)
+	err = decoder.Decode(&emergencyUpdate)
 	if err != nil {
 		log.Println("Cannot decode emergency_request:", err)
 		http.Error(
@@ -102,19 +194,198 @@ func updateHandler(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// Send the item to the database
-	db.SendItem(emergencyUpdate)
+	// Only accept emergencies from the registered device they claim to be from
+	err = signatures.Verify(request, body, emergencyUpdate.EventId, emergencyUpdate.UUID)
+	if err != nil {
+		log.Println("Rejected emergency_request:", err)
+		devices.Reject(writer, err)
+		return
+	}
+	if ok, wait := limits.AllowDevice(emergencyUpdate.EventId, emergencyUpdate.UUID); !ok {
+		metrics.Add("emergency_updates_throttled_device", 1)
+		ratelimit.Reject(writer, wait)
+		return
+	}
 
-	// Push the item to Pusher
-	channelName := strconv.Itoa(emergencyUpdate.EventId)
-	data, _ := json.Marshal(emergencyUpdate)
-	pc.SendItem(channelName, "emergency-update", data)
+	// Replace the device's identifier, keeping the way back for stewards
+	devicePseudonym, err := pseudonyms.Pseudonym(emergencyUpdate.EventId, emergencyUpdate.UUID)
+	if err != nil {
+		log.Println("Error pseudonymising emergency_request:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to accept emergency: %s", err),
+			http.StatusServiceUnavailable)
+		return
+	}
+	identity := emergency_identity{
+		Pseudonym: devicePseudonym,
+		EventId:   emergencyUpdate.EventId,
+		UUID:      emergencyUpdate.UUID,
+	}
+	identities.SendItem(identity)
+	emergencyUpdate.UUID = identity.Pseudonym
+
+	// An unreadable previous report only costs readers of the feed a wait
+	previous, err := readEmergency(emergencyUpdate.UUID)
+	if err != nil {
+		log.Println("Error reading previous emergency_request:", err)
+	}
+	err = publish(&emergencyUpdate, previous)
+	if err != nil {
+		log.Println("Error assigning emergency sequence number:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to record emergency: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
 
 	// Return the update to the user
 	_ = json.NewEncoder(writer).Encode(emergencyUpdate)
 }
 
-func requestHandler(writer http.ResponseWriter, request *http.Request) {
+// deviceHandler returns the device an emergency was reported from, given
+// the pseudonym it was reported under
+func deviceHandler(writer http.ResponseWriter, request *http.Request) {
+
+	utils.SetAccessControlHeaders(writer)
+
+	vars := mux.Vars(request)
+	eventId, err := parseRequestArgs(vars, "eventId", writer)
+	if err != nil {
+		return
+	}
+
+	var identity emergency_identity
+	row := identities.GetItem("pseudonym", vars["pseudonym"])
+	if row != nil {
+		_ = mapstructure.Decode(row, &identity)
+	}
+	if identity.UUID == "" || identity.EventId != eventId {
+		http.Error(
+			writer,
+			fmt.Sprintf("No emergency reported as %s at event %d", vars["pseudonym"], eventId),
+			http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Steward looked up the device behind %s at event %d", identity.Pseudonym, eventId)
+	_ = json.NewEncoder(writer).Encode(identity)
+}
+
+// statusHandler lets stewards mark an emergency as dealt with, or not,
+// given the pseudonym it was reported under
+func statusHandler(writer http.ResponseWriter, request *http.Request) {
+
+	utils.SetAccessControlHeaders(writer)
+
+	vars := mux.Vars(request)
+	eventId, err := parseRequestArgs(vars, "eventId", writer)
+	if err != nil {
+		return
+	}
+
+	var status emergency_status
+	err = json.NewDecoder(request.Body).Decode(&status)
+	if err != nil {
+		log.Println("Cannot decode emergency_status:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to decode emergency_status: %s", err),
+			http.StatusBadRequest)
+		return
+	}
+	if status.DealtWith == nil {
+		http.Error(
+			writer,
+			fmt.Sprintf("dealtWith missing"),
+			http.StatusBadRequest)
+		return
+	}
+
+	previous, err := readEmergency(vars["pseudonym"])
+	if err != nil {
+		log.Println("Error reading emergency_request:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to read emergency: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+	if previous == nil || previous.EventId != eventId {
+		http.Error(
+			writer,
+			fmt.Sprintf("No emergency reported as %s at event %d", vars["pseudonym"], eventId),
+			http.StatusNotFound)
+		return
+	}
+
+	emergency := *previous
+	emergency.DealtWith = *status.DealtWith
+	err = publish(&emergency, previous)
+	if err != nil {
+		log.Println("Error assigning emergency sequence number:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to record emergency: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Steward set the emergency reported as %s at event %d dealt with: %t", emergency.UUID, eventId, emergency.DealtWith)
+	_ = json.NewEncoder(writer).Encode(emergency)
+}
+
+// readEmergency returns the latest report of the emergency with the
+// pseudonym, or nil if there is none
+func readEmergency(pseudonym string) (*emergency_request, error) {
+	row := db.GetItem("uuid", pseudonym)
+	if row == nil {
+		return nil, errors.New("failed to read emergency " + pseudonym)
+	}
+	if len(row) == 0 {
+		return nil, nil
+	}
+	var emergency emergency_request
+	_ = mapstructure.Decode(row, &emergency)
+	return &emergency, nil
+}
+
+// publish stores the emergency in place of its previous report, if any,
+// and pushes it to listeners
+func publish(emergency *emergency_request, previous *emergency_request) error {
+
+	// Stamp the update with the next position in the event's change feed,
+	// so pollers see it regardless of the clock on the reporting device.
+	// The number is taken before the row is written, so a failed write
+	// leaves a gap and concurrent writes can land out of order, which
+	// readers of the feed wait out. The number the previous report had is
+	// a gap too once it is replaced, which is recorded for readers to skip.
+	emergency.Supersedes = nil
+	if previous != nil && previous.Sequence > 0 {
+		emergency.Supersedes = append(append([]int{}, previous.Supersedes...), previous.Sequence)
+		if len(emergency.Supersedes) > MAX_SUPERSEDED {
+			emergency.Supersedes = emergency.Supersedes[len(emergency.Supersedes)-MAX_SUPERSEDED:]
+		}
+	}
+	sequence, err := counters.IncrementCounter("counterName", feedCounterName(emergency.EventId), "value")
+	if err != nil {
+		return err
+	}
+	emergency.Sequence = sequence
+	emergency.SequencedAt = int(time.Now().Unix())
+
+	// Send the item to the database
+	db.SendItem(*emergency)
+
+	// Push the item to Pusher
+	channelName := strconv.Itoa(emergency.EventId)
+	data, _ := json.Marshal(emergency)
+	pc.SendItem(channelName, "emergency-update", data)
+	return nil
+}
+
+func feedHandler(writer http.ResponseWriter, request *http.Request) {
 
 	// Allow cross origin
 	utils.SetAccessControlHeaders(writer)
@@ -125,50 +396,105 @@ func requestHandler(writer http.ResponseWriter, request *http.Request) {
 	// Convert the eventId to an int
 	eventId, err := parseRequestArgs(vars, "eventId", writer)
 	if err != nil {
-		log.Println("Error parsing eventId")
+		return
+	}
+
+	// Read the position the client has already seen up to
+	cursor, err := parseQueryArg(request, "cursor", 0, writer)
+	if err != nil {
+		return
+	}
+	if cursor < 0 {
 		http.Error(
 			writer,
-			fmt.Sprintf("Invalid EventId"),
+			fmt.Sprintf("Invalid cursor"),
 			http.StatusBadRequest)
 		return
 	}
 
-	// Convert the last poll timestamp to an int
-	lastPoll, err := parseRequestArgs(vars, "lastPoll", writer)
+	// Read the maximum number of emergencies to return
+	limit, err := parseQueryArg(request, "limit", DEFAULT_FEED_LIMIT, writer)
 	if err != nil {
-		log.Println("Error parsing last poll time")
+		return
+	}
+	if limit <= 0 || limit > MAX_FEED_LIMIT {
 		http.Error(
 			writer,
-			fmt.Sprintf("Invalid last poll time"),
+			fmt.Sprintf("limit must be between 1 and %d", MAX_FEED_LIMIT),
 			http.StatusBadRequest)
 		return
 	}
 
-	// Scan the table, parse the result and filter out old events
-	unparsedRows := db.GetTableScan()
+	// Read the event's changes after the cursor, in the order they changed
+	from := cursor + 1
+	unparsedRows, _, err := db.QueryItems(dynamoDB.Query{
+		IndexName:   FEED_INDEX_NAME,
+		PKeyColName: "eventId",
+		PKeyValue:   eventId,
+		SortColName: "sequence",
+		SortFrom:    &from,
+		Limit:       limit,
+	})
+	if err != nil {
+		log.Println("Error reading emergency feed:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to read emergencies: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
 	var parsedRows []emergency_request = make([]emergency_request, len(unparsedRows))
 	for index, row := range unparsedRows {
 		_ = mapstructure.Decode(row, &parsedRows[index])
 	}
 
-	// Extract relevant values
-	recents := extractRecentUpdates(parsedRows, eventId, lastPoll)
+	// Extract the changes the client can safely move past
+	feed := extractFeedPage(parsedRows, cursor, int(time.Now().Unix()))
 
 	// Transmit the result back
-	_ = json.NewEncoder(writer).Encode(recents)
+	_ = json.NewEncoder(writer).Encode(feed)
 }
 
-func extractRecentUpdates(parsed []emergency_request, event int, prevPoll int) (res []emergency_request) {
-	// Remove the values that don't satisfy a criteria
-	deleted := 0
-	for i := range parsed {
-		j := i - deleted
-		if parsed[j].EventId != event || parsed[j].OccurredAt < prevPoll {
-			parsed = parsed[:j+copy(parsed[j:], parsed[j+1:])]
-			deleted++
+// extractFeedPage returns the changes after the cursor, which are in the
+// order they changed, up to the first gap in the sequence numbers which
+// could still be filled by a write in flight. Gaps older than
+// FEED_SETTLE_SECONDS are from failed writes and are skipped, as are the
+// gaps the changes record they superseded.
+func extractFeedPage(changes []emergency_request, cursor int, now int) emergency_feed {
+	superseded := make(map[int]bool)
+	for _, change := range changes {
+		for _, sequence := range change.Supersedes {
+			superseded[sequence] = true
+		}
+	}
+
+	page := make([]emergency_request, 0, len(changes))
+	last := cursor
+	for _, change := range changes {
+		if change.Sequence <= last {
+			continue
 		}
+		for superseded[last+1] && last+1 < change.Sequence {
+			last++
+		}
+		if change.Sequence != last+1 && change.SequencedAt > now-FEED_SETTLE_SECONDS {
+			break
+		}
+		page = append(page, change)
+		last = change.Sequence
+	}
+
+	// Continue from the last change returned, or stay put if there were none
+	return emergency_feed{
+		Emergencies: page,
+		NextCursor:  last,
 	}
-	return parsed
+}
+
+// feedCounterName is the name of the counter holding the latest
+// sequence number of an event's emergency feed
+func feedCounterName(eventId int) string {
+	return "emergency-" + strconv.Itoa(eventId)
 }
 
 func parseRequestArgs(vars map[string]string, varName string, writer http.ResponseWriter) (int, error) {
@@ -182,3 +508,19 @@ func parseRequestArgs(vars map[string]string, varName string, writer http.Respon
 	}
 	return id, err
 }
+
+func parseQueryArg(request *http.Request, varName string, defaultValue int, writer http.ResponseWriter) (int, error) {
+	str := request.URL.Query().Get(varName)
+	if str == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		log.Println("Cannot decode query parameter "+varName, err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to decode %s: %s", varName, err),
+			http.StatusBadRequest)
+	}
+	return value, err
+}
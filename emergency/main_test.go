@@ -3,9 +3,19 @@ package emergency
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/mitchellh/mapstructure"
+	"github.com/real-time-footfall-analysis/rtfa-backend/devices"
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/ratelimit"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -16,6 +26,10 @@ var router *mux.Router
 func init() {
 	router = mux.NewRouter()
 	Init(router)
+	identities = &dummy_identities{rows: make(map[string]map[string]interface{})}
+	pseudonyms = &dummy_pseudonyms{}
+	signatures = devices.NewVerifier(&dummy_registry{}, time.Minute, time.Time{}, nil)
+	limits = ratelimit.NewIngestionLimiter(&dummy_events{})
 }
 
 func TestGETLocationWithValues(t *testing.T) {
@@ -24,30 +38,114 @@ func TestGETLocationWithValues(t *testing.T) {
 	pc = &dummy_pusher{t}
 
 	// Event has one entry
-	req, _ := http.NewRequest("GET", "/live/emergency/99/0", nil)
+	req, _ := http.NewRequest("GET", "/live/emergency/99", nil)
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
-	expected := "[{\"uuid\":\"test\",\"eventId\":99,\"regionIds\":[99,99,99],\"occurredAt\":99,\"dealtWith\":false,\"description\":\"test\",\"position\":{\"lat\":99,\"lng\":99}}]"
+	expected := "{\"emergencies\":[{\"uuid\":\"test\",\"eventId\":99,\"regionIds\":[99,99,99],\"occurredAt\":99,\"dealtWith\":false,\"description\":\"test\",\"position\":{\"lat\":99,\"lng\":99},\"sequence\":7}],\"nextCursor\":7}"
 	body := response.Body.String()
 	if strings.TrimSpace(body) != expected {
 		t.Errorf("Expected %s. Got %s", expected, body)
 	}
 }
 
+func TestGETFeedAfterCursor(t *testing.T) {
+	db = &dummy_db{t}
+	pc = &dummy_pusher{t}
+
+	// Only the changes after sequence 2 are returned, in sequence order
+	req, _ := http.NewRequest("GET", "/live/emergency/50?cursor=2", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var feed emergency_feed
+	if err := json.NewDecoder(response.Body).Decode(&feed); err != nil {
+		t.Fatalf("Unable to decode feed: %s", err)
+	}
+	if len(feed.Emergencies) != 2 || feed.Emergencies[0].Sequence != 3 || feed.Emergencies[1].Sequence != 5 {
+		t.Errorf("Expected the changes with sequence 3 and 5. Got %+v", feed.Emergencies)
+	}
+	if feed.NextCursor != 5 {
+		t.Errorf("Expected next cursor 5. Got %d", feed.NextCursor)
+	}
+}
+
+func TestGETFeedWithLimit(t *testing.T) {
+	db = &dummy_db{t}
+	pc = &dummy_pusher{t}
+
+	// The page stops at the limit and the cursor points at its last change
+	req, _ := http.NewRequest("GET", "/live/emergency/50?limit=2", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var feed emergency_feed
+	if err := json.NewDecoder(response.Body).Decode(&feed); err != nil {
+		t.Fatalf("Unable to decode feed: %s", err)
+	}
+	if len(feed.Emergencies) != 2 || feed.Emergencies[0].Sequence != 1 || feed.Emergencies[1].Sequence != 3 {
+		t.Errorf("Expected the changes with sequence 1 and 3. Got %+v", feed.Emergencies)
+	}
+	if feed.NextCursor != 3 {
+		t.Errorf("Expected next cursor 3. Got %d", feed.NextCursor)
+	}
+}
+
+func TestFeedWaitsForRecentGaps(t *testing.T) {
+	now := 1000
+	changes := []emergency_request{
+		{Sequence: 3, SequencedAt: now - 60},
+		{Sequence: 5, SequencedAt: now - 5},
+		{Sequence: 6, SequencedAt: now - 1},
+	}
+
+	// Sequence 4 may still be being written, so the page stops before 5
+	feed := extractFeedPage(changes, 2, now)
+	if len(feed.Emergencies) != 1 || feed.NextCursor != 3 {
+		t.Errorf("Expected the page to stop at the recent gap. Got %+v", feed)
+	}
+
+	// Once the gap has settled it is skipped
+	feed = extractFeedPage(changes, 2, now+FEED_SETTLE_SECONDS)
+	if len(feed.Emergencies) != 3 || feed.NextCursor != 6 {
+		t.Errorf("Expected the settled gap to be skipped. Got %+v", feed)
+	}
+}
+
+func TestFeedSkipsSupersededGaps(t *testing.T) {
+	now := 1000
+	changes := []emergency_request{
+		{Sequence: 3, SequencedAt: now - 60},
+		{Sequence: 6, SequencedAt: now - 1, Supersedes: []int{4, 5}},
+	}
+
+	// Sequences 4 and 5 were replaced by 6, so nothing is waited on
+	feed := extractFeedPage(changes, 2, now)
+	if len(feed.Emergencies) != 2 || feed.NextCursor != 6 {
+		t.Errorf("Expected the superseded gaps to be skipped. Got %+v", feed)
+	}
+}
+
+func TestGETFeedInvalidLimit(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/live/emergency/50?limit=0", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
 func TestGETNoResults(t *testing.T) {
 	// Create a dummy db with no entries
 	db = &dummy_db{t}
 	pc = &dummy_pusher{t}
 
 	// Event has no entry
-	req, _ := http.NewRequest("GET", "/live/emergency/1/0", nil)
+	req, _ := http.NewRequest("GET", "/live/emergency/1?cursor=4", nil)
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
-	expected := "[]"
+	expected := "{\"emergencies\":[],\"nextCursor\":4}"
 	if body := response.Body.String(); strings.TrimSpace(body) != expected {
-		t.Errorf("Expected an empty list. Got %s", body)
+		t.Errorf("Expected an empty page. Got %s", body)
 	}
 }
 
@@ -66,6 +164,7 @@ func TestValidLocationUpdate(t *testing.T) {
 
 	// Create a dummy db with no entries
 	db = &dummy_db{t}
+	counters = &dummy_counters{value: 41}
 	pc = &dummy_pusher{t}
 
 	update := emergency_request{
@@ -86,7 +185,7 @@ func TestValidLocationUpdate(t *testing.T) {
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
-	expected := "{\"uuid\":\"Test-UUID-00000000000000000000000000\",\"eventId\":99,\"regionIds\":[99,99,99],\"occurredAt\":123456,\"dealtWith\":false,\"description\":\"Help me\",\"position\":null}\n"
+	expected := "{\"uuid\":\"pseudonym-99-Test-UUID-00000000000000000000000000\",\"eventId\":99,\"regionIds\":[99,99,99],\"occurredAt\":123456,\"dealtWith\":false,\"description\":\"Help me\",\"position\":null,\"sequence\":42}\n"
 	body := response.Body.String()
 	if body != expected {
 		t.Errorf("Expected %s. Got %s", expected, body)
@@ -96,6 +195,8 @@ func TestValidLocationUpdate(t *testing.T) {
 func TestValidLocationUpdateWithoutPosition(t *testing.T) {
 	var buf bytes.Buffer
 
+	counters = &dummy_counters{value: 1}
+
 	update := emergency_request{
 		UUID:       "Test-UUID-00000000000000000000000000",
 		EventId:    99,
@@ -113,7 +214,7 @@ func TestValidLocationUpdateWithoutPosition(t *testing.T) {
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
-	expected := "{\"uuid\":\"Test-UUID-00000000000000000000000000\",\"eventId\":99,\"regionIds\":[99,99,99],\"occurredAt\":123456,\"dealtWith\":false,\"description\":\"\",\"position\":null}\n"
+	expected := "{\"uuid\":\"pseudonym-99-Test-UUID-00000000000000000000000000\",\"eventId\":99,\"regionIds\":[99,99,99],\"occurredAt\":123456,\"dealtWith\":false,\"description\":\"\",\"position\":null,\"sequence\":2}\n"
 	body := response.Body.String()
 	if strings.Compare(expected, body) != 0 {
 		t.Errorf("\n%s\n%s", expected, body)
@@ -123,6 +224,8 @@ func TestValidLocationUpdateWithoutPosition(t *testing.T) {
 func TestValidLocationUpdateWithoutDescription(t *testing.T) {
 	var buf bytes.Buffer
 
+	counters = &dummy_counters{value: 2}
+
 	update := emergency_request{
 		UUID:       "Test-UUID-00000000000000000000000000",
 		EventId:    99,
@@ -144,7 +247,7 @@ func TestValidLocationUpdateWithoutDescription(t *testing.T) {
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
-	expected := "{\"uuid\":\"Test-UUID-00000000000000000000000000\",\"eventId\":99,\"regionIds\":[99,99,99],\"occurredAt\":123456,\"dealtWith\":false,\"description\":\"\",\"position\":{\"lat\":1.1,\"lng\":1.1}}\n"
+	expected := "{\"uuid\":\"pseudonym-99-Test-UUID-00000000000000000000000000\",\"eventId\":99,\"regionIds\":[99,99,99],\"occurredAt\":123456,\"dealtWith\":false,\"description\":\"\",\"position\":{\"lat\":1.1,\"lng\":1.1},\"sequence\":3}\n"
 	if body := response.Body.String(); body != expected {
 		t.Errorf("Expected %s. Got %s", expected, body)
 	}
@@ -215,7 +318,100 @@ func TestLocationUpdateMissingEventId(t *testing.T) {
 	checkResponseCode(t, http.StatusBadRequest, response.Code)
 }
 
+func TestStewardDeviceLookup(t *testing.T) {
+	db = &dummy_db{t}
+	counters = &dummy_counters{}
+	pc = &dummy_pusher{t}
+	os.Setenv("RTFA_STEWARD_TOKEN", "steward-token")
+	defer os.Unsetenv("RTFA_STEWARD_TOKEN")
+
+	body := `{"uuid":"Test-UUID-00000000000000000000000001","eventId":98,"regionIds":[1],"occurredAt":123456}`
+	req, _ := http.NewRequest("POST", "/emergency-update", strings.NewReader(body))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	pseudonym := "pseudonym-98-Test-UUID-00000000000000000000000001"
+
+	// Only stewards can see the device behind a pseudonym
+	req, _ = http.NewRequest("GET", "/events/98/emergencies/"+pseudonym+"/device", nil)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+	req.Header.Set("Authorization", "Bearer wrong-token")
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	req.Header.Set("Authorization", "Bearer steward-token")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var identity emergency_identity
+	_ = json.NewDecoder(response.Body).Decode(&identity)
+	if identity.UUID != "Test-UUID-00000000000000000000000001" || identity.Pseudonym != pseudonym {
+		t.Errorf("Expected the reporting device. Got %+v", identity)
+	}
+
+	// Pseudonyms only resolve at their own event
+	req, _ = http.NewRequest("GET", "/events/97/emergencies/"+pseudonym+"/device", nil)
+	req.Header.Set("Authorization", "Bearer steward-token")
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+}
+
+func TestUpdateSupersedesPreviousReport(t *testing.T) {
+	emergencies := &dummy_emergencies{rows: make(map[string]map[string]interface{})}
+	db = emergencies
+	counters = &dummy_counters{value: 10}
+	pc = &dummy_pusher{t}
+
+	body := `{"uuid":"Test-UUID-00000000000000000000000002","eventId":97,"regionIds":[1],"occurredAt":123456}`
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/emergency-update", strings.NewReader(body))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	}
+
+	// The second report replaces the first, whose sequence number is a gap
+	stored := emergencies.emergency("pseudonym-97-Test-UUID-00000000000000000000000002")
+	if stored.Sequence != 12 || len(stored.Supersedes) != 1 || stored.Supersedes[0] != 11 {
+		t.Errorf("Expected sequence 12 superseding 11. Got %+v", stored)
+	}
+}
+
+func TestStewardMarksDealtWith(t *testing.T) {
+	emergencies := &dummy_emergencies{rows: make(map[string]map[string]interface{})}
+	db = emergencies
+	counters = &dummy_counters{value: 20}
+	pc = &dummy_pusher{t}
+	os.Setenv("RTFA_STEWARD_TOKEN", "steward-token")
+	defer os.Unsetenv("RTFA_STEWARD_TOKEN")
+
+	body := `{"uuid":"Test-UUID-00000000000000000000000003","eventId":96,"regionIds":[1],"occurredAt":123456,"description":"Help"}`
+	req, _ := http.NewRequest("POST", "/emergency-update", strings.NewReader(body))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	pseudonym := "pseudonym-96-Test-UUID-00000000000000000000000003"
+	path := "/events/96/emergencies/" + pseudonym + "/status"
+
+	// Only stewards can change the status
+	req, _ = http.NewRequest("PUT", path, strings.NewReader(`{"dealtWith":true}`))
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("PUT", path, strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer steward-token")
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("PUT", path, strings.NewReader(`{"dealtWith":true}`))
+	req.Header.Set("Authorization", "Bearer steward-token")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	// The change is published as its own entry in the feed
+	stored := emergencies.emergency(pseudonym)
+	if !stored.DealtWith || stored.Description != "Help" || stored.Sequence != 22 ||
+		len(stored.Supersedes) != 1 || stored.Supersedes[0] != 21 {
+		t.Errorf("Expected the emergency dealt with at sequence 22. Got %+v", stored)
+	}
+
+	// Pseudonyms only resolve at their own event
+	req, _ = http.NewRequest("PUT", "/events/95/emergencies/"+pseudonym+"/status", strings.NewReader(`{"dealtWith":true}`))
+	req.Header.Set("Authorization", "Bearer steward-token")
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+}
+
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
+	signRequest(req)
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
@@ -241,20 +437,24 @@ func (dq *dummy_db) InitConn(tableName string) error {
 }
 
 func (db *dummy_db) GetTableScan() []map[string]interface{} {
-	// Make a fake table and insert a row
-	tableScan := make([]map[string]interface{}, 1)
-	tableScan[0] = db.makeRow(99, "test", false)
+	// Make a fake table and insert rows for two events, out of sequence order
+	tableScan := make([]map[string]interface{}, 4)
+	tableScan[0] = db.makeRow(99, 7, "test", false)
+	tableScan[1] = db.makeRow(50, 5, "test", true)
+	tableScan[2] = db.makeRow(50, 1, "test", false)
+	tableScan[3] = db.makeRow(50, 3, "test", false)
 
 	return tableScan
 }
 
-func (db *dummy_db) makeRow(n int, s string, b bool) map[string]interface{} {
+func (db *dummy_db) makeRow(n int, sequence int, s string, b bool) map[string]interface{} {
 	// Use the same number, string, and bool for all values to make testing easier
 
 	// Make the row
 	row := make(map[string]interface{})
 	row["eventId"] = n
 	row["occurredAt"] = n
+	row["sequence"] = sequence
 
 	row["uuid"] = s
 	row["description"] = s
@@ -274,14 +474,111 @@ func (db *dummy_db) makeRow(n int, s string, b bool) map[string]interface{} {
 	return row
 }
 
+// QueryItems answers queries of the feed index from the rows of the scan
+func (db *dummy_db) QueryItems(query dynamoDB.Query) ([]map[string]interface{}, string, error) {
+	var rows []map[string]interface{}
+	for _, row := range db.GetTableScan() {
+		if row["eventId"] == query.PKeyValue && (query.SortFrom == nil || row["sequence"].(int) >= *query.SortFrom) {
+			rows = append(rows, row)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i]["sequence"].(int) < rows[j]["sequence"].(int)
+	})
+	if query.Limit > 0 && len(rows) > query.Limit {
+		rows = rows[:query.Limit]
+	}
+	return rows, "", nil
+}
+
 func (db *dummy_db) SendItem(req interface{}) {
 	return
 }
 
+func (db *dummy_db) SendItemIf(req interface{}, condition string, values map[string]interface{}) (bool, error) {
+	return true, nil
+}
+
 func (db *dummy_db) GetItem(pKeyColName string, pKeyValue string) map[string]interface{} {
 	return nil
 }
 
+func (db *dummy_db) DeleteItem(pKeyColName string, pKeyValue string) error {
+	return nil
+}
+
+func (db *dummy_db) IncrementCounter(pKeyColName string, pKeyValue string, counterColName string) (int, error) {
+	return 0, nil
+}
+
+// dummy_emergencies keeps the emergencies sent to it
+type dummy_emergencies struct {
+	dummy_db
+	rows map[string]map[string]interface{}
+}
+
+func (de *dummy_emergencies) SendItem(req interface{}) {
+	row := make(map[string]interface{})
+	_ = mapstructure.Decode(req, &row)
+	de.rows[row["UUID"].(string)] = row
+}
+
+func (de *dummy_emergencies) GetItem(pKeyColName string, pKeyValue string) map[string]interface{} {
+	if row, ok := de.rows[pKeyValue]; ok {
+		return row
+	}
+	return map[string]interface{}{}
+}
+
+func (de *dummy_emergencies) emergency(pseudonym string) emergency_request {
+	var emergency emergency_request
+	_ = mapstructure.Decode(de.rows[pseudonym], &emergency)
+	return emergency
+}
+
+/***************************
+   FAKE Device identities
+***************************/
+
+type dummy_identities struct {
+	dummy_db
+	rows map[string]map[string]interface{}
+}
+
+func (di *dummy_identities) SendItem(req interface{}) {
+	data, _ := json.Marshal(req)
+	var row map[string]interface{}
+	_ = json.Unmarshal(data, &row)
+	di.rows[row["pseudonym"].(string)] = row
+}
+
+func (di *dummy_identities) GetItem(pKeyColName string, pKeyValue string) map[string]interface{} {
+	return di.rows[pKeyValue]
+}
+
+type dummy_pseudonyms struct{}
+
+func (dp *dummy_pseudonyms) InitConn() {
+}
+
+func (dp *dummy_pseudonyms) Pseudonym(eventId int, uuid string) (string, error) {
+	return fmt.Sprintf("pseudonym-%d-%s", eventId, uuid), nil
+}
+
+/***************************
+   FAKE Sequence counters
+***************************/
+
+type dummy_counters struct {
+	dummy_db
+	value int
+}
+
+func (dc *dummy_counters) IncrementCounter(pKeyColName string, pKeyValue string, counterColName string) (int, error) {
+	dc.value++
+	return dc.value, nil
+}
+
 /***************************
    FAKE Pusher queue
 ***************************/
@@ -297,3 +594,59 @@ func (pc *dummy_pusher) InitConn() {
 func (pc *dummy_pusher) SendItem(channelName string, eventName string, data []byte) {
 	return
 }
+
+/***************************
+   FAKE Device registry
+***************************/
+
+const TEST_SECRET = "test-secret"
+
+// signed counts the requests signed, to give each its own timestamp
+var signed int64
+
+// signRequest signs the request as its registered device would, if it
+// isn't signed already
+func signRequest(req *http.Request) {
+	if req.Body == nil || req.Header.Get(devices.SIGNATURE_HEADER) != "" {
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	signed++
+	timestamp := strconv.FormatInt(time.Now().Unix()-signed%60, 10)
+	req.Header.Set(devices.TIMESTAMP_HEADER, timestamp)
+	req.Header.Set(devices.SIGNATURE_HEADER, devices.Sign(TEST_SECRET, timestamp, body))
+}
+
+type dummy_registry struct {
+	unregistered map[string]bool
+}
+
+func (dr *dummy_registry) InitConn() error {
+	return nil
+}
+
+func (dr *dummy_registry) Register(eventId int, uuid string) (string, error) {
+	return TEST_SECRET, nil
+}
+
+func (dr *dummy_registry) Secret(eventId int, uuid string) (string, error) {
+	if dr.unregistered[uuid] {
+		return "", nil
+	}
+	return TEST_SECRET, nil
+}
+
+/***************************
+   FAKE Event index
+***************************/
+
+type dummy_events struct{}
+
+func (de *dummy_events) GetEventRegions(eventID int) (*eventstaticdata.EventRegions, error) {
+	return &eventstaticdata.EventRegions{}, nil
+}
+
+func (de *dummy_events) Invalidate(eventID int) {
+}
@@ -3,9 +3,9 @@ package eventlivedata
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/mitchellh/mapstructure"
 	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
-	"github.com/real-time-footfall-analysis/rtfa-backend/locationupdate"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/privacy"
 	"log"
 	"net/http"
 	"os"
@@ -16,6 +16,9 @@ import (
 )
 
 var db dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var snapshots dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var policies privacy.PrivacyInterface = privacy.Events
+var sd eventstaticdata.StaticDataInterface = &eventstaticdata.StaticDataClient{}
 
 func Init(r *mux.Router) {
 	// Create a connection to the database
@@ -24,9 +27,23 @@ func Init(r *mux.Router) {
 		log.Println("Error connecting to current position table")
 		os.Exit(1)
 	}
+	err = snapshots.InitConn("occupancy_snapshots")
+	if err != nil {
+		log.Println("Error connecting to occupancy snapshots table")
+		os.Exit(1)
+	}
 
-	// Register the endpoint
+	// Keep a history of occupancy every RTFA_OCCUPANCY_SNAPSHOT_INTERVAL.
+	// Only one server should take the snapshots, the one with
+	// RTFA_RECORD_OCCUPANCY set to "true".
+	snapshotInterval = utils.GetEnvDuration("RTFA_OCCUPANCY_SNAPSHOT_INTERVAL", DEFAULT_SNAPSHOT_INTERVAL)
+	if snapshotInterval > 0 && utils.GetEnv("RTFA_RECORD_OCCUPANCY", "false") == "true" {
+		go recordSnapshots(snapshotInterval)
+	}
+
+	// Register the endpoints
 	r.HandleFunc("/live/heatmap/{eventId}", heatmapHandler).Methods("GET")
+	r.HandleFunc("/events/{eventId}/occupancy", occupancyHandler).Methods("GET")
 }
 
 func heatmapHandler(writer http.ResponseWriter, request *http.Request) {
@@ -45,27 +62,44 @@ func heatmapHandler(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// Get the whole table
-	unparsedRows := db.GetTableScan()
-	var parsedRows []locationupdate.Movement_update = make([]locationupdate.Movement_update, len(unparsedRows))
-	for index, row := range unparsedRows {
-		_ = mapstructure.Decode(row, &parsedRows[index])
-	}
-
-	// Count the rows to make a heatmap
-	regionCounts := make(map[int]int, 0)
-	for _, row := range parsedRows {
-		if eventId == *row.EventID {
-			regionId := *row.RegionID
-			count, ok := regionCounts[regionId]
-			if !ok {
-				regionCounts[regionId] = 1
-			} else {
-				regionCounts[regionId] = count + 1
+	var regionCounts map[int]int
+	if request.URL.Query().Get("at") == "" {
+		// Count the people in each region now
+		regionCounts = countRegions(db.GetTableScan())[eventId]
+	} else {
+		// Show the heatmap as it was in the snapshot taken at the time
+		at, err := parseQueryArg(request, "at", 0, writer)
+		if err != nil {
+			return
+		}
+		snapshot, err := latestSnapshot(eventId, at)
+		if err != nil {
+			log.Println("Error reading occupancy snapshot:", err)
+			http.Error(
+				writer,
+				fmt.Sprintf("Failed to read occupancy: %s", err),
+				http.StatusInternalServerError)
+			return
+		}
+		if snapshot == nil {
+			http.Error(
+				writer,
+				fmt.Sprintf("No occupancy of event %d recorded at %d", eventId, at),
+				http.StatusNotFound)
+			return
+		}
+		regionCounts = make(map[int]int, len(snapshot.Counts))
+		for key, count := range snapshot.Counts {
+			regionId, err := strconv.Atoi(key)
+			if err == nil {
+				regionCounts[regionId] = count
 			}
 		}
 	}
 
+	// Leave out counts small enough to pick out individuals
+	policy := privacy.ForRequest(policies, request, eventId)
+
 	// Return the result
-	_ = json.NewEncoder(writer).Encode(regionCounts)
+	_ = json.NewEncoder(writer).Encode(policy.Counts(regionCounts))
 }
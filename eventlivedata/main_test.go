@@ -1,11 +1,18 @@
 package eventlivedata
 
 import (
+	"encoding/json"
 	"github.com/gorilla/mux"
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/privacy"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 var router *mux.Router
@@ -13,7 +20,9 @@ var router *mux.Router
 func init() {
 	router = mux.NewRouter()
 	Init(router)
-
+	policies = &dummy_policies{}
+	snapshots = &dummy_snapshots{}
+	sd = &dummy_static_data{}
 }
 
 func TestGETLocationUpdate(t *testing.T) {
@@ -32,6 +41,32 @@ func TestGETLocationUpdate(t *testing.T) {
 	}
 }
 
+func TestHeatmapSuppressesSmallCounts(t *testing.T) {
+	db = &dummy_db{t}
+	policies = &dummy_policies{privacy.Policy{MinCount: 2, Mode: privacy.SUPPRESS}}
+	defer func() { policies = &dummy_policies{} }()
+
+	req, _ := http.NewRequest("GET", "/live/heatmap/1", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if body := response.Body.String(); strings.TrimSpace(body) != "{}" {
+		t.Errorf("Expected the region with one person to be left out. Got %s", body)
+	}
+
+	// Stewards see the exact counts
+	os.Setenv("RTFA_STEWARD_TOKEN", "steward-token")
+	defer os.Unsetenv("RTFA_STEWARD_TOKEN")
+	req, _ = http.NewRequest("GET", "/live/heatmap/1", nil)
+	req.Header.Set("Authorization", "Bearer steward-token")
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if body := response.Body.String(); strings.TrimSpace(body) != "{\"1\":1}" {
+		t.Errorf("Expected the exact count for a steward. Got %s", body)
+	}
+}
+
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
@@ -57,15 +92,149 @@ func (db *dummy_db) GetTableScan() []map[string]interface{} {
 	row := make(map[string]interface{})
 	row["eventId"] = 1
 	row["regionId"] = 1
-	rows := make([]map[string]interface{}, 1)
+	left := make(map[string]interface{})
+	left["eventId"] = 1
+	left["regionId"] = 2
+	left["entering"] = false
+	rows := make([]map[string]interface{}, 2)
 	rows[0] = row
+	rows[1] = left
 	return rows
 }
 
+func (db *dummy_db) QueryItems(query dynamoDB.Query) ([]map[string]interface{}, string, error) {
+	if query.IndexName != POSITION_INDEX_NAME {
+		db.t.Errorf("Expected positions to be queried by event. Got index %s", query.IndexName)
+	}
+	var rows []map[string]interface{}
+	for _, row := range db.GetTableScan() {
+		if row["eventId"] == query.PKeyValue {
+			rows = append(rows, row)
+		}
+	}
+	return rows, "", nil
+}
+
 func (db *dummy_db) SendItem(req interface{}) {
 	return
 }
 
+func (db *dummy_db) SendItemIf(req interface{}, condition string, values map[string]interface{}) (bool, error) {
+	return true, nil
+}
+
 func (db *dummy_db) GetItem(pKeyColName string, pKeyValue string) map[string]interface{} {
 	return nil
 }
+
+func (db *dummy_db) DeleteItem(pKeyColName string, pKeyValue string) error {
+	return nil
+}
+
+func (db *dummy_db) IncrementCounter(pKeyColName string, pKeyValue string, counterColName string) (int, error) {
+	return 0, nil
+}
+
+type dummy_policies struct {
+	policy privacy.Policy
+}
+
+func (dp *dummy_policies) ForEvent(eventID int) privacy.Policy {
+	if dp.policy.MinCount == 0 {
+		return privacy.Exact
+	}
+	return dp.policy
+}
+
+/*************************** FAKE SNAPSHOTS ***************************/
+
+// dummy_snapshots keeps the snapshots sent to it, and answers queries of
+// them a row per page
+type dummy_snapshots struct {
+	rows []map[string]interface{}
+}
+
+func (ds *dummy_snapshots) InitConn(tableName string) error {
+	return nil
+}
+
+func (ds *dummy_snapshots) GetTableScan() []map[string]interface{} {
+	return ds.rows
+}
+
+func (ds *dummy_snapshots) QueryItems(query dynamoDB.Query) ([]map[string]interface{}, string, error) {
+	var matched []map[string]interface{}
+	for _, row := range ds.rows {
+		takenAt := int(row["takenAt"].(float64))
+		if int(row["eventId"].(float64)) == query.PKeyValue.(int) &&
+			(query.SortFrom == nil || takenAt >= *query.SortFrom) &&
+			(query.SortTo == nil || takenAt <= *query.SortTo) {
+			matched = append(matched, row)
+		}
+	}
+	if query.Descending {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
+		}
+	}
+
+	page := 0
+	if query.Cursor != "" {
+		page, _ = strconv.Atoi(query.Cursor)
+	}
+	if page >= len(matched) {
+		return nil, "", nil
+	}
+	cursor := ""
+	if page+1 < len(matched) && query.Limit != 1 {
+		cursor = strconv.Itoa(page + 1)
+	}
+	return matched[page : page+1], cursor, nil
+}
+
+// SendItem keeps the item as it would be read back from the table, with
+// numbers as float64
+func (ds *dummy_snapshots) SendItem(req interface{}) {
+	data, _ := json.Marshal(req)
+	var row map[string]interface{}
+	_ = json.Unmarshal(data, &row)
+	ds.rows = append(ds.rows, row)
+}
+
+func (ds *dummy_snapshots) SendItemIf(req interface{}, condition string, values map[string]interface{}) (bool, error) {
+	return true, nil
+}
+
+func (ds *dummy_snapshots) GetItem(pKeyColName string, pKeyValue string) map[string]interface{} {
+	return nil
+}
+
+func (ds *dummy_snapshots) DeleteItem(pKeyColName string, pKeyValue string) error {
+	return nil
+}
+
+func (ds *dummy_snapshots) IncrementCounter(pKeyColName string, pKeyValue string, counterColName string) (int, error) {
+	return 0, nil
+}
+
+/***************************
+   FAKE Static data
+***************************/
+
+// dummy_static_data has event 1 running in 1970 and event 2 long over
+type dummy_static_data struct{}
+
+func (sd *dummy_static_data) GetEvents() ([]eventstaticdata.Event, error) {
+	return []eventstaticdata.Event{
+		{ID: 1, StartDate: time.Unix(0, 0), EndDate: time.Unix(0, 0).AddDate(0, 0, 2)},
+		{ID: 2, StartDate: time.Unix(0, 0).AddDate(-1, 0, 0), EndDate: time.Unix(0, 0).AddDate(-1, 0, 2)},
+	}, nil
+}
+
+func (sd *dummy_static_data) GetEvent(eventID int) (*eventstaticdata.Event, error) {
+	return &eventstaticdata.Event{ID: int32(eventID)}, nil
+}
+
+func (sd *dummy_static_data) GetRegions(eventID int) ([]eventstaticdata.Region, error) {
+	return nil, nil
+}
@@ -0,0 +1,405 @@
+package eventlivedata
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mitchellh/mapstructure"
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/locationupdate"
+	"github.com/real-time-footfall-analysis/rtfa-backend/metrics"
+	"github.com/real-time-footfall-analysis/rtfa-backend/privacy"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const (
+	DEFAULT_SNAPSHOT_INTERVAL = 5 * time.Minute
+
+	// POSITION_INDEX_NAME is the index of the current positions table keyed
+	// by eventId, which snapshots read the positions of an event from
+	POSITION_INDEX_NAME = "eventId-index"
+
+	// Occupancy is returned for the last day in hourly buckets unless asked
+	// otherwise, in seconds
+	DEFAULT_OCCUPANCY_RANGE  = 24 * 60 * 60
+	DEFAULT_OCCUPANCY_BUCKET = 60 * 60
+	MAX_OCCUPANCY_BUCKETS    = 1000
+)
+
+// occupancy_snapshot is the number of people in each region of an event at
+// a time, keyed by region id
+type occupancy_snapshot struct {
+	EventId int            `json:"eventId"`
+	TakenAt int            `json:"takenAt"`
+	Counts  map[string]int `json:"counts"`
+}
+
+// region_occupancy summarises the snapshots of a region within a bucket
+type region_occupancy struct {
+	Min int     `json:"min"`
+	Avg float64 `json:"avg"`
+	Max int     `json:"max"`
+	// minSuppressed and avgSuppressed are set when the figures can't be
+	// reported, as they are small enough to pick out individuals
+	minSuppressed bool
+	avgSuppressed bool
+}
+
+// MarshalJSON writes the figures which can't be reported as null, marking
+// the occupancy as suppressed
+func (ro region_occupancy) MarshalJSON() ([]byte, error) {
+	reported := struct {
+		Min        *int     `json:"min"`
+		Avg        *float64 `json:"avg"`
+		Max        int      `json:"max"`
+		Suppressed bool     `json:"suppressed,omitempty"`
+	}{Min: &ro.Min, Avg: &ro.Avg, Max: ro.Max}
+	if ro.minSuppressed {
+		reported.Min = nil
+		reported.Suppressed = true
+	}
+	if ro.avgSuppressed {
+		reported.Avg = nil
+		reported.Suppressed = true
+	}
+	return json.Marshal(reported)
+}
+
+// occupancy_bucket is the occupancy of the regions of an event over the
+// bucket starting at Start
+type occupancy_bucket struct {
+	Start     int                      `json:"start"`
+	Snapshots int                      `json:"snapshots"`
+	Regions   map[int]region_occupancy `json:"regions"`
+}
+
+type occupancy_response struct {
+	EventId int                `json:"eventId"`
+	From    int                `json:"from"`
+	To      int                `json:"to"`
+	Bucket  int                `json:"bucket"`
+	Buckets []occupancy_bucket `json:"buckets"`
+}
+
+// snapshotInterval is how often snapshots are taken, and how old the latest
+// can be to still show the heatmap at a time
+var snapshotInterval time.Duration
+
+// recordSnapshots takes a snapshot of the occupancy of every running event
+// each interval. Snapshots are taken at multiples of the interval, so a
+// server taking over from another writes the same rows.
+func recordSnapshots(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		recordSnapshot(int(now.Truncate(interval).Unix()))
+	}
+}
+
+// recordSnapshot stores the current occupancy of every event running at
+// the time as taken at the time
+func recordSnapshot(takenAt int) {
+	events, err := sd.GetEvents()
+	if err != nil {
+		log.Println("Unable to read events for occupancy snapshot:", err)
+		return
+	}
+
+	for _, event := range events {
+		if !event.RunningAt(time.Unix(int64(takenAt), 0)) {
+			continue
+		}
+		eventId := int(event.ID)
+		rows, err := eventPositions(eventId)
+		if err != nil {
+			log.Printf("Unable to read current positions of event %d for occupancy snapshot: %s", eventId, err)
+			continue
+		}
+
+		counts := countRegions(rows)[eventId]
+		snapshot := occupancy_snapshot{
+			EventId: eventId,
+			TakenAt: takenAt,
+			Counts:  make(map[string]int, len(counts)),
+		}
+		for regionId, count := range counts {
+			snapshot.Counts[strconv.Itoa(regionId)] = count
+		}
+		snapshots.SendItem(snapshot)
+		metrics.Add("occupancy_snapshots_recorded", 1)
+	}
+}
+
+// eventPositions returns the current positions of the people at the event
+func eventPositions(eventId int) ([]map[string]interface{}, error) {
+	query := dynamoDB.Query{
+		IndexName:   POSITION_INDEX_NAME,
+		PKeyColName: "eventId",
+		PKeyValue:   eventId,
+	}
+
+	var result []map[string]interface{}
+	for {
+		rows, cursor, err := db.QueryItems(query)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rows...)
+		if cursor == "" {
+			return result, nil
+		}
+		query.Cursor = cursor
+	}
+}
+
+// countRegions counts the people in each region of each event, keyed by
+// event and then region
+func countRegions(unparsedRows []map[string]interface{}) map[int]map[int]int {
+	counts := make(map[int]map[int]int)
+	for _, unparsed := range unparsedRows {
+		var row locationupdate.Movement_update
+		_ = mapstructure.Decode(unparsed, &row)
+		if row.EventID == nil || row.RegionID == nil {
+			continue
+		}
+
+		eventCounts, ok := counts[*row.EventID]
+		if !ok {
+			eventCounts = make(map[int]int)
+			counts[*row.EventID] = eventCounts
+		}
+		// Skip people who have left, which are kept until they are seen again
+		if row.Entering != nil && !*row.Entering {
+			continue
+		}
+		eventCounts[*row.RegionID]++
+	}
+	return counts
+}
+
+// querySnapshots returns the snapshots of the event taken from from to to
+// inclusive, oldest first
+func querySnapshots(eventId int, from int, to int) ([]occupancy_snapshot, error) {
+	query := dynamoDB.Query{
+		PKeyColName: "eventId",
+		PKeyValue:   eventId,
+		SortColName: "takenAt",
+		SortFrom:    &from,
+		SortTo:      &to,
+	}
+
+	var result []occupancy_snapshot
+	for {
+		rows, cursor, err := snapshots.QueryItems(query)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			var snapshot occupancy_snapshot
+			_ = mapstructure.Decode(row, &snapshot)
+			result = append(result, snapshot)
+		}
+		if cursor == "" {
+			return result, nil
+		}
+		query.Cursor = cursor
+	}
+}
+
+// latestSnapshot returns the last snapshot of the event taken at or before
+// the time, or nil if there was none within two intervals of it
+func latestSnapshot(eventId int, at int) (*occupancy_snapshot, error) {
+	from := at - int(2*snapshotInterval/time.Second)
+	rows, _, err := snapshots.QueryItems(dynamoDB.Query{
+		PKeyColName: "eventId",
+		PKeyValue:   eventId,
+		SortColName: "takenAt",
+		SortFrom:    &from,
+		SortTo:      &at,
+		Descending:  true,
+		Limit:       1,
+	})
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	var snapshot occupancy_snapshot
+	_ = mapstructure.Decode(rows[0], &snapshot)
+	return &snapshot, nil
+}
+
+// bucketOccupancy summarises the snapshots in buckets of the given length
+// from from, leaving out buckets without snapshots. Regions missing from a
+// snapshot had nobody in them. Only the region is summarised if one is given.
+func bucketOccupancy(snapshots []occupancy_snapshot, from int, bucket int, regionId *int) []occupancy_bucket {
+	// Group the snapshots by bucket
+	grouped := make(map[int][]occupancy_snapshot)
+	for _, snapshot := range snapshots {
+		start := from + (snapshot.TakenAt-from)/bucket*bucket
+		grouped[start] = append(grouped[start], snapshot)
+	}
+
+	buckets := make([]occupancy_bucket, 0, len(grouped))
+	for start, group := range grouped {
+		// Every region seen during the bucket is summarised
+		regions := make(map[int]bool)
+		for _, snapshot := range group {
+			for key := range snapshot.Counts {
+				id, err := strconv.Atoi(key)
+				if err == nil && (regionId == nil || id == *regionId) {
+					regions[id] = true
+				}
+			}
+		}
+
+		summary := make(map[int]region_occupancy, len(regions))
+		for id := range regions {
+			occupancy := region_occupancy{Min: math.MaxInt32}
+			total := 0
+			for _, snapshot := range group {
+				count := snapshot.Counts[strconv.Itoa(id)]
+				total += count
+				if count < occupancy.Min {
+					occupancy.Min = count
+				}
+				if count > occupancy.Max {
+					occupancy.Max = count
+				}
+			}
+			occupancy.Avg = float64(total) / float64(len(group))
+			summary[id] = occupancy
+		}
+
+		buckets = append(buckets, occupancy_bucket{Start: start, Snapshots: len(group), Regions: summary})
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Start < buckets[j].Start
+	})
+	return buckets
+}
+
+// report applies the policy to the occupancy, returning false if even the
+// busiest moment can't be reported. Smaller figures which can't be reported
+// are marked as suppressed.
+func (ro region_occupancy) report(policy privacy.Policy) (region_occupancy, bool) {
+	if policy.MinCount <= 1 {
+		return ro, true
+	}
+	max, ok := policy.Count(ro.Max)
+	if !ok {
+		return ro, false
+	}
+	min, minOk := policy.Count(ro.Min)
+	avg, avgOk := policy.Count(int(ro.Avg))
+	return region_occupancy{
+		Min:           min,
+		Avg:           float64(avg),
+		Max:           max,
+		minSuppressed: !minOk,
+		avgSuppressed: !avgOk,
+	}, true
+}
+
+func occupancyHandler(writer http.ResponseWriter, request *http.Request) {
+	// Allow cross origin
+	utils.SetAccessControlHeaders(writer)
+
+	eventId, err := strconv.Atoi(mux.Vars(request)["eventId"])
+	if err != nil {
+		log.Println("Cannot decode request event id:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to decode request: %s", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	// Read the range, in seconds since the epoch, and the bucket length
+	to, err := parseQueryArg(request, "to", int(time.Now().Unix()), writer)
+	if err != nil {
+		return
+	}
+	from, err := parseQueryArg(request, "from", to-DEFAULT_OCCUPANCY_RANGE, writer)
+	if err != nil {
+		return
+	}
+	bucket, err := parseQueryArg(request, "bucket", DEFAULT_OCCUPANCY_BUCKET, writer)
+	if err != nil {
+		return
+	}
+	var regionId *int
+	if request.URL.Query().Get("regionId") != "" {
+		id, err := parseQueryArg(request, "regionId", 0, writer)
+		if err != nil {
+			return
+		}
+		regionId = &id
+	}
+
+	if from > to {
+		http.Error(
+			writer,
+			fmt.Sprint("from must not be after to"),
+			http.StatusBadRequest)
+		return
+	}
+	if bucket <= 0 || (to-from)/bucket >= MAX_OCCUPANCY_BUCKETS {
+		http.Error(
+			writer,
+			fmt.Sprintf("bucket must be positive and split the range into at most %d buckets", MAX_OCCUPANCY_BUCKETS),
+			http.StatusBadRequest)
+		return
+	}
+
+	snapshots, err := querySnapshots(eventId, from, to)
+	if err != nil {
+		log.Println("Error reading occupancy snapshots:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to read occupancy: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+	buckets := bucketOccupancy(snapshots, from, bucket, regionId)
+
+	// Leave out occupancy small enough to pick out individuals
+	policy := privacy.ForRequest(policies, request, eventId)
+	for _, b := range buckets {
+		for id, occupancy := range b.Regions {
+			if reported, ok := occupancy.report(policy); ok {
+				b.Regions[id] = reported
+			} else {
+				delete(b.Regions, id)
+			}
+		}
+	}
+
+	_ = json.NewEncoder(writer).Encode(occupancy_response{
+		EventId: eventId,
+		From:    from,
+		To:      to,
+		Bucket:  bucket,
+		Buckets: buckets,
+	})
+}
+
+func parseQueryArg(request *http.Request, varName string, defaultValue int, writer http.ResponseWriter) (int, error) {
+	str := request.URL.Query().Get(varName)
+	if str == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		log.Println("Cannot decode query parameter "+varName, err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to decode %s: %s", varName, err),
+			http.StatusBadRequest)
+	}
+	return value, err
+}
@@ -0,0 +1,144 @@
+package eventlivedata
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/privacy"
+)
+
+// sendSnapshots stores snapshots of event 1 taken at the times, with the
+// counts of region 1 and region 2
+func sendSnapshots(takenAt []int, region1 []int, region2 []int) *dummy_snapshots {
+	ds := &dummy_snapshots{}
+	for i, at := range takenAt {
+		counts := map[string]int{"1": region1[i]}
+		if region2[i] > 0 {
+			counts["2"] = region2[i]
+		}
+		ds.SendItem(occupancy_snapshot{EventId: 1, TakenAt: at, Counts: counts})
+	}
+	ds.SendItem(occupancy_snapshot{EventId: 2, TakenAt: takenAt[0], Counts: map[string]int{"1": 50}})
+	return ds
+}
+
+func TestRecordSnapshot(t *testing.T) {
+	db = &dummy_db{t}
+	ds := &dummy_snapshots{}
+	snapshots = ds
+	defer func() { snapshots = &dummy_snapshots{} }()
+
+	recordSnapshot(1000)
+
+	if len(ds.rows) != 1 {
+		t.Fatalf("Expected a snapshot of the one event. Got %d", len(ds.rows))
+	}
+	expected := map[string]interface{}{"eventId": 1.0, "takenAt": 1000.0, "counts": map[string]interface{}{"1": 1.0}}
+	if !reflect.DeepEqual(ds.rows[0], expected) {
+		t.Errorf("Expected %v. Got %v", expected, ds.rows[0])
+	}
+}
+
+func TestSnapshotOnlyRunningEvents(t *testing.T) {
+	db = &dummy_db{t}
+	ds := &dummy_snapshots{}
+	snapshots = ds
+	defer func() { snapshots = &dummy_snapshots{} }()
+
+	// After event 1 has finished, nothing is recorded
+	recordSnapshot(int(time.Unix(0, 0).AddDate(0, 0, 3).Unix()))
+
+	if len(ds.rows) != 0 {
+		t.Errorf("Expected no snapshots once the events have ended. Got %v", ds.rows)
+	}
+}
+
+func TestBucketOccupancy(t *testing.T) {
+	ds := sendSnapshots([]int{100, 400, 700, 1300}, []int{2, 6, 4, 3}, []int{1, 0, 0, 0})
+	var parsed []occupancy_snapshot
+	for _, row := range ds.rows[:4] {
+		var snapshot occupancy_snapshot
+		data, _ := json.Marshal(row)
+		_ = json.Unmarshal(data, &snapshot)
+		parsed = append(parsed, snapshot)
+	}
+
+	buckets := bucketOccupancy(parsed, 0, 900, nil)
+	expected := []occupancy_bucket{
+		{Start: 0, Snapshots: 3, Regions: map[int]region_occupancy{
+			1: {Min: 2, Avg: 4, Max: 6},
+			2: {Min: 0, Avg: 1.0 / 3, Max: 1},
+		}},
+		{Start: 900, Snapshots: 1, Regions: map[int]region_occupancy{1: {Min: 3, Avg: 3, Max: 3}}},
+	}
+	if !reflect.DeepEqual(buckets, expected) {
+		t.Errorf("Expected %+v. Got %+v", expected, buckets)
+	}
+
+	region := 2
+	buckets = bucketOccupancy(parsed, 0, 900, &region)
+	if len(buckets) != 2 || len(buckets[0].Regions) != 1 || len(buckets[1].Regions) != 0 {
+		t.Errorf("Expected only region 2 to be summarised. Got %+v", buckets)
+	}
+}
+
+func TestGETOccupancy(t *testing.T) {
+	snapshots = sendSnapshots([]int{100, 400, 700, 1300}, []int{2, 6, 4, 3}, []int{1, 0, 0, 0})
+	defer func() { snapshots = &dummy_snapshots{} }()
+
+	req, _ := http.NewRequest("GET", "/events/1/occupancy?from=0&to=1200&bucket=600&regionId=1", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	expected := `{"eventId":1,"from":0,"to":1200,"bucket":600,"buckets":[` +
+		`{"start":0,"snapshots":2,"regions":{"1":{"min":2,"avg":4,"max":6}}},` +
+		`{"start":600,"snapshots":1,"regions":{"1":{"min":4,"avg":4,"max":4}}}]}`
+	if body := response.Body.String(); strings.TrimSpace(body) != expected {
+		t.Errorf("Expected %s. Got %s", expected, body)
+	}
+
+	// Regions which never had enough people in them are left out
+	policies = &dummy_policies{privacy.Policy{MinCount: 5, Mode: privacy.SUPPRESS}}
+	defer func() { policies = &dummy_policies{} }()
+	req, _ = http.NewRequest("GET", "/events/1/occupancy?from=0&to=1200&bucket=600", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	expected = `{"eventId":1,"from":0,"to":1200,"bucket":600,"buckets":[` +
+		`{"start":0,"snapshots":2,"regions":{"1":{"min":null,"avg":null,"max":6,"suppressed":true}}},` +
+		`{"start":600,"snapshots":1,"regions":{}}]}`
+	if body := response.Body.String(); strings.TrimSpace(body) != expected {
+		t.Errorf("Expected %s. Got %s", expected, body)
+	}
+}
+
+func TestGETOccupancyInvalidRange(t *testing.T) {
+	for _, query := range []string{"from=10&to=0", "from=0&to=100000&bucket=60", "bucket=0", "from=yesterday"} {
+		req, _ := http.NewRequest("GET", "/events/1/occupancy?"+query, nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+	}
+}
+
+func TestHeatmapAtTime(t *testing.T) {
+	snapshots = sendSnapshots([]int{100, 400, 700}, []int{2, 6, 4}, []int{1, 0, 0})
+	defer func() { snapshots = &dummy_snapshots{} }()
+	snapshotInterval = 5 * time.Minute
+
+	req, _ := http.NewRequest("GET", "/live/heatmap/1?at=450", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if body := response.Body.String(); strings.TrimSpace(body) != `{"1":6}` {
+		t.Errorf("Expected the heatmap of the snapshot before the time. Got %s", body)
+	}
+
+	// Snapshots older than two intervals don't show the heatmap at the time
+	req, _ = http.NewRequest("GET", "/live/heatmap/1?at=2000", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
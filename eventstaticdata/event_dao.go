@@ -14,6 +14,9 @@ const (
 	DATABASE_HOST string = "rtfa-crowd-static-data.chh9za0s2bso.eu-central-1.rds.amazonaws.com"
 	DATABASE_PORT int    = 5432
 	DATABASE_NAME string = "rtfa_crowd_static_data"
+
+	// DEFAULT_LOCALE is the locale of events that don't set one
+	DEFAULT_LOCALE string = "en"
 )
 
 type Event struct {
@@ -27,6 +30,41 @@ type Event struct {
 	IndoorOutdoor string    `json:"indoorOutdoor"`
 	MaxAttendance int64     `json:"maxAttendance"`
 	CoverPhotoURL string    `json:"coverPhotoUrl"`
+	DefaultLocale string    `json:"defaultLocale,omitempty"`
+	Locales       []string  `json:"locales,omitempty" sql:",array"`
+	// MinReportedCount is the fewest people a count of the event can be
+	// reported for, or 0 for the server's default
+	MinReportedCount int32 `json:"minReportedCount,omitempty"`
+	// MaxDeviceUpdatesPerMinute is how many updates each device at the
+	// event can send a minute, or 0 for the server's default
+	MaxDeviceUpdatesPerMinute int32 `json:"maxDeviceUpdatesPerMinute,omitempty"`
+}
+
+// RunningAt returns whether the event is on at the given time. Events run
+// from the start of their start date until the end of their end date.
+func (event *Event) RunningAt(t time.Time) bool {
+	return !t.Before(event.StartDate) && t.Before(event.EndDate.AddDate(0, 0, 1))
+}
+
+// GetDefaultLocale returns the locale notifications of the event are
+// written in when no other is requested
+func (event *Event) GetDefaultLocale() string {
+	if event.DefaultLocale == "" {
+		return DEFAULT_LOCALE
+	}
+	return event.DefaultLocale
+}
+
+// GetLocales returns every locale attendees of the event can receive
+// notifications in, starting with the default one
+func (event *Event) GetLocales() []string {
+	locales := []string{event.GetDefaultLocale()}
+	for _, locale := range event.Locales {
+		if locale != locales[0] {
+			locales = append(locales, locale)
+		}
+	}
+	return locales
 }
 
 type AllEventsRequest struct {
@@ -0,0 +1,183 @@
+package eventstaticdata
+
+import (
+	"sync"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const (
+	DEFAULT_EVENT_INDEX_TTL = 5 * time.Minute
+
+	// MAX_UNKNOWN_EVENTS is how many IDs of events which don't exist are
+	// cached, so sending made up IDs can't use up the memory
+	MAX_UNKNOWN_EVENTS = 10000
+)
+
+// EventIndexInterface gives quick access to which regions belong to which
+// events, for checking data sent by attendees
+type EventIndexInterface interface {
+	// GetEventRegions returns the event and its regions, or nil if there is
+	// no such event
+	GetEventRegions(eventID int) (*EventRegions, error)
+	// Invalidate makes the next lookup of the event read it again
+	Invalidate(eventID int)
+}
+
+// EventRegions is an event along with the IDs of its regions
+type EventRegions struct {
+	Event     Event
+	RegionIDs map[int]bool
+}
+
+// HasRegion returns whether the region belongs to the event
+func (er *EventRegions) HasRegion(regionID int) bool {
+	return er.RegionIDs[regionID]
+}
+
+// EndedBefore returns whether the event was over by the given time. Events
+// run until the end of the day of their end date.
+func (er *EventRegions) EndedBefore(t time.Time) bool {
+	return !t.Before(er.Event.EndDate.AddDate(0, 0, 1))
+}
+
+// Index is the index shared by this package's handlers, which keep it up to
+// date, and the other packages which read it. Other instances of the server
+// see changes once their cached copy expires.
+var Index = NewEventIndex(&StaticDataClient{},
+	utils.GetEnvDuration("RTFA_EVENT_INDEX_TTL", DEFAULT_EVENT_INDEX_TTL))
+
+// EventIndex caches the events and regions read from the static data,
+// including events which don't exist so that unknown IDs can't overload
+// the database. Once maxUnknown of those are cached, others are evicted to
+// make room for new ones.
+type EventIndex struct {
+	data       StaticDataInterface
+	ttl        time.Duration
+	now        func() time.Time
+	maxUnknown int
+
+	mutex   sync.Mutex
+	entries map[int]*eventIndexEntry
+	// unknown counts the entries of events which don't exist
+	unknown int
+	// invalidations counts calls to Invalidate, so a copy read while an
+	// event changed isn't cached
+	invalidations int
+}
+
+type eventIndexEntry struct {
+	regions  *EventRegions
+	loadedAt time.Time
+}
+
+// NewEventIndex returns an index of the static data keeping each event for
+// the given time
+func NewEventIndex(data StaticDataInterface, ttl time.Duration) *EventIndex {
+	return &EventIndex{
+		data:       data,
+		ttl:        ttl,
+		now:        time.Now,
+		maxUnknown: MAX_UNKNOWN_EVENTS,
+		entries:    make(map[int]*eventIndexEntry),
+	}
+}
+
+func (ei *EventIndex) GetEventRegions(eventID int) (*EventRegions, error) {
+	ei.mutex.Lock()
+	entry, ok := ei.entries[eventID]
+	invalidations := ei.invalidations
+	ei.mutex.Unlock()
+	if ok && ei.now().Sub(entry.loadedAt) < ei.ttl {
+		return entry.regions, nil
+	}
+
+	// Read the event outside the lock so a slow database doesn't hold up
+	// lookups of cached events
+	loadedAt := ei.now()
+	regions, err := ei.load(eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	ei.mutex.Lock()
+	defer ei.mutex.Unlock()
+	if ei.invalidations == invalidations {
+		ei.store(eventID, &eventIndexEntry{regions: regions, loadedAt: loadedAt})
+	}
+	return regions, nil
+}
+
+func (ei *EventIndex) Invalidate(eventID int) {
+	ei.mutex.Lock()
+	defer ei.mutex.Unlock()
+	ei.remove(eventID)
+	ei.invalidations++
+}
+
+// store caches the entry of the event, making room for it if it is of an
+// unknown event and there are too many of those. Must be called with the
+// mutex held.
+func (ei *EventIndex) store(eventID int, entry *eventIndexEntry) {
+	ei.remove(eventID)
+	if entry.regions == nil {
+		if ei.unknown >= ei.maxUnknown {
+			ei.evict()
+		}
+		ei.unknown++
+	}
+	ei.entries[eventID] = entry
+}
+
+// evict removes expired entries, and entries of unknown events until a
+// tenth of their room is free, so that it isn't needed on every lookup of
+// a new unknown event. Must be called with the mutex held.
+func (ei *EventIndex) evict() {
+	keep := ei.maxUnknown - ei.maxUnknown/10
+	if keep >= ei.maxUnknown {
+		keep = ei.maxUnknown - 1
+	}
+
+	now := ei.now()
+	for eventID, entry := range ei.entries {
+		expired := now.Sub(entry.loadedAt) >= ei.ttl
+		if expired || (entry.regions == nil && ei.unknown > keep) {
+			ei.remove(eventID)
+		}
+	}
+}
+
+// remove drops the entry of the event. Must be called with the mutex held.
+func (ei *EventIndex) remove(eventID int) {
+	entry, ok := ei.entries[eventID]
+	if !ok {
+		return
+	}
+	if entry.regions == nil {
+		ei.unknown--
+	}
+	delete(ei.entries, eventID)
+}
+
+// load reads the event and its regions from the static data
+func (ei *EventIndex) load(eventID int) (*EventRegions, error) {
+	event, err := ei.data.GetEvent(eventID)
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	regions, err := ei.data.GetRegions(eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	regionIDs := make(map[int]bool, len(regions))
+	for _, region := range regions {
+		regionIDs[int(region.ID)] = true
+	}
+	return &EventRegions{Event: *event, RegionIDs: regionIDs}, nil
+}
@@ -0,0 +1,99 @@
+package eventstaticdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+type dummy_static_data struct {
+	reads   int
+	regions []Region
+}
+
+func (sd *dummy_static_data) GetEvents() ([]Event, error) {
+	return nil, nil
+}
+
+func (sd *dummy_static_data) GetEvent(eventID int) (*Event, error) {
+	sd.reads++
+	if eventID != 1 {
+		return nil, pg.ErrNoRows
+	}
+	return &Event{ID: 1, EndDate: time.Date(2018, 12, 10, 0, 0, 0, 0, time.UTC)}, nil
+}
+
+func (sd *dummy_static_data) GetRegions(eventID int) ([]Region, error) {
+	return sd.regions, nil
+}
+
+func TestEventIndex(t *testing.T) {
+	data := &dummy_static_data{regions: []Region{{ID: 3, EventID: 1}}}
+	index := NewEventIndex(data, time.Minute)
+
+	event, err := index.GetEventRegions(1)
+	if err != nil || event == nil {
+		t.Fatalf("Expected the event to be found. Got %v", err)
+	}
+	if !event.HasRegion(3) || event.HasRegion(4) {
+		t.Errorf("Expected only the event's regions. Got %v", event.RegionIDs)
+	}
+	if event.EndedBefore(time.Date(2018, 12, 10, 23, 0, 0, 0, time.UTC)) ||
+		!event.EndedBefore(time.Date(2018, 12, 11, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Expected the event to run until the end of its end date")
+	}
+
+	// Unknown events are cached too
+	for i := 0; i < 2; i++ {
+		if event, _ := index.GetEventRegions(2); event != nil {
+			t.Error("Expected no event for an unknown ID")
+		}
+	}
+	if data.reads != 2 {
+		t.Errorf("Expected each event to be read once. Got %d reads", data.reads)
+	}
+
+	// New regions are seen once the event is invalidated
+	data.regions = append(data.regions, Region{ID: 4, EventID: 1})
+	if event, _ := index.GetEventRegions(1); event.HasRegion(4) {
+		t.Error("Expected the cached regions until the event is invalidated")
+	}
+	index.Invalidate(1)
+	if event, _ := index.GetEventRegions(1); !event.HasRegion(4) {
+		t.Error("Expected the new region after the event was invalidated")
+	}
+
+	// Cached events expire
+	now := time.Now().Add(2 * time.Minute)
+	index.now = func() time.Time { return now }
+	_, _ = index.GetEventRegions(2)
+	if data.reads != 4 {
+		t.Errorf("Expected an expired event to be read again. Got %d reads", data.reads)
+	}
+}
+
+func TestEventIndexLimitsUnknownEvents(t *testing.T) {
+	data := &dummy_static_data{regions: []Region{{ID: 3, EventID: 1}}}
+	index := NewEventIndex(data, time.Minute)
+	index.maxUnknown = 2
+
+	_, _ = index.GetEventRegions(1)
+	for eventID := 2; eventID < 10; eventID++ {
+		_, _ = index.GetEventRegions(eventID)
+	}
+	if index.unknown > 2 || len(index.entries) > 3 {
+		t.Errorf("Expected at most 2 unknown events cached. Got %d of %d entries", index.unknown, len(index.entries))
+	}
+
+	// Known events aren't evicted to make room
+	reads := data.reads
+	if event, _ := index.GetEventRegions(1); event == nil || data.reads != reads {
+		t.Error("Expected the known event to stay cached")
+	}
+
+	// The most recent unknown event is still cached
+	if _, _ = index.GetEventRegions(9); data.reads != reads {
+		t.Error("Expected the latest unknown event to stay cached")
+	}
+}
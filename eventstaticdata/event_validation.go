@@ -3,9 +3,13 @@ package eventstaticdata
 import (
 	"errors"
 	"net/url"
+	"regexp"
 	"time"
 )
 
+// localePattern matches BCP 47 style language tags such as "en" or "pt-BR"
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
 func validateEvent(event *Event) error {
 
 	if err := validateOrganiserID(event.OrganiserID); err != nil {
@@ -29,6 +33,15 @@ func validateEvent(event *Event) error {
 	if err := validateCoverPhotoURL(event.CoverPhotoURL); err != nil {
 		return err
 	}
+	if err := validateLocales(event.DefaultLocale, event.Locales); err != nil {
+		return err
+	}
+	if event.MinReportedCount < 0 {
+		return errors.New("The event min reported count can't be negative")
+	}
+	if event.MaxDeviceUpdatesPerMinute < 0 {
+		return errors.New("The event max device updates per minute can't be negative")
+	}
 
 	return nil
 }
@@ -134,6 +147,25 @@ func validateCoverPhotoURL(coverPhotoURL string) error {
 	return nil
 }
 
+func validateLocales(defaultLocale string, locales []string) error {
+
+	if defaultLocale != "" && !ValidLocale(defaultLocale) {
+		return errors.New("The event default locale must be a language tag such as \"en\" or \"pt-BR\"")
+	}
+	for _, locale := range locales {
+		if !ValidLocale(locale) {
+			return errors.New("The event locales must be language tags such as \"en\" or \"pt-BR\"")
+		}
+	}
+
+	return nil
+}
+
+// ValidLocale reports whether the locale is a well formed language tag
+func ValidLocale(locale string) bool {
+	return localePattern.MatchString(locale)
+}
+
 func validateMapType(mapType string) error {
 
 	if mapType == "" {
@@ -136,3 +136,34 @@ func TestValidateCoverPhotoURL(t *testing.T) {
 	}
 
 }
+
+func TestValidateLocales(t *testing.T) {
+
+	if err := validateLocales("", nil); err != nil {
+		t.Error("Not expecting an error when validating an event without locales")
+	}
+	if err := validateLocales("en", []string{"fr", "pt-BR"}); err != nil {
+		t.Error("Not expecting an error when validating valid event locales")
+	}
+	if err := validateLocales("English", nil); err == nil {
+		t.Error("Expected an error when validating a default locale which is not a language tag")
+	}
+	if err := validateLocales("en", []string{"fr_FR"}); err == nil {
+		t.Error("Expected an error when validating a locale which is not a language tag")
+	}
+
+}
+
+func TestEventLocales(t *testing.T) {
+
+	event := Event{}
+	if locales := event.GetLocales(); len(locales) != 1 || locales[0] != DEFAULT_LOCALE {
+		t.Errorf("Expected an event without locales to use the default. Got %v", locales)
+	}
+
+	event = Event{DefaultLocale: "de", Locales: []string{"en", "de"}}
+	if locales := event.GetLocales(); len(locales) != 2 || locales[0] != "de" || locales[1] != "en" {
+		t.Errorf("Expected the default locale first without duplicates. Got %v", locales)
+	}
+
+}
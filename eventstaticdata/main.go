@@ -112,6 +112,7 @@ func postEventsHandler(w http.ResponseWriter, r *http.Request) {
 			http.StatusInternalServerError)
 		return
 	}
+	Index.Invalidate(int(event.ID))
 
 	_ = json.NewEncoder(w).Encode(event)
 
@@ -279,6 +280,7 @@ func postRegionsHandler(w http.ResponseWriter, r *http.Request) {
 			http.StatusInternalServerError)
 		return
 	}
+	Index.Invalidate(eventID)
 
 	_ = json.NewEncoder(w).Encode(regions)
 
@@ -468,6 +470,7 @@ func updateRegionHandler(w http.ResponseWriter, r *http.Request) {
 			http.StatusInternalServerError)
 		return
 	}
+	Index.Invalidate(eventID)
 
 	_ = json.NewEncoder(w).Encode(region)
 
@@ -0,0 +1,8 @@
+-- Columns of the event table read by the server, which must be added to
+-- existing databases before deploying it, as every select of an event names
+-- them. They are nullable, so existing events keep working: no default
+-- locale means DEFAULT_LOCALE.
+
+-- Locales notifications can be sent in
+ALTER TABLE event ADD COLUMN IF NOT EXISTS default_locale text;
+ALTER TABLE event ADD COLUMN IF NOT EXISTS locales text[];
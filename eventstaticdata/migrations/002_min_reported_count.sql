@@ -0,0 +1,4 @@
+-- Fewest people a count of the event can be reported for, where 0 means
+-- the server's default. Defaulted, so existing events keep working.
+ALTER TABLE event ADD COLUMN IF NOT EXISTS min_reported_count integer NOT NULL DEFAULT 0
+    CHECK (min_reported_count >= 0);
@@ -0,0 +1,4 @@
+-- Updates each device at the event can send a minute, where 0 means the
+-- server's default. Defaulted, so existing events keep working.
+ALTER TABLE event ADD COLUMN IF NOT EXISTS max_device_updates_per_minute integer NOT NULL DEFAULT 0
+    CHECK (max_device_updates_per_minute >= 0);
@@ -0,0 +1,38 @@
+package eventstaticdata
+
+import "github.com/go-pg/pg"
+
+// StaticDataInterface gives other packages read access to the static
+// event data without depending on the database directly
+type StaticDataInterface interface {
+	GetEvents() ([]Event, error)
+	GetEvent(eventID int) (*Event, error)
+	GetRegions(eventID int) ([]Region, error)
+}
+
+type StaticDataClient struct{}
+
+// GetEvents returns every event
+func (sd *StaticDataClient) GetEvents() ([]Event, error) {
+	return getAllEvents()
+}
+
+// GetEvent returns the event with the given ID
+func (sd *StaticDataClient) GetEvent(eventID int) (*Event, error) {
+	return getEventByID(eventID)
+}
+
+// GetRegions returns all the regions belonging to the given event
+func (sd *StaticDataClient) GetRegions(eventID int) ([]Region, error) {
+	regions, err := getRegionsByEventID(eventID)
+	if err != nil {
+		return nil, err
+	}
+	return *regions, nil
+}
+
+// IsNotFound returns whether the error is from reading an event, or other
+// static data, which doesn't exist
+func IsNotFound(err error) bool {
+	return err == pg.ErrNoRows
+}
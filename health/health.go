@@ -0,0 +1,31 @@
+package health
+
+import "sync"
+
+// Check reports the state of a component for the health endpoint
+type Check func() interface{}
+
+var (
+	mutex  sync.Mutex
+	checks = make(map[string]Check)
+)
+
+// Register adds a component to the health report under the given name,
+// replacing any component already registered with that name
+func Register(name string, check Check) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	checks[name] = check
+}
+
+// Report returns the state of every registered component
+func Report() map[string]interface{} {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	report := map[string]interface{}{"status": "ok"}
+	for name, check := range checks {
+		report[name] = check()
+	}
+	return report
+}
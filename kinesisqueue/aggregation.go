@@ -0,0 +1,118 @@
+package kinesisqueue
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/protowire"
+)
+
+// Records can be aggregated into one Kinesis record in the format of the
+// Kinesis Producer Library, which the Kinesis Client Library and this
+// package's readers take apart again: the magic bytes, an AggregatedRecord
+// message, then the MD5 digest of the message.
+var aggregateMagic = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+// MAX_AGGREGATE_BYTES is the largest an aggregated record is made, as the
+// Kinesis Producer Library does
+const MAX_AGGREGATE_BYTES = 50 * 1024
+
+// aggregator builds an aggregated record of records with the same
+// partition key
+type aggregator struct {
+	partitionKey string
+	records      []Record
+	message      []byte
+}
+
+func newAggregator(partitionKey string) *aggregator {
+	return &aggregator{
+		partitionKey: partitionKey,
+		message:      protowire.AppendBytesField(nil, 1, []byte(partitionKey)),
+	}
+}
+
+// add adds the record unless it would take the aggregated record over the
+// maximum size, which an empty aggregator always takes
+func (a *aggregator) add(record Record) bool {
+	var entry []byte
+	entry = protowire.AppendVarintField(entry, 1, 0)
+	entry = protowire.AppendBytesField(entry, 3, record.Data)
+	message := protowire.AppendBytesField(a.message, 3, entry)
+
+	size := len(aggregateMagic) + len(message) + md5.Size
+	if len(a.records) > 0 && size > MAX_AGGREGATE_BYTES {
+		return false
+	}
+	a.message = message
+	a.records = append(a.records, record)
+	return true
+}
+
+// record returns the aggregated record, or the only record if there is
+// just one as it is smaller left alone
+func (a *aggregator) record() Record {
+	if len(a.records) == 1 {
+		return a.records[0]
+	}
+	digest := md5.Sum(a.message)
+	data := make([]byte, 0, len(aggregateMagic)+len(a.message)+md5.Size)
+	data = append(data, aggregateMagic...)
+	data = append(data, a.message...)
+	data = append(data, digest[:]...)
+	return Record{PartitionKey: a.partitionKey, Data: data}
+}
+
+// Deaggregate returns the records aggregated in the data. It returns false
+// if the data isn't an aggregated record.
+func Deaggregate(data []byte) ([]Record, bool, error) {
+	if len(data) < len(aggregateMagic)+md5.Size || !bytes.HasPrefix(data, aggregateMagic) {
+		return nil, false, nil
+	}
+	message := data[len(aggregateMagic) : len(data)-md5.Size]
+	digest := md5.Sum(message)
+	if !bytes.Equal(digest[:], data[len(data)-md5.Size:]) {
+		// Just a record which happens to start with the magic bytes
+		return nil, false, nil
+	}
+
+	var keys []string
+	var entries [][]byte
+	err := protowire.Parse(message, func(field protowire.Field) error {
+		switch {
+		case field.Number == 1 && field.Type == protowire.BYTES:
+			keys = append(keys, string(field.Bytes))
+		case field.Number == 3 && field.Type == protowire.BYTES:
+			entries = append(entries, field.Bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, true, err
+	}
+
+	records := make([]Record, 0, len(entries))
+	for _, entry := range entries {
+		var record Record
+		keyIndex := -1
+		err = protowire.Parse(entry, func(field protowire.Field) error {
+			switch {
+			case field.Number == 1 && field.Type == protowire.VARINT:
+				keyIndex = int(field.Varint)
+			case field.Number == 3 && field.Type == protowire.BYTES:
+				record.Data = field.Bytes
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, true, err
+		}
+		if keyIndex < 0 || keyIndex >= len(keys) {
+			return nil, true, fmt.Errorf("aggregated record has partition key index %d of %d", keyIndex, len(keys))
+		}
+		record.PartitionKey = keys[keyIndex]
+		records = append(records, record)
+	}
+	return records, true, nil
+}
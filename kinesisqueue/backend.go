@@ -0,0 +1,68 @@
+package kinesisqueue
+
+import (
+	"log"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const (
+	KINESIS_BACKEND = "kinesis"
+	FILE_BACKEND    = "file"
+	CHANNEL_BACKEND = "channel"
+
+	DEFAULT_QUEUE_DIR          = "/var/lib/rtfa/queue"
+	DEFAULT_CHANNEL_QUEUE_SIZE = 1024
+)
+
+// NewQueue returns the queue backend chosen by RTFA_QUEUE_BACKEND:
+// "kinesis" (the default), "file" to append to a log in RTFA_QUEUE_DIR, or
+// "channel" for an in-process channel holding RTFA_QUEUE_CHANNEL_SIZE
+// records. Kinesis records are encoded as RTFA_KINESIS_ENCODING, "json" (the
+// default) or "protobuf".
+func NewQueue() KinesisQueueInterface {
+	backend := Backend()
+	switch backend {
+	case KINESIS_BACKEND:
+		return newKinesisQueue()
+	case FILE_BACKEND:
+		return &FileQueueClient{Dir: utils.GetEnv("RTFA_QUEUE_DIR", DEFAULT_QUEUE_DIR)}
+	case CHANNEL_BACKEND:
+		return &ChannelQueueClient{Size: channelSize()}
+	default:
+		log.Printf("Unknown queue backend %q, using %s", backend, KINESIS_BACKEND)
+		return newKinesisQueue()
+	}
+}
+
+// Backend returns the queue backend chosen by RTFA_QUEUE_BACKEND
+func Backend() string {
+	return utils.GetEnv("RTFA_QUEUE_BACKEND", KINESIS_BACKEND)
+}
+
+// channelSize returns how many records a channel queue holds, set by
+// RTFA_QUEUE_CHANNEL_SIZE for both ends of the channel
+func channelSize() int {
+	return utils.GetEnvInt("RTFA_QUEUE_CHANNEL_SIZE", DEFAULT_CHANNEL_QUEUE_SIZE)
+}
+
+// newKinesisQueue returns a Kinesis queue which sends the records of
+// concurrent requests in batches, unless RTFA_KINESIS_BATCHING is "false"
+// when each record is sent as it arrives. Batches are sent every
+// RTFA_KINESIS_FLUSH_INTERVAL, at most RTFA_KINESIS_MAX_BUFFERED records are
+// held, records are aggregated if RTFA_KINESIS_AGGREGATE is "true", and
+// closing waits up to RTFA_KINESIS_CLOSE_TIMEOUT for those buffered to be
+// sent.
+func newKinesisQueue() KinesisQueueInterface {
+	encoding := utils.GetEnv("RTFA_KINESIS_ENCODING", JSON_ENCODING)
+	if utils.GetEnv("RTFA_KINESIS_BATCHING", "true") == "false" {
+		return &KinesisQueueClient{Encoding: encoding}
+	}
+	return &BatchProducer{
+		Encoding:      encoding,
+		FlushInterval: utils.GetEnvDuration("RTFA_KINESIS_FLUSH_INTERVAL", DEFAULT_FLUSH_INTERVAL),
+		MaxBuffered:   utils.GetEnvInt("RTFA_KINESIS_MAX_BUFFERED", DEFAULT_MAX_BUFFERED),
+		Aggregate:     utils.GetEnv("RTFA_KINESIS_AGGREGATE", "false") == "true",
+		CloseTimeout:  utils.GetEnvDuration("RTFA_KINESIS_CLOSE_TIMEOUT", DEFAULT_CLOSE_TIMEOUT),
+	}
+}
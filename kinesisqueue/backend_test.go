@@ -0,0 +1,142 @@
+package kinesisqueue
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestFileQueue(t *testing.T) {
+	dir := newSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	fq := &FileQueueClient{Dir: dir}
+	if err := fq.InitConn("stream"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if err := fq.SendToQueue(map[string]int{"regionId": i}, "shard"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(FileQueuePath(dir, "stream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Expected json records in the log, got decode error: %s", err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 || string(records[1].Data) != `{"regionId":2}` || records[1].PartitionKey != "shard" {
+		t.Errorf("Expected the records to be appended to the log. Got %+v", records)
+	}
+}
+
+func TestChannelQueue(t *testing.T) {
+	cq := &ChannelQueueClient{Size: 1}
+	if err := cq.InitConn("channel-test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cq.SendToQueue("first", "shard"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cq.SendToQueue("second", "shard"); err != ErrChannelFull {
+		t.Errorf("Expected ErrChannelFull. Got %v", err)
+	}
+
+	record := <-Channel("channel-test")
+	if string(record.Data) != `"first"` || record.PartitionKey != "shard" {
+		t.Errorf("Expected the first record from the channel. Got %+v", record)
+	}
+}
+
+func TestNewQueue(t *testing.T) {
+	defer os.Unsetenv("RTFA_QUEUE_BACKEND")
+
+	os.Unsetenv("RTFA_QUEUE_BACKEND")
+	if _, ok := NewQueue().(*BatchProducer); !ok {
+		t.Error("Expected batched Kinesis to be the default backend")
+	}
+	os.Setenv("RTFA_KINESIS_BATCHING", "false")
+	defer os.Unsetenv("RTFA_KINESIS_BATCHING")
+	if _, ok := NewQueue().(*KinesisQueueClient); !ok {
+		t.Error("Expected unbatched Kinesis")
+	}
+	os.Setenv("RTFA_QUEUE_BACKEND", FILE_BACKEND)
+	if _, ok := NewQueue().(*FileQueueClient); !ok {
+		t.Error("Expected the file backend")
+	}
+	os.Setenv("RTFA_QUEUE_BACKEND", CHANNEL_BACKEND)
+	if _, ok := NewQueue().(*ChannelQueueClient); !ok {
+		t.Error("Expected the channel backend")
+	}
+}
+
+func TestFileStreamReader(t *testing.T) {
+	dir := newSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	fq := &FileQueueClient{Dir: dir}
+	if err := fq.InitConn("stream"); err != nil {
+		t.Fatal(err)
+	}
+	_ = fq.SendToQueue(1, "a")
+
+	// A record still being written is left for the next read
+	fq.file.WriteString(`{"partitionKey":"a",`)
+
+	fr := &FileStreamReader{Dir: dir}
+	if err := fr.InitConn("stream", func(string) string { return "" }); err != nil {
+		t.Fatal(err)
+	}
+	records, err := fr.ReadRecords()
+	if err != nil || len(records) != 1 || string(records[0].Data) != "1" {
+		t.Fatalf("Expected the complete record. Got %+v, %v", records, err)
+	}
+	checkpoint := records[0].Sequence
+
+	fq.file.WriteString(`"data":2}` + "\n")
+	records, err = fr.ReadRecords()
+	if err != nil || len(records) != 1 || string(records[0].Data) != "2" {
+		t.Fatalf("Expected the record once it was complete. Got %+v, %v", records, err)
+	}
+
+	// Reading again resumes after the checkpoint
+	fr = &FileStreamReader{Dir: dir}
+	if err := fr.InitConn("stream", func(string) string { return checkpoint }); err != nil {
+		t.Fatal(err)
+	}
+	records, err = fr.ReadRecords()
+	if err != nil || len(records) != 1 || string(records[0].Data) != "2" {
+		t.Errorf("Expected to resume after the checkpoint. Got %+v, %v", records, err)
+	}
+}
+
+func TestChannelSize(t *testing.T) {
+	os.Setenv("RTFA_QUEUE_BACKEND", CHANNEL_BACKEND)
+	os.Setenv("RTFA_QUEUE_CHANNEL_SIZE", "2")
+	defer os.Unsetenv("RTFA_QUEUE_BACKEND")
+	defer os.Unsetenv("RTFA_QUEUE_CHANNEL_SIZE")
+
+	// The reader connecting first creates the channel the queue sends on
+	if err := NewStreamReader().InitConn("channel-size-test", nil); err != nil {
+		t.Fatal(err)
+	}
+	queue := NewQueue()
+	if err := queue.InitConn("channel-size-test"); err != nil {
+		t.Fatal(err)
+	}
+	if size := cap(Channel("channel-size-test")); size != 2 {
+		t.Errorf("Expected a channel of RTFA_QUEUE_CHANNEL_SIZE records. Got %d", size)
+	}
+}
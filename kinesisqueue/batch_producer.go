@@ -0,0 +1,385 @@
+package kinesisqueue
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	// Limits of the PutRecords request
+	MAX_BATCH_RECORDS = 500
+	MAX_BATCH_BYTES   = 5 * 1024 * 1024
+	MAX_RECORD_BYTES  = 1024 * 1024
+
+	DEFAULT_FLUSH_INTERVAL = 100 * time.Millisecond
+	DEFAULT_MAX_BUFFERED   = 10000
+	DEFAULT_CLOSE_TIMEOUT  = 10 * time.Second
+)
+
+var (
+	// ErrProducerFull is returned by SendToQueue when the buffer is full,
+	// which happens when Kinesis has been rejecting records for a while
+	ErrProducerFull   = errors.New("producer buffer is full")
+	ErrProducerClosed = errors.New("producer is closed")
+	ErrRecordTooLarge = errors.New("record is larger than Kinesis allows")
+)
+
+// putRecordsAPI is the part of the Kinesis client the producer uses
+type putRecordsAPI interface {
+	PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
+}
+
+// BatchProducer sends records to Kinesis in the background. Records are
+// buffered and sent with PutRecords every flush interval, or as soon as
+// there are enough to fill a request.
+//
+// SendToQueue returns as soon as the record is buffered. Records Kinesis
+// rejects are kept and sent again, backing off while Kinesis keeps
+// rejecting them, so they are only lost if the process stops without being
+// closed, or if Kinesis rejects them permanently. SendToQueue fails when the
+// buffer is full, so the producer can be wrapped in a spool to hold records
+// on disk through longer outages.
+//
+// Records sent with SendAsync aren't kept by the producer. Whether each was
+// sent is reported to the caller, which sends it again if it must.
+type BatchProducer struct {
+	Encoding      string
+	FlushInterval time.Duration
+	MaxBuffered   int
+	// Aggregate packs records with the same partition key into one Kinesis
+	// record, to cut the number of records paid for
+	Aggregate    bool
+	CloseTimeout time.Duration
+
+	kinesis    putRecordsAPI
+	streamName string
+
+	mutex   sync.Mutex
+	pending []queuedRecord
+	closed  bool
+	wake    chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+	// lastErr is the error of the last flush that didn't send everything
+	lastErr error
+}
+
+// queuedRecord is a buffered record and, for records sent with SendAsync,
+// where to report whether it was sent
+type queuedRecord struct {
+	Record
+	result chan error
+}
+
+// InitConn connects to the stream and starts sending records in the
+// background
+func (bp *BatchProducer) InitConn(streamName string) error {
+	if bp.kinesis == nil {
+		bp.kinesis = newKinesis()
+	}
+	bp.streamName = streamName
+	if bp.FlushInterval <= 0 {
+		bp.FlushInterval = DEFAULT_FLUSH_INTERVAL
+	}
+	if bp.MaxBuffered <= 0 {
+		bp.MaxBuffered = DEFAULT_MAX_BUFFERED
+	}
+	if bp.CloseTimeout <= 0 {
+		bp.CloseTimeout = DEFAULT_CLOSE_TIMEOUT
+	}
+	bp.wake = make(chan struct{}, 1)
+	bp.closing = make(chan struct{})
+	bp.done = make(chan struct{})
+
+	go bp.run()
+	return nil
+}
+
+// SendToQueue adds the record to the buffer to be sent
+func (bp *BatchProducer) SendToQueue(data interface{}, shardId string) error {
+	return bp.add(data, shardId, nil)
+}
+
+// SendAsync adds the record to the buffer to be sent, returning where the
+// result of sending it is reported
+func (bp *BatchProducer) SendAsync(data interface{}, shardId string) <-chan error {
+	result := make(chan error, 1)
+	err := bp.add(data, shardId, result)
+	if err != nil {
+		result <- err
+	}
+	return result
+}
+
+// add buffers the record, waking the flush once a request can be filled
+func (bp *BatchProducer) add(data interface{}, shardId string, result chan error) error {
+	encoded, err := Encode(data, bp.Encoding)
+	if err != nil {
+		return err
+	}
+	if len(encoded)+len(shardId) > MAX_RECORD_BYTES {
+		return ErrRecordTooLarge
+	}
+
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	if bp.closed {
+		return ErrProducerClosed
+	}
+	if len(bp.pending) >= bp.MaxBuffered {
+		return ErrProducerFull
+	}
+	bp.pending = append(bp.pending, queuedRecord{
+		Record: Record{PartitionKey: shardId, Data: encoded},
+		result: result,
+	})
+
+	if len(bp.pending) >= MAX_BATCH_RECORDS {
+		select {
+		case bp.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Buffered returns the number of records waiting to be sent
+func (bp *BatchProducer) Buffered() int {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	return len(bp.pending)
+}
+
+// Close stops accepting records and sends those buffered, giving up after
+// the close timeout
+func (bp *BatchProducer) Close() error {
+	bp.mutex.Lock()
+	if bp.closed {
+		bp.mutex.Unlock()
+		return nil
+	}
+	bp.closed = true
+	bp.mutex.Unlock()
+
+	close(bp.closing)
+	<-bp.done
+
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	if len(bp.pending) > 0 {
+		return fmt.Errorf("%d records not sent to Kinesis before closing: %v", len(bp.pending), bp.lastErr)
+	}
+	return nil
+}
+
+// run flushes the buffer until the producer is closed, then flushes what is
+// left
+func (bp *BatchProducer) run() {
+	defer close(bp.done)
+
+	ticker := time.NewTicker(bp.FlushInterval)
+	defer ticker.Stop()
+	backoff := time.Duration(0)
+	var retryAt time.Time
+
+	for {
+		select {
+		case <-bp.closing:
+			bp.drain()
+			return
+		case <-ticker.C:
+		case <-bp.wake:
+		}
+		if time.Now().Before(retryAt) {
+			continue
+		}
+
+		if bp.flush() {
+			backoff = 0
+			continue
+		}
+		// Wait before sending rejected records again
+		backoff *= 2
+		if backoff < minReplayBackoff {
+			backoff = minReplayBackoff
+		}
+		if backoff > maxReplayBackoff {
+			backoff = maxReplayBackoff
+		}
+		retryAt = time.Now().Add(backoff)
+	}
+}
+
+// drain flushes until the buffer is empty or the close timeout passes
+func (bp *BatchProducer) drain() {
+	deadline := time.Now().Add(bp.CloseTimeout)
+	backoff := minReplayBackoff
+	for bp.Buffered() > 0 && time.Now().Before(deadline) {
+		if !bp.flush() {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// flush sends the buffered records. Records sent with SendAsync are told
+// whether they were sent, and the others Kinesis rejects are put back at
+// the front of the buffer, unless they can never be sent. It returns
+// whether everything was sent.
+func (bp *BatchProducer) flush() bool {
+	bp.mutex.Lock()
+	pending := bp.pending
+	bp.pending = nil
+	bp.mutex.Unlock()
+
+	var failed []queuedRecord
+	var lastErr error
+	for _, batch := range bp.batches(pending) {
+		for i, err := range bp.send(batch) {
+			if err != nil {
+				lastErr = err
+			}
+			for _, record := range batch[i].records {
+				switch {
+				case record.result != nil:
+					record.result <- err
+				case err != nil && IsPermanent(err):
+					log.Println("Dropping record Kinesis can never take:", err)
+				case err != nil:
+					failed = append(failed, record)
+				}
+			}
+		}
+	}
+	if lastErr == nil {
+		return true
+	}
+
+	log.Println("Error sending records to Kinesis:", lastErr)
+	bp.mutex.Lock()
+	bp.pending = append(failed, bp.pending...)
+	bp.lastErr = lastErr
+	bp.mutex.Unlock()
+	return false
+}
+
+// send puts a batch, returning the error of each entry Kinesis rejected
+func (bp *BatchProducer) send(batch []batchEntry) []error {
+	errs := make([]error, len(batch))
+	rejected, err := bp.put(batch)
+	if err != nil && IsPermanent(err) && len(batch) > 1 {
+		// One bad record fails the whole request, so send them one at a
+		// time to find it
+		for i := range batch {
+			errs[i] = bp.send(batch[i : i+1])[0]
+		}
+		return errs
+	}
+	for i := range batch {
+		if rejected[i] {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// batchEntry is a Kinesis record and the records it was made from
+type batchEntry struct {
+	record  Record
+	records []queuedRecord
+}
+
+// batches groups the records into Kinesis records, aggregating them if
+// configured, and the Kinesis records into requests within the limits of
+// PutRecords
+func (bp *BatchProducer) batches(records []queuedRecord) [][]batchEntry {
+	var entries []batchEntry
+	if bp.Aggregate {
+		// Records are aggregated with the others of their partition key,
+		// in order, so each key's records stay in order
+		aggregated := make(map[string]int)
+		var aggregators []*aggregator
+		for _, record := range records {
+			i, ok := aggregated[record.PartitionKey]
+			if !ok || !aggregators[i].add(record.Record) {
+				a := newAggregator(record.PartitionKey)
+				a.add(record.Record)
+				i = len(aggregators)
+				aggregated[record.PartitionKey] = i
+				aggregators = append(aggregators, a)
+				entries = append(entries, batchEntry{})
+			}
+			entries[i].records = append(entries[i].records, record)
+		}
+		for i, a := range aggregators {
+			entries[i].record = a.record()
+		}
+	} else {
+		for _, record := range records {
+			entries = append(entries, batchEntry{record: record.Record, records: []queuedRecord{record}})
+		}
+	}
+
+	var batches [][]batchEntry
+	var batch []batchEntry
+	size := 0
+	for _, entry := range entries {
+		entrySize := len(entry.record.Data) + len(entry.record.PartitionKey)
+		if len(batch) == MAX_BATCH_RECORDS || (len(batch) > 0 && size+entrySize > MAX_BATCH_BYTES) {
+			batches = append(batches, batch)
+			batch = nil
+			size = 0
+		}
+		batch = append(batch, entry)
+		size += entrySize
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// put sends a batch with PutRecords, returning which entries Kinesis
+// rejected
+func (bp *BatchProducer) put(batch []batchEntry) ([]bool, error) {
+	input := &kinesis.PutRecordsInput{
+		StreamName: aws.String(bp.streamName),
+		Records:    make([]*kinesis.PutRecordsRequestEntry, len(batch)),
+	}
+	for i, entry := range batch {
+		input.Records[i] = &kinesis.PutRecordsRequestEntry{
+			Data:         entry.record.Data,
+			PartitionKey: aws.String(entry.record.PartitionKey),
+		}
+	}
+
+	rejected := make([]bool, len(batch))
+	output, err := bp.kinesis.PutRecords(input)
+	if err != nil {
+		for i := range rejected {
+			rejected[i] = true
+		}
+		return rejected, err
+	}
+	if aws.Int64Value(output.FailedRecordCount) == 0 {
+		return rejected, nil
+	}
+
+	// Records fail one by one, most often by being throttled
+	failed := 0
+	message := ""
+	for i, result := range output.Records {
+		if result.ErrorCode != nil && i < len(batch) {
+			rejected[i] = true
+			failed++
+			message = aws.StringValue(result.ErrorMessage)
+		}
+	}
+	return rejected, fmt.Errorf("Kinesis rejected %d records: %s", failed, message)
+}
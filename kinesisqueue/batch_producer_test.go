@@ -0,0 +1,334 @@
+package kinesisqueue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// dummy_kinesis records the records put, rejecting some as configured
+type dummy_kinesis struct {
+	mutex    sync.Mutex
+	requests int
+	records  []*kinesis.PutRecordsRequestEntry
+	// reject is how many of the next records to throttle
+	reject int
+	fail   error
+	// invalid is the data of a record which fails every request it is in
+	invalid string
+}
+
+func (dk *dummy_kinesis) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	dk.mutex.Lock()
+	defer dk.mutex.Unlock()
+	dk.requests++
+	if dk.fail != nil {
+		return nil, dk.fail
+	}
+	for _, record := range input.Records {
+		if dk.invalid != "" && string(record.Data) == dk.invalid {
+			return nil, awserr.New(kinesis.ErrCodeInvalidArgumentException, "Invalid record", nil)
+		}
+	}
+
+	output := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for _, record := range input.Records {
+		result := &kinesis.PutRecordsResultEntry{}
+		if dk.reject > 0 {
+			dk.reject--
+			result.ErrorCode = aws.String(kinesis.ErrCodeProvisionedThroughputExceededException)
+			result.ErrorMessage = aws.String("Rate exceeded")
+			*output.FailedRecordCount++
+		} else {
+			dk.records = append(dk.records, record)
+		}
+		output.Records = append(output.Records, result)
+	}
+	return output, nil
+}
+
+func (dk *dummy_kinesis) sent() []string {
+	dk.mutex.Lock()
+	defer dk.mutex.Unlock()
+	var sent []string
+	for _, record := range dk.records {
+		records, ok, _ := Deaggregate(record.Data)
+		if !ok {
+			records = []Record{{PartitionKey: aws.StringValue(record.PartitionKey), Data: record.Data}}
+		}
+		for _, r := range records {
+			sent = append(sent, r.PartitionKey+":"+string(r.Data))
+		}
+	}
+	return sent
+}
+
+func newTestProducer(dk *dummy_kinesis, aggregate bool) *BatchProducer {
+	bp := &BatchProducer{
+		FlushInterval: time.Hour,
+		MaxBuffered:   1000,
+		Aggregate:     aggregate,
+		kinesis:       dk,
+	}
+	_ = bp.InitConn("test-stream")
+	return bp
+}
+
+// waitForBuffered waits until the producer holds the number of records
+func waitForBuffered(t *testing.T, bp *BatchProducer, buffered int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for bp.Buffered() != buffered {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d buffered records. Got %d", buffered, bp.Buffered())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBatchProducerBuffers(t *testing.T) {
+	dk := &dummy_kinesis{}
+	bp := newTestProducer(dk, false)
+	defer bp.Close()
+
+	// Records are acknowledged once buffered, and sent together
+	for i := 0; i < 3; i++ {
+		if err := bp.SendToQueue(i, "shard"); err != nil {
+			t.Fatalf("Expected the record to be buffered. Got %s", err)
+		}
+	}
+	if dk.requests != 0 || bp.Buffered() != 3 {
+		t.Fatalf("Expected the records to wait for the flush. Got %d requests", dk.requests)
+	}
+
+	if !bp.flush() {
+		t.Error("Expected the flush to send every record")
+	}
+	if len(dk.sent()) != 3 || dk.requests != 1 {
+		t.Errorf("Expected one request with every record. Got %d with %v", dk.requests, dk.sent())
+	}
+}
+
+func TestBatchProducerRetriesRejectedRecords(t *testing.T) {
+	dk := &dummy_kinesis{reject: 2}
+	bp := newTestProducer(dk, false)
+	defer bp.Close()
+
+	for i := 0; i < 4; i++ {
+		_ = bp.SendToQueue(i, "shard")
+	}
+	if bp.flush() {
+		t.Error("Expected the flush to report rejected records")
+	}
+	if bp.Buffered() != 2 {
+		t.Errorf("Expected the rejected records to be kept. Got %d", bp.Buffered())
+	}
+	if !bp.flush() {
+		t.Error("Expected the rejected records to be sent again")
+	}
+	if sent := fmt.Sprint(dk.sent()); sent != "[shard:2 shard:3 shard:0 shard:1]" {
+		t.Errorf("Expected every record to be sent. Got %s", sent)
+	}
+}
+
+func TestBatchProducerDropsInvalidRecords(t *testing.T) {
+	dk := &dummy_kinesis{invalid: "1"}
+	bp := newTestProducer(dk, false)
+	defer bp.Close()
+
+	for i := 0; i < 3; i++ {
+		_ = bp.SendToQueue(i, "shard")
+	}
+	result := bp.SendAsync(1, "shard")
+	bp.flush()
+
+	// The invalid records are found and dropped, and the rest sent
+	if err := <-result; !IsPermanent(err) {
+		t.Errorf("Expected the invalid record to be rejected permanently. Got %v", err)
+	}
+	if bp.Buffered() != 0 {
+		t.Errorf("Expected the invalid record not to be retried. Got %d buffered", bp.Buffered())
+	}
+	if sent := fmt.Sprint(dk.sent()); sent != "[shard:0 shard:2]" {
+		t.Errorf("Expected the valid records to be sent. Got %s", sent)
+	}
+}
+
+func TestBatchProducerFlushesOnClose(t *testing.T) {
+	dk := &dummy_kinesis{}
+	bp := newTestProducer(dk, false)
+
+	var results []<-chan error
+	for i := 0; i < 3; i++ {
+		results = append(results, bp.SendAsync(i, "shard"))
+	}
+	if dk.requests != 0 {
+		t.Error("Expected records to wait for the flush interval")
+	}
+
+	if err := bp.Close(); err != nil {
+		t.Errorf("Unable to close: %s", err)
+	}
+	for _, result := range results {
+		if err := <-result; err != nil {
+			t.Errorf("Expected every record to be sent. Got %s", err)
+		}
+	}
+	if sent := fmt.Sprint(dk.sent()); sent != "[shard:0 shard:1 shard:2]" || dk.requests != 1 {
+		t.Errorf("Expected one request with every record. Got %d with %s", dk.requests, sent)
+	}
+	if err := bp.SendToQueue(3, "shard"); err != ErrProducerClosed {
+		t.Errorf("Expected the producer to be closed. Got %v", err)
+	}
+}
+
+func TestBatchProducerFlushesFullBatches(t *testing.T) {
+	dk := &dummy_kinesis{}
+	bp := newTestProducer(dk, false)
+	defer bp.Close()
+
+	var results []<-chan error
+	for i := 0; i < MAX_BATCH_RECORDS; i++ {
+		results = append(results, bp.SendAsync(i, "shard"))
+	}
+	for _, result := range results {
+		if err := <-result; err != nil {
+			t.Fatalf("Expected a full batch to be sent without waiting. Got %s", err)
+		}
+	}
+	if len(dk.sent()) != MAX_BATCH_RECORDS {
+		t.Errorf("Expected a full batch to be sent. Got %d", len(dk.sent()))
+	}
+}
+
+func TestBatchProducerReportsRejectedRecords(t *testing.T) {
+	dk := &dummy_kinesis{reject: 2}
+	bp := newTestProducer(dk, false)
+	defer bp.Close()
+
+	var results []<-chan error
+	for i := 0; i < 4; i++ {
+		results = append(results, bp.SendAsync(i, "shard"))
+	}
+	if bp.flush() {
+		t.Error("Expected the flush to report rejected records")
+	}
+	for i, result := range results {
+		err := <-result
+		if i < 2 && err == nil {
+			t.Errorf("Expected record %d to be rejected", i)
+		}
+		if i >= 2 && err != nil {
+			t.Errorf("Expected record %d to be sent. Got %s", i, err)
+		}
+	}
+	// Rejected records are left to the caller rather than held in memory
+	if bp.Buffered() != 0 {
+		t.Errorf("Expected no records to be kept. Got %d", bp.Buffered())
+	}
+	if sent := fmt.Sprint(dk.sent()); sent != "[shard:2 shard:3]" {
+		t.Errorf("Expected the accepted records to be sent. Got %s", sent)
+	}
+}
+
+func TestBatchProducerFull(t *testing.T) {
+	dk := &dummy_kinesis{}
+	bp := newTestProducer(dk, false)
+	defer bp.Close()
+	bp.MaxBuffered = 2
+
+	for i := 0; i < 2; i++ {
+		bp.SendAsync(i, "shard")
+	}
+	if err := bp.SendToQueue(2, "shard"); err != ErrProducerFull {
+		t.Errorf("Expected the buffer to be full. Got %v", err)
+	}
+}
+
+func TestBatchProducerAggregates(t *testing.T) {
+	dk := &dummy_kinesis{}
+	bp := newTestProducer(dk, true)
+
+	keys := []string{"1", "2", "1", "1", "2", "3"}
+	var results []<-chan error
+	for i, key := range keys {
+		results = append(results, bp.SendAsync(i, key))
+	}
+	if err := bp.Close(); err != nil {
+		t.Fatalf("Unable to close: %s", err)
+	}
+	for _, result := range results {
+		if err := <-result; err != nil {
+			t.Errorf("Expected every record to be sent. Got %s", err)
+		}
+	}
+
+	// One Kinesis record for each partition key, in the order of each key
+	if len(dk.records) != 3 {
+		t.Errorf("Expected 3 Kinesis records. Got %d", len(dk.records))
+	}
+	if sent := fmt.Sprint(dk.sent()); sent != "[1:0 1:2 1:3 2:1 2:4 3:5]" {
+		t.Errorf("Expected every record to be aggregated. Got %s", sent)
+	}
+	if string(dk.records[2].Data) != "5" {
+		t.Errorf("Expected a lone record not to be aggregated. Got %x", dk.records[2].Data)
+	}
+}
+
+func TestSpoolHoldsRecordsKinesisRejects(t *testing.T) {
+	dir := newSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	dk := &dummy_kinesis{fail: errors.New("stream unavailable")}
+	bp := &BatchProducer{FlushInterval: time.Millisecond, MaxBuffered: 2, kinesis: dk}
+	sq := NewSpooledQueue(bp, dir, 1024*1024)
+	if err := sq.InitConn("test-stream"); err != nil {
+		t.Fatal(err)
+	}
+	defer sq.Close()
+
+	// Once the buffer fills, records are on disk before they are
+	// acknowledged
+	for i := 0; i < 4; i++ {
+		if err := sq.SendToQueue(i, "shard"); err != nil {
+			t.Fatalf("Expected the record to be held. Got %s", err)
+		}
+	}
+	if sq.Stats().Depth != 2 {
+		t.Fatalf("Expected the records the buffer couldn't hold to be spooled. Got %+v", sq.Stats())
+	}
+
+	dk.mutex.Lock()
+	dk.fail = nil
+	dk.mutex.Unlock()
+	waitForDepth(t, sq, 0)
+
+	if sent := fmt.Sprint(dk.sent()); sent != "[shard:0 shard:1 shard:2 shard:3]" {
+		t.Errorf("Expected the records to be sent in order. Got %s", sent)
+	}
+}
+
+func TestConsumedRecordsOfAggregate(t *testing.T) {
+	a := newAggregator("1")
+	a.add(Record{PartitionKey: "1", Data: []byte(`"a"`)})
+	a.add(Record{PartitionKey: "1", Data: []byte(`"b"`)})
+
+	records := consumedRecords("shard-0", &kinesis.Record{
+		Data:           a.record().Data,
+		PartitionKey:   aws.String("1"),
+		SequenceNumber: aws.String("42"),
+	})
+	if len(records) != 2 || string(records[0].Data) != `"a"` || string(records[1].Data) != `"b"` {
+		t.Fatalf("Expected the records of the aggregate. Got %+v", records)
+	}
+	// Only checkpointed once both have been processed
+	if records[0].Sequence != "" || records[1].Sequence != "42" {
+		t.Errorf("Expected only the last record to have the sequence number. Got %+v", records)
+	}
+}
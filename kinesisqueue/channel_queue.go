@@ -0,0 +1,107 @@
+package kinesisqueue
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	channelReadLimit    = 500
+	channelPollInterval = 500 * time.Millisecond
+)
+
+// ErrChannelFull is returned when a channel queue has no room for a record
+var ErrChannelFull = errors.New("channel queue is full")
+
+var (
+	channelsMutex sync.Mutex
+	channels      = make(map[string]chan Record)
+)
+
+// ChannelQueueClient delivers records in-process over a buffered channel
+// in place of a Kinesis stream. Records sent to a stream are read from the
+// channel returned by Channel, or by a ChannelStreamReader, in the same
+// process. The channel is created with the Size of whichever end connects
+// first, so both should be given the same size.
+type ChannelQueueClient struct {
+	Size int
+
+	records chan Record
+}
+
+// InitConn connects to the channel for the stream
+func (cq *ChannelQueueClient) InitConn(streamName string) error {
+	cq.records = channel(streamName, cq.Size)
+	return nil
+}
+
+// SendToQueue adds the record to the channel without waiting for a reader
+func (cq *ChannelQueueClient) SendToQueue(data interface{}, shardId string) error {
+	encoded, err := Encode(data, JSON_ENCODING)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case cq.records <- Record{PartitionKey: shardId, Data: encoded}:
+		return nil
+	default:
+		return ErrChannelFull
+	}
+}
+
+// Channel returns the channel records sent to the stream are delivered on,
+// holding RTFA_QUEUE_CHANNEL_SIZE records if it doesn't exist yet
+func Channel(streamName string) <-chan Record {
+	return channel(streamName, channelSize())
+}
+
+// channel returns the channel for the stream, creating it with the given
+// buffer size if it doesn't exist yet
+func channel(streamName string, size int) chan Record {
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+
+	records, ok := channels[streamName]
+	if !ok {
+		records = make(chan Record, size)
+		channels[streamName] = records
+	}
+	return records
+}
+
+// ChannelStreamReader reads the records sent to a channel queue in the same
+// process. Records can't be read again, so it doesn't checkpoint.
+type ChannelStreamReader struct {
+	Size int
+
+	records <-chan Record
+}
+
+// InitConn connects to the channel for the stream
+func (cr *ChannelStreamReader) InitConn(streamName string, checkpoint Checkpoint) error {
+	cr.records = channel(streamName, cr.Size)
+	return nil
+}
+
+// ReadRecords waits briefly for a record, then takes any others waiting
+func (cr *ChannelStreamReader) ReadRecords() ([]ConsumedRecord, error) {
+	var records []ConsumedRecord
+	select {
+	case record := <-cr.records:
+		records = append(records, ConsumedRecord{Record: record})
+	case <-time.After(channelPollInterval):
+		return nil, nil
+	}
+
+	for len(records) < channelReadLimit {
+		select {
+		case record := <-cr.records:
+			records = append(records, ConsumedRecord{Record: record})
+		default:
+			return records, nil
+		}
+	}
+	return records, nil
+}
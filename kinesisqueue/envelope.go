@@ -0,0 +1,100 @@
+package kinesisqueue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/protowire"
+)
+
+const (
+	JSON_ENCODING     = "json"
+	PROTOBUF_ENCODING = "protobuf"
+
+	// ENVELOPE_VERSION is the version of the envelope written. Consumers
+	// should skip envelopes of versions newer than they understand.
+	ENVELOPE_VERSION = 1
+)
+
+// Message is data which can be sent as Protocol Buffers
+type Message interface {
+	// MessageType names the schema of the message, telling consumers how
+	// to decode it
+	MessageType() string
+	MarshalBinary() ([]byte, error)
+}
+
+// Envelope wraps a message sent as Protocol Buffers, so consumers can tell
+// it from JSON and decode it. It is itself a message, described by
+// envelope.proto. As no JSON record starts with the byte an envelope
+// starts with, records of both formats can be read from the same stream.
+type Envelope struct {
+	Version int
+	Type    string
+	Payload []byte
+}
+
+// Encoded is data already encoded for a stream, such as a record read back
+// from a spool, which is sent as it is
+type Encoded []byte
+
+// Encode returns the data in the encoding. Data which isn't a Message is
+// encoded as JSON whatever the encoding, and Encoded data isn't changed.
+func Encode(data interface{}, encoding string) ([]byte, error) {
+	if encoded, ok := data.(Encoded); ok {
+		return encoded, nil
+	}
+	message, ok := data.(Message)
+	if encoding != PROTOBUF_ENCODING || !ok {
+		return json.Marshal(data)
+	}
+
+	payload, err := message.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	envelope := Envelope{
+		Version: ENVELOPE_VERSION,
+		Type:    message.MessageType(),
+		Payload: payload,
+	}
+	return envelope.MarshalBinary()
+}
+
+func (e Envelope) MarshalBinary() ([]byte, error) {
+	var b []byte
+	b = protowire.AppendVarintField(b, 1, uint64(e.Version))
+	b = protowire.AppendBytesField(b, 2, []byte(e.Type))
+	b = protowire.AppendBytesField(b, 3, e.Payload)
+	return b, nil
+}
+
+// ParseEnvelope reads the envelope a record is wrapped in. It returns false
+// if the record is JSON, which isn't wrapped.
+func ParseEnvelope(data []byte) (Envelope, bool, error) {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return Envelope{}, false, nil
+	}
+
+	var envelope Envelope
+	err := protowire.Parse(data, func(field protowire.Field) error {
+		switch {
+		case field.Number == 1 && field.Type == protowire.VARINT:
+			envelope.Version = int(field.Varint)
+		case field.Number == 2 && field.Type == protowire.BYTES:
+			envelope.Type = string(field.Bytes)
+		case field.Number == 3 && field.Type == protowire.BYTES:
+			envelope.Payload = field.Bytes
+		}
+		return nil
+	})
+	if err != nil {
+		return Envelope{}, true, err
+	}
+	if envelope.Version == 0 {
+		return Envelope{}, true, fmt.Errorf("record is neither JSON nor an envelope")
+	}
+	return envelope, true, nil
+}
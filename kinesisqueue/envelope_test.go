@@ -0,0 +1,60 @@
+package kinesisqueue
+
+import (
+	"testing"
+)
+
+type test_message struct {
+	Name string `json:"name"`
+}
+
+func (tm test_message) MessageType() string {
+	return "test_message"
+}
+
+func (tm test_message) MarshalBinary() ([]byte, error) {
+	return []byte(tm.Name), nil
+}
+
+func TestEncodeJSON(t *testing.T) {
+	for _, encoding := range []string{JSON_ENCODING, ""} {
+		data, err := Encode(test_message{Name: "test"}, encoding)
+		if err != nil || string(data) != `{"name":"test"}` {
+			t.Errorf("Expected JSON for encoding %q. Got %s, %v", encoding, data, err)
+		}
+		_, ok, err := ParseEnvelope(data)
+		if ok || err != nil {
+			t.Errorf("Expected JSON not to be in an envelope. Got %t, %v", ok, err)
+		}
+	}
+
+	// Data which isn't a message can only be sent as JSON
+	data, err := Encode(map[string]int{"a": 1}, PROTOBUF_ENCODING)
+	if err != nil || string(data) != `{"a":1}` {
+		t.Errorf("Expected JSON. Got %s, %v", data, err)
+	}
+}
+
+func TestEncodeProtobuf(t *testing.T) {
+	data, err := Encode(test_message{Name: "test"}, PROTOBUF_ENCODING)
+	if err != nil {
+		t.Fatalf("Unable to encode: %s", err)
+	}
+
+	envelope, ok, err := ParseEnvelope(data)
+	if !ok || err != nil {
+		t.Fatalf("Expected an envelope. Got %t, %v", ok, err)
+	}
+	if envelope.Version != ENVELOPE_VERSION || envelope.Type != "test_message" || string(envelope.Payload) != "test" {
+		t.Errorf("Unexpected envelope %+v", envelope)
+	}
+}
+
+func TestParseInvalidEnvelope(t *testing.T) {
+	for _, data := range [][]byte{{0x12, 0x05}, {0x12, 0x01, 'a'}} {
+		_, ok, err := ParseEnvelope(data)
+		if !ok || err == nil {
+			t.Errorf("Expected %x to be an invalid envelope. Got %t, %v", data, ok, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package kinesisqueue
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	fileReadLimit    = 500
+	filePollInterval = 500 * time.Millisecond
+)
+
+// FileQueueClient appends records to a local log file, one JSON record per
+// line, in place of a Kinesis stream. The log for a stream is named after
+// the stream in the client's directory.
+type FileQueueClient struct {
+	Dir string
+
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// InitConn opens the log file for the stream, creating it if needed
+func (fq *FileQueueClient) InitConn(streamName string) error {
+	err := os.MkdirAll(fq.Dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	fq.file, err = os.OpenFile(FileQueuePath(fq.Dir, streamName),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	return err
+}
+
+// SendToQueue appends the record to the end of the log
+func (fq *FileQueueClient) SendToQueue(data interface{}, shardId string) error {
+	encoded, err := Encode(data, JSON_ENCODING)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(Record{PartitionKey: shardId, Data: encoded})
+	if err != nil {
+		return err
+	}
+
+	fq.mutex.Lock()
+	defer fq.mutex.Unlock()
+
+	_, err = fq.file.Write(append(line, '\n'))
+	return err
+}
+
+// FileQueuePath returns the log file used for the stream in the directory
+func FileQueuePath(dir string, streamName string) string {
+	return filepath.Join(dir, streamName+".log")
+}
+
+// FileStreamReader reads back the log written by FileQueueClient. The log
+// is a single shard whose sequence is the byte offset after each record.
+type FileStreamReader struct {
+	Dir string
+
+	file   *os.File
+	reader *bufio.Reader
+	offset int64
+}
+
+// InitConn opens the log for the stream after its checkpoint
+func (fr *FileStreamReader) InitConn(streamName string, checkpoint Checkpoint) error {
+	err := os.MkdirAll(fr.Dir, 0700)
+	if err != nil {
+		return err
+	}
+	fr.file, err = os.OpenFile(FileQueuePath(fr.Dir, streamName), os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	if sequence := checkpoint(FILE_BACKEND); sequence != "" {
+		fr.offset, err = strconv.ParseInt(sequence, 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fr.file.Seek(fr.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	fr.reader = bufio.NewReader(fr.file)
+	return nil
+}
+
+// ReadRecords reads the records appended since the last read
+func (fr *FileStreamReader) ReadRecords() ([]ConsumedRecord, error) {
+	var records []ConsumedRecord
+	for len(records) < fileReadLimit {
+		line, err := fr.reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Leave a record that is still being written for the next read
+			if len(line) > 0 {
+				_, err = fr.file.Seek(fr.offset, io.SeekStart)
+				fr.reader.Reset(fr.file)
+				if err != nil {
+					return records, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return records, err
+		}
+		fr.offset += int64(len(line))
+
+		var record Record
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			log.Println("Skipping unreadable record in queue log:", err)
+			continue
+		}
+		records = append(records, ConsumedRecord{
+			Record:   record,
+			Shard:    FILE_BACKEND,
+			Sequence: strconv.FormatInt(fr.offset, 10),
+		})
+	}
+
+	// Don't spin on a log with nothing new in it
+	if len(records) == 0 {
+		time.Sleep(filePollInterval)
+	}
+	return records, nil
+}
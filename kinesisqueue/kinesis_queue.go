@@ -5,46 +5,91 @@ import (
 	"log"
 	"os"
 
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 )
 
+const DEFAULT_KINESIS_REGION = "eu-central-1"
+
+// Record is a record as it is written to a file log or spool, or delivered
+// by a channel queue
+type Record struct {
+	PartitionKey string          `json:"partitionKey"`
+	Data         json.RawMessage `json:"data"`
+}
+
 type KinesisQueueInterface interface {
 	InitConn(streamName string) error
 	SendToQueue(data interface{}, shardId string) error
 }
 
+// IsPermanent returns whether a record was rejected because of the record
+// itself, so sending it again can never work
+func IsPermanent(err error) bool {
+	if err == ErrRecordTooLarge {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case kinesis.ErrCodeInvalidArgumentException, "ValidationException", "SerializationException":
+			return true
+		}
+	}
+	return false
+}
+
 type KinesisQueueClient struct {
 	kinesis    *kinesis.Kinesis
 	streamName string
+	// Encoding is how records are written, JSON_ENCODING (the default) or
+	// PROTOBUF_ENCODING
+	Encoding string
 }
 
 // InitConn opens the connection to the location event kinesis queue
 func (kq *KinesisQueueClient) InitConn(streamName string) error {
-	// Define the stream name and the AWS region it's in
-	region := "eu-central-1"
+	// Create a new kinesis adapter (assume stream exists
+	kq.kinesis = newKinesis()
+	kq.streamName = streamName
+
+	return nil
+}
+
+// newKinesis creates a Kinesis adapter for the configured region, pointing
+// at a local Kinesis emulator if one is configured
+func newKinesis() *kinesis.Kinesis {
+	// Define the AWS region the streams are in
+	config := aws.Config{
+		Region: aws.String(utils.GetEnv("RTFA_KINESIS_REGION", DEFAULT_KINESIS_REGION)),
+	}
+	if endpoint := os.Getenv("RTFA_KINESIS_ENDPOINT"); endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
 	// Create a new AWS session in the required region
-	s, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	s, err := session.NewSession(&config)
 	if err != nil {
 		log.Println(err.Error())
 		os.Exit(1)
 	}
 
-	// Create a new kinesis adapter (assume stream exists
-	kq.kinesis = kinesis.New(s)
-	kq.streamName = streamName
-
-	return nil
+	return kinesis.New(s)
 }
 
 // Pre: the event object is valid
 func (kq *KinesisQueueClient) SendToQueue(data interface{}, shardId string) error {
-	// Encode a record into JSON bytes
-	byteEncodedData, _ := json.Marshal(data)
+	// Encode a record into bytes
+	byteEncodedData, err := Encode(data, kq.Encoding)
+	if err != nil {
+		log.Println("Error encoding item for Kinesis:", err)
+		return err
+	}
 
 	// Send the record to Kinesis
-	_, err := kq.kinesis.PutRecord(&kinesis.PutRecordInput{
+	_, err = kq.kinesis.PutRecord(&kinesis.PutRecordInput{
 		Data:         byteEncodedData,
 		StreamName:   aws.String(kq.streamName),
 		PartitionKey: aws.String(shardId),
@@ -0,0 +1,171 @@
+package kinesisqueue
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	kinesisReadLimit = 500
+	// Kinesis allows five reads a second on each shard
+	kinesisReadInterval = 200 * time.Millisecond
+)
+
+// KinesisStreamReader reads every shard of a Kinesis stream. Shards made by
+// splitting or merging are read once their parents have been read.
+type KinesisStreamReader struct {
+	kinesis    *kinesis.Kinesis
+	streamName string
+	checkpoint Checkpoint
+	iterators  map[string]*string
+	seen       map[string]bool
+	lastRead   time.Time
+}
+
+// InitConn connects to the stream and starts each shard after its checkpoint
+func (kr *KinesisStreamReader) InitConn(streamName string, checkpoint Checkpoint) error {
+	kr.kinesis = newKinesis()
+	kr.streamName = streamName
+	kr.checkpoint = checkpoint
+	kr.iterators = make(map[string]*string)
+	kr.seen = make(map[string]bool)
+
+	return kr.addShards()
+}
+
+// ReadRecords reads the next records from every open shard
+func (kr *KinesisStreamReader) ReadRecords() ([]ConsumedRecord, error) {
+	// Stay under the read limit of each shard
+	wait := kinesisReadInterval - time.Since(kr.lastRead)
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	kr.lastRead = time.Now()
+
+	var records []ConsumedRecord
+	closed := false
+	for shard, iterator := range kr.iterators {
+		output, err := kr.kinesis.GetRecords(&kinesis.GetRecordsInput{
+			ShardIterator: iterator,
+			Limit:         aws.Int64(kinesisReadLimit),
+		})
+		if err != nil {
+			return records, err
+		}
+
+		for _, record := range output.Records {
+			records = append(records, consumedRecords(shard, record)...)
+		}
+
+		// A shard with no next iterator has been split or merged
+		if output.NextShardIterator == nil {
+			delete(kr.iterators, shard)
+			closed = true
+		} else {
+			kr.iterators[shard] = output.NextShardIterator
+		}
+	}
+
+	if closed {
+		return records, kr.addShards()
+	}
+	return records, nil
+}
+
+// consumedRecords returns the records held in a Kinesis record, taking
+// apart aggregated records. Only the last record taken from an aggregated
+// record has its sequence number, so that it is only checkpointed once
+// every record in it has been processed.
+func consumedRecords(shard string, record *kinesis.Record) []ConsumedRecord {
+	sequence := aws.StringValue(record.SequenceNumber)
+	aggregated, ok, err := Deaggregate(record.Data)
+	if err != nil {
+		log.Println("Error taking apart aggregated record "+sequence+":", err)
+		ok = false
+	}
+	if !ok {
+		aggregated = []Record{{PartitionKey: aws.StringValue(record.PartitionKey), Data: record.Data}}
+	}
+
+	if len(aggregated) == 0 {
+		return nil
+	}
+
+	records := make([]ConsumedRecord, len(aggregated))
+	for i, r := range aggregated {
+		records[i] = ConsumedRecord{Record: r, Shard: shard}
+	}
+	records[len(records)-1].Sequence = sequence
+	return records
+}
+
+// addShards starts reading any shards of the stream not seen before whose
+// parents have been read to the end, so records stay in order across a
+// split or merge
+func (kr *KinesisStreamReader) addShards() error {
+	shards, err := kr.describeShards()
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		listed[aws.StringValue(shard.ShardId)] = true
+	}
+
+	for _, shard := range shards {
+		shardId := aws.StringValue(shard.ShardId)
+		if kr.seen[shardId] || kr.waiting(listed, shard.ParentShardId) ||
+			kr.waiting(listed, shard.AdjacentParentShardId) {
+			continue
+		}
+
+		input := &kinesis.GetShardIteratorInput{
+			StreamName:        aws.String(kr.streamName),
+			ShardId:           shard.ShardId,
+			ShardIteratorType: aws.String(kinesis.ShardIteratorTypeTrimHorizon),
+		}
+		if sequence := kr.checkpoint(shardId); sequence != "" {
+			input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+			input.StartingSequenceNumber = aws.String(sequence)
+		}
+		iterator, err := kr.kinesis.GetShardIterator(input)
+		if err != nil {
+			return err
+		}
+
+		kr.seen[shardId] = true
+		kr.iterators[shardId] = iterator.ShardIterator
+	}
+	return nil
+}
+
+// waiting reports whether a parent shard still has records to be read
+func (kr *KinesisStreamReader) waiting(listed map[string]bool, parent *string) bool {
+	if parent == nil || !listed[*parent] {
+		return false
+	}
+	_, open := kr.iterators[*parent]
+	return open || !kr.seen[*parent]
+}
+
+// describeShards lists every shard of the stream
+func (kr *KinesisStreamReader) describeShards() ([]*kinesis.Shard, error) {
+	var shards []*kinesis.Shard
+	input := &kinesis.DescribeStreamInput{StreamName: aws.String(kr.streamName)}
+	for {
+		output, err := kr.kinesis.DescribeStream(input)
+		if err != nil {
+			return nil, err
+		}
+		page := output.StreamDescription.Shards
+		shards = append(shards, page...)
+
+		if !aws.BoolValue(output.StreamDescription.HasMoreShards) || len(page) == 0 {
+			return shards, nil
+		}
+		input.ExclusiveStartShardId = page[len(page)-1].ShardId
+	}
+}
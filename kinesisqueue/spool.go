@@ -0,0 +1,558 @@
+package kinesisqueue
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSpoolFull is returned by SendToQueue when a record can neither be
+	// sent nor spooled
+	ErrSpoolFull        = errors.New("spool is full")
+	ErrSpoolUnavailable = errors.New("spool is unavailable")
+)
+
+const (
+	spoolLogName     = "spool.log"
+	spoolOffsetName  = "spool.offset"
+	spoolDeadName    = "spool.dead"
+	minReplayBackoff = 100 * time.Millisecond
+	maxReplayBackoff = 30 * time.Second
+
+	// spoolCompactBytes is how much of the spool can have been replayed
+	// before the rest is moved to the start of a new file, so a spool
+	// replaying through a long outage doesn't grow without bound
+	spoolCompactBytes = 16 * 1024 * 1024
+)
+
+// spooledRecord is a record as it is written to the spool, holding the
+// bytes the queue is sent. Data holds the JSON of records spooled before
+// the bytes were kept.
+type spooledRecord struct {
+	PartitionKey string          `json:"partitionKey"`
+	Data         json.RawMessage `json:"data,omitempty"`
+	Payload      []byte          `json:"payload,omitempty"`
+}
+
+// encoded returns the record as it is sent to the queue
+func (sr *spooledRecord) encoded() Encoded {
+	if sr.Payload != nil {
+		return Encoded(sr.Payload)
+	}
+	return Encoded(sr.Data)
+}
+
+// SpoolStats describes the records waiting in a spool
+type SpoolStats struct {
+	Available bool  `json:"available"`
+	Depth     int   `json:"depth"`
+	Bytes     int64 `json:"bytes"`
+	// DeadLettered is how many records the queue rejected permanently
+	DeadLettered int `json:"deadLettered"`
+}
+
+// SpooledQueue wraps a queue with a durable on-disk write-ahead spool.
+// Records the queue rejects are appended to the spool, and while anything is
+// spooled new records join the back of it, so records reach the queue in the
+// order they were sent. A background goroutine replays the spool with
+// exponential backoff until the queue accepts them again, a batch at a time
+// if the queue can send records together. Records the queue rejects
+// permanently, such as ones too large for it, are moved to a dead letter
+// file in the spool directory rather than holding up those behind them.
+//
+// Replay is at least once: a record sent just before a crash may be sent
+// again on restart. Each spool directory must only be used by one process.
+type SpooledQueue struct {
+	queue    KinesisQueueInterface
+	dir      string
+	maxBytes int64
+	// encoding is how the queue encodes records, which they are spooled in
+	encoding     string
+	compactBytes int64
+
+	// sendMutex is held for reading while records are sent straight to the
+	// queue, and for writing while they are spooled, so no record is sent
+	// straight to the queue once an earlier one has been spooled
+	sendMutex sync.RWMutex
+
+	mutex     sync.Mutex
+	available bool
+	dead      *os.File
+	deadCount int
+	appender  *os.File
+	readFile  *os.File
+	reader    *bufio.Reader
+	// pending are the records being replayed, read from the lines before
+	// pendingAt
+	pending      []spooledRecord
+	pendingAt    int64
+	pendingLines int
+	offset       int64
+	size         int64
+	depth        int
+	wake         chan struct{}
+}
+
+// asyncQueue is a queue which sends records together, such as a
+// BatchProducer, reporting on the channel returned whether each was sent
+type asyncQueue interface {
+	SendAsync(data interface{}, shardId string) <-chan error
+}
+
+// NewSpooledQueue wraps the queue with a spool in dir holding at most maxBytes
+func NewSpooledQueue(queue KinesisQueueInterface, dir string, maxBytes int64) *SpooledQueue {
+	return &SpooledQueue{
+		queue:        queue,
+		dir:          dir,
+		maxBytes:     maxBytes,
+		encoding:     queueEncoding(queue),
+		compactBytes: spoolCompactBytes,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// queueEncoding returns the encoding the queue sends records in
+func queueEncoding(queue KinesisQueueInterface) string {
+	switch queue := queue.(type) {
+	case *KinesisQueueClient:
+		return queue.Encoding
+	case *BatchProducer:
+		return queue.Encoding
+	}
+	return JSON_ENCODING
+}
+
+// InitConn opens the wrapped queue and the spool, and starts replaying any
+// records left in the spool. If the spool can't be opened records are sent
+// straight to the queue.
+func (sq *SpooledQueue) InitConn(streamName string) error {
+	err := sq.queue.InitConn(streamName)
+	if err != nil {
+		return err
+	}
+
+	err = sq.open()
+	if err != nil {
+		log.Println("Spool unavailable, records the queue rejects will be lost:", err)
+		return nil
+	}
+	if sq.depth > 0 {
+		log.Println("Replaying", sq.depth, "spooled records")
+	}
+
+	go sq.replay()
+	return nil
+}
+
+// SendToQueue sends the record to the queue, spooling it if the queue
+// rejects it or there are older records still waiting in the spool
+func (sq *SpooledQueue) SendToQueue(data interface{}, shardId string) error {
+	sq.sendMutex.RLock()
+	sq.mutex.Lock()
+	available, spooled := sq.available, sq.depth > 0
+	sq.mutex.Unlock()
+
+	if !spooled || !available {
+		err := sq.queue.SendToQueue(data, shardId)
+		sq.sendMutex.RUnlock()
+		if err == nil || !available || IsPermanent(err) {
+			return err
+		}
+		log.Println("Spooling record the queue rejected:", err)
+	} else {
+		sq.sendMutex.RUnlock()
+	}
+
+	sq.sendMutex.Lock()
+	defer sq.sendMutex.Unlock()
+	return sq.spool(data, shardId)
+}
+
+// Close closes the wrapped queue, if it can be closed. Records still in the
+// spool are replayed when it is next opened.
+func (sq *SpooledQueue) Close() error {
+	if closer, ok := sq.queue.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Stats returns the number and size of the records waiting in the spool
+func (sq *SpooledQueue) Stats() SpoolStats {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+
+	return SpoolStats{
+		Available:    sq.available,
+		Depth:        sq.depth,
+		Bytes:        sq.size - sq.offset,
+		DeadLettered: sq.deadCount,
+	}
+}
+
+// open opens the spool files and works out which records are still to be sent
+func (sq *SpooledQueue) open() error {
+	err := os.MkdirAll(sq.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	logPath := filepath.Join(sq.dir, spoolLogName)
+	sq.appender, err = os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	sq.readFile, err = os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	sq.dead, err = os.OpenFile(filepath.Join(sq.dir, spoolDeadName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Find where the replay had got to
+	sq.offset = 0
+	offsetData, err := ioutil.ReadFile(filepath.Join(sq.dir, spoolOffsetName))
+	if err == nil {
+		sq.offset, _ = strconv.ParseInt(string(offsetData), 10, 64)
+	}
+
+	// Count the complete records after it, dropping any record cut short
+	// by a crash while it was being written
+	_, err = sq.readFile.Seek(sq.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	sq.reader = bufio.NewReader(sq.readFile)
+	sq.size = sq.offset
+	for {
+		line, err := sq.reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sq.size += int64(len(line))
+		sq.depth++
+	}
+	err = sq.appender.Truncate(sq.size)
+	if err != nil {
+		return err
+	}
+
+	// Start reading from the first record to send
+	_, err = sq.readFile.Seek(sq.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	sq.reader.Reset(sq.readFile)
+	sq.available = true
+	return nil
+}
+
+// spool durably appends a record to the back of the spool, encoded as the
+// queue would send it
+func (sq *SpooledQueue) spool(data interface{}, shardId string) error {
+	encoded, err := Encode(data, sq.encoding)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(spooledRecord{PartitionKey: shardId, Payload: encoded})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+
+	if !sq.available {
+		return ErrSpoolUnavailable
+	}
+	if sq.size-sq.offset+int64(len(line)) > sq.maxBytes {
+		log.Println("Spool full, rejecting record")
+		return ErrSpoolFull
+	}
+
+	// The record only counts as spooled once it is on disk
+	_, err = sq.appender.Write(line)
+	if err == nil {
+		err = sq.appender.Sync()
+	}
+	if err != nil {
+		log.Println("Error writing to spool:", err)
+		_ = sq.appender.Truncate(sq.size)
+		return err
+	}
+	sq.size += int64(len(line))
+	sq.depth++
+
+	// Let the replay know there is work to do
+	select {
+	case sq.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// replay sends spooled records to the queue, oldest first, backing off
+// while the queue keeps rejecting them
+func (sq *SpooledQueue) replay() {
+	batchSize := 1
+	if _, ok := sq.queue.(asyncQueue); ok {
+		batchSize = MAX_BATCH_RECORDS
+	}
+
+	backoff := minReplayBackoff
+	for {
+		records, ok := sq.next(batchSize)
+		if !ok {
+			<-sq.wake
+			continue
+		}
+
+		if sq.advance(records, sq.send(records)) {
+			backoff = minReplayBackoff
+			continue
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxReplayBackoff {
+			backoff = maxReplayBackoff
+		}
+	}
+}
+
+// send sends the records to the queue, together if it can, returning the
+// error of each record that wasn't sent
+func (sq *SpooledQueue) send(records []spooledRecord) []error {
+	errs := make([]error, len(records))
+	async, ok := sq.queue.(asyncQueue)
+	if !ok {
+		for i, record := range records {
+			errs[i] = sq.queue.SendToQueue(record.encoded(), record.PartitionKey)
+			if errs[i] != nil && !IsPermanent(errs[i]) {
+				// Keep the order of the records behind it
+				for j := i + 1; j < len(records); j++ {
+					errs[j] = errs[i]
+				}
+				break
+			}
+		}
+		return errs
+	}
+
+	results := make([]<-chan error, len(records))
+	for i, record := range records {
+		results[i] = async.SendAsync(record.encoded(), record.PartitionKey)
+	}
+	for i, result := range results {
+		errs[i] = <-result
+	}
+	return errs
+}
+
+// next returns up to max of the oldest records in the spool, if there are
+// any, skipping records that can't be read
+func (sq *SpooledQueue) next(max int) ([]spooledRecord, bool) {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+
+	for {
+		if len(sq.pending) > 0 {
+			return sq.pending, true
+		}
+		if sq.depth == 0 {
+			return nil, false
+		}
+
+		sq.pendingAt = sq.offset
+		sq.pendingLines = 0
+		for len(sq.pending) < max && sq.pendingLines < sq.depth {
+			line, err := sq.reader.ReadBytes('\n')
+			if err != nil {
+				log.Println("Error reading spool:", err)
+				break
+			}
+			sq.pendingAt += int64(len(line))
+			sq.pendingLines++
+
+			var record spooledRecord
+			err = json.Unmarshal(line, &record)
+			if err != nil {
+				// Skip records that can never be sent rather than blocking
+				// the spool
+				log.Println("Dropping unreadable spooled record:", err)
+				continue
+			}
+			sq.pending = append(sq.pending, record)
+		}
+		if sq.pendingLines == 0 {
+			return nil, false
+		}
+		if len(sq.pending) == 0 {
+			sq.commit()
+		}
+	}
+}
+
+// advance removes the records sent or rejected permanently from those
+// being replayed, moving the replay position past them once none are left.
+// It returns whether they were all sent or dead lettered.
+func (sq *SpooledQueue) advance(records []spooledRecord, errs []error) bool {
+	sq.mutex.Lock()
+	defer sq.mutex.Unlock()
+
+	var retry []spooledRecord
+	for i, record := range records {
+		switch {
+		case errs[i] == nil:
+		case IsPermanent(errs[i]):
+			sq.deadLetter(record, errs[i])
+		default:
+			retry = append(retry, record)
+		}
+	}
+	if len(retry) > 0 {
+		sq.pending = retry
+		return false
+	}
+	sq.commit()
+	return true
+}
+
+// deadLetter moves a record the queue will never take to the dead letter
+// file. The mutex must be held.
+func (sq *SpooledQueue) deadLetter(record spooledRecord, reason error) {
+	log.Println("Dead lettering spooled record the queue rejected permanently:", reason)
+	sq.deadCount++
+
+	line, err := json.Marshal(record)
+	if err == nil {
+		_, err = sq.dead.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = sq.dead.Sync()
+	}
+	if err != nil {
+		log.Println("Error writing to dead letter file:", err)
+	}
+}
+
+// commit moves the replay position past the pending records, emptying the
+// spool files once everything has been sent and compacting them once
+// enough has. The mutex must be held.
+func (sq *SpooledQueue) commit() {
+	sq.pending = nil
+	sq.offset = sq.pendingAt
+	sq.depth -= sq.pendingLines
+	sq.pendingLines = 0
+
+	if sq.depth == 0 {
+		err := sq.appender.Truncate(0)
+		if err == nil {
+			_, err = sq.readFile.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			log.Println("Error emptying spool:", err)
+		} else {
+			sq.reader.Reset(sq.readFile)
+			sq.offset = 0
+			sq.size = 0
+		}
+	} else if sq.offset >= sq.compactBytes {
+		err := sq.compact()
+		if err != nil {
+			log.Println("Error compacting spool:", err)
+		}
+	}
+
+	err := sq.saveOffset()
+	if err != nil {
+		log.Println("Error saving spool position:", err)
+	}
+}
+
+// compact moves the records still to be sent to the start of a new spool
+// file. A crash part way through replays records again rather than losing
+// any. The mutex must be held.
+func (sq *SpooledQueue) compact() error {
+	logPath := filepath.Join(sq.dir, spoolLogName)
+
+	// Copy the records still to be sent
+	_, err := sq.readFile.Seek(sq.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	compacted, err := os.OpenFile(logPath+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(compacted, sq.readFile, sq.size-sq.offset)
+	if err == nil {
+		err = compacted.Sync()
+	}
+	closeErr := compacted.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(logPath + ".tmp")
+		_, _ = sq.readFile.Seek(sq.offset, io.SeekStart)
+		sq.reader.Reset(sq.readFile)
+		return err
+	}
+
+	// Replay from the start before swapping the file in, so a crash in
+	// between replays the old file from its start
+	offset := sq.offset
+	sq.offset = 0
+	err = sq.saveOffset()
+	if err == nil {
+		err = os.Rename(logPath+".tmp", logPath)
+	}
+	if err != nil {
+		sq.offset = offset
+		_, _ = sq.readFile.Seek(sq.offset, io.SeekStart)
+		sq.reader.Reset(sq.readFile)
+		return err
+	}
+
+	// Switch to the new file
+	_ = sq.appender.Close()
+	_ = sq.readFile.Close()
+	sq.size -= offset
+	sq.appender, err = os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err == nil {
+		sq.readFile, err = os.Open(logPath)
+	}
+	if err != nil {
+		// Without the files nothing more can be spooled or replayed
+		sq.available = false
+		return err
+	}
+	sq.reader.Reset(sq.readFile)
+	return nil
+}
+
+// saveOffset writes the replay position atomically, so a crash leaves the
+// old or new one. The mutex must be held.
+func (sq *SpooledQueue) saveOffset() error {
+	offsetPath := filepath.Join(sq.dir, spoolOffsetName)
+	err := ioutil.WriteFile(offsetPath+".tmp", []byte(strconv.FormatInt(sq.offset, 10)), 0600)
+	if err == nil {
+		err = os.Rename(offsetPath+".tmp", offsetPath)
+	}
+	return err
+}
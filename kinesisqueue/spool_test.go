@@ -0,0 +1,300 @@
+package kinesisqueue
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type dummy_queue struct {
+	mutex  sync.Mutex
+	down   bool
+	sent   []string
+	shards []string
+	// limit is how many records are accepted before the queue goes down
+	limit int
+	// invalid is the encoding of a record the queue never accepts
+	invalid string
+}
+
+func (dq *dummy_queue) InitConn(streamName string) error {
+	return nil
+}
+
+func (dq *dummy_queue) SendToQueue(data interface{}, shardId string) error {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+
+	if dq.down || (dq.limit > 0 && len(dq.sent) >= dq.limit) {
+		return errors.New("stream unavailable")
+	}
+	encoded, _ := Encode(data, JSON_ENCODING)
+	if dq.invalid != "" && string(encoded) == dq.invalid {
+		return ErrRecordTooLarge
+	}
+	dq.sent = append(dq.sent, string(encoded))
+	dq.shards = append(dq.shards, shardId)
+	return nil
+}
+
+func (dq *dummy_queue) setDown(down bool) {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	dq.down = down
+}
+
+func (dq *dummy_queue) sentRecords() []string {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	return append([]string(nil), dq.sent...)
+}
+
+func newSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rtfa-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func waitForDepth(t *testing.T, sq *SpooledQueue, depth int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for sq.Stats().Depth != depth {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected spool depth %d. Got %d", depth, sq.Stats().Depth)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSpoolReplaysInOrder(t *testing.T) {
+	dir := newSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &dummy_queue{}
+	sq := NewSpooledQueue(inner, dir, 1024*1024)
+	if err := sq.InitConn("stream"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sq.SendToQueue(1, "a"); err != nil {
+		t.Errorf("Not expecting an error while the queue is up: %s", err)
+	}
+
+	inner.setDown(true)
+	for i := 2; i <= 4; i++ {
+		if err := sq.SendToQueue(i, "b"); err != nil {
+			t.Errorf("Not expecting an error while the spool has space: %s", err)
+		}
+	}
+	if stats := sq.Stats(); stats.Depth != 3 || stats.Bytes == 0 {
+		t.Errorf("Expected 3 spooled records. Got %+v", stats)
+	}
+
+	inner.setDown(false)
+	if err := sq.SendToQueue(5, "c"); err != nil {
+		t.Errorf("Not expecting an error while the queue is up: %s", err)
+	}
+	waitForDepth(t, sq, 0)
+
+	sent := inner.sentRecords()
+	expected := []string{"1", "2", "3", "4", "5"}
+	if len(sent) != len(expected) {
+		t.Fatalf("Expected %v to be sent. Got %v", expected, sent)
+	}
+	for i := range expected {
+		if sent[i] != expected[i] {
+			t.Errorf("Expected %v to be sent in order. Got %v", expected, sent)
+			break
+		}
+	}
+	if inner.shards[1] != "b" || inner.shards[4] != "c" {
+		t.Errorf("Expected partition keys to be kept. Got %v", inner.shards)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	dir := newSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &dummy_queue{down: true}
+	sq := NewSpooledQueue(inner, dir, 64)
+	if err := sq.InitConn("stream"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sq.SendToQueue("first", "a"); err != nil {
+		t.Errorf("Not expecting an error while the spool has space: %s", err)
+	}
+	if err := sq.SendToQueue("second", "a"); err != ErrSpoolFull {
+		t.Errorf("Expected ErrSpoolFull. Got %v", err)
+	}
+}
+
+func TestSpoolSurvivesRestart(t *testing.T) {
+	dir := newSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &dummy_queue{down: true}
+	sq := NewSpooledQueue(inner, dir, 1024*1024)
+	if err := sq.InitConn("stream"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if err := sq.SendToQueue(i, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A record cut short by a crash is dropped when the spool reopens
+	f, err := os.OpenFile(dir+"/"+spoolLogName, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"partitionKey":"a","da`)
+	f.Close()
+
+	restarted := &dummy_queue{}
+	sq = NewSpooledQueue(restarted, dir, 1024*1024)
+	if err := sq.InitConn("stream"); err != nil {
+		t.Fatal(err)
+	}
+	waitForDepth(t, sq, 0)
+
+	if sent := restarted.sentRecords(); len(sent) != 2 || sent[0] != "1" || sent[1] != "2" {
+		t.Errorf("Expected spooled records to be replayed after a restart. Got %v", sent)
+	}
+}
+
+func TestSpoolKeepsEncoding(t *testing.T) {
+	dir := newSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &dummy_queue{down: true}
+	sq := NewSpooledQueue(inner, dir, 1024*1024)
+	sq.encoding = PROTOBUF_ENCODING
+	if err := sq.InitConn("stream"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sq.SendToQueue(test_message{Name: "test"}, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	inner.setDown(false)
+	waitForDepth(t, sq, 0)
+
+	sent := inner.sentRecords()
+	if len(sent) != 1 {
+		t.Fatalf("Expected the record to be replayed. Got %v", sent)
+	}
+	envelope, ok, err := ParseEnvelope([]byte(sent[0]))
+	if !ok || err != nil || envelope.Type != "test_message" || string(envelope.Payload) != "test" {
+		t.Errorf("Expected the record to be replayed as Protocol Buffers. Got %+v, %t, %v", envelope, ok, err)
+	}
+}
+
+func TestSpoolReplaysJSONRecords(t *testing.T) {
+	dir := newSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	// Records spooled before the encoded bytes were kept
+	err := ioutil.WriteFile(dir+"/"+spoolLogName, []byte(`{"partitionKey":"a","data":{"name":"test"}}`+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner := &dummy_queue{}
+	sq := NewSpooledQueue(inner, dir, 1024*1024)
+	if err := sq.InitConn("stream"); err != nil {
+		t.Fatal(err)
+	}
+	waitForDepth(t, sq, 0)
+
+	if sent := inner.sentRecords(); len(sent) != 1 || sent[0] != `{"name":"test"}` {
+		t.Errorf("Expected the JSON record to be replayed. Got %v", sent)
+	}
+}
+
+func TestSpoolCompacts(t *testing.T) {
+	dir := newSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &dummy_queue{down: true, limit: 2}
+	sq := NewSpooledQueue(inner, dir, 1024*1024)
+	sq.compactBytes = 1
+	if err := sq.InitConn("stream"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		if err := sq.SendToQueue(i, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	full := sq.Stats().Bytes
+
+	inner.setDown(false)
+	waitForDepth(t, sq, 2)
+
+	// The replayed records are gone from the file
+	spooled, err := ioutil.ReadFile(dir + "/" + spoolLogName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(spooled), "\n"); lines != 2 || int64(len(spooled)) >= full {
+		t.Errorf("Expected the spool to be compacted to 2 records. Got %d in %d bytes", lines, len(spooled))
+	}
+	if stats := sq.Stats(); stats.Bytes != int64(len(spooled)) {
+		t.Errorf("Expected the spool size to be %d. Got %+v", len(spooled), stats)
+	}
+
+	restarted := &dummy_queue{}
+	sq = NewSpooledQueue(restarted, dir, 1024*1024)
+	if err := sq.InitConn("stream"); err != nil {
+		t.Fatal(err)
+	}
+	waitForDepth(t, sq, 0)
+
+	if sent := restarted.sentRecords(); len(sent) != 2 || sent[0] != "3" || sent[1] != "4" {
+		t.Errorf("Expected the rest of the spool to be replayed after a restart. Got %v", sent)
+	}
+}
+
+func TestSpoolDeadLettersInvalidRecords(t *testing.T) {
+	dir := newSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &dummy_queue{down: true, invalid: "2"}
+	sq := NewSpooledQueue(inner, dir, 1024*1024)
+	if err := sq.InitConn("stream"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := sq.SendToQueue(i, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The record the queue never accepts doesn't hold up those behind it
+	inner.setDown(false)
+	waitForDepth(t, sq, 0)
+
+	if sent := inner.sentRecords(); len(sent) != 2 || sent[0] != "1" || sent[1] != "3" {
+		t.Errorf("Expected the valid records to be replayed. Got %v", sent)
+	}
+	if stats := sq.Stats(); stats.DeadLettered != 1 {
+		t.Errorf("Expected one dead lettered record. Got %+v", stats)
+	}
+	dead, err := ioutil.ReadFile(dir + "/" + spoolDeadName)
+	if err != nil || strings.Count(string(dead), "\n") != 1 {
+		t.Errorf("Expected the record in the dead letter file. Got %q, %v", dead, err)
+	}
+
+	// Records the queue never accepts are rejected rather than spooled
+	if err := sq.SendToQueue(2, "a"); err != ErrRecordTooLarge {
+		t.Errorf("Expected the record to be rejected. Got %v", err)
+	}
+}
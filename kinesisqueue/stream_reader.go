@@ -0,0 +1,40 @@
+package kinesisqueue
+
+import (
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+// ConsumedRecord is a record read back from a stream along with where it was
+// read from. Reading can resume after it by passing its Sequence as the
+// checkpoint of its Shard. Backends which can't resume leave Sequence empty.
+type ConsumedRecord struct {
+	Record
+	Shard    string
+	Sequence string
+}
+
+// Checkpoint returns the sequence a shard was last read up to, or "" to read
+// the shard from the start
+type Checkpoint func(shard string) string
+
+// StreamReaderInterface reads back the records sent to a stream by the
+// matching KinesisQueueInterface backend
+type StreamReaderInterface interface {
+	InitConn(streamName string, checkpoint Checkpoint) error
+	// ReadRecords returns the next records, oldest first for each shard.
+	// It returns no records if none arrived within a short wait.
+	ReadRecords() ([]ConsumedRecord, error)
+}
+
+// NewStreamReader returns the reader for the queue backend chosen by
+// RTFA_QUEUE_BACKEND, configured in the same way as NewQueue
+func NewStreamReader() StreamReaderInterface {
+	switch Backend() {
+	case FILE_BACKEND:
+		return &FileStreamReader{Dir: utils.GetEnv("RTFA_QUEUE_DIR", DEFAULT_QUEUE_DIR)}
+	case CHANNEL_BACKEND:
+		return &ChannelStreamReader{Size: channelSize()}
+	default:
+		return &KinesisStreamReader{}
+	}
+}
@@ -0,0 +1,91 @@
+package locationupdate
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_DEDUP_WINDOW = 10 * time.Minute
+	// MAX_DEDUP_ENTRIES bounds the memory used, forgetting the oldest
+	// updates early if there are more than this many in the window
+	MAX_DEDUP_ENTRIES = 1000000
+)
+
+// dedupWindow remembers the updates accepted within a sliding window of
+// time so that retried requests can be dropped
+type dedupWindow struct {
+	window time.Duration
+	now    func() time.Time
+
+	mutex sync.Mutex
+	seen  map[string]time.Time
+	order []dedupEntry
+	head  int
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+func newDedupWindow(window time.Duration) *dedupWindow {
+	return &dedupWindow{
+		window: window,
+		now:    time.Now,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// dedupKey identifies an update by everything the client sent
+func dedupKey(update *Movement_update) string {
+	return fmt.Sprintf("%s|%d|%d|%t|%d", *update.UUID, *update.EventID,
+		*update.RegionID, *update.Entering, *update.OccurredAt)
+}
+
+// reserve records the key and reports whether it is new. A key which turns
+// out not to have been accepted should be released so a retry can succeed.
+func (dw *dedupWindow) reserve(key string) bool {
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+
+	now := dw.now()
+	dw.expire(now)
+	if _, ok := dw.seen[key]; ok {
+		return false
+	}
+
+	dw.seen[key] = now
+	dw.order = append(dw.order, dedupEntry{key: key, seen: now})
+	return true
+}
+
+// release forgets a reserved key
+func (dw *dedupWindow) release(key string) {
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+	delete(dw.seen, key)
+}
+
+// expire forgets keys which have left the window. The mutex must be held.
+func (dw *dedupWindow) expire(now time.Time) {
+	for dw.head < len(dw.order) {
+		entry := dw.order[dw.head]
+		inWindow := now.Sub(entry.seen) < dw.window
+		if inWindow && len(dw.order)-dw.head <= MAX_DEDUP_ENTRIES {
+			break
+		}
+		// Only forget the key if it hasn't been released and reserved again
+		if seen, ok := dw.seen[entry.key]; ok && seen.Equal(entry.seen) {
+			delete(dw.seen, entry.key)
+		}
+		dw.head++
+	}
+
+	// Reclaim the space of expired entries once they are most of the slice
+	if dw.head > len(dw.order)/2 {
+		dw.order = append([]dedupEntry(nil), dw.order[dw.head:]...)
+		dw.head = 0
+	}
+}
@@ -1,36 +1,114 @@
 package locationupdate
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/real-time-footfall-analysis/rtfa-backend/archive"
+	"github.com/real-time-footfall-analysis/rtfa-backend/consent"
+	"github.com/real-time-footfall-analysis/rtfa-backend/devices"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/health"
 	"github.com/real-time-footfall-analysis/rtfa-backend/kinesisqueue"
+	"github.com/real-time-footfall-analysis/rtfa-backend/metrics"
+	"github.com/real-time-footfall-analysis/rtfa-backend/pseudonym"
+	"github.com/real-time-footfall-analysis/rtfa-backend/ratelimit"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
-const kinesisStreamName = "movement_event_stream"
+// KINESIS_STREAM_NAME is the stream movement updates are sent to
+const KINESIS_STREAM_NAME = "movement_event_stream"
+
+const (
+	DEFAULT_SPOOL_DIR       = "/var/spool/rtfa"
+	DEFAULT_SPOOL_MAX_BYTES = 256 * 1024 * 1024
+)
 
 // Init registers the endpoints exposed by this package
 // with the given Router.
 // Also initialises the static data database connection
-var queue kinesisqueue.KinesisQueueInterface = &kinesisqueue.KinesisQueueClient{}
+var queue kinesisqueue.KinesisQueueInterface = kinesisqueue.NewQueue()
+var movementArchive archive.ArchiveInterface
+var recentUpdates *dedupWindow
+var events eventstaticdata.EventIndexInterface = eventstaticdata.Index
+var pseudonyms pseudonym.PseudonymInterface = &pseudonym.Pseudonymiser{}
+var consents consent.ConsentInterface = consent.Devices
+var signatures devices.VerifierInterface = devices.Signatures
+var limits ratelimit.IngestionLimiterInterface = ratelimit.NewIngestionLimiter(eventstaticdata.Index)
 
 func Init(r *mux.Router) {
 
-	err := queue.InitConn(kinesisStreamName)
+	if producer, ok := queue.(*kinesisqueue.BatchProducer); ok {
+		health.Register("kinesis_producer", func() interface{} {
+			return map[string]int{"buffered": producer.Buffered()}
+		})
+	}
+
+	// Hold movement updates on disk while Kinesis is unavailable
+	spool := kinesisqueue.NewSpooledQueue(
+		queue,
+		utils.GetEnv("RTFA_SPOOL_DIR", DEFAULT_SPOOL_DIR),
+		int64(utils.GetEnvInt("RTFA_SPOOL_MAX_BYTES", DEFAULT_SPOOL_MAX_BYTES)))
+	queue = spool
+	health.Register("spool", func() interface{} { return spool.Stats() })
+	health.Register("movement_rate_limits", func() interface{} { return limits.Stats() })
+
+	// Keep a copy of every update so analytics can be recomputed
+	movementArchive = archive.Shared()
+
+	pseudonyms.InitConn()
+
+	err := consents.InitConn()
+	if err != nil {
+		log.Println("Error connecting to device_consent table")
+		os.Exit(1)
+	}
+	err = signatures.InitConn()
+	if err != nil {
+		log.Println("Error connecting to device_registrations table")
+		os.Exit(1)
+	}
+
+	// Correct the timestamps of devices with wrong clocks
+	skew = loadSkewPolicy()
+
+	// Drop updates retried by clients on flaky networks
+	recentUpdates = newDedupWindow(utils.GetEnvDuration("RTFA_DEDUP_WINDOW", DEFAULT_DEDUP_WINDOW))
+
+	err = queue.InitConn(KINESIS_STREAM_NAME)
 	if err != nil {
-		log.Println("Failed to connect to Kinesis: " + kinesisStreamName)
+		log.Println("Failed to connect to Kinesis: " + KINESIS_STREAM_NAME)
 		os.Exit(1)
 	}
 
 	r.HandleFunc("/update", updateHandler).Methods("POST")
 }
 
+// Close sends on the updates still buffered, so none are lost when the
+// server stops
+func Close() error {
+	var err error
+	if closer, ok := queue.(io.Closer); ok {
+		err = closer.Close()
+	}
+	if movementArchive != nil {
+		archiveErr := movementArchive.Flush()
+		if err == nil {
+			err = archiveErr
+		}
+	}
+	return err
+}
+
 const (
 	UUID_LENGTH = 36
 )
@@ -41,6 +119,10 @@ type Movement_update struct {
 	RegionID   *int    `json:"regionId"`
 	Entering   *bool   `json:"entering"`
 	OccurredAt *int    `json:"occurredAt"`
+	// Set by the server, along with the OccurredAt the client sent before
+	// it was corrected for clock skew
+	ReceivedAt       *int `json:"receivedAt,omitempty"`
+	ClientOccurredAt *int `json:"clientOccurredAt,omitempty"`
 }
 
 func notPresentError(writer http.ResponseWriter, name string) {
@@ -76,11 +158,31 @@ func notPresentCheck(writer http.ResponseWriter, update Movement_update) bool {
 }
 
 func updateHandler(writer http.ResponseWriter, request *http.Request) {
-	decoder := json.NewDecoder(request.Body)
+	// Turn away floods before doing any work for them
+	if ok, wait := limits.AllowClient(request); !ok {
+		metrics.Add("movement_updates_throttled_client", 1)
+		ratelimit.Reject(writer, wait)
+		return
+	}
 
-	var update Movement_update
+	// Keep the body as it was sent to check its signature
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Println("Cannot read movement update:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to read movement update: %s", err),
+			http.StatusBadRequest)
+		return
+	}
 
-	err := decoder.Decode(&update)
+	// Devices can send updates as Protocol Buffers to save bandwidth
+	var update Movement_update
+	if isProtobuf(request.Header.Get("Content-Type")) {
+		err = update.UnmarshalBinary(body)
+	} else {
+		err = json.NewDecoder(bytes.NewReader(body)).Decode(&update)
+	}
 
 	if err != nil {
 		log.Println("Cannot decode movement update:", err)
@@ -96,11 +198,91 @@ func updateHandler(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// Only accept updates from the registered device they claim to be from
+	err = signatures.Verify(request, body, *update.EventID, *update.UUID)
+	if err != nil {
+		log.Println("Rejected movement update:", err)
+		devices.Reject(writer, err)
+		return
+	}
+
+	// Devices are only limited once they are known to be who they claim,
+	// so nobody can use up the limit of someone else's device
+	if ok, wait := limits.AllowDevice(*update.EventID, *update.UUID); !ok {
+		metrics.Add("movement_updates_throttled_device", 1)
+		ratelimit.Reject(writer, wait)
+		return
+	}
+
+	// Events are only looked up for signed updates, so made up IDs don't
+	// reach the database
+	err = validateEventRegion(&update, writer)
+	if err != nil {
+		return
+	}
+
+	// Devices which have opted out of tracking are not followed any further
+	if consents.Withdrawn(*update.UUID) {
+		metrics.Add("movement_updates_withdrawn", 1)
+		http.Error(
+			writer,
+			fmt.Sprint("Device has withdrawn consent to tracking"),
+			http.StatusForbidden)
+		return
+	}
+
+	// Retries are recognised by what the client sent, before any correction
+	key := dedupKey(&update)
+
+	err = correctTimestamp(&update, int(time.Now().Unix()), writer)
+	if err != nil {
+		return
+	}
+
+	err = validateEventRunning(&update, writer)
+	if err != nil {
+		return
+	}
+
+	// A retry of an update already accepted succeeds without sending it again
+	if !recentUpdates.reserve(key) {
+		metrics.Add("movement_updates_duplicate", 1)
+		return
+	}
+
+	// Replace the device's identifier before the update leaves the API
+	devicePseudonym, err := pseudonyms.Pseudonym(*update.EventID, *update.UUID)
+	if err != nil {
+		recentUpdates.release(key)
+		log.Println("Error pseudonymising movement update:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to accept movement update: %s", err),
+			http.StatusServiceUnavailable)
+		return
+	}
+	update.UUID = &devicePseudonym
+
 	// Send the data to the kinesis stream
-	err = queue.SendToQueue(update, strconv.Itoa(*update.RegionID))
+	err = queue.SendToQueue(update, PartitionKey(&update))
 	if err != nil {
+		recentUpdates.release(key)
+		metrics.Add("movement_updates_failed", 1)
 		log.Println("Error sending data to Kinesis")
 		log.Println(err.Error())
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to accept movement update: %s", err),
+			http.StatusServiceUnavailable)
+		return
+	}
+
+	metrics.Add("movement_updates_accepted", 1)
+
+	// Archive the accepted update, which the client doesn't need to wait on
+	err = movementArchive.Append(*update.EventID, *update.OccurredAt, update)
+	if err != nil {
+		log.Println("Error archiving movement update:", err)
 	}
 }
 
@@ -143,3 +325,59 @@ func validateUpdate(update *Movement_update, writer http.ResponseWriter) error {
 	return nil
 
 }
+
+// validateEventRegion rejects updates which aren't for a region of a known
+// event
+func validateEventRegion(update *Movement_update, writer http.ResponseWriter) error {
+	event, err := events.GetEventRegions(*update.EventID)
+	if err != nil {
+		// Keep updates rather than lose them while the events can't be read
+		log.Println("Unable to check event of movement update:", err)
+		metrics.Add("movement_updates_unchecked", 1)
+		return nil
+	}
+
+	if event == nil {
+		msg := fmt.Sprintf("Unknown EventId %d in movement update", *update.EventID)
+		log.Println(msg)
+		http.Error(
+			writer,
+			msg,
+			http.StatusBadRequest)
+		return errors.New(msg)
+	}
+
+	if !event.HasRegion(*update.RegionID) {
+		msg := fmt.Sprintf("RegionId %d not in event %d in movement update", *update.RegionID, *update.EventID)
+		log.Println(msg)
+		http.Error(
+			writer,
+			msg,
+			http.StatusBadRequest)
+		return errors.New(msg)
+	}
+
+	return nil
+
+}
+
+// validateEventRunning rejects updates which occurred after their event
+// ended, once their timestamp has been corrected
+func validateEventRunning(update *Movement_update, writer http.ResponseWriter) error {
+	event, err := events.GetEventRegions(*update.EventID)
+	if err != nil || event == nil {
+		return nil
+	}
+
+	if event.EndedBefore(time.Unix(int64(*update.OccurredAt), 0)) {
+		msg := fmt.Sprintf("Event %d ended before movement update", *update.EventID)
+		log.Println(msg)
+		http.Error(
+			writer,
+			msg,
+			http.StatusBadRequest)
+		return errors.New(msg)
+	}
+
+	return nil
+}
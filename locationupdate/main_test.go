@@ -3,6 +3,9 @@ package locationupdate
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
 	"net/http"
@@ -15,13 +18,30 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/real-time-footfall-analysis/rtfa-backend/devices"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/metrics"
+	"github.com/real-time-footfall-analysis/rtfa-backend/ratelimit"
 )
 
 var router *mux.Router
 
 func init() {
+	dir, err := ioutil.TempDir("", "rtfa-spool")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("RTFA_SPOOL_DIR", dir)
+	os.Setenv("RTFA_ARCHIVE_DIR", dir)
+	events = &dummy_events{}
+	consents = &dummy_consents{withdrawn: map[string]bool{}}
+	signatures = devices.NewVerifier(&dummy_registry{unregistered: map[string]bool{
+		"Test-UUID-00000000000000000000000004": true,
+	}}, time.Minute, time.Time{}, nil)
+	limits = ratelimit.NewIngestionLimiter(&dummy_events{})
 	router = mux.NewRouter()
 	Init(router)
+	pseudonyms = &dummy_pseudonyms{}
 }
 
 func TestGETLocationUpdate(t *testing.T) {
@@ -231,7 +251,211 @@ func TestLocationUpdate(t *testing.T) {
 	}
 }
 
+func TestDuplicateLocationUpdate(t *testing.T) {
+	uuid := "Test-UUID-00000000000000000000000001"
+	eventId := 0
+	regionID := 2
+	entering := true
+	occurredAt := int(time.Now().Unix())
+	update := Movement_update{
+		UUID:       &uuid,
+		EventID:    &eventId,
+		RegionID:   &regionID,
+		Entering:   &entering,
+		OccurredAt: &occurredAt,
+	}
+	body, _ := json.Marshal(&update)
+	duplicates := metrics.Get("movement_updates_duplicate")
+
+	// A failed send isn't remembered, so the client's retry goes through
+	dq := &dummy_queue{update: update, t: t, fail: true}
+	queue = dq
+	req, _ := http.NewRequest("POST", "/update", bytes.NewReader(body))
+	checkResponseCode(t, http.StatusServiceUnavailable, executeRequest(req).Code)
+
+	dq.fail = false
+	for i := 0; i < 3; i++ {
+		req, _ = http.NewRequest("POST", "/update", bytes.NewReader(body))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	}
+
+	if dq.sent != 1 {
+		t.Errorf("Expected the update to be sent once. Got %d", dq.sent)
+	}
+	if count := metrics.Get("movement_updates_duplicate") - duplicates; count != 2 {
+		t.Errorf("Expected 2 duplicates to be counted. Got %d", count)
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	now := time.Date(2018, 12, 5, 14, 0, 0, 0, time.UTC)
+	dw := newDedupWindow(time.Minute)
+	dw.now = func() time.Time { return now }
+
+	if !dw.reserve("a") || dw.reserve("a") {
+		t.Error("Expected only the first update to be new")
+	}
+	now = now.Add(30 * time.Second)
+	if !dw.reserve("b") {
+		t.Error("Expected a different update to be new")
+	}
+	now = now.Add(40 * time.Second)
+	if !dw.reserve("a") {
+		t.Error("Expected an update to be new again once it left the window")
+	}
+	if dw.reserve("b") {
+		t.Error("Expected an update still in the window to be a duplicate")
+	}
+}
+
+func TestUnknownEventLocationUpdate(t *testing.T) {
+	queue = &dummy_queue{t: t}
+
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{`{"eventId":7,"regionId":1}`, "Unknown EventId 7"},
+		{`{"eventId":0,"regionId":3}`, "RegionId 3 not in event 0"},
+		{`{"eventId":5,"regionId":1}`, "Event 5 ended"},
+	}
+	for _, test := range tests {
+		body := strings.Replace(test.body, "}",
+			`,"uuid":"Test-UUID-00000000000000000000000002","entering":true,"occurredAt":`+
+				strconv.FormatInt(time.Now().Unix(), 10)+"}", 1)
+		req, _ := http.NewRequest("POST", "/update", strings.NewReader(body))
+		response := executeRequest(req)
+
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+		if !strings.Contains(response.Body.String(), test.expected) {
+			t.Errorf("Expected error: %s. Got %s", test.expected, response.Body.String())
+		}
+	}
+	if queue.(*dummy_queue).sent != 0 {
+		t.Error("Expected no updates to be sent")
+	}
+}
+
+func TestUnsignedUnknownEventIsNotLookedUp(t *testing.T) {
+	queue = &dummy_queue{t: t}
+	lookups := events.(*dummy_events).lookups
+
+	// Made up events are turned away by the signature check before the
+	// event is read
+	body := `{"uuid":"Test-UUID-00000000000000000000000002","eventId":7,"regionId":1,"entering":true,"occurredAt":` +
+		strconv.FormatInt(time.Now().Unix(), 10) + "}"
+	req, _ := http.NewRequest("POST", "/update", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	checkResponseCode(t, http.StatusUnauthorized, rr.Code)
+	if events.(*dummy_events).lookups != lookups {
+		t.Error("Expected the event of an unsigned update not to be looked up")
+	}
+}
+
+func TestWithdrawnLocationUpdate(t *testing.T) {
+	uuid := "Test-UUID-00000000000000000000000003"
+	consents.(*dummy_consents).withdrawn[uuid] = true
+	defer delete(consents.(*dummy_consents).withdrawn, uuid)
+	queue = &dummy_queue{t: t}
+
+	body := `{"uuid":"` + uuid + `","eventId":0,"regionId":1,"entering":true,"occurredAt":` +
+		strconv.FormatInt(time.Now().Unix(), 10) + "}"
+	req, _ := http.NewRequest("POST", "/update", strings.NewReader(body))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+	if queue.(*dummy_queue).sent != 0 {
+		t.Error("Expected no updates to be sent")
+	}
+}
+
+func TestUnsignedLocationUpdate(t *testing.T) {
+	uuid := "Test-UUID-00000000000000000000000005"
+	eventId := 0
+	regionID := 1
+	entering := true
+	occurredAt := int(time.Now().Unix())
+	update := Movement_update{
+		UUID:       &uuid,
+		EventID:    &eventId,
+		RegionID:   &regionID,
+		Entering:   &entering,
+		OccurredAt: &occurredAt,
+	}
+	queue = &dummy_queue{update: update, t: t}
+	encoded, _ := json.Marshal(&update)
+	body := string(encoded)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		body      string
+	}{
+		{"unsigned", "", "", body},
+		{"wrong secret", timestamp, devices.Sign("other-secret", timestamp, []byte(body)), body},
+		{"altered body", timestamp, devices.Sign(TEST_SECRET, timestamp, []byte(body)), strings.Replace(body, `"regionId":1`, `"regionId":2`, 1)},
+		{"stale", "1543000000", devices.Sign(TEST_SECRET, "1543000000", []byte(body)), body},
+		{"unregistered", timestamp, devices.Sign(TEST_SECRET, timestamp, []byte(body)),
+			strings.Replace(body, "00005", "00004", 1)},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "/update", strings.NewReader(test.body))
+		req.Header.Set(devices.TIMESTAMP_HEADER, test.timestamp)
+		req.Header.Set(devices.SIGNATURE_HEADER, test.signature)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("Expected a %s update to be rejected. Got %d", test.name, rr.Code)
+		}
+	}
+
+	// A signed request is only accepted once
+	for i, expected := range []int{http.StatusOK, http.StatusUnauthorized} {
+		req, _ := http.NewRequest("POST", "/update", strings.NewReader(body))
+		req.Header.Set(devices.TIMESTAMP_HEADER, timestamp)
+		req.Header.Set(devices.SIGNATURE_HEADER, devices.Sign(TEST_SECRET, timestamp, []byte(body)))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != expected {
+			t.Errorf("Expected request %d to get %d. Got %d", i, expected, rr.Code)
+		}
+	}
+	if queue.(*dummy_queue).sent != 1 {
+		t.Errorf("Expected one update to be sent. Got %d", queue.(*dummy_queue).sent)
+	}
+}
+
+func TestThrottledLocationUpdate(t *testing.T) {
+	queue = &dummy_queue{t: t}
+	throttled := metrics.Get("movement_updates_throttled_device")
+
+	// Event 6 allows each device one update a minute
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		body := `{"uuid":"Test-UUID-00000000000000000000000006","eventId":6,"regionId":1,"entering":true,"occurredAt":` +
+			strconv.FormatInt(time.Now().Unix()-int64(i), 10) + "}"
+		queue.(*dummy_queue).update = Movement_update{}
+		_ = json.Unmarshal([]byte(body), &queue.(*dummy_queue).update)
+		req, _ := http.NewRequest("POST", "/update", strings.NewReader(body))
+		response := executeRequest(req)
+
+		checkResponseCode(t, expected, response.Code)
+		if expected == http.StatusTooManyRequests && response.Header().Get("Retry-After") != "60" {
+			t.Errorf("Expected to retry after 60 seconds. Got %q", response.Header().Get("Retry-After"))
+		}
+	}
+	if count := metrics.Get("movement_updates_throttled_device") - throttled; count != 1 {
+		t.Errorf("Expected 1 throttled update to be counted. Got %d", count)
+	}
+}
+
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
+	signRequest(req)
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
@@ -247,6 +471,8 @@ func checkResponseCode(t *testing.T, expected, actual int) {
 type dummy_queue struct {
 	update Movement_update
 	t      *testing.T
+	sent   int
+	fail   bool
 }
 
 // InitConn opens the connection to the location event kinesis queue
@@ -264,7 +490,7 @@ func (dq *dummy_queue) SendToQueue(data interface{}, shardId string) error {
 	}
 
 	match := true
-	if *event.UUID != *dq.update.UUID {
+	if pseudonym, _ := pseudonyms.Pseudonym(*dq.update.EventID, *dq.update.UUID); *event.UUID != pseudonym {
 		match = false
 	}
 	if *event.EventID != *dq.update.EventID {
@@ -283,5 +509,103 @@ func (dq *dummy_queue) SendToQueue(data interface{}, shardId string) error {
 	if !match {
 		dq.t.Error("incorrect update fired to queue")
 	}
+	if dq.fail {
+		return errors.New("stream unavailable")
+	}
+	dq.sent++
+	return nil
+}
+
+// dummy_events knows event 0, which is running, and event 5, which has ended
+type dummy_events struct {
+	lookups int
+}
+
+func (de *dummy_events) GetEventRegions(eventID int) (*eventstaticdata.EventRegions, error) {
+	de.lookups++
+	switch eventID {
+	case 0:
+		return &eventstaticdata.EventRegions{
+			Event:     eventstaticdata.Event{EndDate: time.Now().AddDate(1, 0, 0)},
+			RegionIDs: map[int]bool{1: true, 2: true},
+		}, nil
+	case 5:
+		return &eventstaticdata.EventRegions{
+			Event:     eventstaticdata.Event{EndDate: time.Date(2018, 12, 10, 0, 0, 0, 0, time.UTC)},
+			RegionIDs: map[int]bool{1: true},
+		}, nil
+	case 6:
+		return &eventstaticdata.EventRegions{
+			Event:     eventstaticdata.Event{EndDate: time.Now().AddDate(1, 0, 0), MaxDeviceUpdatesPerMinute: 1},
+			RegionIDs: map[int]bool{1: true},
+		}, nil
+	}
+	return nil, nil
+}
+
+func (de *dummy_events) Invalidate(eventID int) {
+}
+
+type dummy_pseudonyms struct{}
+
+func (dp *dummy_pseudonyms) InitConn() {
+}
+
+func (dp *dummy_pseudonyms) Pseudonym(eventId int, uuid string) (string, error) {
+	return fmt.Sprintf("pseudonym-%d-%s", eventId, uuid), nil
+}
+
+type dummy_consents struct {
+	withdrawn map[string]bool
+}
+
+func (dc *dummy_consents) InitConn() error {
+	return nil
+}
+
+func (dc *dummy_consents) Withdrawn(uuid string) bool {
+	return dc.withdrawn[uuid]
+}
+
+/***************************
+   FAKE Device registry
+***************************/
+
+const TEST_SECRET = "test-secret"
+
+// signed counts the requests signed, to give each its own timestamp
+var signed int64
+
+// signRequest signs the request as its registered device would, if it
+// isn't signed already
+func signRequest(req *http.Request) {
+	if req.Body == nil || req.Header.Get(devices.SIGNATURE_HEADER) != "" {
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	signed++
+	timestamp := strconv.FormatInt(time.Now().Unix()-signed%60, 10)
+	req.Header.Set(devices.TIMESTAMP_HEADER, timestamp)
+	req.Header.Set(devices.SIGNATURE_HEADER, devices.Sign(TEST_SECRET, timestamp, body))
+}
+
+type dummy_registry struct {
+	unregistered map[string]bool
+}
+
+func (dr *dummy_registry) InitConn() error {
 	return nil
 }
+
+func (dr *dummy_registry) Register(eventId int, uuid string) (string, error) {
+	return TEST_SECRET, nil
+}
+
+func (dr *dummy_registry) Secret(eventId int, uuid string) (string, error) {
+	if dr.unregistered[uuid] {
+		return "", nil
+	}
+	return TEST_SECRET, nil
+}
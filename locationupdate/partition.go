@@ -0,0 +1,75 @@
+package locationupdate
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+// Strategies for choosing the Kinesis partition key of an update. Kinesis
+// keeps the records of a partition key in order, on one shard, so each
+// strategy trades what stays in order against how evenly shards are used.
+// The consumer applies updates by OccurredAt, so it is correct under any of
+// them.
+const (
+	// EVENT_REGION_PARTITIONING keys updates by event and region. Every
+	// update of a region stays in order, but a crowded region loads one
+	// shard.
+	EVENT_REGION_PARTITIONING = "event_region"
+	// REGION_PARTITIONING keys updates by region alone, as the server once
+	// did. Regions of different events with the same ID share a key.
+	REGION_PARTITIONING = "region"
+	// DEVICE_PARTITIONING keys updates by the device's pseudonym. Each
+	// device's updates stay in order while its pseudonym lasts, and load
+	// is spread evenly whatever the crowd does.
+	DEVICE_PARTITIONING = "device"
+	// SPREAD_PARTITIONING keys updates by event and one of
+	// RTFA_PARTITION_SPREAD keys chosen at random. Nothing stays in order,
+	// but an event's updates are spread over that many keys.
+	SPREAD_PARTITIONING = "spread"
+
+	DEFAULT_PARTITION_SPREAD = 16
+)
+
+// partitioner returns the partition key of an update, once its identifier
+// has been replaced by a pseudonym
+type partitioner func(update *Movement_update) string
+
+// partitionKey is the strategy chosen by RTFA_PARTITION_STRATEGY
+var partitionKey = loadPartitioner()
+
+// PartitionKey returns the partition key the update is sent to Kinesis with
+func PartitionKey(update *Movement_update) string {
+	return partitionKey(update)
+}
+
+// loadPartitioner reads the partitioning strategy from the environment
+func loadPartitioner() partitioner {
+	strategy := utils.GetEnv("RTFA_PARTITION_STRATEGY", EVENT_REGION_PARTITIONING)
+	switch strategy {
+	case REGION_PARTITIONING:
+		return func(update *Movement_update) string {
+			return fmt.Sprint(*update.RegionID)
+		}
+	case DEVICE_PARTITIONING:
+		return func(update *Movement_update) string {
+			return *update.UUID
+		}
+	case SPREAD_PARTITIONING:
+		spread := utils.GetEnvInt("RTFA_PARTITION_SPREAD", DEFAULT_PARTITION_SPREAD)
+		if spread <= 0 {
+			spread = DEFAULT_PARTITION_SPREAD
+		}
+		return func(update *Movement_update) string {
+			return fmt.Sprintf("%d/spread-%d", *update.EventID, rand.Intn(spread))
+		}
+	case EVENT_REGION_PARTITIONING:
+	default:
+		log.Printf("Unknown partition strategy %q, using %s", strategy, EVENT_REGION_PARTITIONING)
+	}
+	return func(update *Movement_update) string {
+		return fmt.Sprintf("%d/%d", *update.EventID, *update.RegionID)
+	}
+}
@@ -0,0 +1,52 @@
+package locationupdate
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPartitionStrategies(t *testing.T) {
+	defer os.Unsetenv("RTFA_PARTITION_STRATEGY")
+	update := testUpdate()
+	update.EventID = new(int)
+	*update.EventID = 3
+
+	tests := []struct {
+		strategy string
+		expected string
+	}{
+		{"", "3/2"},
+		{EVENT_REGION_PARTITIONING, "3/2"},
+		{REGION_PARTITIONING, "2"},
+		{DEVICE_PARTITIONING, *update.UUID},
+		{"unknown", "3/2"},
+	}
+	for _, test := range tests {
+		os.Setenv("RTFA_PARTITION_STRATEGY", test.strategy)
+		if key := loadPartitioner()(&update); key != test.expected {
+			t.Errorf("Expected strategy %q to give key %s. Got %s", test.strategy, test.expected, key)
+		}
+	}
+}
+
+func TestSpreadPartitioning(t *testing.T) {
+	defer os.Unsetenv("RTFA_PARTITION_STRATEGY")
+	defer os.Unsetenv("RTFA_PARTITION_SPREAD")
+	os.Setenv("RTFA_PARTITION_STRATEGY", SPREAD_PARTITIONING)
+	os.Setenv("RTFA_PARTITION_SPREAD", "4")
+	update := testUpdate()
+
+	keys := make(map[string]bool)
+	partition := loadPartitioner()
+	for i := 0; i < 200; i++ {
+		key := partition(&update)
+		if !strings.HasPrefix(key, "0/spread-") {
+			t.Fatalf("Expected a key of event 0. Got %s", key)
+		}
+		keys[key] = true
+	}
+	if len(keys) != 4 {
+		t.Errorf("Expected updates to be spread over 4 keys. Got %v", keys)
+	}
+}
@@ -0,0 +1,125 @@
+package locationupdate
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/kinesisqueue"
+	"github.com/real-time-footfall-analysis/rtfa-backend/protowire"
+)
+
+// MOVEMENT_UPDATE_TYPE is the type of envelopes holding movement updates
+const MOVEMENT_UPDATE_TYPE = "movement_update"
+
+// protobufMediaTypes are the content types of movement updates sent as
+// Protocol Buffers
+var protobufMediaTypes = map[string]bool{
+	"application/x-protobuf": true,
+	"application/protobuf":   true,
+}
+
+// isProtobuf returns whether the content type is one of Protocol Buffers
+func isProtobuf(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && protobufMediaTypes[mediaType]
+}
+
+func (update Movement_update) MessageType() string {
+	return MOVEMENT_UPDATE_TYPE
+}
+
+// MarshalBinary encodes the update as the MovementUpdate message of
+// movement_update.proto, leaving out fields which aren't set
+func (update Movement_update) MarshalBinary() ([]byte, error) {
+	var b []byte
+	if update.UUID != nil {
+		b = protowire.AppendBytesField(b, 1, []byte(*update.UUID))
+	}
+	ints := []struct {
+		number int
+		value  *int
+	}{
+		{2, update.EventID},
+		{3, update.RegionID},
+		{5, update.OccurredAt},
+		{6, update.ReceivedAt},
+		{7, update.ClientOccurredAt},
+	}
+	for _, field := range ints {
+		if field.value != nil {
+			b = protowire.AppendVarintField(b, field.number, uint64(int64(*field.value)))
+		}
+	}
+	if update.Entering != nil {
+		entering := uint64(0)
+		if *update.Entering {
+			entering = 1
+		}
+		b = protowire.AppendVarintField(b, 4, entering)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a MovementUpdate message, setting the fields
+// present in it
+func (update *Movement_update) UnmarshalBinary(data []byte) error {
+	return protowire.Parse(data, func(field protowire.Field) error {
+		if field.Number == 1 {
+			if field.Type != protowire.BYTES {
+				return fmt.Errorf("field %d of MovementUpdate has wire type %d", field.Number, field.Type)
+			}
+			uuid := string(field.Bytes)
+			update.UUID = &uuid
+			return nil
+		}
+		if field.Number > 7 {
+			// Fields added by newer clients
+			return nil
+		}
+		if field.Type != protowire.VARINT {
+			return fmt.Errorf("field %d of MovementUpdate has wire type %d", field.Number, field.Type)
+		}
+
+		value := int(int64(field.Varint))
+		switch field.Number {
+		case 2:
+			update.EventID = &value
+		case 3:
+			update.RegionID = &value
+		case 4:
+			entering := field.Varint != 0
+			update.Entering = &entering
+		case 5:
+			update.OccurredAt = &value
+		case 6:
+			update.ReceivedAt = &value
+		case 7:
+			update.ClientOccurredAt = &value
+		}
+		return nil
+	})
+}
+
+// DecodeRecord decodes a movement update read from the stream, which may be
+// JSON or Protocol Buffers in an envelope
+func DecodeRecord(data []byte) (Movement_update, error) {
+	var update Movement_update
+	envelope, ok, err := kinesisqueue.ParseEnvelope(data)
+	if err != nil {
+		return update, err
+	}
+	if !ok {
+		err = json.Unmarshal(data, &update)
+		return update, err
+	}
+
+	if envelope.Version > kinesisqueue.ENVELOPE_VERSION {
+		return update, fmt.Errorf("unsupported envelope version %d", envelope.Version)
+	}
+	if envelope.Type != MOVEMENT_UPDATE_TYPE {
+		return update, fmt.Errorf("record is a %q, not a movement update", envelope.Type)
+	}
+	err = update.UnmarshalBinary(envelope.Payload)
+	return update, err
+}
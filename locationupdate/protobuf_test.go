@@ -0,0 +1,95 @@
+package locationupdate
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/kinesisqueue"
+)
+
+func testUpdate() Movement_update {
+	uuid := "Test-UUID-00000000000000000000000007"
+	eventId := 0
+	regionID := 2
+	entering := false
+	occurredAt := int(time.Now().Unix())
+	receivedAt := occurredAt + 1
+	return Movement_update{
+		UUID:       &uuid,
+		EventID:    &eventId,
+		RegionID:   &regionID,
+		Entering:   &entering,
+		OccurredAt: &occurredAt,
+		ReceivedAt: &receivedAt,
+	}
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	update := testUpdate()
+	data, err := update.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unable to encode: %s", err)
+	}
+
+	var decoded Movement_update
+	err = decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("Unable to decode: %s", err)
+	}
+	if !reflect.DeepEqual(update, decoded) {
+		t.Errorf("Expected %+v. Got %+v", update, decoded)
+	}
+	if decoded.ClientOccurredAt != nil {
+		t.Error("Expected a field which wasn't sent to stay unset")
+	}
+}
+
+func TestDecodeRecord(t *testing.T) {
+	update := testUpdate()
+	for _, encoding := range []string{kinesisqueue.JSON_ENCODING, kinesisqueue.PROTOBUF_ENCODING} {
+		data, _ := kinesisqueue.Encode(update, encoding)
+		decoded, err := DecodeRecord(data)
+		if err != nil || !reflect.DeepEqual(update, decoded) {
+			t.Errorf("Expected %s record to decode to %+v. Got %+v, %v", encoding, update, decoded, err)
+		}
+	}
+
+	tests := []kinesisqueue.Envelope{
+		{Version: kinesisqueue.ENVELOPE_VERSION + 1, Type: MOVEMENT_UPDATE_TYPE},
+		{Version: kinesisqueue.ENVELOPE_VERSION, Type: "emergency"},
+	}
+	for _, envelope := range tests {
+		data, _ := envelope.MarshalBinary()
+		if _, err := DecodeRecord(data); err == nil {
+			t.Errorf("Expected envelope %+v not to decode", envelope)
+		}
+	}
+}
+
+func TestProtobufLocationUpdate(t *testing.T) {
+	update := testUpdate()
+	update.ReceivedAt = nil
+	dq := &dummy_queue{update: update, t: t}
+	queue = dq
+
+	body, _ := update.MarshalBinary()
+	req, _ := http.NewRequest("POST", "/update", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	if dq.sent != 1 {
+		t.Errorf("Expected the update to be sent. Got %d", dq.sent)
+	}
+
+	// The body is only read as JSON without the content type
+	req, _ = http.NewRequest("POST", "/update", bytes.NewReader(body))
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+
+	jsonBody, _ := json.Marshal(update)
+	req, _ = http.NewRequest("POST", "/update", bytes.NewReader(jsonBody))
+	req.Header.Set("Content-Type", "application/x-protobuf; charset=binary")
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+}
@@ -0,0 +1,157 @@
+package locationupdate
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/metrics"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const (
+	// CLAMP_SKEW replaces an OccurredAt outside the skew window with the time
+	// the update was received, REJECT_SKEW refuses the update
+	CLAMP_SKEW  = "clamp"
+	REJECT_SKEW = "reject"
+
+	DEFAULT_MAX_PAST_SKEW    = 24 * time.Hour
+	DEFAULT_MAX_FUTURE_SKEW  = 5 * time.Minute
+	DEFAULT_SKEW_CORRECTION  = 2 * time.Minute
+	MIN_SKEW_SAMPLES         = 3
+	SKEW_SAMPLES_PER_DEVICE  = 10
+	MAX_SKEW_DEVICES         = 100000
+	SKEW_DEVICE_IDLE_SECONDS = 60 * 60
+)
+
+// skewPolicy is how far from the receive time an OccurredAt may be
+type skewPolicy struct {
+	maxPast    int
+	maxFuture  int
+	correction int
+	action     string
+}
+
+var skew skewPolicy
+var deviceClocks = newSkewEstimator()
+
+// loadSkewPolicy reads the skew window from the environment
+func loadSkewPolicy() skewPolicy {
+	policy := skewPolicy{
+		maxPast:    int(utils.GetEnvDuration("RTFA_MAX_PAST_SKEW", DEFAULT_MAX_PAST_SKEW).Seconds()),
+		maxFuture:  int(utils.GetEnvDuration("RTFA_MAX_FUTURE_SKEW", DEFAULT_MAX_FUTURE_SKEW).Seconds()),
+		correction: int(utils.GetEnvDuration("RTFA_SKEW_CORRECTION_THRESHOLD", DEFAULT_SKEW_CORRECTION).Seconds()),
+		action:     utils.GetEnv("RTFA_SKEW_POLICY", CLAMP_SKEW),
+	}
+	if policy.action != CLAMP_SKEW && policy.action != REJECT_SKEW {
+		log.Printf("Unknown skew policy %q, using %s", policy.action, CLAMP_SKEW)
+		policy.action = CLAMP_SKEW
+	}
+	return policy
+}
+
+// correctTimestamp stamps the update with the time it was received and
+// corrects its OccurredAt for the device's clock skew, keeping the time the
+// device reported in ClientOccurredAt
+func correctTimestamp(update *Movement_update, receivedAt int, writer http.ResponseWriter) error {
+	clientOccurredAt := *update.OccurredAt
+	update.ReceivedAt = &receivedAt
+	update.ClientOccurredAt = &clientOccurredAt
+
+	// Shift back by the device's estimated skew once its clock is clearly
+	// ahead. A clock which seems behind can't be told from updates delivered
+	// late after the device was offline, so is left to the skew window.
+	occurredAt := clientOccurredAt
+	estimate, samples := deviceClocks.observe(*update.UUID, receivedAt-clientOccurredAt, receivedAt)
+	if samples >= MIN_SKEW_SAMPLES && estimate < -skew.correction {
+		occurredAt += estimate
+		metrics.Add("movement_updates_skew_corrected", 1)
+	}
+
+	if occurredAt < receivedAt-skew.maxPast || occurredAt > receivedAt+skew.maxFuture {
+		if skew.action == REJECT_SKEW {
+			metrics.Add("movement_updates_skew_rejected", 1)
+			msg := fmt.Sprintf("OccurredAt %d too far from the current time in movement update", clientOccurredAt)
+			log.Println(msg)
+			http.Error(
+				writer,
+				msg,
+				http.StatusBadRequest)
+			return errors.New(msg)
+		}
+		metrics.Add("movement_updates_skew_clamped", 1)
+		occurredAt = receivedAt
+	}
+
+	update.OccurredAt = &occurredAt
+	return nil
+}
+
+// skewEstimator estimates how far each device's clock is behind the
+// server's from the recent differences between when its updates were
+// received and when it said they occurred. The smallest difference is used,
+// as network and offline delays only ever make it larger.
+type skewEstimator struct {
+	mutex   sync.Mutex
+	devices map[string]*deviceClock
+}
+
+type deviceClock struct {
+	offsets  []int
+	next     int
+	lastSeen int
+}
+
+func newSkewEstimator() *skewEstimator {
+	return &skewEstimator{devices: make(map[string]*deviceClock)}
+}
+
+// observe adds an offset for the device and returns its estimated skew and
+// the number of offsets it was estimated from
+func (se *skewEstimator) observe(uuid string, offset int, receivedAt int) (int, int) {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	device, ok := se.devices[uuid]
+	if !ok {
+		se.evict(receivedAt)
+		device = &deviceClock{}
+		se.devices[uuid] = device
+	}
+	device.lastSeen = receivedAt
+
+	// Keep the most recent offsets
+	if len(device.offsets) < SKEW_SAMPLES_PER_DEVICE {
+		device.offsets = append(device.offsets, offset)
+	} else {
+		device.offsets[device.next] = offset
+		device.next = (device.next + 1) % SKEW_SAMPLES_PER_DEVICE
+	}
+
+	estimate := device.offsets[0]
+	for _, o := range device.offsets[1:] {
+		if o < estimate {
+			estimate = o
+		}
+	}
+	return estimate, len(device.offsets)
+}
+
+// evict makes room for another device by forgetting idle ones, or every
+// device if none are idle. The mutex must be held.
+func (se *skewEstimator) evict(now int) {
+	if len(se.devices) < MAX_SKEW_DEVICES {
+		return
+	}
+	for uuid, device := range se.devices {
+		if now-device.lastSeen > SKEW_DEVICE_IDLE_SECONDS {
+			delete(se.devices, uuid)
+		}
+	}
+	if len(se.devices) >= MAX_SKEW_DEVICES {
+		se.devices = make(map[string]*deviceClock)
+	}
+}
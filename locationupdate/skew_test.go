@@ -0,0 +1,89 @@
+package locationupdate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func skewedUpdate(uuid string, occurredAt int) *Movement_update {
+	eventId, regionId, entering := 0, 1, true
+	return &Movement_update{
+		UUID:       &uuid,
+		EventID:    &eventId,
+		RegionID:   &regionId,
+		Entering:   &entering,
+		OccurredAt: &occurredAt,
+	}
+}
+
+func TestClockSkewWindow(t *testing.T) {
+	skew = skewPolicy{maxPast: 3600, maxFuture: 60, correction: 120, action: CLAMP_SKEW}
+	deviceClocks = newSkewEstimator()
+	const now = 1544018400
+
+	update := skewedUpdate("device-1970", 0)
+	if err := correctTimestamp(update, now, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if *update.OccurredAt != now || *update.ClientOccurredAt != 0 || *update.ReceivedAt != now {
+		t.Errorf("Expected a timestamp outside the window to be clamped. Got %+v", update)
+	}
+
+	update = skewedUpdate("device-delayed", now-600)
+	if err := correctTimestamp(update, now, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if *update.OccurredAt != now-600 {
+		t.Errorf("Expected a timestamp inside the window to be kept. Got %d", *update.OccurredAt)
+	}
+
+	skew.action = REJECT_SKEW
+	recorder := httptest.NewRecorder()
+	update = skewedUpdate("device-future", now+365*24*3600)
+	if err := correctTimestamp(update, now, recorder); err == nil {
+		t.Error("Expected a timestamp in the future to be rejected")
+	}
+	checkResponseCode(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestClockSkewCorrection(t *testing.T) {
+	skew = skewPolicy{maxPast: 3600, maxFuture: 60, correction: 120, action: REJECT_SKEW}
+	deviceClocks = newSkewEstimator()
+	const now = 1544018400
+
+	// A clock ten minutes fast is only corrected once it has been seen a few times
+	for i := 0; i < MIN_SKEW_SAMPLES; i++ {
+		update := skewedUpdate("device-fast", now+i*10+600)
+		err := correctTimestamp(update, now+i*10+5, httptest.NewRecorder())
+		if i < MIN_SKEW_SAMPLES-1 && err == nil {
+			t.Error("Expected an uncorrected timestamp in the future to be rejected")
+		}
+		if i == MIN_SKEW_SAMPLES-1 {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *update.OccurredAt != now+i*10+5 {
+				t.Errorf("Expected the timestamp to be corrected by the device's skew. Got %d", *update.OccurredAt-now)
+			}
+		}
+	}
+}
+
+func TestLateUpdatesAreNotCorrected(t *testing.T) {
+	skew = skewPolicy{maxPast: 3600, maxFuture: 60, correction: 120, action: REJECT_SKEW}
+	deviceClocks = newSkewEstimator()
+	const now = 1544018400
+
+	// Updates queued while the device was offline arrive together, long after
+	// they occurred
+	for i := 0; i < SKEW_SAMPLES_PER_DEVICE; i++ {
+		update := skewedUpdate("device-offline", now-1800+i*60)
+		if err := correctTimestamp(update, now, httptest.NewRecorder()); err != nil {
+			t.Fatal(err)
+		}
+		if *update.OccurredAt != now-1800+i*60 {
+			t.Errorf("Expected a late update to keep its timestamp. Got %d", *update.OccurredAt-now)
+		}
+	}
+}
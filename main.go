@@ -1,17 +1,94 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/consumer"
+	"github.com/real-time-footfall-analysis/rtfa-backend/kinesisqueue"
+	"github.com/real-time-footfall-analysis/rtfa-backend/replay"
+	"github.com/real-time-footfall-analysis/rtfa-backend/simulator"
 )
 
+// SHUTDOWN_TIMEOUT is how long requests in flight have to finish when the
+// server is stopped
+const SHUTDOWN_TIMEOUT = 20 * time.Second
+
 type TestMessage struct {
 	Message string `json:"message"`
 }
 
 func main() {
+	// Serve the API unless another mode is asked for
+	mode := "serve"
+	if len(os.Args) > 1 {
+		mode = os.Args[1]
+	}
+
+	switch mode {
+	case "serve":
+		serve()
+	case "consume":
+		// Records sent over a channel can only be read by the process
+		// sending them, which consumes them itself
+		if kinesisqueue.Backend() == kinesisqueue.CHANNEL_BACKEND {
+			log.Fatalf("Can't consume the %s queue backend from another process, serve consumes it", kinesisqueue.CHANNEL_BACKEND)
+		}
+		log.Fatal(consumer.Run())
+	case "replay":
+		err := replay.Run(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "simulate":
+		err := simulator.Run(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Unknown mode %q, expected serve, consume, replay or simulate", mode)
+	}
+}
+
+func serve() {
 	a := App{}
 	initialize(&a)
 
-	log.Fatal(http.ListenAndServe(":80", a.Router))
+	// Nothing else can read the updates sent over a channel
+	if kinesisqueue.Backend() == kinesisqueue.CHANNEL_BACKEND {
+		go func() {
+			log.Fatal(consumer.Run())
+		}()
+	}
+
+	server := &http.Server{Addr: ":80", Handler: a.Router}
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Finish the requests in flight and send on what they buffered before
+	// exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Println("Error finishing requests:", err)
+	}
+	err = shutdown(&a)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,34 @@
+package metrics
+
+import "sync"
+
+var (
+	mutex    sync.Mutex
+	counters = make(map[string]int64)
+)
+
+// Add adds delta to the named counter, creating it if needed
+func Add(name string, delta int64) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	counters[name] += delta
+}
+
+// Get returns the value of the named counter
+func Get(name string) int64 {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return counters[name]
+}
+
+// Snapshot returns the value of every counter
+func Snapshot() map[string]int64 {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	snapshot := make(map[string]int64, len(counters))
+	for name, value := range counters {
+		snapshot[name] = value
+	}
+	return snapshot
+}
@@ -0,0 +1,169 @@
+package notifications
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/pusher"
+)
+
+// notification_content is the text of a notification in one locale
+type notification_content struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// contentFor returns the text of the notification in the given locale,
+// falling back to the untranslated text
+func (notification *organiser_notification) contentFor(locale string) notification_content {
+	if translation, ok := notification.Translations[locale]; ok && locale != notification.Locale {
+		return translation
+	}
+	return notification_content{
+		Title:       notification.Title,
+		Description: notification.Description,
+	}
+}
+
+// locales returns every locale the notification has text in, starting with
+// the locale of the untranslated text
+func (notification *organiser_notification) locales() []string {
+	locales := []string{notification.Locale}
+	for locale := range notification.Translations {
+		if locale != notification.Locale {
+			locales = append(locales, locale)
+		}
+	}
+	sort.Strings(locales[1:])
+	return locales
+}
+
+// validateTranslations checks every translation is complete and in a
+// locale attendees of the event can receive
+func validateTranslations(notification organiser_notification, event *eventstaticdata.Event) error {
+	supported := make(map[string]bool)
+	for _, locale := range event.GetLocales() {
+		supported[locale] = true
+	}
+
+	if !supported[notification.Locale] {
+		return fmt.Errorf("Event %d does not support locale %s", event.ID, notification.Locale)
+	}
+	for locale, translation := range notification.Translations {
+		if !supported[locale] {
+			return fmt.Errorf("Event %d does not support locale %s", event.ID, locale)
+		}
+		if translation.Title == "" || translation.Description == "" {
+			return fmt.Errorf("Translation to %s is missing its title or description", locale)
+		}
+	}
+	return nil
+}
+
+// publishToLocales sends the notification to the attendees of each locale of
+// the event, in their locale where there is a translation. The title is
+// prefixed with prefix, and body replaces the description if it is not empty.
+// It records the publish IDs and delivery status on the notification.
+func publishToLocales(notification *organiser_notification, event *eventstaticdata.Event, interests []string, prefix string, body string) {
+	var sendErr error
+	notification.PublishIds = make(map[string]string)
+	for _, locale := range event.GetLocales() {
+		content := notification.contentFor(locale)
+		if body != "" {
+			content.Description = body
+		}
+
+		publishId, err := pb.SendNotification(pusher.LocaleInterests(interests, locale), prefix+content.Title, content.Description)
+		if err != nil && sendErr == nil {
+			sendErr = err
+		}
+		if publishId != "" {
+			notification.PublishIds[locale] = publishId
+		}
+	}
+
+	notification.PublishId = notification.PublishIds[event.GetDefaultLocale()]
+	notification.DeliveryStatus = deliveryStatus(sendErr)
+}
+
+// localise replaces the text of the notification with the translation that
+// best matches the Accept-Language header, if it has one
+func localise(notification *organiser_notification, acceptLanguage string) {
+	locale, ok := bestLocale(acceptLanguage, notification.locales())
+	if !ok || locale == notification.Locale {
+		return
+	}
+
+	content := notification.contentFor(locale)
+	notification.Title = content.Title
+	notification.Description = content.Description
+	notification.Locale = locale
+}
+
+// bestLocale picks the available locale that best matches an Accept-Language
+// header, preferring an exact match over one of the same language
+func bestLocale(acceptLanguage string, available []string) (string, bool) {
+	for _, wanted := range parseAcceptLanguage(acceptLanguage) {
+		if wanted == "*" && len(available) > 0 {
+			return available[0], true
+		}
+		for _, locale := range available {
+			if strings.EqualFold(locale, wanted) {
+				return locale, true
+			}
+		}
+		for _, locale := range available {
+			if strings.EqualFold(primaryLanguage(locale), primaryLanguage(wanted)) {
+				return locale, true
+			}
+		}
+	}
+	return "", false
+}
+
+// parseAcceptLanguage returns the language ranges of an Accept-Language
+// header, most preferred first
+func parseAcceptLanguage(header string) []string {
+	type languageRange struct {
+		tag     string
+		quality float64
+	}
+
+	var ranges []languageRange
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			ranges = append(ranges, languageRange{tag, quality})
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].quality > ranges[j].quality
+	})
+	tags := make([]string, len(ranges))
+	for i, r := range ranges {
+		tags[i] = r.tag
+	}
+	return tags
+}
+
+func primaryLanguage(locale string) string {
+	return strings.SplitN(locale, "-", 2)[0]
+}
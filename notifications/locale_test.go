@@ -0,0 +1,85 @@
+package notifications
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNotificationDeliveredPerLocale(t *testing.T) {
+	beam := &dummy_pusher_beam{}
+	pb = beam
+	defer func() { pb = &dummy_pusher_beam{} }()
+
+	sent := postTestNotification(t, 30, `{"title":"Gates open","description":"Welcome","regionIds":[3],"occurredAt":123456,
+		"translations":{"fr":{"title":"Portes ouvertes","description":"Bienvenue"}}}`)
+
+	if sent.Locale != "en" {
+		t.Errorf("Expected the untranslated text to be in the default locale. Got %s", sent.Locale)
+	}
+	expected := map[string]string{
+		"event-30-region-3-locale-en":    "[Gates open]",
+		"event-30-region-3-locale-fr":    "[Portes ouvertes]",
+		"event-30-region-3-locale-pt-BR": "[Gates open]",
+	}
+	for interest, titles := range expected {
+		if got := fmt.Sprint(beam.published[interest]); got != titles {
+			t.Errorf("Expected %s to receive %s. Got %s", interest, titles, got)
+		}
+	}
+	if len(sent.PublishIds) != 3 || sent.PublishId != publishKey {
+		t.Errorf("Expected a publish ID for each locale. Got %v", sent.PublishIds)
+	}
+}
+
+func TestNotificationWithUnsupportedLocale(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/events/30/notifications", strings.NewReader(
+		`{"title":"Gates open","description":"Welcome","regionIds":[3],"occurredAt":123456,
+		"translations":{"de":{"title":"Tore offen","description":"Willkommen"}}}`))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestGETInterestsForLocale(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/events/30/notifications/interests", nil)
+	req.Header.Set("Accept-Language", "de-DE, fr-CA;q=0.8, en;q=0.5")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if body := response.Body.String(); !strings.Contains(body, `"locale":"fr"`) || !strings.Contains(body, `"event":"event-30-locale-fr"`) {
+		t.Errorf("Expected the French interests. Got %s", body)
+	}
+}
+
+func TestLocalise(t *testing.T) {
+	notification := organiser_notification{
+		Title:       "Gates open",
+		Description: "Welcome",
+		Locale:      "en",
+		Translations: map[string]notification_content{
+			"fr":    {Title: "Portes ouvertes", Description: "Bienvenue"},
+			"pt-BR": {Title: "Portões abertos", Description: "Bem-vindo"},
+		},
+	}
+
+	localised := notification
+	localise(&localised, "pt, en;q=0.5")
+	if localised.Title != "Portões abertos" || localised.Locale != "pt-BR" {
+		t.Errorf("Expected the Brazilian Portuguese text. Got %+v", localised)
+	}
+
+	localised = notification
+	localise(&localised, "de")
+	if localised.Title != "Gates open" || localised.Locale != "en" {
+		t.Errorf("Expected the untranslated text. Got %+v", localised)
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	ranges := parseAcceptLanguage("fr-CH, fr;q=0.9, en;q=0.8, de;q=0, *;q=0.5")
+	if got := fmt.Sprint(ranges); got != "[fr-CH fr en *]" {
+		t.Errorf("Expected ranges in order of preference. Got %s", got)
+	}
+}
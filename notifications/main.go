@@ -1,20 +1,45 @@
 package notifications
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/mitchellh/mapstructure"
 	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
 	"github.com/real-time-footfall-analysis/rtfa-backend/pusher"
 	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
-	"hash/fnv"
 	"log"
 	"net/http"
 	"os"
-	"sort"
 	"strconv"
+	"time"
+)
+
+const (
+	MAX_IDEMPOTENCY_KEY_LENGTH = 255
+	// MAX_NOTIFICATION_ID is the largest integer JavaScript clients hold
+	// exactly, which notification IDs stay within
+	MAX_NOTIFICATION_ID = 1<<53 - 1
+	DEFAULT_PAGE_LIMIT  = 50
+	MAX_PAGE_LIMIT      = 200
+	// EVENT_INDEX_NAME is the index of the notifications table keyed by
+	// eventId and sorted by occurredAt
+	EVENT_INDEX_NAME = "eventId-occurredAt-index"
+	// DELIVERY_TIMEOUT is how long a notification stays pending before a
+	// retry takes to mean the request delivering it died, and delivers it
+	DELIVERY_TIMEOUT = 60 * time.Second
+)
+
+// Delivery statuses of a notification
+const (
+	DELIVERY_PENDING = "pending"
+	DELIVERY_SENT    = "sent"
+	DELIVERY_FAILED  = "failed"
 )
 
 type organiser_notification struct {
@@ -24,22 +49,72 @@ type organiser_notification struct {
 	OccurredAt     int    `json:"occurredAt"`
 	NotificationId int    `json:"notificationId"`
 	EventId        int    `json:"eventId"`
+	AllRegions     bool   `json:"allRegions,omitempty"`
+	Categories     []int  `json:"categories,omitempty"`
+	PublishId      string `json:"publishId"`
+	DeliveryStatus string `json:"deliveryStatus"`
+	// ClaimedAt is when delivery of the notification was last started
+	ClaimedAt int `json:"claimedAt,omitempty"`
+	// Locale is the locale of the title and description, and Translations
+	// holds their text in other locales
+	Locale       string                          `json:"locale,omitempty"`
+	Translations map[string]notification_content `json:"translations,omitempty"`
+	// TemplateId is the template the text was filled in from, using Variables
+	TemplateId string            `json:"templateId,omitempty"`
+	Variables  map[string]string `json:"variables,omitempty"`
+	// PublishIds holds the Beams publish ID of each locale delivered to
+	PublishIds map[string]string `json:"publishIds,omitempty"`
+	// Interests are the interests the notification was published to, which
+	// corrections and retractions are sent to as well
+	Interests []string `json:"interests,omitempty"`
+	// Revisions holds every earlier version of the notification, oldest first
+	Revisions   []notification_revision `json:"revisions,omitempty"`
+	Retracted   bool                    `json:"retracted,omitempty"`
+	RetractedAt int                     `json:"retractedAt,omitempty"`
+}
+
+// notification_page is a page of an event's notification history
+type notification_page struct {
+	Notifications []organiser_notification `json:"notifications"`
+	NextCursor    string                   `json:"nextCursor,omitempty"`
+}
+
+// event_interests lists the Pusher Beams interests a mobile client can
+// subscribe to for an event
+type event_interests struct {
+	Locale     string         `json:"locale"`
+	Event      string         `json:"event"`
+	Regions    map[int]string `json:"regions"`
+	Categories map[int]string `json:"categories"`
 }
 
 var db dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
 var pb pusher.PusherBeamsInterface = &pusher.PusherBeamsClient{}
 var pc pusher.PusherChannelInterface = &pusher.PusherChannelClient{}
+var sd eventstaticdata.StaticDataInterface = &eventstaticdata.StaticDataClient{}
 
 func Init(r *mux.Router) {
 	err := db.InitConn("notifications")
 	if err != nil {
 		os.Exit(1)
 	}
+	err = templates.InitConn("notification_templates")
+	if err != nil {
+		os.Exit(1)
+	}
 
 	pb.InitConn()
 	pc.InitConn()
 	r.HandleFunc("/events/{eventId}/notifications", postNotification).Methods("POST")
 	r.HandleFunc("/events/{eventId}/notifications", getAllNotifications).Methods("GET")
+	r.HandleFunc("/events/{eventId}/notifications/interests", getInterests).Methods("GET")
+	r.HandleFunc("/events/{eventId}/notifications/{notificationId}", patchNotification).Methods("PATCH")
+	r.HandleFunc("/events/{eventId}/notifications/{notificationId}", retractNotification).Methods("DELETE")
+	r.HandleFunc("/events/{eventId}/notification-templates", postTemplate).Methods("POST")
+	r.HandleFunc("/events/{eventId}/notification-templates", getAllTemplates).Methods("GET")
+	r.HandleFunc("/events/{eventId}/notification-templates/{templateId}", getTemplateHandler).Methods("GET")
+	r.HandleFunc("/events/{eventId}/notification-templates/{templateId}", putTemplate).Methods("PUT")
+	r.HandleFunc("/events/{eventId}/notification-templates/{templateId}", deleteTemplate).Methods("DELETE")
 }
 
 func postNotification(writer http.ResponseWriter, request *http.Request) {
@@ -65,14 +140,89 @@ func postNotification(writer http.ResponseWriter, request *http.Request) {
 	}
 	notification.EventId = eventId
 
-	// Send the notification to pusher beams
-	regions := intsToStrings(notification.RegionIds)
-	publishId, err := pb.SendNotification(regions, notification.Title, notification.Description)
+	// Check the targets against the regions of the event
+	regions, err := sd.GetRegions(eventId)
+	if err != nil {
+		log.Println("Error getting regions for event", eventId, err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to get regions of event: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+	interests, err := resolveTargets(&notification, regions)
+	if err != nil {
+		log.Println(err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Invalid notification targets: %s", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	// Check the translations against the locales of the event
+	event, ok := getEvent(writer, eventId)
+	if !ok {
+		return
+	}
+	if notification.TemplateId != "" && !applyTemplate(writer, &notification, event, regions) {
+		return
+	}
+	if notification.Locale == "" {
+		notification.Locale = event.GetDefaultLocale()
+	}
+	err = validateTranslations(notification, event)
+	if err != nil {
+		log.Println(err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Invalid notification translations: %s", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	// Give the notification its ID, which is derived from the idempotency
+	// key when there is one so retries of the same request collide
+	notification.NotificationId, err = notificationId(eventId, request.Header.Get("Idempotency-Key"))
+	if err != nil {
+		log.Println(err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Invalid Idempotency-Key: %s", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	// Record the notification before sending it, unless a previous
+	// request with the same idempotency key already has
+	notification.PublishId = ""
+	notification.PublishIds = nil
+	notification.Interests = interests
+	notification.DeliveryStatus = DELIVERY_PENDING
+	notification.ClaimedAt = int(time.Now().Unix())
+	stored, err := db.SendItemIf(notification, "attribute_not_exists(notificationId)", nil)
+	if err != nil {
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to record notification: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+	if !stored {
+		// Deliver the notification recorded by an earlier request which
+		// died before it could, or return it as it is
+		notification, stored = claimAbandonedNotification(notification.NotificationId)
+		if !stored {
+			returnExistingNotification(writer, notification.NotificationId)
+			return
+		}
+		interests = notification.Interests
+	}
 
-	// Generate a hash based on the response
-	notification.NotificationId = hashString(publishId)
+	// Send the notification to pusher beams in each locale
+	publishToLocales(&notification, event, interests, "", "")
 
-	// Send the item to the database
+	// Record the outcome of the delivery in the database
 	db.SendItem(notification)
 
 	// Send the notification to web app through pusher
@@ -99,28 +249,95 @@ func decodeNotification(writer http.ResponseWriter, request *http.Request) (orga
 	return notification, err
 }
 
-func hashString(str string) int {
-	h := fnv.New32a()
-	_, _ = h.Write([]byte(str))
-	return int(h.Sum32())
+// notificationId returns a new random notification ID, or the ID belonging
+// to the idempotency key if one was given
+func notificationId(eventId int, idempotencyKey string) (int, error) {
+	b := make([]byte, 8)
+	if idempotencyKey == "" {
+		if _, err := rand.Read(b); err != nil {
+			return 0, err
+		}
+	} else {
+		if len(idempotencyKey) > MAX_IDEMPOTENCY_KEY_LENGTH {
+			return 0, fmt.Errorf("key longer than %d characters", MAX_IDEMPOTENCY_KEY_LENGTH)
+		}
+
+		// Keys are only unique within an event
+		h := sha256.Sum256([]byte(fmt.Sprintf("notification:%d:%s", eventId, idempotencyKey)))
+		copy(b, h[:])
+	}
+	return int(binary.BigEndian.Uint64(b) & MAX_NOTIFICATION_ID), nil
 }
 
-func intsToStrings(ints []int) []string {
-	var strings []string = make([]string, len(ints))
-	for i := 0; i < len(ints); i++ {
-		strings[i] = strconv.Itoa(ints[i])
+// getNotification returns the stored notification with the ID, or false if
+// there is none
+func getNotification(notificationId int) (organiser_notification, bool, error) {
+	var notification organiser_notification
+	rows, _, err := db.QueryItems(dynamoDB.Query{
+		PKeyColName: "notificationId",
+		PKeyValue:   notificationId,
+		Limit:       1,
+	})
+	if err != nil || len(rows) == 0 {
+		return notification, false, err
 	}
-	return strings
+	_ = mapstructure.Decode(rows[0], &notification)
+	return notification, true, nil
+}
+
+// claimAbandonedNotification takes over delivery of the notification with
+// the ID if it has been pending for longer than DELIVERY_TIMEOUT, returning
+// whether it did
+func claimAbandonedNotification(notificationId int) (organiser_notification, bool) {
+	existing, ok, err := getNotification(notificationId)
+	if err != nil || !ok {
+		return organiser_notification{NotificationId: notificationId}, false
+	}
+	now := time.Now()
+	if existing.DeliveryStatus != DELIVERY_PENDING || existing.Retracted ||
+		now.Sub(time.Unix(int64(existing.ClaimedAt), 0)) < DELIVERY_TIMEOUT {
+		return existing, false
+	}
+
+	// Only one retry claims it, and only if nothing else changed it since
+	condition := "deliveryStatus = :pending AND attribute_not_exists(retracted) AND attribute_not_exists(claimedAt)"
+	values := map[string]interface{}{":pending": DELIVERY_PENDING}
+	if existing.ClaimedAt != 0 {
+		condition = "deliveryStatus = :pending AND attribute_not_exists(retracted) AND claimedAt = :claimedAt"
+		values[":claimedAt"] = existing.ClaimedAt
+	}
+	existing.ClaimedAt = int(now.Unix())
+	claimed, err := db.SendItemIf(existing, condition, values)
+	if err != nil || !claimed {
+		return existing, false
+	}
+	log.Printf("Delivering notification %d abandoned while pending", notificationId)
+	return existing, true
+}
+
+// returnExistingNotification sends back a notification that was already
+// posted, without sending it again
+func returnExistingNotification(writer http.ResponseWriter, notificationId int) {
+	existing, ok, err := getNotification(notificationId)
+	if err != nil || !ok {
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to get notification %d", notificationId),
+			http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(writer).Encode(existing)
 }
 
 func validateNotification(notification organiser_notification, writer http.ResponseWriter) error {
 	// Check the fields in the data
+	// Notifications sent from a template get their text from it
 	msg := ""
-	if len(notification.Title) == 0 {
+	if len(notification.Title) == 0 && notification.TemplateId == "" {
 		msg = "title is empty"
-	} else if len(notification.Description) == 0 {
+	} else if len(notification.Description) == 0 && notification.TemplateId == "" {
 		msg = "Description is empty"
-	} else if notification.RegionIds == nil || len(notification.RegionIds) == 0 {
+	} else if len(notification.RegionIds) == 0 && len(notification.Categories) == 0 && !notification.AllRegions {
 		msg = "No regions specified"
 	} else if notification.OccurredAt == 0 {
 		msg = "occurredAt timestamp missing"
@@ -150,36 +367,189 @@ func getAllNotifications(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// Scan the table, parse the result and filter out old events
-	unparsedRows := db.GetTableScan()
-	var parsedRows []organiser_notification = make([]organiser_notification, len(unparsedRows))
-	for index, row := range unparsedRows {
-		_ = mapstructure.Decode(row, &parsedRows[index])
+	// Get the optional filters
+	since, err := parseOptionalQueryArg(request, "since", writer)
+	if err != nil {
+		return
+	}
+	until, err := parseOptionalQueryArg(request, "until", writer)
+	if err != nil {
+		return
+	}
+	if since != nil && until != nil && *since > *until {
+		http.Error(
+			writer,
+			fmt.Sprint("since must not be after until"),
+			http.StatusBadRequest)
+		return
+	}
+	regionId, err := parseOptionalQueryArg(request, "regionId", writer)
+	if err != nil {
+		return
+	}
+	limit, err := parseOptionalQueryArg(request, "limit", writer)
+	if err != nil {
+		return
+	}
+	if limit == nil {
+		defaultLimit := DEFAULT_PAGE_LIMIT
+		limit = &defaultLimit
+	} else if *limit <= 0 || *limit > MAX_PAGE_LIMIT {
+		http.Error(
+			writer,
+			fmt.Sprintf("limit must be between 1 and %d", MAX_PAGE_LIMIT),
+			http.StatusBadRequest)
+		return
 	}
 
-	// Extract relevant values
-	eventNotifications := extractRecentUpdates(parsedRows, eventId)
+	// Query the event's notifications, newest first
+	query := dynamoDB.Query{
+		IndexName:   EVENT_INDEX_NAME,
+		PKeyColName: "eventId",
+		PKeyValue:   eventId,
+		SortColName: "occurredAt",
+		SortFrom:    since,
+		SortTo:      until,
+		Descending:  true,
+		Limit:       *limit,
+		Cursor:      request.URL.Query().Get("cursor"),
+	}
+	if regionId != nil {
+		query.ContainsCol = "regionIds"
+		query.ContainsValue = *regionId
+	}
+	unparsedRows, nextCursor, err := queryPage(query)
+	if err == dynamoDB.ErrInvalidCursor {
+		http.Error(
+			writer,
+			fmt.Sprintf("Invalid cursor"),
+			http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to get notifications: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
 
-	// Sort the values by timestamp descending
-	sort.Slice(eventNotifications, func(i, j int) bool {
-		return eventNotifications[i].OccurredAt > eventNotifications[j].OccurredAt
-	})
+	// Parse the result
+	page := notification_page{
+		Notifications: make([]organiser_notification, len(unparsedRows)),
+		NextCursor:    nextCursor,
+	}
+	for index, row := range unparsedRows {
+		_ = mapstructure.Decode(row, &page.Notifications[index])
+	}
+
+	// Give each notification in the language the client asked for
+	writer.Header().Set("Vary", "Accept-Language")
+	if acceptLanguage := request.Header.Get("Accept-Language"); acceptLanguage != "" {
+		for index := range page.Notifications {
+			localise(&page.Notifications[index], acceptLanguage)
+		}
+	}
 
 	// Transmit the result back
-	_ = json.NewEncoder(writer).Encode(eventNotifications)
+	_ = json.NewEncoder(writer).Encode(page)
 }
 
-func extractRecentUpdates(parsed []organiser_notification, event int) (res []organiser_notification) {
-	// Remove the values that don't satisfy a criteria
-	deleted := 0
-	for i := range parsed {
-		j := i - deleted
-		if parsed[j].EventId != event {
-			parsed = parsed[:j+copy(parsed[j:], parsed[j+1:])]
-			deleted++
+// queryPage runs the query until it has filled a page or read to the end.
+// The region filter is applied after the limit, so a single query can come
+// back short or empty while more matches follow.
+func queryPage(query dynamoDB.Query) ([]map[string]interface{}, string, error) {
+	limit := query.Limit
+	var rows []map[string]interface{}
+	for {
+		page, cursor, err := db.QueryItems(query)
+		if err != nil {
+			return nil, "", err
+		}
+		rows = append(rows, page...)
+		if cursor == "" || len(rows) >= limit {
+			return rows, cursor, nil
 		}
+		query.Cursor = cursor
+		query.Limit = limit - len(rows)
 	}
-	return parsed
+}
+
+func getInterests(writer http.ResponseWriter, request *http.Request) {
+
+	// Allow cross origin
+	utils.SetAccessControlHeaders(writer)
+
+	// Get the event id
+	vars := mux.Vars(request)
+	eventId, err := parseRequestArgs(vars, "eventId", writer)
+	if err != nil {
+		return
+	}
+
+	// Get the regions of the event
+	regions, err := sd.GetRegions(eventId)
+	if err != nil {
+		log.Println("Error getting regions for event", eventId, err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to get regions of event: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	// Pick the locale the client wants notifications in
+	event, ok := getEvent(writer, eventId)
+	if !ok {
+		return
+	}
+	wanted := request.URL.Query().Get("locale")
+	if wanted == "" {
+		wanted = request.Header.Get("Accept-Language")
+	}
+	locale, ok := bestLocale(wanted, event.GetLocales())
+	if !ok {
+		locale = event.GetDefaultLocale()
+	}
+
+	// Transmit the interests back
+	_ = json.NewEncoder(writer).Encode(buildInterests(eventId, regions, locale))
+}
+
+func buildInterests(eventId int, regions []eventstaticdata.Region, locale string) event_interests {
+	interests := event_interests{
+		Locale:     locale,
+		Event:      pusher.LocaleInterest(pusher.EventInterest(eventId), locale),
+		Regions:    make(map[int]string),
+		Categories: make(map[int]string),
+	}
+	for _, region := range regions {
+		interests.Regions[int(region.ID)] = pusher.LocaleInterest(pusher.RegionInterest(eventId, int(region.ID)), locale)
+		interests.Categories[int(region.Cat)] = pusher.LocaleInterest(pusher.CategoryInterest(eventId, int(region.Cat)), locale)
+	}
+	return interests
+}
+
+// getEvent gets the event from the static data, responding with an error
+// if it can't
+func getEvent(writer http.ResponseWriter, eventId int) (*eventstaticdata.Event, bool) {
+	event, err := sd.GetEvent(eventId)
+	if eventstaticdata.IsNotFound(err) {
+		http.Error(
+			writer,
+			fmt.Sprintf("Event %d not found", eventId),
+			http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Println("Error getting event", eventId, err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to get event: %s", err),
+			http.StatusInternalServerError)
+		return nil, false
+	}
+	return event, true
 }
 
 func parseRequestArgs(vars map[string]string, varName string, writer http.ResponseWriter) (int, error) {
@@ -193,3 +563,20 @@ func parseRequestArgs(vars map[string]string, varName string, writer http.Respon
 	}
 	return id, err
 }
+
+func parseOptionalQueryArg(request *http.Request, varName string, writer http.ResponseWriter) (*int, error) {
+	str := request.URL.Query().Get(varName)
+	if str == "" {
+		return nil, nil
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		log.Println("Cannot decode query parameter "+varName, err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to decode %s: %s", varName, err),
+			http.StatusBadRequest)
+		return nil, err
+	}
+	return &value, nil
+}
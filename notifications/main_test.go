@@ -3,13 +3,19 @@ package notifications
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/go-pg/pg"
 	"github.com/gorilla/mux"
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
 	"net/http"
 	"net/http/httptest"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 var router *mux.Router
@@ -19,8 +25,10 @@ const publishKey = "PublishKey"
 func init() {
 	// Use dummy connections
 	db = &dummy_db{}
+	templates = &dummy_template_db{dummy_db{key: "templateId"}}
 	pb = &dummy_pusher_beam{}
 	pc = &dummy_pusher{}
+	sd = &dummy_static_data{}
 
 	router = mux.NewRouter()
 	Init(router)
@@ -32,7 +40,7 @@ func TestGETNotificationWithValues(t *testing.T) {
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
-	expected := "[{\"title\":\"test\",\"description\":\"test\",\"regionIds\":[55,55,55],\"occurredAt\":100,\"notificationId\":55,\"eventId\":55}]"
+	expected := "{\"notifications\":[{\"title\":\"test\",\"description\":\"test\",\"regionIds\":[55,55,55],\"occurredAt\":100,\"notificationId\":55,\"eventId\":55,\"publishId\":\"\",\"deliveryStatus\":\"sent\"}]}"
 	body := response.Body.String()
 	if strings.TrimSpace(body) != expected {
 		t.Errorf("Expected %s. Got %s", expected, body)
@@ -45,7 +53,7 @@ func TestGETNotificationWithValuesSorted(t *testing.T) {
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
-	expected := "[{\"title\":\"test\",\"description\":\"test\",\"regionIds\":[99,99,99],\"occurredAt\":500,\"notificationId\":99,\"eventId\":99},{\"title\":\"test\",\"description\":\"test\",\"regionIds\":[99,99,99],\"occurredAt\":100,\"notificationId\":99,\"eventId\":99}]"
+	expected := "{\"notifications\":[{\"title\":\"test\",\"description\":\"test\",\"regionIds\":[99,99,99],\"occurredAt\":500,\"notificationId\":99,\"eventId\":99,\"publishId\":\"\",\"deliveryStatus\":\"sent\"},{\"title\":\"test\",\"description\":\"test\",\"regionIds\":[7],\"occurredAt\":300,\"notificationId\":99,\"eventId\":99,\"publishId\":\"\",\"deliveryStatus\":\"sent\"},{\"title\":\"test\",\"description\":\"test\",\"regionIds\":[99,99,99],\"occurredAt\":100,\"notificationId\":99,\"eventId\":99,\"publishId\":\"\",\"deliveryStatus\":\"sent\"}]}"
 	body := response.Body.String()
 	if strings.TrimSpace(body) != expected {
 		t.Errorf("Expected %s. Got %s", expected, body)
@@ -58,12 +66,95 @@ func TestGETNoResults(t *testing.T) {
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
-	expected := "[]"
+	expected := "{\"notifications\":[]}"
 	if body := response.Body.String(); strings.TrimSpace(body) != expected {
 		t.Errorf("Expected an empty list. Got %s", body)
 	}
 }
 
+func TestGETNotificationsBetween(t *testing.T) {
+	page := getNotificationPage(t, "/events/99/notifications?since=200&until=500")
+
+	if len(page.Notifications) != 2 || page.Notifications[0].OccurredAt != 500 || page.Notifications[1].OccurredAt != 300 {
+		t.Errorf("Expected the notifications at 500 and 300. Got %+v", page.Notifications)
+	}
+}
+
+func TestGETNotificationsForRegion(t *testing.T) {
+	page := getNotificationPage(t, "/events/99/notifications?regionId=7")
+
+	if len(page.Notifications) != 1 || page.Notifications[0].OccurredAt != 300 {
+		t.Errorf("Expected the notification sent to region 7. Got %+v", page.Notifications)
+	}
+}
+
+func TestGETNotificationsForRegionPaged(t *testing.T) {
+	// The newest notification isn't sent to the region, so filling the page
+	// takes more than one query
+	page := getNotificationPage(t, "/events/99/notifications?regionId=7&limit=1")
+	if len(page.Notifications) != 1 || page.Notifications[0].OccurredAt != 300 || page.NextCursor == "" {
+		t.Fatalf("Expected a full page with the notification sent to region 7. Got %+v", page)
+	}
+
+	page = getNotificationPage(t, "/events/99/notifications?regionId=7&limit=1&cursor="+page.NextCursor)
+	if len(page.Notifications) != 0 || page.NextCursor != "" {
+		t.Errorf("Expected no more notifications for region 7. Got %+v", page)
+	}
+}
+
+func TestGETNotificationsPaged(t *testing.T) {
+	page := getNotificationPage(t, "/events/99/notifications?limit=2")
+	if len(page.Notifications) != 2 || page.NextCursor == "" {
+		t.Fatalf("Expected a full first page with a cursor. Got %+v", page)
+	}
+
+	page = getNotificationPage(t, "/events/99/notifications?limit=2&cursor="+page.NextCursor)
+	if len(page.Notifications) != 1 || page.Notifications[0].OccurredAt != 100 || page.NextCursor != "" {
+		t.Errorf("Expected the last notification without a cursor. Got %+v", page)
+	}
+}
+
+func TestGETNotificationsInvalidLimit(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/events/99/notifications?limit=1000", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestNotificationToUnknownEvent(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/events/404/notifications", strings.NewReader(
+		`{"title":"title","description":"description","regionIds":[99],"occurredAt":123456}`))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestGETNotificationsInvalidRange(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/events/99/notifications?since=500&until=200", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestGETNotificationsInvalidCursor(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/events/99/notifications?cursor=garbage", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func getNotificationPage(t *testing.T, url string) notification_page {
+	req, _ := http.NewRequest("GET", url, nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var page notification_page
+	if err := json.NewDecoder(response.Body).Decode(&page); err != nil {
+		t.Fatalf("Unable to decode notification page: %s", err)
+	}
+	return page
+}
+
 func TestValidNotificationUpdate(t *testing.T) {
 	var buf bytes.Buffer
 
@@ -82,12 +173,294 @@ func TestValidNotificationUpdate(t *testing.T) {
 	req, _ := http.NewRequest("POST", "/events/99/notifications", &buf)
 	response := executeRequest(req)
 
-	publishId := strconv.Itoa(hashString(publishKey))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var sent organiser_notification
+	_ = json.NewDecoder(response.Body).Decode(&sent)
+	if sent.NotificationId <= 0 || sent.NotificationId > MAX_NOTIFICATION_ID {
+		t.Errorf("Expected a notification ID JavaScript clients can hold. Got %d", sent.NotificationId)
+	}
+	if sent.PublishId != publishKey || sent.DeliveryStatus != DELIVERY_SENT {
+		t.Errorf("Expected publish ID %s and status %s. Got %s and %s",
+			publishKey, DELIVERY_SENT, sent.PublishId, sent.DeliveryStatus)
+	}
+	if sent.Title != "title" || sent.EventId != 99 || fmt.Sprint(sent.RegionIds) != "[99]" {
+		t.Errorf("Unexpected notification returned: %+v", sent)
+	}
+}
+
+func TestFailedNotificationsGetDistinctIds(t *testing.T) {
+	pb = &dummy_pusher_beam{fail: true}
+	defer func() { pb = &dummy_pusher_beam{} }()
+
+	ids := make(map[int]bool)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/events/99/notifications", strings.NewReader(
+			`{"title":"title","description":"description","regionIds":[99],"occurredAt":123456}`))
+		response := executeRequest(req)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var sent organiser_notification
+		_ = json.NewDecoder(response.Body).Decode(&sent)
+		if sent.DeliveryStatus != DELIVERY_FAILED || sent.PublishId != "" {
+			t.Errorf("Expected a failed delivery without a publish ID. Got %+v", sent)
+		}
+		ids[sent.NotificationId] = true
+	}
+
+	if len(ids) != 2 {
+		t.Errorf("Expected failed notifications to have different IDs. Got %v", ids)
+	}
+}
+
+func TestIdempotentNotificationRetry(t *testing.T) {
+	beam := &dummy_pusher_beam{}
+	pb = beam
+	defer func() { pb = &dummy_pusher_beam{} }()
+
+	var ids []int
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/events/99/notifications", strings.NewReader(
+			`{"title":"title","description":"description","regionIds":[99],"occurredAt":123456}`))
+		req.Header.Set("Idempotency-Key", "retry-me")
+		response := executeRequest(req)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var sent organiser_notification
+		_ = json.NewDecoder(response.Body).Decode(&sent)
+		ids = append(ids, sent.NotificationId)
+	}
+
+	if ids[0] != ids[1] {
+		t.Errorf("Expected a retry to return the same notification. Got %v", ids)
+	}
+	if beam.sends != 1 {
+		t.Errorf("Expected the notification to be sent once. Sent %d times", beam.sends)
+	}
+}
+
+func TestRetryDeliversAbandonedNotification(t *testing.T) {
+	beam := &dummy_pusher_beam{}
+	pb = beam
+	defer func() { pb = &dummy_pusher_beam{} }()
+
+	// An earlier request recorded the notification but died before sending
+	// it, recently in one case and long enough ago to be given up in the
+	// other
+	for _, test := range []struct {
+		key       string
+		claimedAt time.Time
+		sends     int
+		status    string
+	}{
+		{"died-recently", time.Now(), 0, DELIVERY_PENDING},
+		{"died-long-ago", time.Now().Add(-2 * DELIVERY_TIMEOUT), 1, DELIVERY_SENT},
+	} {
+		id, _ := notificationId(99, test.key)
+		db.SendItem(organiser_notification{
+			Title:          "title",
+			Description:    "description",
+			RegionIds:      []int{99},
+			OccurredAt:     123456,
+			NotificationId: id,
+			EventId:        99,
+			Interests:      []string{"event-99-region-99"},
+			DeliveryStatus: DELIVERY_PENDING,
+			ClaimedAt:      int(test.claimedAt.Unix()),
+		})
+		beam.sends = 0
+
+		req, _ := http.NewRequest("POST", "/events/99/notifications", strings.NewReader(
+			`{"title":"title","description":"description","regionIds":[99],"occurredAt":123456}`))
+		req.Header.Set("Idempotency-Key", test.key)
+		response := executeRequest(req)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var sent organiser_notification
+		_ = json.NewDecoder(response.Body).Decode(&sent)
+		if sent.NotificationId != id || sent.DeliveryStatus != test.status || beam.sends != test.sends {
+			t.Errorf("Expected %s to be %s after %d sends. Got %s after %d", test.key, test.status, test.sends, sent.DeliveryStatus, beam.sends)
+		}
+	}
+}
+
+func TestNotificationSentToEventScopedInterests(t *testing.T) {
+	var buf bytes.Buffer
+
+	beam := &dummy_pusher_beam{}
+	pb = beam
+	defer func() { pb = &dummy_pusher_beam{} }()
+
+	update := organiser_notification{
+		RegionIds:   []int{3, 4},
+		OccurredAt:  123456,
+		Title:       "title",
+		Description: "description",
+	}
+
+	err := json.NewEncoder(&buf).Encode(&update)
+	if err != nil {
+		t.Error("Unable to encode update struct to json")
+	}
+
+	req, _ := http.NewRequest("POST", "/events/12/notifications", &buf)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	expected := "[event-12-region-3-locale-en event-12-region-4-locale-en]"
+	if interests := fmt.Sprint(beam.interests); interests != expected {
+		t.Errorf("Expected interests %s. Got %s", expected, interests)
+	}
+}
+
+func TestNotificationToUnknownRegion(t *testing.T) {
+	var buf bytes.Buffer
+
+	update := organiser_notification{
+		RegionIds:   []int{3, 7},
+		OccurredAt:  123456,
+		Title:       "title",
+		Description: "description",
+	}
+
+	err := json.NewEncoder(&buf).Encode(&update)
+	if err != nil {
+		t.Error("Unable to encode update struct to json")
+	}
+
+	req, _ := http.NewRequest("POST", "/events/12/notifications", &buf)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+	expected := "Regions [7] do not belong to event 12"
+	if body := response.Body.String(); !strings.Contains(body, expected) {
+		t.Errorf("Expected error: %s. Got %s", expected, body)
+	}
+}
+
+func TestNotificationToAllRegions(t *testing.T) {
+	var buf bytes.Buffer
+
+	beam := &dummy_pusher_beam{}
+	pb = beam
+	defer func() { pb = &dummy_pusher_beam{} }()
+
+	update := organiser_notification{
+		AllRegions:  true,
+		OccurredAt:  123456,
+		Title:       "title",
+		Description: "description",
+	}
+
+	err := json.NewEncoder(&buf).Encode(&update)
+	if err != nil {
+		t.Error("Unable to encode update struct to json")
+	}
+
+	req, _ := http.NewRequest("POST", "/events/12/notifications", &buf)
+	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
-	expected := "{\"title\":\"title\",\"description\":\"description\",\"regionIds\":[99,99,99],\"occurredAt\":123456,\"notificationId\":" + publishId + ",\"eventId\":99}\n"
-	body := response.Body.String()
-	if body != expected {
+	if interests := fmt.Sprint(beam.interests); interests != "[event-12-locale-en]" {
+		t.Errorf("Expected the event-wide interest. Got %s", interests)
+	}
+	var sent organiser_notification
+	_ = json.NewDecoder(response.Body).Decode(&sent)
+	if regions := fmt.Sprint(sent.RegionIds); regions != "[3 4 99]" {
+		t.Errorf("Expected every region of the event. Got %s", regions)
+	}
+}
+
+func TestNotificationToCategory(t *testing.T) {
+	var buf bytes.Buffer
+
+	beam := &dummy_pusher_beam{}
+	pb = beam
+	defer func() { pb = &dummy_pusher_beam{} }()
+
+	update := organiser_notification{
+		Categories:  []int{1},
+		RegionIds:   []int{99},
+		OccurredAt:  123456,
+		Title:       "title",
+		Description: "description",
+	}
+
+	err := json.NewEncoder(&buf).Encode(&update)
+	if err != nil {
+		t.Error("Unable to encode update struct to json")
+	}
+
+	req, _ := http.NewRequest("POST", "/events/12/notifications", &buf)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if interests := fmt.Sprint(beam.interests); interests != "[event-12-category-1-locale-en event-12-region-99-locale-en]" {
+		t.Errorf("Expected the category and region interests. Got %s", interests)
+	}
+	var sent organiser_notification
+	_ = json.NewDecoder(response.Body).Decode(&sent)
+	if regions := fmt.Sprint(sent.RegionIds); regions != "[3 4 99]" {
+		t.Errorf("Expected the category to expand to its regions. Got %s", regions)
+	}
+}
+
+func TestNotificationToRepeatedTargets(t *testing.T) {
+	var buf bytes.Buffer
+
+	beam := &dummy_pusher_beam{}
+	pb = beam
+	defer func() { pb = &dummy_pusher_beam{} }()
+
+	update := organiser_notification{
+		Categories:  []int{1, 1},
+		RegionIds:   []int{99, 99},
+		OccurredAt:  123456,
+		Title:       "title",
+		Description: "description",
+	}
+
+	err := json.NewEncoder(&buf).Encode(&update)
+	if err != nil {
+		t.Error("Unable to encode update struct to json")
+	}
+
+	req, _ := http.NewRequest("POST", "/events/12/notifications", &buf)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if interests := fmt.Sprint(beam.interests); interests != "[event-12-category-1-locale-en event-12-region-99-locale-en]" {
+		t.Errorf("Expected each interest to be published to once. Got %s", interests)
+	}
+}
+
+func TestNotificationToUnknownCategory(t *testing.T) {
+	var buf bytes.Buffer
+
+	update := organiser_notification{
+		Categories:  []int{5},
+		OccurredAt:  123456,
+		Title:       "title",
+		Description: "description",
+	}
+
+	err := json.NewEncoder(&buf).Encode(&update)
+	if err != nil {
+		t.Error("Unable to encode update struct to json")
+	}
+
+	req, _ := http.NewRequest("POST", "/events/12/notifications", &buf)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestGETInterests(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/events/12/notifications/interests", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	expected := "{\"locale\":\"en\",\"event\":\"event-12-locale-en\",\"regions\":{\"3\":\"event-12-region-3-locale-en\",\"4\":\"event-12-region-4-locale-en\",\"99\":\"event-12-region-99-locale-en\"},\"categories\":{\"1\":\"event-12-category-1-locale-en\",\"2\":\"event-12-category-2-locale-en\"}}"
+	if body := response.Body.String(); strings.TrimSpace(body) != expected {
 		t.Errorf("Expected %s. Got %s", expected, body)
 	}
 }
@@ -191,7 +564,13 @@ func checkResponseCode(t *testing.T, expected, actual int) {
 ***************************/
 
 type dummy_db struct {
-	t *testing.T
+	t     *testing.T
+	items map[string]map[string]interface{}
+	// key is the primary key column, notificationId if not set
+	key string
+	// conflict fails the conditions on revisions, as if another request
+	// had changed the notification
+	conflict bool
 }
 
 func (dq *dummy_db) InitConn(tableName string) error {
@@ -200,15 +579,67 @@ func (dq *dummy_db) InitConn(tableName string) error {
 
 func (db *dummy_db) GetTableScan() []map[string]interface{} {
 	// Make a fake table and insert a row
-	tableScan := make([]map[string]interface{}, 3)
+	tableScan := make([]map[string]interface{}, 4)
 	tableScan[0] = db.makeRow(99, 100, "test")
 	tableScan[1] = db.makeRow(99, 500, "test")
 	tableScan[2] = db.makeRow(55, 100, "test")
+	tableScan[3] = db.makeRow(99, 300, "test")
+	tableScan[3]["regionIds"] = []int{7}
 
-	fmt.Println(tableScan)
 	return tableScan
 }
 
+func (db *dummy_db) QueryItems(query dynamoDB.Query) ([]map[string]interface{}, string, error) {
+	// Notifications are looked up by their ID among those stored
+	if query.PKeyColName == "notificationId" {
+		row, ok := db.store()[fmt.Sprint(query.PKeyValue)]
+		if !ok {
+			return nil, "", nil
+		}
+		return []map[string]interface{}{row}, "", nil
+	}
+
+	// Select the rows of the event in the range
+	var rows []map[string]interface{}
+	for _, row := range db.GetTableScan() {
+		occurredAt := row["occurredAt"].(int)
+		if row[query.PKeyColName] != query.PKeyValue ||
+			(query.SortFrom != nil && occurredAt < *query.SortFrom) ||
+			(query.SortTo != nil && occurredAt > *query.SortTo) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i]["occurredAt"].(int) > rows[j]["occurredAt"].(int)
+	})
+
+	// The cursor is the index of the next row
+	start := 0
+	if query.Cursor != "" {
+		var err error
+		start, err = strconv.Atoi(query.Cursor)
+		if err != nil {
+			return nil, "", dynamoDB.ErrInvalidCursor
+		}
+	}
+	end := start + query.Limit
+	cursor := strconv.Itoa(end)
+	if end >= len(rows) {
+		end = len(rows)
+		cursor = ""
+	}
+
+	// Filter after limiting, as DynamoDB does
+	page := make([]map[string]interface{}, 0)
+	for _, row := range rows[start:end] {
+		if query.ContainsCol == "" || strings.Contains(fmt.Sprint(row[query.ContainsCol]), fmt.Sprint(query.ContainsValue)) {
+			page = append(page, row)
+		}
+	}
+	return page, cursor, nil
+}
+
 func (db *dummy_db) makeRow(n int, time int, s string) map[string]interface{} {
 	// Use the same number, string, and bool for all values to make testing easier
 
@@ -217,6 +648,7 @@ func (db *dummy_db) makeRow(n int, time int, s string) map[string]interface{} {
 	row["eventId"] = n
 	row["notificationId"] = n
 	row["occurredAt"] = time
+	row["deliveryStatus"] = DELIVERY_SENT
 
 	row["title"] = s
 	row["description"] = s
@@ -228,13 +660,85 @@ func (db *dummy_db) makeRow(n int, time int, s string) map[string]interface{} {
 }
 
 func (db *dummy_db) SendItem(req interface{}) {
-	return
+	row := toRow(req)
+	db.store()[db.rowKey(row)] = row
+}
+
+func (db *dummy_db) SendItemIf(req interface{}, condition string, values map[string]interface{}) (bool, error) {
+	// Only the condition used when first recording notifications is checked
+	row := toRow(req)
+	_, exists := db.store()[db.rowKey(row)]
+	if exists && condition == "attribute_not_exists(notificationId)" {
+		return false, nil
+	}
+	if db.conflict && strings.Contains(condition, "revisions") {
+		return false, nil
+	}
+	db.store()[db.rowKey(row)] = row
+	return true, nil
 }
 
 func (db *dummy_db) GetItem(pKeyColName string, pKeyValue string) map[string]interface{} {
+	return db.store()[pKeyValue]
+}
+
+func (db *dummy_db) DeleteItem(pKeyColName string, pKeyValue string) error {
+	delete(db.store(), pKeyValue)
 	return nil
 }
 
+func (db *dummy_db) keyCol() string {
+	if db.key == "" {
+		return "notificationId"
+	}
+	return db.key
+}
+
+// rowKey is the key a row is stored under, the text of its primary key
+func (db *dummy_db) rowKey(row map[string]interface{}) string {
+	if id, ok := row[db.keyCol()].(float64); ok {
+		return strconv.Itoa(int(id))
+	}
+	return fmt.Sprint(row[db.keyCol()])
+}
+
+func (db *dummy_db) store() map[string]map[string]interface{} {
+	if db.items == nil {
+		db.items = make(map[string]map[string]interface{})
+	}
+	return db.items
+}
+
+// toRow converts an item to the row the database would hold
+func toRow(req interface{}) map[string]interface{} {
+	data, _ := json.Marshal(req)
+	row := make(map[string]interface{})
+	_ = json.Unmarshal(data, &row)
+	return row
+}
+
+func (db *dummy_db) IncrementCounter(pKeyColName string, pKeyValue string, counterColName string) (int, error) {
+	return 0, nil
+}
+
+/***************************
+   FAKE Template Database
+***************************/
+
+type dummy_template_db struct {
+	dummy_db
+}
+
+func (db *dummy_template_db) QueryItems(query dynamoDB.Query) ([]map[string]interface{}, string, error) {
+	rows := make([]map[string]interface{}, 0)
+	for _, row := range db.store() {
+		if int(row["eventId"].(float64)) == query.PKeyValue {
+			rows = append(rows, row)
+		}
+	}
+	return rows, "", nil
+}
+
 /***************************
    FAKE Pusher queue
 ***************************/
@@ -256,13 +760,61 @@ func (pc *dummy_pusher) SendItem(channelName string, eventName string, data []by
 ***************************/
 
 type dummy_pusher_beam struct {
-	ct *testing.T
+	ct        *testing.T
+	interests []string
+	title     string
+	sends     int
+	fail      bool
+	// published maps each interest to the titles sent to it
+	published map[string][]string
 }
 
 func (pbc *dummy_pusher_beam) InitConn() {
 	return
 }
 
-func (pbc *dummy_pusher_beam) SendNotification(regionIds []string, title string, body string) (publishId string, err error) {
+func (pbc *dummy_pusher_beam) SendNotification(interests []string, title string, body string) (publishId string, err error) {
+	pbc.interests = interests
+	pbc.title = title
+	pbc.sends++
+	if pbc.published == nil {
+		pbc.published = make(map[string][]string)
+	}
+	for _, interest := range interests {
+		pbc.published[interest] = append(pbc.published[interest], title)
+	}
+	if pbc.fail {
+		return "", errors.New("Beams unavailable")
+	}
 	return publishKey, nil
 }
+
+/***************************
+   FAKE Static data
+***************************/
+
+type dummy_static_data struct{}
+
+func (sd *dummy_static_data) GetEvents() ([]eventstaticdata.Event, error) {
+	return nil, nil
+}
+
+func (sd *dummy_static_data) GetEvent(eventID int) (*eventstaticdata.Event, error) {
+	// Event 404 doesn't exist
+	if eventID == 404 {
+		return nil, pg.ErrNoRows
+	}
+	// Event 30 is multilingual
+	if eventID == 30 {
+		return &eventstaticdata.Event{ID: int32(eventID), DefaultLocale: "en", Locales: []string{"fr", "pt-BR"}}, nil
+	}
+	return &eventstaticdata.Event{ID: int32(eventID)}, nil
+}
+
+func (sd *dummy_static_data) GetRegions(eventID int) ([]eventstaticdata.Region, error) {
+	return []eventstaticdata.Region{
+		{ID: 3, Name: "Main Stage", EventID: int32(eventID), Cat: 1},
+		{ID: 4, Name: "Food Court", EventID: int32(eventID), Cat: 1},
+		{ID: 99, EventID: int32(eventID), Cat: 2},
+	}, nil
+}
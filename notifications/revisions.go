@@ -0,0 +1,283 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/real-time-footfall-analysis/rtfa-backend/pusher"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const (
+	CORRECTION_PREFIX = "Correction: "
+	RETRACTION_PREFIX = "Retracted: "
+	RETRACTION_BODY   = "Please disregard this notification."
+)
+
+// notification_revision is an earlier version of a notification, kept for audit
+type notification_revision struct {
+	Title          string                          `json:"title"`
+	Description    string                          `json:"description"`
+	Translations   map[string]notification_content `json:"translations,omitempty"`
+	PublishId      string                          `json:"publishId"`
+	PublishIds     map[string]string               `json:"publishIds,omitempty"`
+	DeliveryStatus string                          `json:"deliveryStatus"`
+	RevisedAt      int                             `json:"revisedAt"`
+}
+
+// notification_patch holds the fields of a notification an organiser can
+// correct. Translations are merged into the existing ones.
+type notification_patch struct {
+	Title        *string                         `json:"title"`
+	Description  *string                         `json:"description"`
+	Translations map[string]notification_content `json:"translations"`
+}
+
+func patchNotification(writer http.ResponseWriter, request *http.Request) {
+	// Allow cross origin
+	utils.SetAccessControlHeaders(writer)
+
+	notification, ok := getStoredNotification(writer, request)
+	if !ok {
+		return
+	}
+	if notification.Retracted {
+		http.Error(
+			writer,
+			fmt.Sprintf("Notification %d has been retracted", notification.NotificationId),
+			http.StatusConflict)
+		return
+	}
+
+	// Try and decode the correction
+	var patch notification_patch
+	err := json.NewDecoder(request.Body).Decode(&patch)
+	if err != nil {
+		log.Println("Cannot decode notification patch:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to decode notification patch: %s", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	// Keep the current version and apply the correction
+	revisions := len(notification.Revisions)
+	notification.Revisions = append(notification.Revisions, currentRevision(notification))
+	if patch.Title != nil {
+		notification.Title = *patch.Title
+	}
+	if patch.Description != nil {
+		notification.Description = *patch.Description
+	}
+	if len(patch.Translations) > 0 {
+		translations := make(map[string]notification_content)
+		for locale, translation := range notification.Translations {
+			translations[locale] = translation
+		}
+		for locale, translation := range patch.Translations {
+			translations[locale] = translation
+		}
+		notification.Translations = translations
+	}
+	err = validateNotification(notification, writer)
+	if err != nil {
+		return
+	}
+	event, ok := getEvent(writer, notification.EventId)
+	if !ok {
+		return
+	}
+	err = validateTranslations(notification, event)
+	if err != nil {
+		log.Println(err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Invalid notification translations: %s", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	// Store the correction, unless someone else changed the notification
+	// first, and only then tell the attendees about it
+	if !storeRevision(writer, &notification, revisions) {
+		return
+	}
+	publishToLocales(&notification, event, storedInterests(notification), CORRECTION_PREFIX, "")
+	recordDelivery(notification)
+
+	// Send the correction to web app through pusher
+	data, _ := json.Marshal(notification)
+	pc.SendItem(strconv.Itoa(notification.EventId), "organiser-notification-updated", data)
+
+	// Return the corrected notification to the user
+	_ = json.NewEncoder(writer).Encode(notification)
+}
+
+func retractNotification(writer http.ResponseWriter, request *http.Request) {
+	// Allow cross origin
+	utils.SetAccessControlHeaders(writer)
+
+	notification, ok := getStoredNotification(writer, request)
+	if !ok {
+		return
+	}
+
+	// Retracting twice changes nothing
+	if notification.Retracted {
+		_ = json.NewEncoder(writer).Encode(notification)
+		return
+	}
+
+	event, ok := getEvent(writer, notification.EventId)
+	if !ok {
+		return
+	}
+
+	// Keep the current version and mark the notification as retracted
+	revisions := len(notification.Revisions)
+	notification.Revisions = append(notification.Revisions, currentRevision(notification))
+	notification.Retracted = true
+	notification.RetractedAt = int(time.Now().Unix())
+
+	// Store the retraction, unless someone else changed the notification
+	// first, and only then tell the attendees to disregard the notification
+	if !storeRevision(writer, &notification, revisions) {
+		return
+	}
+	publishToLocales(&notification, event, storedInterests(notification), RETRACTION_PREFIX, RETRACTION_BODY)
+	recordDelivery(notification)
+
+	// Send the retraction to web app through pusher
+	data, _ := json.Marshal(notification)
+	pc.SendItem(strconv.Itoa(notification.EventId), "organiser-notification-retracted", data)
+
+	// Return the retracted notification to the user
+	_ = json.NewEncoder(writer).Encode(notification)
+}
+
+// getStoredNotification loads the notification named in the request URL,
+// responding with an error if it isn't part of the event in the URL
+func getStoredNotification(writer http.ResponseWriter, request *http.Request) (organiser_notification, bool) {
+	var notification organiser_notification
+
+	// Get the event id
+	vars := mux.Vars(request)
+	eventId, err := parseRequestArgs(vars, "eventId", writer)
+	if err != nil {
+		return notification, false
+	}
+
+	// Get the notification
+	notificationId, err := strconv.Atoi(vars["notificationId"])
+	if err != nil {
+		http.Error(
+			writer,
+			fmt.Sprintf("Notification %s not found in event %d", vars["notificationId"], eventId),
+			http.StatusNotFound)
+		return notification, false
+	}
+	notification, ok, err := getNotification(notificationId)
+	if err != nil {
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to get notification %d: %s", notificationId, err),
+			http.StatusInternalServerError)
+		return notification, false
+	}
+	if !ok || notification.EventId != eventId {
+		http.Error(
+			writer,
+			fmt.Sprintf("Notification %d not found in event %d", notificationId, eventId),
+			http.StatusNotFound)
+		return notification, false
+	}
+
+	return notification, true
+}
+
+// storeRevision writes back a changed notification, pending delivery, as
+// long as it still has the number of revisions it was loaded with and hasn't
+// been retracted since
+func storeRevision(writer http.ResponseWriter, notification *organiser_notification, revisions int) bool {
+	condition := "attribute_not_exists(retracted) AND attribute_not_exists(revisions)"
+	values := map[string]interface{}{}
+	if revisions > 0 {
+		condition = "attribute_not_exists(retracted) AND size(revisions) = :revisions"
+		values[":revisions"] = revisions
+	}
+
+	notification.PublishId = ""
+	notification.PublishIds = nil
+	notification.DeliveryStatus = DELIVERY_PENDING
+	notification.ClaimedAt = int(time.Now().Unix())
+	stored, err := db.SendItemIf(*notification, condition, values)
+	if err != nil {
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to update notification: %s", err),
+			http.StatusInternalServerError)
+		return false
+	}
+	if !stored {
+		http.Error(
+			writer,
+			fmt.Sprintf("Notification %d was changed by another request, try again", notification.NotificationId),
+			http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// recordDelivery records the outcome of delivering a stored revision,
+// unless the notification has been revised again since
+func recordDelivery(notification organiser_notification) {
+	stored, err := db.SendItemIf(notification, "size(revisions) = :revisions",
+		map[string]interface{}{":revisions": len(notification.Revisions)})
+	if err != nil || !stored {
+		log.Printf("Unable to record delivery of notification %d: %v", notification.NotificationId, err)
+	}
+}
+
+// currentRevision captures the current version of a notification
+func currentRevision(notification organiser_notification) notification_revision {
+	return notification_revision{
+		Title:          notification.Title,
+		Description:    notification.Description,
+		Translations:   notification.Translations,
+		PublishId:      notification.PublishId,
+		PublishIds:     notification.PublishIds,
+		DeliveryStatus: notification.DeliveryStatus,
+		RevisedAt:      int(time.Now().Unix()),
+	}
+}
+
+// storedInterests returns the interests a stored notification was sent to.
+// Notifications stored before their interests were kept are sent to the
+// interests of their regions and categories.
+func storedInterests(notification organiser_notification) []string {
+	if len(notification.Interests) > 0 {
+		return notification.Interests
+	}
+	if notification.AllRegions {
+		return []string{pusher.EventInterest(notification.EventId)}
+	}
+
+	var interests []string
+	for _, category := range notification.Categories {
+		interests = append(interests, pusher.CategoryInterest(notification.EventId, category))
+	}
+	return uniqueInterests(append(interests, pusher.RegionInterests(notification.EventId, notification.RegionIds)...))
+}
+
+func deliveryStatus(err error) string {
+	if err != nil {
+		return DELIVERY_FAILED
+	}
+	return DELIVERY_SENT
+}
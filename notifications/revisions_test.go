@@ -0,0 +1,116 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPatchNotification(t *testing.T) {
+	beam := &dummy_pusher_beam{}
+	pb = beam
+	defer func() { pb = &dummy_pusher_beam{} }()
+
+	original := postTestNotification(t, 12, `{"title":"Exit B closed","description":"Use exit A","categories":[1],"occurredAt":123456}`)
+
+	req, _ := http.NewRequest("PATCH", "/events/12/notifications/"+strconv.Itoa(original.NotificationId), strings.NewReader(`{"title":"Exit C closed"}`))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var patched organiser_notification
+	_ = json.NewDecoder(response.Body).Decode(&patched)
+	if patched.Title != "Exit C closed" || patched.Description != "Use exit A" {
+		t.Errorf("Expected the title to be corrected. Got %+v", patched)
+	}
+	if len(patched.Revisions) != 1 || patched.Revisions[0].Title != "Exit B closed" || patched.Revisions[0].PublishId != publishKey {
+		t.Errorf("Expected the original to be kept as a revision. Got %+v", patched.Revisions)
+	}
+	if beam.title != CORRECTION_PREFIX+"Exit C closed" {
+		t.Errorf("Expected a correction to be published. Got %s", beam.title)
+	}
+	if interests := fmt.Sprint(beam.interests); interests != "[event-12-category-1-locale-en]" {
+		t.Errorf("Expected the correction to reach the original audience. Got %s", interests)
+	}
+}
+
+func TestRetractNotification(t *testing.T) {
+	beam := &dummy_pusher_beam{}
+	pb = beam
+	defer func() { pb = &dummy_pusher_beam{} }()
+
+	original := postTestNotification(t, 12, `{"title":"Evacuate","description":"Leave now","allRegions":true,"occurredAt":123456}`)
+
+	req, _ := http.NewRequest("DELETE", "/events/12/notifications/"+strconv.Itoa(original.NotificationId), nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var retracted organiser_notification
+	_ = json.NewDecoder(response.Body).Decode(&retracted)
+	if !retracted.Retracted || retracted.RetractedAt == 0 {
+		t.Errorf("Expected the notification to be retracted. Got %+v", retracted)
+	}
+	if len(retracted.Revisions) != 1 || retracted.Revisions[0].Title != "Evacuate" {
+		t.Errorf("Expected the original to be kept as a revision. Got %+v", retracted.Revisions)
+	}
+	if beam.title != RETRACTION_PREFIX+"Evacuate" || fmt.Sprint(beam.interests) != "[event-12-locale-en]" {
+		t.Errorf("Expected a retraction to be published to the event. Got %s to %v", beam.title, beam.interests)
+	}
+
+	// A retracted notification can't be corrected
+	req, _ = http.NewRequest("PATCH", "/events/12/notifications/"+strconv.Itoa(original.NotificationId), strings.NewReader(`{"title":"Stay"}`))
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusConflict, response.Code)
+}
+
+func TestConflictingPatchIsNotPublished(t *testing.T) {
+	beam := &dummy_pusher_beam{}
+	pb = beam
+	defer func() { pb = &dummy_pusher_beam{} }()
+
+	original := postTestNotification(t, 12, `{"title":"Exit B closed","description":"Use exit A","regionIds":[3],"occurredAt":123456}`)
+
+	// Another request changes the notification before the correction is stored
+	notifications := db.(*dummy_db)
+	notifications.conflict = true
+	defer func() { notifications.conflict = false }()
+
+	req, _ := http.NewRequest("PATCH", "/events/12/notifications/"+strconv.Itoa(original.NotificationId), strings.NewReader(`{"title":"Exit C closed"}`))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusConflict, response.Code)
+	if beam.sends != 1 {
+		t.Errorf("Expected a correction which wasn't stored not to be published. Sent %d times", beam.sends)
+	}
+}
+
+func TestPatchNotificationOfOtherEvent(t *testing.T) {
+	original := postTestNotification(t, 12, `{"title":"title","description":"description","regionIds":[3],"occurredAt":123456}`)
+
+	req, _ := http.NewRequest("PATCH", "/events/13/notifications/"+strconv.Itoa(original.NotificationId), strings.NewReader(`{"title":"other"}`))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestRetractUnknownNotification(t *testing.T) {
+	req, _ := http.NewRequest("DELETE", "/events/12/notifications/unknown", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func postTestNotification(t *testing.T, eventId int, body string) organiser_notification {
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/events/%d/notifications", eventId), strings.NewReader(body))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var notification organiser_notification
+	if err := json.NewDecoder(response.Body).Decode(&notification); err != nil {
+		t.Fatalf("Unable to decode notification: %s", err)
+	}
+	return notification
+}
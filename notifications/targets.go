@@ -0,0 +1,98 @@
+package notifications
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/pusher"
+)
+
+// resolveTargets checks the regions and categories a notification targets
+// belong to the event, expands "all regions" and category targets into the
+// matching region IDs, and returns the interests to publish to
+func resolveTargets(notification *organiser_notification, regions []eventstaticdata.Region) ([]string, error) {
+	eventId := notification.EventId
+
+	// Index the regions of the event
+	known := make(map[int]bool, len(regions))
+	categories := make(map[int][]int)
+	for _, region := range regions {
+		known[int(region.ID)] = true
+		categories[int(region.Cat)] = append(categories[int(region.Cat)], int(region.ID))
+	}
+
+	// Reject regions that are not part of this event
+	var unknown []int
+	for _, regionId := range notification.RegionIds {
+		if !known[regionId] {
+			unknown = append(unknown, regionId)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("Regions %v do not belong to event %d", unknown, eventId)
+	}
+
+	// Reject categories that no region of this event is in
+	for _, category := range notification.Categories {
+		if _, ok := categories[category]; !ok {
+			return nil, fmt.Errorf("No region of event %d is in category %d", eventId, category)
+		}
+	}
+
+	// Everyone at the event is reached through the event-wide interest
+	if notification.AllRegions {
+		if len(regions) == 0 {
+			return nil, errors.New("Event has no regions to notify")
+		}
+		regionIds := make([]int, 0, len(regions))
+		for regionId := range known {
+			regionIds = append(regionIds, regionId)
+		}
+		notification.RegionIds = sortedUnique(regionIds)
+		return []string{pusher.EventInterest(eventId)}, nil
+	}
+
+	// Otherwise target each category and each explicitly listed region.
+	// Each interest is only published to once, as a device subscribed to
+	// an interest twice over would otherwise receive the notification twice.
+	var interests []string
+	notification.Categories = sortedUnique(notification.Categories)
+	regionIds := notification.RegionIds
+	for _, category := range notification.Categories {
+		interests = append(interests, pusher.CategoryInterest(eventId, category))
+		regionIds = append(regionIds, categories[category]...)
+	}
+	interests = append(interests, pusher.RegionInterests(eventId, sortedUnique(notification.RegionIds))...)
+	notification.RegionIds = sortedUnique(regionIds)
+
+	return uniqueInterests(interests), nil
+}
+
+// uniqueInterests returns the interests without repeats, in the order they
+// were first given
+func uniqueInterests(interests []string) []string {
+	seen := make(map[string]bool, len(interests))
+	unique := make([]string, 0, len(interests))
+	for _, interest := range interests {
+		if !seen[interest] {
+			seen[interest] = true
+			unique = append(unique, interest)
+		}
+	}
+	return unique
+}
+
+func sortedUnique(ints []int) []int {
+	seen := make(map[int]bool, len(ints))
+	unique := make([]int, 0, len(ints))
+	for _, i := range ints {
+		if !seen[i] {
+			seen[i] = true
+			unique = append(unique, i)
+		}
+	}
+	sort.Ints(unique)
+	return unique
+}
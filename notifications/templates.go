@@ -0,0 +1,364 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mitchellh/mapstructure"
+	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const (
+	// TEMPLATE_INDEX_NAME is the index of the templates table keyed by eventId
+	TEMPLATE_INDEX_NAME = "eventId-index"
+	// TIME_FORMAT is how the {time} placeholder is written when no time is given
+	TIME_FORMAT = "15:04"
+)
+
+// placeholderPattern matches placeholders such as {regionName} in templates
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z][A-Za-z0-9_]*)\}`)
+
+// notification_template is a reusable notification. Its text can contain
+// placeholders which are filled in when a notification is sent from it:
+//
+//	{regionName}  the names of the regions the notification is sent to
+//	{eventName}   the name of the event
+//	{time}        the time the notification occurred at, in UTC
+//
+// along with any other placeholder given a value in the notification's variables.
+type notification_template struct {
+	TemplateId   string                          `json:"templateId"`
+	EventId      int                             `json:"eventId"`
+	Name         string                          `json:"name"`
+	Title        string                          `json:"title"`
+	Description  string                          `json:"description"`
+	Locale       string                          `json:"locale,omitempty"`
+	Translations map[string]notification_content `json:"translations,omitempty"`
+}
+
+var templates dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+
+func postTemplate(writer http.ResponseWriter, request *http.Request) {
+	// Allow cross origin
+	utils.SetAccessControlHeaders(writer)
+
+	template, ok := decodeTemplate(writer, request)
+	if !ok {
+		return
+	}
+
+	// Give the template a new ID
+	templateId, err := utils.NewUUID()
+	if err != nil {
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to create template: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+	template.TemplateId = templateId
+
+	// Send the item to the database
+	templates.SendItem(template)
+
+	// Return the template to the user
+	_ = json.NewEncoder(writer).Encode(template)
+}
+
+func getAllTemplates(writer http.ResponseWriter, request *http.Request) {
+	// Allow cross origin
+	utils.SetAccessControlHeaders(writer)
+
+	// Get the event id
+	vars := mux.Vars(request)
+	eventId, err := parseRequestArgs(vars, "eventId", writer)
+	if err != nil {
+		return
+	}
+
+	// Query every template of the event
+	var rows []map[string]interface{}
+	cursor := ""
+	for {
+		var page []map[string]interface{}
+		page, cursor, err = templates.QueryItems(dynamoDB.Query{
+			IndexName:   TEMPLATE_INDEX_NAME,
+			PKeyColName: "eventId",
+			PKeyValue:   eventId,
+			Cursor:      cursor,
+		})
+		if err != nil {
+			http.Error(
+				writer,
+				fmt.Sprintf("Failed to get templates: %s", err),
+				http.StatusInternalServerError)
+			return
+		}
+		rows = append(rows, page...)
+		if cursor == "" {
+			break
+		}
+	}
+
+	// Parse the result and sort it by name
+	eventTemplates := make([]notification_template, len(rows))
+	for index, row := range rows {
+		_ = mapstructure.Decode(row, &eventTemplates[index])
+	}
+	sort.Slice(eventTemplates, func(i, j int) bool {
+		return eventTemplates[i].Name < eventTemplates[j].Name
+	})
+
+	// Transmit the result back
+	_ = json.NewEncoder(writer).Encode(eventTemplates)
+}
+
+func getTemplateHandler(writer http.ResponseWriter, request *http.Request) {
+	// Allow cross origin
+	utils.SetAccessControlHeaders(writer)
+
+	template, ok := getStoredTemplate(writer, request)
+	if !ok {
+		return
+	}
+
+	_ = json.NewEncoder(writer).Encode(template)
+}
+
+func putTemplate(writer http.ResponseWriter, request *http.Request) {
+	// Allow cross origin
+	utils.SetAccessControlHeaders(writer)
+
+	existing, ok := getStoredTemplate(writer, request)
+	if !ok {
+		return
+	}
+
+	template, ok := decodeTemplate(writer, request)
+	if !ok {
+		return
+	}
+	template.TemplateId = existing.TemplateId
+
+	// Replace the stored template
+	templates.SendItem(template)
+
+	_ = json.NewEncoder(writer).Encode(template)
+}
+
+func deleteTemplate(writer http.ResponseWriter, request *http.Request) {
+	// Allow cross origin
+	utils.SetAccessControlHeaders(writer)
+
+	template, ok := getStoredTemplate(writer, request)
+	if !ok {
+		return
+	}
+
+	err := templates.DeleteItem("templateId", template.TemplateId)
+	if err != nil {
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to delete template: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	_ = json.NewEncoder(writer).Encode(template)
+}
+
+// decodeTemplate decodes and validates the template in the request body,
+// for the event in the request URL
+func decodeTemplate(writer http.ResponseWriter, request *http.Request) (notification_template, bool) {
+	var template notification_template
+
+	// Get the event id
+	vars := mux.Vars(request)
+	eventId, err := parseRequestArgs(vars, "eventId", writer)
+	if err != nil {
+		return template, false
+	}
+
+	// Try and decode the data
+	err = json.NewDecoder(request.Body).Decode(&template)
+	if err != nil {
+		log.Println("Cannot decode notification template:", err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Failed to decode notification template: %s", err),
+			http.StatusBadRequest)
+		return template, false
+	}
+	template.EventId = eventId
+
+	// Check the fields in the data
+	msg := ""
+	if template.Name == "" {
+		msg = "name is empty"
+	} else if template.Title == "" {
+		msg = "title is empty"
+	} else if template.Description == "" {
+		msg = "Description is empty"
+	}
+	for locale, translation := range template.Translations {
+		if translation.Title == "" || translation.Description == "" {
+			msg = "Translation to " + locale + " is missing its title or description"
+		}
+	}
+	if msg != "" {
+		log.Println(msg)
+		http.Error(
+			writer,
+			msg,
+			http.StatusBadRequest)
+		return template, false
+	}
+
+	// Check the locales against those of the event, so a template which
+	// can't be sent is refused now rather than when it is used
+	event, ok := getEvent(writer, eventId)
+	if !ok {
+		return template, false
+	}
+	content := organiser_notification{Locale: template.Locale, Translations: template.Translations}
+	if content.Locale == "" {
+		content.Locale = event.GetDefaultLocale()
+	}
+	err = validateTranslations(content, event)
+	if err != nil {
+		log.Println(err)
+		http.Error(
+			writer,
+			fmt.Sprintf("Invalid template translations: %s", err),
+			http.StatusBadRequest)
+		return template, false
+	}
+
+	return template, true
+}
+
+// getStoredTemplate loads the template named in the request URL, responding
+// with an error if it isn't part of the event in the URL
+func getStoredTemplate(writer http.ResponseWriter, request *http.Request) (notification_template, bool) {
+	vars := mux.Vars(request)
+	eventId, err := parseRequestArgs(vars, "eventId", writer)
+	if err != nil {
+		return notification_template{}, false
+	}
+
+	return loadTemplate(writer, eventId, vars["templateId"])
+}
+
+// loadTemplate gets a template of the event, responding with an error if
+// there isn't one with that ID
+func loadTemplate(writer http.ResponseWriter, eventId int, templateId string) (notification_template, bool) {
+	var template notification_template
+
+	row := templates.GetItem("templateId", templateId)
+	if row != nil {
+		_ = mapstructure.Decode(row, &template)
+	}
+	if row == nil || template.TemplateId != templateId || template.EventId != eventId {
+		http.Error(
+			writer,
+			fmt.Sprintf("Template %s not found in event %d", templateId, eventId),
+			http.StatusNotFound)
+		return template, false
+	}
+
+	return template, true
+}
+
+// applyTemplate fills in the text of a notification from its template,
+// responding with an error if the template can't be used
+func applyTemplate(writer http.ResponseWriter, notification *organiser_notification, event *eventstaticdata.Event, regions []eventstaticdata.Region) bool {
+	template, ok := loadTemplate(writer, notification.EventId, notification.TemplateId)
+	if !ok {
+		return false
+	}
+
+	// Work out the value of every placeholder
+	values := templateValues(notification, event, regions)
+
+	// Fill in the text in every locale
+	var missing []string
+	render := func(text string) string {
+		return placeholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+			name := placeholder[1 : len(placeholder)-1]
+			value, ok := values[name]
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+	}
+	notification.Title = render(template.Title)
+	notification.Description = render(template.Description)
+	notification.Locale = template.Locale
+	notification.Translations = nil
+	if len(template.Translations) > 0 {
+		notification.Translations = make(map[string]notification_content)
+		for locale, translation := range template.Translations {
+			notification.Translations[locale] = notification_content{
+				Title:       render(translation.Title),
+				Description: render(translation.Description),
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		msg := fmt.Sprintf("No value for template placeholders: %s", strings.Join(sortedUniqueStrings(missing), ", "))
+		log.Println(msg)
+		http.Error(
+			writer,
+			msg,
+			http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// templateValues returns the value of each placeholder for a notification,
+// with the notification's own variables taking precedence
+func templateValues(notification *organiser_notification, event *eventstaticdata.Event, regions []eventstaticdata.Region) map[string]string {
+	names := make(map[int]string, len(regions))
+	for _, region := range regions {
+		names[int(region.ID)] = region.Name
+	}
+	regionNames := make([]string, len(notification.RegionIds))
+	for i, regionId := range notification.RegionIds {
+		regionNames[i] = names[regionId]
+	}
+
+	values := map[string]string{
+		"regionName": strings.Join(regionNames, ", "),
+		"eventName":  event.Name,
+		"time":       time.Unix(int64(notification.OccurredAt), 0).UTC().Format(TIME_FORMAT),
+	}
+	for name, value := range notification.Variables {
+		values[name] = value
+	}
+	return values
+}
+
+func sortedUniqueStrings(strs []string) []string {
+	seen := make(map[string]bool, len(strs))
+	unique := make([]string, 0, len(strs))
+	for _, str := range strs {
+		if !seen[str] {
+			seen[str] = true
+			unique = append(unique, str)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
@@ -0,0 +1,124 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTemplateCRUD(t *testing.T) {
+	// Create
+	template := postTestTemplate(t, 40, `{"name":"Closure","title":"{regionName} closed","description":"Closed at {time}"}`)
+	if len(template.TemplateId) != 36 || template.EventId != 40 {
+		t.Fatalf("Expected a new template of event 40. Got %+v", template)
+	}
+	url := fmt.Sprintf("/events/40/notification-templates/%s", template.TemplateId)
+
+	// Update
+	req, _ := http.NewRequest("PUT", url, strings.NewReader(`{"name":"Closure","title":"{regionName} is closed","description":"Closed at {time}"}`))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	// Read
+	req, _ = http.NewRequest("GET", url, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var read notification_template
+	_ = json.NewDecoder(response.Body).Decode(&read)
+	if read.Title != "{regionName} is closed" {
+		t.Errorf("Expected the updated template. Got %+v", read)
+	}
+
+	// List
+	req, _ = http.NewRequest("GET", "/events/40/notification-templates", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var list []notification_template
+	_ = json.NewDecoder(response.Body).Decode(&list)
+	if len(list) != 1 || list[0].TemplateId != template.TemplateId {
+		t.Errorf("Expected the event's template to be listed. Got %+v", list)
+	}
+
+	// Templates of other events can't be reached
+	req, _ = http.NewRequest("GET", "/events/41/notification-templates/"+template.TemplateId, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	// Delete
+	req, _ = http.NewRequest("DELETE", url, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", url, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestInvalidTemplate(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/events/40/notification-templates", strings.NewReader(`{"name":"Empty","title":"title"}`))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestTemplateInUnsupportedLocale(t *testing.T) {
+	for _, body := range []string{
+		`{"name":"Closed","title":"Geschlossen","description":"Bitte warten","locale":"de"}`,
+		`{"name":"Closed","title":"Closed","description":"Please wait","translations":{"de":{"title":"Geschlossen","description":"Bitte warten"}}}`,
+	} {
+		req, _ := http.NewRequest("POST", "/events/30/notification-templates", strings.NewReader(body))
+		response := executeRequest(req)
+
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+	}
+
+	req, _ := http.NewRequest("POST", "/events/30/notification-templates", strings.NewReader(
+		`{"name":"Closed","title":"Fermé","description":"Attendez","locale":"fr"}`))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+func TestNotificationFromTemplate(t *testing.T) {
+	template := postTestTemplate(t, 12, `{"name":"Closure","title":"{regionName} closed",
+		"description":"{regionName} closed at {time}, use {exit}"}`)
+
+	notification := postTestNotification(t, 12, `{"templateId":"`+template.TemplateId+`","regionIds":[3,4],
+		"occurredAt":1540945705,"variables":{"exit":"exit B"}}`)
+
+	if notification.Title != "Main Stage, Food Court closed" {
+		t.Errorf("Expected the region names in the title. Got %s", notification.Title)
+	}
+	if notification.Description != "Main Stage, Food Court closed at 00:28, use exit B" {
+		t.Errorf("Expected the placeholders in the description to be filled in. Got %s", notification.Description)
+	}
+	if notification.TemplateId != template.TemplateId {
+		t.Errorf("Expected the notification to record its template. Got %s", notification.TemplateId)
+	}
+}
+
+func TestNotificationFromTemplateMissingVariable(t *testing.T) {
+	template := postTestTemplate(t, 12, `{"name":"Meet","title":"Meet at {place}","description":"At {time}"}`)
+
+	req, _ := http.NewRequest("POST", "/events/12/notifications", strings.NewReader(
+		`{"templateId":"`+template.TemplateId+`","regionIds":[3],"occurredAt":123456}`))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+	if body := response.Body.String(); !strings.Contains(body, "place") {
+		t.Errorf("Expected the missing placeholder to be named. Got %s", body)
+	}
+}
+
+func postTestTemplate(t *testing.T, eventId int, body string) notification_template {
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/events/%d/notification-templates", eventId), strings.NewReader(body))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var template notification_template
+	if err := json.NewDecoder(response.Body).Decode(&template); err != nil {
+		t.Fatalf("Unable to decode template: %s", err)
+	}
+	return template
+}
@@ -0,0 +1,165 @@
+package privacy
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/auth"
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const (
+	// SUPPRESS leaves out counts below the minimum
+	SUPPRESS = "suppress"
+	// BUCKET rounds every count down to a multiple of the minimum, so small
+	// counts read as none and changes of a single person can't be seen
+	BUCKET = "bucket"
+
+	DEFAULT_MIN_REPORTED_COUNT = 5
+)
+
+// Policy says how counts of people are reported, so that no count picks out
+// fewer than MinCount people
+type Policy struct {
+	MinCount int
+	Mode     string
+}
+
+// Exact reports counts as they are
+var Exact = Policy{MinCount: 1, Mode: SUPPRESS}
+
+// PrivacyInterface gives the policy counts of an event are reported under
+type PrivacyInterface interface {
+	ForEvent(eventID int) Policy
+}
+
+// Events reads each event's minimum count from its static data, falling
+// back to RTFA_MIN_REPORTED_COUNT for events which don't set one. The mode
+// is RTFA_PRIVACY_MODE, "suppress" (the default) or "bucket".
+var Events = &EventPrivacy{
+	events:   eventstaticdata.Index,
+	minCount: utils.GetEnvInt("RTFA_MIN_REPORTED_COUNT", DEFAULT_MIN_REPORTED_COUNT),
+	mode:     loadMode(),
+}
+
+func loadMode() string {
+	mode := utils.GetEnv("RTFA_PRIVACY_MODE", SUPPRESS)
+	if mode != SUPPRESS && mode != BUCKET {
+		log.Printf("Unknown privacy mode %q, using %s", mode, SUPPRESS)
+		return SUPPRESS
+	}
+	return mode
+}
+
+// EventPrivacy gives the policy configured for each event
+type EventPrivacy struct {
+	events   eventstaticdata.EventIndexInterface
+	minCount int
+	mode     string
+}
+
+// ForEvent returns the event's policy. The default minimum is used if the
+// event can't be read, so counts are never reported exactly by mistake.
+func (ep *EventPrivacy) ForEvent(eventID int) Policy {
+	policy := Policy{MinCount: ep.minCount, Mode: ep.mode}
+
+	regions, err := ep.events.GetEventRegions(eventID)
+	if err != nil {
+		log.Printf("Error reading privacy settings of event %d: %s", eventID, err)
+		return policy
+	}
+	if regions != nil && regions.Event.MinReportedCount > 0 {
+		policy.MinCount = int(regions.Event.MinReportedCount)
+	}
+	return policy
+}
+
+// ForRequest returns the policy to report the event's counts to the request
+// under. Stewards see exact counts, as they need to find people in danger.
+func ForRequest(policies PrivacyInterface, request *http.Request, eventID int) Policy {
+	if auth.IsSteward(request) {
+		return Exact
+	}
+	return policies.ForEvent(eventID)
+}
+
+// Count returns the count to report, and false if it shouldn't be reported
+func (p Policy) Count(count int) (int, bool) {
+	if p.MinCount <= 1 {
+		return count, true
+	}
+	if p.Mode == BUCKET {
+		count -= count % p.MinCount
+	}
+	return count, count >= p.MinCount
+}
+
+// Counts returns the counts which can be reported, keyed as given
+func (p Policy) Counts(counts map[int]int) map[int]int {
+	reported := make(map[int]int, len(counts))
+	for key, count := range counts {
+		if count, ok := p.Count(count); ok {
+			reported[key] = count
+		}
+	}
+	return reported
+}
+
+// Fields applies the policy to the named fields of an analytics result,
+// which hold counts of people, leaving the other fields as they are
+func (p Policy) Fields(result map[string]interface{}, fields []string) {
+	for _, field := range fields {
+		value, ok := result[field]
+		if !ok {
+			continue
+		}
+		reported, ok := p.value(value)
+		if ok {
+			result[field] = reported
+		} else {
+			delete(result, field)
+		}
+	}
+}
+
+// Result applies the policy to every number in an analytics result, for
+// results whose fields aren't known, treating them all as counts of
+// people. Numbers which can't be reported are left out of maps and are null
+// in lists, to keep the positions of the others.
+func (p Policy) Result(result map[string]interface{}) {
+	for key, value := range result {
+		reported, ok := p.value(value)
+		if ok {
+			result[key] = reported
+		} else {
+			delete(result, key)
+		}
+	}
+}
+
+func (p Policy) value(value interface{}) (interface{}, bool) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		p.Result(value)
+		return value, true
+	case []interface{}:
+		for i, item := range value {
+			reported, ok := p.value(item)
+			if !ok {
+				reported = nil
+			}
+			value[i] = reported
+		}
+		return value, true
+	case float64:
+		count, ok := p.Count(int(value))
+		return float64(count), ok
+	case int:
+		return p.Count(value)
+	case int64:
+		count, ok := p.Count(int(value))
+		return int64(count), ok
+	}
+	return value, true
+}
@@ -0,0 +1,110 @@
+package privacy
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+)
+
+func TestSuppressCounts(t *testing.T) {
+	policy := Policy{MinCount: 5, Mode: SUPPRESS}
+	counts := policy.Counts(map[int]int{1: 1, 2: 4, 3: 5, 4: 12})
+
+	expected := map[int]int{3: 5, 4: 12}
+	if fmt.Sprint(counts) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v. Got %v", expected, counts)
+	}
+}
+
+func TestBucketCounts(t *testing.T) {
+	policy := Policy{MinCount: 5, Mode: BUCKET}
+	counts := policy.Counts(map[int]int{1: 1, 2: 4, 3: 5, 4: 12})
+
+	expected := map[int]int{3: 5, 4: 10}
+	if fmt.Sprint(counts) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v. Got %v", expected, counts)
+	}
+}
+
+func TestExactCounts(t *testing.T) {
+	counts := Exact.Counts(map[int]int{1: 1, 2: 4})
+
+	expected := map[int]int{1: 1, 2: 4}
+	if fmt.Sprint(counts) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v. Got %v", expected, counts)
+	}
+}
+
+func TestResult(t *testing.T) {
+	result := map[string]interface{}{
+		"Result": map[string]interface{}{
+			"1": float64(2),
+			"2": float64(9),
+		},
+		"Series": []interface{}{float64(1), float64(6)},
+		"Name":   "busiest",
+	}
+	Policy{MinCount: 5, Mode: SUPPRESS}.Result(result)
+
+	expected := "map[Name:busiest Result:map[2:9] Series:[<nil> 6]]"
+	if fmt.Sprint(result) != expected {
+		t.Errorf("Expected %s. Got %v", expected, result)
+	}
+}
+
+func TestFields(t *testing.T) {
+	result := map[string]interface{}{
+		"Result": map[string]interface{}{
+			"1": float64(2),
+			"2": float64(9),
+		},
+		"Total":        float64(3),
+		"AverageStay":  float64(2),
+		"BusiestHours": []interface{}{float64(1), float64(2)},
+	}
+	Policy{MinCount: 5, Mode: SUPPRESS}.Fields(result, []string{"Result", "Total", "Missing"})
+
+	expected := "map[AverageStay:2 BusiestHours:[1 2] Result:map[2:9]]"
+	if fmt.Sprint(result) != expected {
+		t.Errorf("Expected %s. Got %v", expected, result)
+	}
+}
+
+func TestEventPolicy(t *testing.T) {
+	ep := &EventPrivacy{events: &dummy_index{}, minCount: 5, mode: BUCKET}
+
+	tests := []struct {
+		eventID  int
+		expected int
+	}{
+		{1, 10}, // set by the event
+		{2, 5},  // not set by the event
+		{3, 5},  // unknown event
+		{4, 5},  // failed to read
+	}
+	for _, test := range tests {
+		policy := ep.ForEvent(test.eventID)
+		if policy.MinCount != test.expected || policy.Mode != BUCKET {
+			t.Errorf("Expected event %d to report at least %d. Got %+v", test.eventID, test.expected, policy)
+		}
+	}
+}
+
+type dummy_index struct{}
+
+func (di *dummy_index) GetEventRegions(eventID int) (*eventstaticdata.EventRegions, error) {
+	switch eventID {
+	case 1:
+		return &eventstaticdata.EventRegions{Event: eventstaticdata.Event{MinReportedCount: 10}}, nil
+	case 2:
+		return &eventstaticdata.EventRegions{}, nil
+	case 3:
+		return nil, nil
+	}
+	return nil, errors.New("database unavailable")
+}
+
+func (di *dummy_index) Invalidate(eventID int) {
+}
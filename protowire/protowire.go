@@ -0,0 +1,114 @@
+package protowire
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Wire types of fields
+const (
+	VARINT  = 0
+	FIXED64 = 1
+	BYTES   = 2
+	FIXED32 = 5
+)
+
+var ErrTruncated = errors.New("protobuf message truncated")
+
+// Field is a field read from a message. Varint holds the value of VARINT
+// fields and Bytes the value of BYTES fields.
+type Field struct {
+	Number int
+	Type   int
+	Varint uint64
+	Bytes  []byte
+}
+
+// AppendVarint appends the value as a base 128 varint
+func AppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// AppendVarintField appends a VARINT field. Negative numbers should be
+// converted with uint64(int64(n)), as for int64 fields.
+func AppendVarintField(b []byte, number int, v uint64) []byte {
+	b = AppendVarint(b, uint64(number)<<3|VARINT)
+	return AppendVarint(b, v)
+}
+
+// AppendBytesField appends a BYTES field, which holds strings, bytes and
+// embedded messages
+func AppendBytesField(b []byte, number int, v []byte) []byte {
+	b = AppendVarint(b, uint64(number)<<3|BYTES)
+	b = AppendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// Parse calls fn with each field of the message in turn. Fixed size fields
+// are skipped, as no message read by the server has any.
+func Parse(data []byte, fn func(Field) error) error {
+	for len(data) > 0 {
+		key, n := readVarint(data)
+		if n == 0 {
+			return ErrTruncated
+		}
+		data = data[n:]
+
+		field := Field{Number: int(key >> 3), Type: int(key & 7)}
+		if field.Number <= 0 {
+			return fmt.Errorf("invalid protobuf field number %d", field.Number)
+		}
+		switch field.Type {
+		case VARINT:
+			field.Varint, n = readVarint(data)
+			if n == 0 {
+				return ErrTruncated
+			}
+			data = data[n:]
+		case BYTES:
+			length, n := readVarint(data)
+			if n == 0 || uint64(len(data)-n) < length {
+				return ErrTruncated
+			}
+			field.Bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case FIXED64:
+			if len(data) < 8 {
+				return ErrTruncated
+			}
+			data = data[8:]
+			continue
+		case FIXED32:
+			if len(data) < 4 {
+				return ErrTruncated
+			}
+			data = data[4:]
+			continue
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", field.Type)
+		}
+
+		err := fn(field)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readVarint returns the varint at the start of the data and its length,
+// which is 0 if the data doesn't start with a whole varint
+func readVarint(data []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(data) && i < 10; i++ {
+		v |= uint64(data[i]&0x7f) << (7 * uint(i))
+		if data[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
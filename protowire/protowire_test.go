@@ -0,0 +1,62 @@
+package protowire
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAppendAndParse(t *testing.T) {
+	negative := int64(-2)
+	var b []byte
+	b = AppendVarintField(b, 1, 150)
+	b = AppendBytesField(b, 2, []byte("testing"))
+	b = AppendVarintField(b, 3, uint64(negative))
+
+	// The examples of the Protocol Buffers encoding guide
+	if !bytes.HasPrefix(b, []byte{0x08, 0x96, 0x01, 0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}) {
+		t.Errorf("Unexpected encoding %x", b)
+	}
+
+	var fields []Field
+	err := Parse(b, func(field Field) error {
+		fields = append(fields, field)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to parse: %s", err)
+	}
+	if len(fields) != 3 || fields[0].Varint != 150 || string(fields[1].Bytes) != "testing" ||
+		int64(fields[2].Varint) != -2 {
+		t.Errorf("Unexpected fields %+v", fields)
+	}
+}
+
+func TestParseSkipsFixedFields(t *testing.T) {
+	b := []byte{0x09, 1, 2, 3, 4, 5, 6, 7, 8, 0x15, 1, 2, 3, 4}
+	b = AppendVarintField(b, 4, 1)
+
+	var numbers []int
+	err := Parse(b, func(field Field) error {
+		numbers = append(numbers, field.Number)
+		return nil
+	})
+	if err != nil || len(numbers) != 1 || numbers[0] != 4 {
+		t.Errorf("Expected only field 4. Got %v, %v", numbers, err)
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	b := AppendBytesField(nil, 1, []byte("testing"))
+	tests := [][]byte{
+		b[:len(b)-1],
+		{0x08},
+		{0x08, 0x96},
+		{0x09, 1, 2},
+	}
+	for _, test := range tests {
+		err := Parse(test, func(field Field) error { return nil })
+		if err != ErrTruncated {
+			t.Errorf("Expected %x to be truncated. Got %v", test, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package pseudonym
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const DEFAULT_ROTATION_PERIOD = 7 * 24 * time.Hour
+
+// PseudonymInterface replaces device identifiers with pseudonyms which
+// can't be linked across events
+type PseudonymInterface interface {
+	InitConn()
+	Pseudonym(eventId int, uuid string) (string, error)
+}
+
+// Pseudonymiser makes keyed pseudonyms from a secret. The key rotates every
+// rotation period, counted from the Unix epoch, and each event has its own
+// key derived from the one of the period it starts in. A device keeps one
+// pseudonym throughout an event however long it runs, and has a different
+// one at every other event.
+type Pseudonymiser struct {
+	// Secret is read from RTFA_PSEUDONYM_SECRET unless already set
+	Secret []byte
+	// Rotation is read from RTFA_PSEUDONYM_ROTATION unless already set
+	Rotation time.Duration
+	// Events is where the start of events is read from, the shared index
+	// unless already set
+	Events eventstaticdata.EventIndexInterface
+}
+
+// InitConn reads the secret and rotation period from the environment
+func (p *Pseudonymiser) InitConn() {
+	if len(p.Secret) == 0 {
+		secret := os.Getenv("RTFA_PSEUDONYM_SECRET")
+		if secret == "" {
+			log.Fatal("RTFA_PSEUDONYM_SECRET not set.")
+		}
+		p.Secret = []byte(secret)
+	}
+
+	if p.Rotation <= 0 {
+		p.Rotation = utils.GetEnvDuration("RTFA_PSEUDONYM_ROTATION", DEFAULT_ROTATION_PERIOD)
+	}
+	if p.Rotation <= 0 {
+		log.Printf("RTFA_PSEUDONYM_ROTATION must be positive, using %s", DEFAULT_ROTATION_PERIOD)
+		p.Rotation = DEFAULT_ROTATION_PERIOD
+	}
+
+	if p.Events == nil {
+		p.Events = eventstaticdata.Index
+	}
+}
+
+// Pseudonym returns the device's pseudonym at the event, formatted like a
+// UUID so it can stand in for one
+func (p *Pseudonymiser) Pseudonym(eventId int, uuid string) (string, error) {
+	version, err := p.keyVersion(eventId)
+	if err != nil {
+		return "", err
+	}
+
+	keyMac := hmac.New(sha256.New, p.Secret)
+	keyMac.Write([]byte("pseudonym-key:" + strconv.FormatInt(version, 10) + ":" + strconv.Itoa(eventId)))
+	key := keyMac.Sum(nil)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(uuid))
+	sum := hex.EncodeToString(mac.Sum(nil)[:16])
+
+	return sum[0:8] + "-" + sum[8:12] + "-" + sum[12:16] + "-" + sum[16:20] + "-" + sum[20:32], nil
+}
+
+// keyVersion returns the rotation period the event started in, whose key
+// the event's key is derived from. Events which aren't known use the
+// current period.
+func (p *Pseudonymiser) keyVersion(eventId int) (int64, error) {
+	event, err := p.Events.GetEventRegions(eventId)
+	if err != nil {
+		return 0, err
+	}
+	startedAt := time.Now()
+	if event != nil {
+		startedAt = event.Event.StartDate
+	}
+	return startedAt.UnixNano() / int64(p.Rotation), nil
+}
@@ -0,0 +1,89 @@
+package pseudonym
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+)
+
+// dummy_events has events starting at the given times
+type dummy_events struct {
+	starts map[int]time.Time
+	err    error
+}
+
+func (de *dummy_events) GetEventRegions(eventID int) (*eventstaticdata.EventRegions, error) {
+	start, ok := de.starts[eventID]
+	if de.err != nil || !ok {
+		return nil, de.err
+	}
+	return &eventstaticdata.EventRegions{Event: eventstaticdata.Event{ID: int32(eventID), StartDate: start}}, nil
+}
+
+func (de *dummy_events) Invalidate(eventID int) {
+}
+
+func newPseudonymiser(secret string, events *dummy_events) *Pseudonymiser {
+	return &Pseudonymiser{Secret: []byte(secret), Rotation: 24 * time.Hour, Events: events}
+}
+
+func TestPseudonym(t *testing.T) {
+	start := time.Date(2018, 12, 5, 0, 0, 0, 0, time.UTC)
+	events := &dummy_events{starts: map[int]time.Time{1: start, 2: start}}
+	p := newPseudonymiser("secret", events)
+	const uuid = "123e4567-e89b-12d3-a456-426655440000"
+
+	pseudonym, err := p.Pseudonym(1, uuid)
+	if err != nil || len(pseudonym) != len(uuid) || pseudonym == uuid {
+		t.Errorf("Expected a pseudonym shaped like a UUID. Got %s, %v", pseudonym, err)
+	}
+	if again, _ := p.Pseudonym(1, uuid); again != pseudonym {
+		t.Error("Expected the same pseudonym for the device throughout the event")
+	}
+	if other, _ := p.Pseudonym(2, uuid); other == pseudonym {
+		t.Error("Expected a different pseudonym at another event")
+	}
+
+	other := newPseudonymiser("other", events)
+	if otherPseudonym, _ := other.Pseudonym(1, uuid); otherPseudonym == pseudonym {
+		t.Error("Expected pseudonyms to depend on the secret")
+	}
+}
+
+func TestPseudonymKeyRotates(t *testing.T) {
+	start := time.Date(2018, 12, 5, 0, 0, 0, 0, time.UTC)
+	events := &dummy_events{starts: map[int]time.Time{1: start}}
+	p := newPseudonymiser("secret", events)
+	const uuid = "123e4567-e89b-12d3-a456-426655440000"
+
+	// An event keeps the key of the period it started in
+	pseudonym, _ := p.Pseudonym(1, uuid)
+	events.starts[1] = start.Add(23 * time.Hour)
+	if again, _ := p.Pseudonym(1, uuid); again != pseudonym {
+		t.Error("Expected the key of the period the event started in")
+	}
+
+	// and an event starting in the next period has another key
+	events.starts[1] = start.Add(24 * time.Hour)
+	if rotated, _ := p.Pseudonym(1, uuid); rotated == pseudonym {
+		t.Error("Expected the key to rotate with the period")
+	}
+}
+
+func TestPseudonymUnreadableEvent(t *testing.T) {
+	p := newPseudonymiser("secret", &dummy_events{err: errors.New("database unavailable")})
+	if _, err := p.Pseudonym(1, "uuid"); err == nil {
+		t.Error("Expected an error when the event can't be read")
+	}
+}
+
+func TestSettingsAreKept(t *testing.T) {
+	events := &dummy_events{}
+	p := newPseudonymiser("secret", events)
+	p.InitConn()
+	if string(p.Secret) != "secret" || p.Rotation != 24*time.Hour || p.Events != events {
+		t.Errorf("Expected settings already set to be kept. Got %+v", p)
+	}
+}
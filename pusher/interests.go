@@ -0,0 +1,55 @@
+package pusher
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Pusher Beams interest names are scoped by event, so devices only ever
+// receive the notifications of the event they subscribed to:
+//
+//	event-{eventId}                        everyone at the event
+//	event-{eventId}-region-{regionId}      everyone following a region
+//	event-{eventId}-category-{category}    everyone following a region category
+//
+// Devices subscribe to these qualified by the locale they want notifications
+// in, e.g. event-{eventId}-locale-fr, so each receives a single translation.
+
+// EventInterest is the interest every attendee of an event subscribes to
+func EventInterest(eventId int) string {
+	return fmt.Sprintf("event-%d", eventId)
+}
+
+// RegionInterest is the interest of attendees following a single region
+func RegionInterest(eventId int, regionId int) string {
+	return EventInterest(eventId) + "-region-" + strconv.Itoa(regionId)
+}
+
+// CategoryInterest is the interest of attendees following every region
+// in a region category
+func CategoryInterest(eventId int, category int) string {
+	return EventInterest(eventId) + "-category-" + strconv.Itoa(category)
+}
+
+// RegionInterests returns the interests of each of the given regions
+func RegionInterests(eventId int, regionIds []int) []string {
+	interests := make([]string, len(regionIds))
+	for i, regionId := range regionIds {
+		interests[i] = RegionInterest(eventId, regionId)
+	}
+	return interests
+}
+
+// LocaleInterests qualifies each of the interests with a locale
+func LocaleInterests(interests []string, locale string) []string {
+	localised := make([]string, len(interests))
+	for i, interest := range interests {
+		localised[i] = LocaleInterest(interest, locale)
+	}
+	return localised
+}
+
+// LocaleInterest qualifies an interest with a locale
+func LocaleInterest(interest string, locale string) string {
+	return interest + "-locale-" + locale
+}
@@ -44,9 +44,12 @@ func (pc *PusherChannelClient) SendItem(channelName string, eventName string, da
 
 type PusherBeamsInterface interface {
 	InitConn()
-	SendNotification(regionIds []string, title string, body string) (publishId string, err error)
+	SendNotification(interests []string, title string, body string) (publishId string, err error)
 }
 
+// Pusher Beams rejects publishes to more than this many interests at once
+const maxInterestsPerPublish = 100
+
 type PusherBeamsClient struct {
 	client pushnotifications.PushNotifications
 }
@@ -74,7 +77,9 @@ func (pbc *PusherBeamsClient) InitConn() {
 	pbc.client = client
 }
 
-func (pbc *PusherBeamsClient) SendNotification(regionIds []string, title string, body string) (publishId string, err error) {
+// SendNotification publishes a notification to the given interests, which
+// should be built with the helpers in interests.go
+func (pbc *PusherBeamsClient) SendNotification(interests []string, title string, body string) (publishId string, err error) {
 	// Make the request
 	publishRequest := map[string]interface{}{
 		"apns": map[string]interface{}{
@@ -87,11 +92,24 @@ func (pbc *PusherBeamsClient) SendNotification(regionIds []string, title string,
 		},
 	}
 
-	// Send the notification
-	publishId, err = pbc.client.Publish(regionIds, publishRequest)
-	if err != nil {
-		log.Println("Error sending to pusher beam")
-		log.Println(err)
+	// Send the notification, splitting the interests into publishes Beams accepts
+	for start := 0; start < len(interests); start += maxInterestsPerPublish {
+		end := start + maxInterestsPerPublish
+		if end > len(interests) {
+			end = len(interests)
+		}
+
+		id, err := pbc.client.Publish(interests[start:end], publishRequest)
+		if err != nil {
+			log.Println("Error sending to pusher beam")
+			log.Println(err)
+			return publishId, err
+		}
+
+		// Report the first publish, which covers the leading interests
+		if publishId == "" {
+			publishId = id
+		}
 	}
-	return publishId, err
+	return publishId, nil
 }
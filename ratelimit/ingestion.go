@@ -0,0 +1,130 @@
+package ratelimit
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+const (
+	DEFAULT_DEVICE_UPDATES_PER_MINUTE = 60
+	DEFAULT_DEVICE_BURST              = 10
+	// Many attendees can share an address behind the NAT of a mobile
+	// network, so clients are allowed far more than devices
+	DEFAULT_CLIENT_UPDATES_PER_MINUTE = 6000
+	DEFAULT_CLIENT_BURST              = 500
+)
+
+// IngestionLimiterInterface limits the updates received from each client
+// address and each device
+type IngestionLimiterInterface interface {
+	// AllowClient takes a request from the address the request came from
+	AllowClient(request *http.Request) (bool, time.Duration)
+	// AllowDevice takes a request from the device at the event
+	AllowDevice(eventId int, uuid string) (bool, time.Duration)
+	Stats() map[string]Stats
+}
+
+// IngestionLimiter limits devices to the rate configured for their event,
+// or RTFA_DEVICE_UPDATES_PER_MINUTE for events which don't set one, and
+// client addresses to RTFA_CLIENT_UPDATES_PER_MINUTE
+type IngestionLimiter struct {
+	events eventstaticdata.EventIndexInterface
+	device Limit
+	client Limit
+	// trustForwardedFor is set when the server is behind a load balancer,
+	// which gives the client's address in X-Forwarded-For
+	trustForwardedFor bool
+
+	devices *Limiter
+	clients *Limiter
+}
+
+// NewIngestionLimiter returns a limiter configured from the environment,
+// reading the limits of events from the index
+func NewIngestionLimiter(events eventstaticdata.EventIndexInterface) *IngestionLimiter {
+	return &IngestionLimiter{
+		events: events,
+		device: perMinute(utils.GetEnvInt("RTFA_DEVICE_UPDATES_PER_MINUTE", DEFAULT_DEVICE_UPDATES_PER_MINUTE),
+			utils.GetEnvInt("RTFA_DEVICE_BURST", DEFAULT_DEVICE_BURST)),
+		client: perMinute(utils.GetEnvInt("RTFA_CLIENT_UPDATES_PER_MINUTE", DEFAULT_CLIENT_UPDATES_PER_MINUTE),
+			utils.GetEnvInt("RTFA_CLIENT_BURST", DEFAULT_CLIENT_BURST)),
+		trustForwardedFor: utils.GetEnv("RTFA_TRUST_FORWARDED_FOR", "false") == "true",
+		devices:           NewLimiter(),
+		clients:           NewLimiter(),
+	}
+}
+
+func (il *IngestionLimiter) AllowClient(request *http.Request) (bool, time.Duration) {
+	return il.clients.Allow(ClientIP(request, il.trustForwardedFor), il.client)
+}
+
+func (il *IngestionLimiter) AllowDevice(eventId int, uuid string) (bool, time.Duration) {
+	return il.devices.Allow(strconv.Itoa(eventId)+"/"+uuid, il.deviceLimit(eventId))
+}
+
+func (il *IngestionLimiter) Stats() map[string]Stats {
+	return map[string]Stats{
+		"devices": il.devices.Stats(),
+		"clients": il.clients.Stats(),
+	}
+}
+
+// deviceLimit returns the limit of devices at the event, using the default
+// if the event can't be read
+func (il *IngestionLimiter) deviceLimit(eventId int) Limit {
+	regions, err := il.events.GetEventRegions(eventId)
+	if err != nil {
+		log.Printf("Error reading rate limit of event %d: %s", eventId, err)
+		return il.device
+	}
+	if regions == nil || regions.Event.MaxDeviceUpdatesPerMinute <= 0 {
+		return il.device
+	}
+	updates := int(regions.Event.MaxDeviceUpdatesPerMinute)
+	burst := il.device.Burst
+	if updates < burst {
+		burst = updates
+	}
+	return perMinute(updates, burst)
+}
+
+func perMinute(updates int, burst int) Limit {
+	return Limit{PerSecond: float64(updates) / 60, Burst: burst}
+}
+
+// ClientIP returns the address of the client which sent the request. If
+// X-Forwarded-For is trusted the last address in it is used, as that was
+// added by the load balancer rather than the client.
+func ClientIP(request *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		forwarded := request.Header.Get("X-Forwarded-For")
+		if forwarded != "" {
+			addresses := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// Reject writes the response to a request which was over its limit, telling
+// the client when to try again
+func Reject(writer http.ResponseWriter, wait time.Duration) {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	writer.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(writer, "Too many requests", http.StatusTooManyRequests)
+}
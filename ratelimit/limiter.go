@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// MAX_BUCKETS bounds the memory used. Once there are this many buckets
+	// the idle ones are dropped, and if none are idle everyone starts afresh.
+	MAX_BUCKETS = 500000
+	// SWEEP_INTERVAL is how often buckets which have refilled are dropped
+	SWEEP_INTERVAL = time.Minute
+)
+
+// Limit is a rate of requests a key is allowed, with bursts of up to Burst
+// requests
+type Limit struct {
+	PerSecond float64
+	Burst     int
+}
+
+// Unlimited lets every request through
+var Unlimited = Limit{PerSecond: math.Inf(1)}
+
+// Stats describes the keys a limiter is tracking
+type Stats struct {
+	Tracked   int `json:"tracked"`
+	Throttled int `json:"throttled"`
+}
+
+// Limiter is a token bucket limiter of the requests of many keys, each with
+// a bucket of its own
+type Limiter struct {
+	now func() time.Time
+
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	limit     Limit
+	// throttled is whether the last request of the key was refused
+	throttled bool
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the key's bucket, which holds up to the limit's
+// burst and refills at its rate. If there is no token it returns false and
+// how long until there will be.
+func (l *Limiter) Allow(key string, limit Limit) (bool, time.Duration) {
+	if math.IsInf(limit.PerSecond, 1) {
+		return true, 0
+	}
+	if limit.PerSecond <= 0 || limit.Burst <= 0 {
+		return false, time.Hour
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updatedAt: now}
+		l.buckets[key] = b
+	}
+	b.refill(now, limit)
+
+	if b.tokens < 1 {
+		b.throttled = true
+		wait := time.Duration((1 - b.tokens) / limit.PerSecond * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	b.throttled = false
+	return true, 0
+}
+
+// Stats returns how many keys are tracked, and how many of them had their
+// last request refused
+func (l *Limiter) Stats() Stats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	stats := Stats{Tracked: len(l.buckets)}
+	for _, b := range l.buckets {
+		if b.throttled {
+			stats.Throttled++
+		}
+	}
+	return stats
+}
+
+// refill adds the tokens earned since the bucket was last updated. The
+// limit is kept so that idle buckets can be recognised.
+func (b *bucket) refill(now time.Time, limit Limit) {
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.PerSecond)
+		b.updatedAt = now
+	}
+	b.limit = limit
+}
+
+// sweep drops the buckets which have refilled, as a new bucket would be
+// the same. The mutex must be held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < SWEEP_INTERVAL && len(l.buckets) < MAX_BUCKETS {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		b.refill(now, b.limit)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	if len(l.buckets) >= MAX_BUCKETS {
+		l.buckets = make(map[string]*bucket)
+	}
+}
@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2018, 12, 5, 14, 0, 0, 0, time.UTC)
+	limiter := NewLimiter()
+	limiter.now = func() time.Time { return now }
+	limit := Limit{PerSecond: 0.5, Burst: 2}
+
+	// The burst is allowed straight away
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("a", limit); !ok {
+			t.Errorf("Expected request %d of the burst to be allowed", i)
+		}
+	}
+	ok, wait := limiter.Allow("a", limit)
+	if ok || wait != 2*time.Second {
+		t.Errorf("Expected to wait 2s for a token. Got %t, %s", ok, wait)
+	}
+	if ok, _ := limiter.Allow("b", limit); !ok {
+		t.Error("Expected another key to have a bucket of its own")
+	}
+	if stats := limiter.Stats(); stats.Tracked != 2 || stats.Throttled != 1 {
+		t.Errorf("Expected 2 keys with 1 throttled. Got %+v", stats)
+	}
+
+	now = now.Add(2 * time.Second)
+	if ok, _ := limiter.Allow("a", limit); !ok {
+		t.Error("Expected the bucket to have refilled a token")
+	}
+
+	// Buckets which have refilled are dropped
+	now = now.Add(SWEEP_INTERVAL)
+	limiter.Allow("c", limit)
+	if stats := limiter.Stats(); stats.Tracked != 1 || stats.Throttled != 0 {
+		t.Errorf("Expected only the new key to be tracked. Got %+v", stats)
+	}
+}
+
+func TestDeviceLimit(t *testing.T) {
+	limiter := NewIngestionLimiter(&dummy_events{})
+	limiter.device = Limit{PerSecond: 1, Burst: 10}
+
+	tests := []struct {
+		eventId  int
+		expected Limit
+	}{
+		{1, Limit{PerSecond: 0.5, Burst: 10}},
+		{2, Limit{PerSecond: 0.05, Burst: 3}},
+		{3, Limit{PerSecond: 1, Burst: 10}},
+		{4, Limit{PerSecond: 1, Burst: 10}},
+	}
+	for _, test := range tests {
+		if limit := limiter.deviceLimit(test.eventId); limit != test.expected {
+			t.Errorf("Expected event %d to have limit %+v. Got %+v", test.eventId, test.expected, limit)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/update", nil)
+	req.RemoteAddr = "10.0.0.1:4321"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+
+	if ip := ClientIP(req, false); ip != "10.0.0.1" {
+		t.Errorf("Expected the connection's address. Got %s", ip)
+	}
+	if ip := ClientIP(req, true); ip != "5.6.7.8" {
+		t.Errorf("Expected the address added by the load balancer. Got %s", ip)
+	}
+}
+
+type dummy_events struct{}
+
+func (de *dummy_events) GetEventRegions(eventID int) (*eventstaticdata.EventRegions, error) {
+	switch eventID {
+	case 1:
+		return &eventstaticdata.EventRegions{Event: eventstaticdata.Event{MaxDeviceUpdatesPerMinute: 30}}, nil
+	case 2:
+		return &eventstaticdata.EventRegions{Event: eventstaticdata.Event{MaxDeviceUpdatesPerMinute: 3}}, nil
+	case 3:
+		return nil, nil
+	}
+	return nil, http.ErrHandlerTimeout
+}
+
+func (de *dummy_events) Invalidate(eventID int) {
+}
@@ -4,15 +4,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/real-time-footfall-analysis/rtfa-backend/dynamoDB"
+	"github.com/real-time-footfall-analysis/rtfa-backend/privacy"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
 )
 
 var analytics_database dynamoDB.DynamoDBInterface = &dynamoDB.DynamoDBClient{}
+var policies privacy.PrivacyInterface = privacy.Events
+
+// countFields names the fields of each task's result which count people,
+// from RTFA_ANALYTICS_COUNT_FIELDS, such as "1:Result,Series;2:Total". Only
+// those fields have the privacy policy applied, so times and averages are
+// reported as they are. Every number in the result of a task not listed is
+// treated as a count.
+var countFields = parseCountFields(utils.GetEnv("RTFA_ANALYTICS_COUNT_FIELDS", ""))
 
 func Init(r *mux.Router) {
 	_ = analytics_database.InitConn("analytics_results")
@@ -71,9 +81,42 @@ func getTaskResultHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Rename the results to a more usable format
 	delete(result, pKeyColName)
+
+	// Leave out counts small enough to pick out individuals
+	policy := privacy.ForRequest(policies, r, eventID)
+	if fields, ok := countFields[taskID]; ok {
+		policy.Fields(result, fields)
+	} else {
+		policy.Result(result)
+	}
+
 	result["eventID"] = eventID
 	result["taskID"] = taskID
 
 	// Send the result back
 	_ = json.NewEncoder(w).Encode(result)
 }
+
+// parseCountFields reads the count fields of each task, given as task IDs
+// and their fields separated by ";"
+func parseCountFields(config string) map[int][]string {
+	fields := make(map[int][]string)
+	for _, task := range strings.Split(config, ";") {
+		if strings.TrimSpace(task) == "" {
+			continue
+		}
+		parts := strings.SplitN(task, ":", 2)
+		taskID, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || len(parts) != 2 {
+			log.Printf("Ignoring invalid analytics count fields %q", task)
+			continue
+		}
+		fields[taskID] = []string{}
+		for _, field := range strings.Split(parts[1], ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields[taskID] = append(fields[taskID], field)
+			}
+		}
+	}
+	return fields
+}
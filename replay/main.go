@@ -0,0 +1,205 @@
+package replay
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/archive"
+	"github.com/real-time-footfall-analysis/rtfa-backend/kinesisqueue"
+	"github.com/real-time-footfall-analysis/rtfa-backend/locationupdate"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+var queue kinesisqueue.KinesisQueueInterface = kinesisqueue.NewQueue()
+var storage archive.StorageInterface = &archive.FileStorage{
+	Dir: utils.GetEnv("RTFA_ARCHIVE_DIR", archive.DEFAULT_ARCHIVE_DIR),
+}
+
+// sleep waits between updates, replaced in tests
+var sleep = time.Sleep
+
+const (
+	// fullBackoff is how long to wait when the queue has too many updates
+	// waiting to be sent, and the first wait before sending again an
+	// update the queue rejected
+	fullBackoff = 50 * time.Millisecond
+
+	// MAX_IN_FLIGHT is how many updates can be waiting to be sent at once,
+	// with a queue which sends updates together
+	MAX_IN_FLIGHT = 1000
+	// MAX_SEND_ATTEMPTS is how many times an update is sent before the
+	// replay gives up
+	MAX_SEND_ATTEMPTS = 5
+)
+
+// asyncQueue is a queue which sends updates together, reporting on the
+// channel returned whether each was sent
+type asyncQueue interface {
+	SendAsync(data interface{}, shardId string) <-chan error
+}
+
+// inFlight is an update waiting to be sent
+type inFlight struct {
+	update locationupdate.Movement_update
+	result <-chan error
+}
+
+// Run sends the archived updates of an event back through the queue. The
+// arguments choose the event, the range of time to replay, and the speed
+// relative to when the updates occurred, where 0 sends them without waiting.
+func Run(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	eventId := flags.Int("event", -1, "id of the event to replay")
+	fromStr := flags.String("from", "", "replay updates from this time (RFC 3339)")
+	toStr := flags.String("to", "", "replay updates until this time (RFC 3339)")
+	speed := flags.Float64("speed", 1, "speed relative to real time, or 0 for as fast as possible")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *eventId < 0 {
+		return errors.New("an event to replay is required")
+	}
+	if *speed < 0 {
+		return errors.New("speed can't be negative")
+	}
+	from, err := time.Parse(time.RFC3339, *fromStr)
+	if err != nil {
+		return err
+	}
+	to, err := time.Parse(time.RFC3339, *toStr)
+	if err != nil {
+		return err
+	}
+
+	err = queue.InitConn(locationupdate.KINESIS_STREAM_NAME)
+	if err != nil {
+		log.Println("Failed to connect to Kinesis: " + locationupdate.KINESIS_STREAM_NAME)
+		return err
+	}
+
+	sent, err := replay(*eventId, from, to, *speed)
+
+	// Stop the queue once everything is sent
+	if closer, ok := queue.(io.Closer); ok {
+		closeErr := closer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	log.Println("Replayed", sent, "movement updates")
+	return err
+}
+
+// replay sends the updates in the range, an hour at a time in the order they
+// occurred, and returns how many were sent
+func replay(eventId int, from time.Time, to time.Time, speed float64) (int, error) {
+	sent := 0
+	var last *int
+	var waiting []inFlight
+	for hour := from.UTC().Truncate(time.Hour); !hour.After(to); hour = hour.Add(time.Hour) {
+		updates, err := readHour(eventId, hour, from, to)
+		if err != nil {
+			return sent, err
+		}
+
+		for _, update := range updates {
+			// Keep the gaps between updates, scaled by the speed
+			if last != nil && speed > 0 {
+				gap := time.Duration(*update.OccurredAt-*last) * time.Second
+				sleep(time.Duration(float64(gap) / speed))
+			}
+			last = update.OccurredAt
+
+			async, ok := queue.(asyncQueue)
+			if !ok {
+				err = send(update)
+				if err != nil {
+					return sent, err
+				}
+				sent++
+				continue
+			}
+
+			// Keep sending while earlier updates wait to be sent together
+			waiting = append(waiting, inFlight{
+				update: update,
+				result: async.SendAsync(update, locationupdate.PartitionKey(&update)),
+			})
+			if len(waiting) > MAX_IN_FLIGHT {
+				err = wait(waiting[0])
+				if err != nil {
+					return sent, err
+				}
+				waiting = waiting[1:]
+				sent++
+			}
+		}
+	}
+
+	for _, w := range waiting {
+		err := wait(w)
+		if err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// wait waits for the update to be sent, sending it again if it wasn't
+func wait(w inFlight) error {
+	if err := <-w.result; err != nil {
+		return send(w.update)
+	}
+	return nil
+}
+
+// send sends the update, backing off while the queue rejects it
+func send(update locationupdate.Movement_update) error {
+	backoff := fullBackoff
+	for attempt := 1; ; attempt++ {
+		err := queue.SendToQueue(update, locationupdate.PartitionKey(&update))
+		if err == kinesisqueue.ErrProducerFull {
+			// Replaying faster than Kinesis takes the updates
+			sleep(fullBackoff)
+			continue
+		}
+		if err == nil || attempt == MAX_SEND_ATTEMPTS || kinesisqueue.IsPermanent(err) {
+			return err
+		}
+		sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// readHour returns the archived updates of an hour within the range, in the
+// order they occurred
+func readHour(eventId int, hour time.Time, from time.Time, to time.Time) ([]locationupdate.Movement_update, error) {
+	var updates []locationupdate.Movement_update
+	err := archive.Read(storage, eventId, hour, hour, func(data json.RawMessage) error {
+		var update locationupdate.Movement_update
+		err := json.Unmarshal(data, &update)
+		if err != nil || update.OccurredAt == nil || update.RegionID == nil {
+			log.Println("Skipping unreadable archived update:", string(data))
+			return nil
+		}
+
+		occurredAt := time.Unix(int64(*update.OccurredAt), 0)
+		if !occurredAt.Before(from) && !occurredAt.After(to) {
+			updates = append(updates, update)
+		}
+		return nil
+	})
+
+	sort.SliceStable(updates, func(i, j int) bool {
+		return *updates[i].OccurredAt < *updates[j].OccurredAt
+	})
+	return updates, err
+}
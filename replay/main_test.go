@@ -0,0 +1,122 @@
+package replay
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/archive"
+	"github.com/real-time-footfall-analysis/rtfa-backend/locationupdate"
+)
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtfa-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage = &archive.FileStorage{Dir: dir}
+	a := archive.New(storage, time.Hour)
+	start := time.Date(2018, 12, 5, 14, 0, 0, 0, time.UTC)
+	for _, offset := range []int{100, 10, 30, 4000} {
+		_ = a.Append(3, int(start.Unix())+offset, movementUpdate(int(start.Unix())+offset))
+	}
+	_ = a.Flush()
+
+	dq := &dummy_queue{}
+	queue = dq
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	sent, err := replay(3, start.Add(20*time.Second), start.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 || len(dq.sent) != 2 {
+		t.Fatalf("Expected the two updates in range to be sent. Got %d", sent)
+	}
+	if *dq.sent[0].OccurredAt != int(start.Unix())+30 || *dq.sent[1].OccurredAt != int(start.Unix())+100 {
+		t.Error("Expected updates to be sent in the order they occurred")
+	}
+	if len(slept) != 1 || slept[0] != 7*time.Second {
+		t.Errorf("Expected the gap between updates to be scaled by the speed. Got %v", slept)
+	}
+}
+
+func TestReplayInFlight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtfa-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage = &archive.FileStorage{Dir: dir}
+	a := archive.New(storage, time.Hour)
+	start := time.Date(2018, 12, 5, 14, 0, 0, 0, time.UTC)
+	for offset := 0; offset < MAX_IN_FLIGHT+10; offset++ {
+		_ = a.Append(3, int(start.Unix())+offset, movementUpdate(int(start.Unix())+offset))
+	}
+	_ = a.Flush()
+
+	// The queue rejects the first update it is sent together with others
+	dq := &dummy_async_queue{reject: 1}
+	queue = dq
+	sleep = func(time.Duration) {}
+
+	sent, err := replay(3, start, start.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != MAX_IN_FLIGHT+10 || len(dq.sent) != MAX_IN_FLIGHT+10 {
+		t.Errorf("Expected every update to be sent, the rejected one again. Got %d and %d sent", sent, len(dq.sent))
+	}
+}
+
+func movementUpdate(occurredAt int) locationupdate.Movement_update {
+	uuid := "123e4567-e89b-12d3-a456-426655440000"
+	eventId, regionId, entering := 3, 4, true
+	return locationupdate.Movement_update{
+		UUID:       &uuid,
+		EventID:    &eventId,
+		RegionID:   &regionId,
+		Entering:   &entering,
+		OccurredAt: &occurredAt,
+	}
+}
+
+type dummy_queue struct {
+	sent []locationupdate.Movement_update
+}
+
+func (dq *dummy_queue) InitConn(streamName string) error {
+	return nil
+}
+
+func (dq *dummy_queue) SendToQueue(data interface{}, shardId string) error {
+	var update locationupdate.Movement_update
+	encoded, _ := json.Marshal(data)
+	_ = json.Unmarshal(encoded, &update)
+	dq.sent = append(dq.sent, update)
+	return nil
+}
+
+// dummy_async_queue sends updates together, rejecting some as configured
+type dummy_async_queue struct {
+	dummy_queue
+	reject int
+}
+
+func (dq *dummy_async_queue) SendAsync(data interface{}, shardId string) <-chan error {
+	result := make(chan error, 1)
+	if dq.reject > 0 {
+		dq.reject--
+		result <- errors.New("throttled")
+		return result
+	}
+	result <- dq.SendToQueue(data, shardId)
+	return result
+}
@@ -0,0 +1,185 @@
+package simulator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/devices"
+	"github.com/real-time-footfall-analysis/rtfa-backend/locationupdate"
+)
+
+// REQUEST_TIMEOUT is how long the server has to answer each request
+const REQUEST_TIMEOUT = 10 * time.Second
+
+// emergency_request is an emergency as reported by a device
+type emergency_request struct {
+	UUID        string `json:"uuid"`
+	EventId     int    `json:"eventId"`
+	RegionIds   []int  `json:"regionIds"`
+	OccurredAt  int    `json:"occurredAt"`
+	Description string `json:"description"`
+}
+
+type registration_response struct {
+	Secret string `json:"secret"`
+}
+
+// summary counts what the simulated devices sent
+type summary struct {
+	Sent        int64
+	Failed      int64
+	Throttled   int64
+	Emergencies int64
+}
+
+// client sends the updates of simulated devices to a server the way the
+// app does, registering each device and signing its requests
+type client struct {
+	server         string
+	eventId        int
+	enrolmentToken string
+	http           *http.Client
+	now            func() time.Time
+	summary        summary
+}
+
+func newClient(server string, eventId int, enrolmentToken string) *client {
+	return &client{
+		server:         server,
+		eventId:        eventId,
+		enrolmentToken: enrolmentToken,
+		http:           &http.Client{Timeout: REQUEST_TIMEOUT},
+		now:            time.Now,
+	}
+}
+
+// send sends the updates of a move, registering the device first if it
+// hasn't been
+func (c *client) send(m move) error {
+	a := m.attendee
+	if a.secret == "" {
+		err := c.register(a)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.from != nil {
+		c.sendMovement(a, m.from.id, false)
+	}
+	if m.to != nil {
+		c.sendMovement(a, m.to.id, true)
+		if m.emergency {
+			c.sendEmergency(a, m.to.id)
+		}
+	}
+	return nil
+}
+
+// register registers the attendee's device with the event, keeping the
+// secret it signs its requests with
+func (c *client) register(a *attendee) error {
+	body, _ := json.Marshal(map[string]string{"uuid": a.uuid})
+	url := fmt.Sprintf("%s/events/%d/devices", c.server, c.eventId)
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(devices.ENROLMENT_HEADER, c.enrolmentToken)
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("failed to register device %s: %s: %s", a.uuid, response.Status, bytes.TrimSpace(message))
+	}
+	var registration registration_response
+	err = json.NewDecoder(response.Body).Decode(&registration)
+	if err != nil {
+		return fmt.Errorf("failed to decode registration of device %s: %s", a.uuid, err)
+	}
+	a.secret = registration.Secret
+	return nil
+}
+
+func (c *client) sendMovement(a *attendee, regionId int, entering bool) {
+	occurredAt := c.occurredAt(a)
+	update := locationupdate.Movement_update{
+		UUID:       &a.uuid,
+		EventID:    &c.eventId,
+		RegionID:   &regionId,
+		Entering:   &entering,
+		OccurredAt: &occurredAt,
+	}
+	c.post("/update", a, update)
+}
+
+func (c *client) sendEmergency(a *attendee, regionId int) {
+	emergency := emergency_request{
+		UUID:        a.uuid,
+		EventId:     c.eventId,
+		RegionIds:   []int{regionId},
+		OccurredAt:  c.occurredAt(a),
+		Description: "Simulated emergency",
+	}
+	if c.post("/emergency-update", a, emergency) {
+		atomic.AddInt64(&c.summary.Emergencies, 1)
+	}
+}
+
+// occurredAt returns the time of the device's next update, at least a
+// second after its last so the server can tell their order. Devices run
+// ahead of the clock when they move more than once a second.
+func (c *client) occurredAt(a *attendee) int {
+	occurredAt := int(c.now().Unix())
+	if occurredAt <= a.lastOccurredAt {
+		occurredAt = a.lastOccurredAt + 1
+	}
+	a.lastOccurredAt = occurredAt
+	return occurredAt
+}
+
+// post sends the request signed by the device, and returns whether the
+// server accepted it
+func (c *client) post(path string, a *attendee, value interface{}) bool {
+	body, _ := json.Marshal(value)
+	request, err := http.NewRequest("POST", c.server+path, bytes.NewReader(body))
+	if err != nil {
+		atomic.AddInt64(&c.summary.Failed, 1)
+		return false
+	}
+	timestamp := strconv.FormatInt(c.now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(devices.TIMESTAMP_HEADER, timestamp)
+	request.Header.Set(devices.SIGNATURE_HEADER, devices.Sign(a.secret, timestamp, body))
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		atomic.AddInt64(&c.summary.Failed, 1)
+		return false
+	}
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusTooManyRequests:
+		atomic.AddInt64(&c.summary.Throttled, 1)
+		return false
+	case response.StatusCode >= 300:
+		atomic.AddInt64(&c.summary.Failed, 1)
+		return false
+	}
+	atomic.AddInt64(&c.summary.Sent, 1)
+	return true
+}
@@ -0,0 +1,221 @@
+package simulator
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+)
+
+// crowd_config describes the regions of an event and how strongly they
+// attract attendees over the simulation, as read from a file:
+//
+//	{"regions": [{"regionId": 1, "name": "Main stage", "weight": 3,
+//	  "schedule": [{"from": "30m", "to": "1h30m", "weight": 20}]}]}
+//
+// Times in schedules are from the start of the simulation. Regions attract
+// with their weight outside their schedule, which is 1 if not given.
+type crowd_config struct {
+	Regions []region_config `json:"regions"`
+}
+
+type region_config struct {
+	RegionId int             `json:"regionId"`
+	Name     string          `json:"name"`
+	Weight   *float64        `json:"weight"`
+	Schedule []schedule_slot `json:"schedule"`
+}
+
+type schedule_slot struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Weight float64 `json:"weight"`
+}
+
+// region is a region with its schedule parsed
+type region struct {
+	id     int
+	weight float64
+	slots  []slot
+}
+
+type slot struct {
+	from   time.Duration
+	to     time.Duration
+	weight float64
+}
+
+// weightAt returns how strongly the region attracts attendees at the time
+// into the simulation
+func (r *region) weightAt(t time.Duration) float64 {
+	for _, s := range r.slots {
+		if t >= s.from && t < s.to {
+			return s.weight
+		}
+	}
+	return r.weight
+}
+
+// loadRegions reads the regions from the file, or from the event's static
+// data if no file is given
+func loadRegions(sd eventstaticdata.StaticDataInterface, eventId int, path string) ([]*region, error) {
+	var config crowd_config
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %s", path, err)
+		}
+	} else {
+		eventRegions, err := sd.GetRegions(eventId)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range eventRegions {
+			config.Regions = append(config.Regions, region_config{RegionId: int(r.ID), Name: r.Name})
+		}
+	}
+	if len(config.Regions) == 0 {
+		return nil, fmt.Errorf("event %d has no regions to simulate", eventId)
+	}
+
+	regions := make([]*region, len(config.Regions))
+	for i, rc := range config.Regions {
+		r := &region{id: rc.RegionId, weight: 1}
+		if rc.Weight != nil {
+			r.weight = *rc.Weight
+		}
+		for _, s := range rc.Schedule {
+			from, err := time.ParseDuration(s.From)
+			if err != nil {
+				return nil, fmt.Errorf("invalid schedule of region %d: %s", rc.RegionId, err)
+			}
+			to, err := time.ParseDuration(s.To)
+			if err != nil {
+				return nil, fmt.Errorf("invalid schedule of region %d: %s", rc.RegionId, err)
+			}
+			r.slots = append(r.slots, slot{from: from, to: to, weight: s.Weight})
+		}
+		regions[i] = r
+	}
+	return regions, nil
+}
+
+// attendee is a simulated attendee, with the device it carries
+type attendee struct {
+	uuid string
+	// region is the region the attendee is in, or nil
+	region *region
+	// next is when the attendee next moves, from the start of the simulation
+	next time.Duration
+	// secret is the key the device signs its requests with, once registered
+	secret string
+	// lastOccurredAt keeps the device's updates a second apart, so the
+	// server can tell their order
+	lastOccurredAt int
+}
+
+// crowd is a set of attendees ordered by when they next move
+type crowd []*attendee
+
+func (c crowd) Len() int            { return len(c) }
+func (c crowd) Less(i, j int) bool  { return c[i].next < c[j].next }
+func (c crowd) Swap(i, j int)       { c[i], c[j] = c[j], c[i] }
+func (c *crowd) Push(x interface{}) { *c = append(*c, x.(*attendee)) }
+func (c *crowd) Pop() interface{} {
+	old := *c
+	a := old[len(old)-1]
+	*c = old[:len(old)-1]
+	return a
+}
+
+// move is a movement of an attendee, leaving one region for another
+type move struct {
+	attendee  *attendee
+	from      *region
+	to        *region
+	emergency bool
+}
+
+// simulation moves attendees between regions, each staying in a region for
+// a time drawn from an exponential distribution with the mean dwell time
+type simulation struct {
+	regions []*region
+	dwell   time.Duration
+	// emergencyChance is the chance an attendee reports an emergency on
+	// arriving in a region
+	emergencyChance float64
+	random          *rand.Rand
+	crowd           crowd
+}
+
+func newSimulation(regions []*region, attendees []*attendee, dwell time.Duration, emergencyChance float64, seed int64) *simulation {
+	s := &simulation{
+		regions:         regions,
+		dwell:           dwell,
+		emergencyChance: emergencyChance,
+		random:          rand.New(rand.NewSource(seed)),
+	}
+	// Attendees arrive over the first dwell time
+	for _, a := range attendees {
+		a.next = time.Duration(s.random.Int63n(int64(dwell)))
+		s.crowd = append(s.crowd, a)
+	}
+	heap.Init(&s.crowd)
+	return s
+}
+
+// nextMove moves the attendee who moves soonest, returning the move and
+// when it happened, unless nobody moves before the end
+func (s *simulation) nextMove(end time.Duration) (move, time.Duration, bool) {
+	if len(s.crowd) == 0 || s.crowd[0].next >= end {
+		return move{}, 0, false
+	}
+	a := s.crowd[0]
+	at := a.next
+
+	m := move{attendee: a, from: a.region, to: s.choose(at, a.region)}
+	m.emergency = m.to != nil && s.random.Float64() < s.emergencyChance
+	a.region = m.to
+
+	a.next = at + time.Duration(s.random.ExpFloat64()*float64(s.dwell))
+	if a.next <= at {
+		a.next = at + 1
+	}
+	heap.Fix(&s.crowd, 0)
+	return m, at, true
+}
+
+// choose picks the region an attendee moves to at the time, in proportion
+// to how strongly each attracts, other than the one they are in. It
+// returns nil if no region attracts anyone.
+func (s *simulation) choose(at time.Duration, current *region) *region {
+	total := 0.0
+	for _, r := range s.regions {
+		if r != current || len(s.regions) == 1 {
+			total += r.weightAt(at)
+		}
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	pick := s.random.Float64() * total
+	for _, r := range s.regions {
+		if r == current && len(s.regions) > 1 {
+			continue
+		}
+		pick -= r.weightAt(at)
+		if pick < 0 {
+			return r
+		}
+	}
+	return nil
+}
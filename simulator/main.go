@@ -0,0 +1,130 @@
+package simulator
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/eventstaticdata"
+	"github.com/real-time-footfall-analysis/rtfa-backend/utils"
+)
+
+var staticData eventstaticdata.StaticDataInterface = &eventstaticdata.StaticDataClient{}
+
+// sleep waits between moves, replaced in tests
+var sleep = time.Sleep
+
+// Run simulates a crowd moving between the regions of an event, sending
+// the updates of their devices to a server. The arguments choose the event,
+// how many attend and for how long, and the speed relative to real time,
+// where 0 sends the updates without waiting.
+func Run(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	eventId := flags.Int("event", -1, "id of the event to simulate")
+	regionsFile := flags.String("regions", "", "JSON file of the regions and their attraction, instead of the event's regions")
+	server := flags.String("server", "http://localhost:80", "server to send the updates to")
+	enrolmentToken := flags.String("enrolment-token", "", "enrolment token of the event, which devices register with")
+	attendees := flags.Int("attendees", 100, "number of attendees")
+	duration := flags.Duration("duration", time.Hour, "length of the simulation")
+	speed := flags.Float64("speed", 1, "speed relative to real time, or 0 for as fast as possible")
+	dwell := flags.Duration("dwell", 20*time.Minute, "mean time attendees stay in a region")
+	emergencyChance := flags.Float64("emergency-rate", 0.001, "chance an attendee reports an emergency on arriving in a region")
+	seed := flags.Int64("seed", time.Now().UnixNano(), "seed of the simulation")
+	concurrency := flags.Int("concurrency", 8, "number of devices sending at once")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *eventId < 0 {
+		return errors.New("an event to simulate is required")
+	}
+	if *attendees <= 0 || *concurrency <= 0 {
+		return errors.New("attendees and concurrency must be positive")
+	}
+	if *speed < 0 {
+		return errors.New("speed can't be negative")
+	}
+	if *dwell <= 0 || *duration <= 0 {
+		return errors.New("dwell and duration must be positive")
+	}
+
+	regions, err := loadRegions(staticData, *eventId, *regionsFile)
+	if err != nil {
+		return err
+	}
+
+	crowd := make([]*attendee, *attendees)
+	for i := range crowd {
+		uuid, err := utils.NewUUID()
+		if err != nil {
+			return err
+		}
+		crowd[i] = &attendee{uuid: uuid}
+	}
+
+	c := newClient(*server, *eventId, *enrolmentToken)
+	simulate(c, newSimulation(regions, crowd, *dwell, *emergencyChance, *seed), *duration, *speed, *concurrency)
+
+	log.Printf("Simulated %d attendees: %d updates sent, %d failed, %d throttled, %d emergencies",
+		*attendees, c.summary.Sent, c.summary.Failed, c.summary.Throttled, c.summary.Emergencies)
+	return nil
+}
+
+// simulate runs the simulation until the end, when every attendee leaves,
+// sending each move as it happens. Each device's moves are sent by the same
+// worker so they arrive in order.
+func simulate(c *client, s *simulation, end time.Duration, speed float64, concurrency int) {
+	workers := make([]chan move, concurrency)
+	var done sync.WaitGroup
+	for i := range workers {
+		workers[i] = make(chan move, 100)
+		done.Add(1)
+		go func(moves chan move) {
+			defer done.Done()
+			for m := range moves {
+				err := c.send(m)
+				if err != nil {
+					log.Println("Error sending simulated move:", err)
+				}
+			}
+		}(workers[i])
+	}
+
+	worker := make(map[*attendee]chan move)
+	for i, a := range s.crowd {
+		worker[a] = workers[i%concurrency]
+	}
+
+	// Keep the gaps between moves, scaled by the speed
+	var last time.Duration
+	for {
+		m, at, ok := s.nextMove(end)
+		if !ok {
+			break
+		}
+		if speed > 0 {
+			sleep(time.Duration(float64(at-last) / speed))
+		}
+		last = at
+		worker[m.attendee] <- m
+	}
+
+	// Everyone still at the event leaves at the end
+	if speed > 0 {
+		sleep(time.Duration(float64(end-last) / speed))
+	}
+	for _, a := range s.crowd {
+		if a.region != nil {
+			worker[a] <- move{attendee: a, from: a.region}
+			a.region = nil
+		}
+	}
+
+	for _, moves := range workers {
+		close(moves)
+	}
+	done.Wait()
+}
@@ -0,0 +1,147 @@
+package simulator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/real-time-footfall-analysis/rtfa-backend/devices"
+	"github.com/real-time-footfall-analysis/rtfa-backend/locationupdate"
+)
+
+const (
+	TEST_SECRET          = "simulated-secret"
+	TEST_ENROLMENT_TOKEN = "simulated-enrolment-token"
+)
+
+// dummy_server records the updates it receives from registered devices
+type dummy_server struct {
+	mutex       sync.Mutex
+	registered  map[string]bool
+	movements   map[string][]locationupdate.Movement_update
+	emergencies int
+	unsigned    int
+}
+
+func newDummyServer() *dummy_server {
+	return &dummy_server{
+		registered: make(map[string]bool),
+		movements:  make(map[string][]locationupdate.Movement_update),
+	}
+}
+
+func (ds *dummy_server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	if request.URL.Path == "/events/7/devices" {
+		if request.Header.Get(devices.ENROLMENT_HEADER) != TEST_ENROLMENT_TOKEN {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var registration map[string]string
+		_ = json.Unmarshal(body, &registration)
+		ds.registered[registration["uuid"]] = true
+		writer.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(writer).Encode(map[string]interface{}{"uuid": registration["uuid"], "eventId": 7, "secret": TEST_SECRET})
+		return
+	}
+
+	timestamp := request.Header.Get(devices.TIMESTAMP_HEADER)
+	if request.Header.Get(devices.SIGNATURE_HEADER) != devices.Sign(TEST_SECRET, timestamp, body) {
+		ds.unsigned++
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch request.URL.Path {
+	case "/update":
+		var update locationupdate.Movement_update
+		_ = json.Unmarshal(body, &update)
+		ds.movements[*update.UUID] = append(ds.movements[*update.UUID], update)
+	case "/emergency-update":
+		ds.emergencies++
+	default:
+		writer.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtfa-simulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	regionsFile := filepath.Join(dir, "regions.json")
+	err = ioutil.WriteFile(regionsFile, []byte(`{"regions": [
+		{"regionId": 1, "name": "Entrance"},
+		{"regionId": 2, "name": "Main stage", "weight": 0, "schedule": [{"from": "30m", "to": "1h", "weight": 5}]},
+		{"regionId": 3, "name": "Bar", "weight": 2}]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds := newDummyServer()
+	server := httptest.NewServer(ds)
+	defer server.Close()
+
+	err = Run([]string{"-event", "7", "-regions", regionsFile, "-server", server.URL, "-enrolment-token", TEST_ENROLMENT_TOKEN,
+		"-attendees", "20", "-duration", "1h", "-dwell", "10m", "-speed", "0",
+		"-emergency-rate", "0.5", "-seed", "1", "-concurrency", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ds.registered) != 20 || len(ds.movements) != 20 {
+		t.Fatalf("Expected every attendee's device to register and send updates. Got %d registered and %d sending",
+			len(ds.registered), len(ds.movements))
+	}
+	if ds.unsigned != 0 {
+		t.Errorf("Expected every update to be signed. Got %d unsigned", ds.unsigned)
+	}
+	if ds.emergencies == 0 {
+		t.Error("Expected emergencies to be reported")
+	}
+
+	for uuid, updates := range ds.movements {
+		if len(updates)%2 != 0 {
+			t.Errorf("Expected device %s to leave every region it entered. Got %d updates", uuid, len(updates))
+		}
+		for i, update := range updates {
+			if *update.Entering != (i%2 == 0) {
+				t.Fatalf("Expected device %s to alternate entering and leaving", uuid)
+			}
+			if i%2 == 1 && *update.RegionID != *updates[i-1].RegionID {
+				t.Fatalf("Expected device %s to leave the region it entered", uuid)
+			}
+			if i > 0 && *update.OccurredAt <= *updates[i-1].OccurredAt {
+				t.Fatalf("Expected the updates of device %s to be a second apart", uuid)
+			}
+		}
+	}
+}
+
+func TestChooseFollowsSchedule(t *testing.T) {
+	stage := &region{id: 2, slots: []slot{{from: 30 * time.Minute, to: time.Hour, weight: 1}}}
+	bar := &region{id: 3, weight: 1}
+	s := newSimulation([]*region{stage, bar}, nil, time.Minute, 0, 1)
+
+	for i := 0; i < 100; i++ {
+		if s.choose(0, nil) != bar {
+			t.Fatal("Expected nobody to go to a region outside its schedule")
+		}
+		if s.choose(45*time.Minute, bar) != stage {
+			t.Fatal("Expected attendees to move to another region")
+		}
+	}
+	if s.choose(0, bar) != nil {
+		t.Error("Expected no region to be chosen when none attract")
+	}
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// GetEnv returns the value of the environment variable, or the default
+// if it is not set
+func GetEnv(name string, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// GetEnvInt returns the integer value of the environment variable, or the
+// default if it is not set or not an integer
+func GetEnvInt(name string, defaultValue int) int {
+	str := os.Getenv(name)
+	if str == "" {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		log.Printf("%s is not an integer, using %d: %s", name, defaultValue, err)
+		return defaultValue
+	}
+	return value
+}
+
+// GetEnvDuration returns the duration value (such as "90s") of the
+// environment variable, or the default if it is not set or not a duration
+func GetEnvDuration(name string, defaultValue time.Duration) time.Duration {
+	str := os.Getenv(name)
+	if str == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(str)
+	if err != nil {
+		log.Printf("%s is not a duration, using %s: %s", name, defaultValue, err)
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// NewUUID returns a random (version 4) UUID
+func NewUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return formatUUID(b, 4), nil
+}
+
+func formatUUID(b []byte, version byte) string {
+	// Set the version and the RFC 4122 variant
+	b[6] = (b[6] & 0x0f) | version<<4
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}